@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"github.com/encryptedmessaging/quibit"
 	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/db"
 	"github.com/msecret/emp/local/localapi"
 	"os"
 	"os/signal"
@@ -33,8 +34,18 @@ func BlockingLogger(channel chan string) {
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if _, ok := cliCommands[os.Args[1]]; ok {
+			os.Exit(runCommand(os.Args[1], os.Args[2:]))
+		}
+		if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+			cliUsage()
+			return
+		}
+	}
+
 	if len(os.Args) > 2 {
-		fmt.Println("Usage: emp [config_directory]")
+		cliUsage()
 		return
 	}
 
@@ -59,6 +70,14 @@ func main() {
 		return
 	}
 
+	// Open the inventory before anything can use it
+	config.Inventory, err = db.Open(config.Log, config.InventoryBackend, config.DbFile)
+	if err != nil {
+		fmt.Printf("Error opening inventory: %s", err)
+		return
+	}
+	defer config.Inventory.Close()
+
 	// Start Signal Handler
 	signal.Notify(config.Quit, os.Interrupt, os.Kill)
 
@@ -21,6 +21,9 @@ import (
 	"time"
 )
 
+// Messages and publications are swept from the inventory after this long.
+const MessageLifetime = 30 * 24 * time.Hour
+
 // Starts a new TCP Server wth configuration specified in ApiConfig.
 // Server will terminate cleanly only when data is sent to the Quit channel.
 //
@@ -33,13 +36,15 @@ func Start(config *ApiConfig) {
 
 	config.Log <- "Starting api..."
 
-	// Start Database Services
-	err = db.Initialize(config.Log, config.DbFile)
-	defer db.Cleanup()
-	if err != nil {
-		config.Log <- fmt.Sprintf("Error initializing database: %s", err)
-		config.Log <- "Quit"
-		return
+	// Start Database Services, unless the caller already opened the inventory
+	if config.Inventory == nil {
+		config.Inventory, err = db.Open(config.Log, config.InventoryBackend, config.DbFile)
+		if err != nil {
+			config.Log <- fmt.Sprintf("Error initializing database: %s", err)
+			config.Log <- "Quit"
+			return
+		}
+		defer config.Inventory.Close()
 	}
 	config.LocalVersion.Timestamp = time.Now().Round(time.Second)
 
@@ -208,10 +213,11 @@ func Start(config *ApiConfig) {
 			}
 		case <-minute:
 			// Dump old messages
-			err = db.SweepMessages(30 * 24 * time.Hour)
+			err = config.Inventory.Sweep(MessageLifetime)
 			if err != nil {
 				config.Log <- fmt.Sprintf("Error Sweeping Messages: %s", err)
 			}
+			sweepFirstSeen()
 		}
 	}
 
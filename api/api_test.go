@@ -12,6 +12,7 @@
 package api
 
 import (
+	"emp/db"
 	"emp/objects"
 	"fmt"
 	"os"
@@ -114,3 +115,63 @@ func TestHandshake(t *testing.T) {
 
 	cleanup(config)
 }
+
+func TestRefreshMessage(t *testing.T) {
+	config := new(ApiConfig)
+	config.SendQueue = make(chan quibit.Frame, 10)
+	config.MessageRegister = make(chan objects.Message, 10)
+	config.Log = make(chan string, 100)
+	config.Inventory, _ = db.Open(config.Log, db.Memory, "")
+	defer config.Inventory.Close()
+
+	msg := new(objects.Message)
+	msg.TxidHash = objects.MakeHash([]byte("refresh"))
+	msg.AddrHash = objects.MakeHash([]byte("recipient"))
+	msg.Timestamp = time.Now().Add(-time.Hour).Round(time.Second)
+	msg.Content.CipherText = make([]byte, 16)
+
+	fMSG(config, quibit.Frame{}, msg)
+	if len(config.SendQueue) != 1 || len(config.MessageRegister) != 1 {
+		fmt.Println("New message not broadcast and registered.")
+		t.FailNow()
+	}
+	<-config.SendQueue
+
+	// A newer copy restarts the lifetime and is passed on, but not registered again.
+	newer := *msg
+	newer.Timestamp = time.Now().Round(time.Second)
+	fMSG(config, quibit.Frame{}, &newer)
+	if len(config.SendQueue) != 1 || len(config.MessageRegister) != 1 || !config.Inventory.GetMessage(msg.TxidHash).Timestamp.Equal(newer.Timestamp) {
+		fmt.Println("Newer copy didn't refresh the message.")
+		t.Fail()
+	}
+	<-config.SendQueue
+
+	// The same copy again, a changed copy, or one from the far future, are dropped.
+	changed := newer
+	changed.Timestamp = newer.Timestamp.Add(time.Minute)
+	changed.Content.CipherText = []byte("0123456789abcdef")
+	future := newer
+	future.Timestamp = time.Now().Add(48 * time.Hour)
+	for _, m := range []*objects.Message{&newer, &changed, &future} {
+		fMSG(config, quibit.Frame{}, m)
+	}
+	if len(config.SendQueue) != 0 || !config.Inventory.GetMessage(msg.TxidHash).Timestamp.Equal(newer.Timestamp) {
+		fmt.Println("Invalid refresh accepted.")
+		t.Fail()
+	}
+
+	// Replaying copies can't keep a message alive forever.
+	old := *msg
+	old.TxidHash = objects.MakeHash([]byte("old"))
+	old.Timestamp = time.Now().Add(-maxMessageAge - time.Hour).Round(time.Second)
+	fMSG(config, quibit.Frame{}, &old)
+	<-config.SendQueue
+	replay := old
+	replay.Timestamp = time.Now().Round(time.Second)
+	fMSG(config, quibit.Frame{}, &replay)
+	if len(config.SendQueue) != 0 || !config.Inventory.GetMessage(old.TxidHash).Timestamp.Equal(old.Timestamp) {
+		fmt.Println("Message refreshed past its maximum age.")
+		t.Fail()
+	}
+}
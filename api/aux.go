@@ -12,14 +12,55 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/encryptedmessaging/quibit"
 	"github.com/msecret/emp/db"
 	"github.com/msecret/emp/objects"
 	"runtime"
+	"sync"
 	"time"
 )
 
+const (
+	maxClockSkew  = time.Hour           // Refreshed messages may be timestamped this far in the future, to allow for clock differences.
+	maxMessageAge = 4 * MessageLifetime // Refreshes are refused this long after a message was first seen.
+)
+
+// When each refreshed message was first seen. Only kept in memory, after a restart the
+// stored timestamp counts as first seen.
+var firstSeen = struct {
+	sync.Mutex
+	times map[string]time.Time
+}{times: make(map[string]time.Time)}
+
+// Whether a copy of a stored message timestamped at refresh may restart its lifetime.
+func refreshAllowed(stored *objects.Message, refresh time.Time) bool {
+	firstSeen.Lock()
+	defer firstSeen.Unlock()
+
+	hash := string(stored.TxidHash.GetBytes())
+	first, ok := firstSeen.times[hash]
+	if !ok {
+		first = stored.Timestamp
+		firstSeen.times[hash] = first
+	}
+	return refresh.Sub(first) <= maxMessageAge
+}
+
+// Forget messages that can't be refreshed any more, and have been swept since.
+func sweepFirstSeen() {
+	firstSeen.Lock()
+	defer firstSeen.Unlock()
+
+	cutoff := time.Now().Add(-maxMessageAge - MessageLifetime)
+	for hash, first := range firstSeen.times {
+		if first.Before(cutoff) {
+			delete(firstSeen.times, hash)
+		}
+	}
+}
+
 // Handle a Version Request or Reply
 func fVERSION(config *ApiConfig, frame quibit.Frame, version *objects.Version) {
 
@@ -101,7 +142,7 @@ func fPEER(config *ApiConfig, frame quibit.Frame, nodeList *objects.NodeList) {
 		sending = objects.MakeFrame(objects.PEER, objects.REPLY, &config.NodeList)
 	} else {
 		// If a objects.REPLY, send an object list as a objects.REQUEST
-		sending = objects.MakeFrame(objects.OBJ, objects.REQUEST, db.ObjList())
+		sending = objects.MakeFrame(objects.OBJ, objects.REQUEST, config.Inventory.List())
 	}
 
 	sending.Peer = frame.Peer
@@ -148,7 +189,7 @@ func fOBJ(config *ApiConfig, frame quibit.Frame, obj *objects.Obj) {
 
 	if frame.Header.Type == objects.REQUEST {
 		// If a objects.REQUEST, send local object list as objects.REPLY
-		sending = objects.MakeFrame(objects.OBJ, objects.REPLY, db.ObjList())
+		sending = objects.MakeFrame(objects.OBJ, objects.REPLY, config.Inventory.List())
 		sending.Peer = frame.Peer
 		config.SendQueue <- *sending
 	}
@@ -156,11 +197,11 @@ func fOBJ(config *ApiConfig, frame quibit.Frame, obj *objects.Obj) {
 	// For each object in object list:
 	// If object not stored locally, send GETOBJ objects.REQUEST
 	for _, hash := range obj.HashList {
-		if db.Contains(hash) == db.NOTFOUND {
+		if config.Inventory.Contains(hash) == db.NOTFOUND {
 			sending = objects.MakeFrame(objects.GETOBJ, objects.REQUEST, &hash)
 			sending.Peer = frame.Peer
 			config.SendQueue <- *sending
-		} else if db.Contains(hash) == db.MSG {
+		} else if config.Inventory.Contains(hash) == db.MSG {
 			// Check for purge
 			sending = objects.MakeFrame(objects.CHECKTXID, objects.REQUEST, &hash)
 			sending.Peer = frame.Peer
@@ -182,20 +223,20 @@ func fGETOBJ(config *ApiConfig, frame quibit.Frame, hash *objects.Hash) {
 	// If object stored locally, send object as a objects.REPLY
 	var sending *quibit.Frame
 	if frame.Header.Type == objects.REQUEST {
-		switch db.Contains(*hash) {
+		switch config.Inventory.Contains(*hash) {
 		case db.PUBKEY:
-			sending = objects.MakeFrame(objects.PUBKEY, objects.REPLY, db.GetPubkey(config.Log, *hash))
+			sending = objects.MakeFrame(objects.PUBKEY, objects.REPLY, config.Inventory.GetPubkey(*hash))
 		case db.PURGE:
-			sending = objects.MakeFrame(objects.PURGE, objects.REPLY, db.GetPurge(config.Log, *hash))
+			sending = objects.MakeFrame(objects.PURGE, objects.REPLY, config.Inventory.GetPurge(*hash))
 		case db.MSG:
-			message := db.GetMessage(config.Log, *hash)
+			message := config.Inventory.GetMessage(*hash)
 			if message != nil {
 				sending = objects.MakeFrame(objects.MSG, objects.REPLY, message)
 			} else {
 				config.Log <- "Error pulling message from database!"
 			}
 		case db.PUB:
-			message := db.GetMessage(config.Log, *hash)
+			message := config.Inventory.GetMessage(*hash)
 			if message != nil {
 				sending = objects.MakeFrame(objects.PUB, objects.REPLY, message)
 			} else {
@@ -219,11 +260,11 @@ func fPUBKEY_REQUEST(config *ApiConfig, frame quibit.Frame, pubHash *objects.Has
 	// Check Hash in Object List
 	var sending quibit.Frame
 
-	switch db.Contains(*pubHash) {
+	switch config.Inventory.Contains(*pubHash) {
 	// If request is Not in List, store the request
 	case db.NOTFOUND:
 		// If a objects.BROADCAST, send out another objects.BROADCAST
-		db.Add(*pubHash, db.PUBKEYRQ)
+		config.Inventory.AddRequest(*pubHash)
 		if frame.Header.Type == objects.BROADCAST {
 			sending = *objects.MakeFrame(objects.PUBKEY_REQUEST, objects.BROADCAST, pubHash)
 			sending.Peer = frame.Peer
@@ -233,7 +274,7 @@ func fPUBKEY_REQUEST(config *ApiConfig, frame quibit.Frame, pubHash *objects.Has
 	// If request is a Public Key in List:
 	case db.PUBKEY:
 		// Send out the PUBKEY as a objects.BROADCAST
-		sending = *objects.MakeFrame(objects.PUBKEY, objects.BROADCAST, db.GetPubkey(config.Log, *pubHash))
+		sending = *objects.MakeFrame(objects.PUBKEY, objects.BROADCAST, config.Inventory.GetPubkey(*pubHash))
 		sending.Peer = frame.Peer
 		config.SendQueue <- sending
 	}
@@ -242,14 +283,14 @@ func fPUBKEY_REQUEST(config *ApiConfig, frame quibit.Frame, pubHash *objects.Has
 // Handle Public Key Broadcasts
 func fPUBKEY(config *ApiConfig, frame quibit.Frame, pubkey *objects.EncryptedPubkey) {
 	// Check Hash in Object List
-	switch db.Contains(pubkey.AddrHash) {
+	switch config.Inventory.Contains(pubkey.AddrHash) {
 	// If request is a Pubkey Request, remove the pubkey request
 	case db.PUBKEYRQ:
-		db.Delete(pubkey.AddrHash)
+		config.Inventory.Remove(pubkey.AddrHash)
 		fallthrough
 	case db.NOTFOUND:
 		// Add Pubkey to database
-		err := db.AddPubkey(config.Log, *pubkey)
+		err := config.Inventory.AddPubkey(*pubkey)
 		if err != nil {
 			config.Log <- fmt.Sprintf("Error adding pubkey to database: %s", err)
 			break
@@ -269,10 +310,10 @@ func fPUBKEY(config *ApiConfig, frame quibit.Frame, pubkey *objects.EncryptedPub
 func fMSG(config *ApiConfig, frame quibit.Frame, msg *objects.Message) {
 	var sending quibit.Frame
 	// Check Hash in Object List
-	switch db.Contains(msg.TxidHash) {
+	switch config.Inventory.Contains(msg.TxidHash) {
 	// If Not in List, Store and objects.BROADCAST
 	case db.NOTFOUND:
-		err := db.AddMessage(config.Log, msg)
+		err := config.Inventory.AddMessage(msg)
 		if err != nil {
 			config.Log <- fmt.Sprintf("Error adding message to database: %s", err)
 			break
@@ -285,10 +326,38 @@ func fMSG(config *ApiConfig, frame quibit.Frame, msg *objects.Message) {
 		config.Log <- "Registering message..."
 		config.MessageRegister <- *msg
 
+	// A newer copy of a stored message is its sender keeping it alive, restart its
+	// lifetime and pass it on. Recipients already have it, so it isn't registered again.
+	// Anyone can replay a copy, so messages aren't kept alive past maxMessageAge.
+	case db.MSG:
+		stored := config.Inventory.GetMessage(msg.TxidHash)
+		if stored == nil || !msg.Timestamp.After(stored.Timestamp) || msg.Timestamp.After(time.Now().Add(maxClockSkew)) {
+			break
+		}
+		if !bytes.Equal(stored.Content.GetBytes(), msg.Content.GetBytes()) || stored.AddrHash != msg.AddrHash {
+			break
+		}
+		if !refreshAllowed(stored, msg.Timestamp) {
+			config.Log <- "Message is past its maximum age, not refreshing it."
+			break
+		}
+
+		err := config.Inventory.Remove(msg.TxidHash)
+		if err == nil {
+			err = config.Inventory.AddMessage(msg)
+		}
+		if err != nil {
+			config.Log <- fmt.Sprintf("Error refreshing message in database: %s", err)
+			break
+		}
+		sending = *objects.MakeFrame(objects.MSG, objects.BROADCAST, msg)
+		sending.Peer = frame.Peer
+		config.SendQueue <- sending
+
 	// If found as PURGE, reply with PURGE
 	case db.PURGE:
 		config.Log <- "Received already-purged message!"
-		sending = *objects.MakeFrame(objects.PURGE, objects.REPLY, db.GetPurge(config.Log, msg.TxidHash))
+		sending = *objects.MakeFrame(objects.PURGE, objects.REPLY, config.Inventory.GetPurge(msg.TxidHash))
 		sending.Peer = frame.Peer
 		config.SendQueue <- sending
 	}
@@ -298,10 +367,10 @@ func fMSG(config *ApiConfig, frame quibit.Frame, msg *objects.Message) {
 func fPUB(config *ApiConfig, frame quibit.Frame, msg *objects.Message) {
 	var sending quibit.Frame
 	// Check Hash in Object List
-	switch db.Contains(msg.TxidHash) {
+	switch config.Inventory.Contains(msg.TxidHash) {
 	// If Not in List, Store and objects.BROADCAST
 	case db.NOTFOUND:
-		err := db.AddPub(config.Log, msg)
+		err := config.Inventory.AddPub(msg)
 		if err != nil {
 			config.Log <- fmt.Sprintf("Error adding publication to database: %s", err)
 			break
@@ -316,7 +385,7 @@ func fPUB(config *ApiConfig, frame quibit.Frame, msg *objects.Message) {
 	// If found as PURGE, reply with PURGE
 	case db.PURGE:
 		config.Log <- "Received already-purged publication!"
-		sending = *objects.MakeFrame(objects.PURGE, objects.REPLY, db.GetPurge(config.Log, msg.TxidHash))
+		sending = *objects.MakeFrame(objects.PURGE, objects.REPLY, config.Inventory.GetPurge(msg.TxidHash))
 		sending.Peer = frame.Peer
 		config.SendQueue <- sending
 	}
@@ -328,12 +397,12 @@ func fPURGE(config *ApiConfig, frame quibit.Frame, purge *objects.Purge) {
 	txidHash := objects.MakeHash(purge.Txid[:])
 
 	// Check Hash in Object List
-	switch db.Contains(txidHash) {
+	switch config.Inventory.Contains(txidHash) {
 	// Delete Stored Messages
 	case db.PUB:
 		fallthrough
 	case db.MSG:
-		err = db.RemoveHash(config.Log, txidHash)
+		err = config.Inventory.Remove(txidHash)
 		if err != nil {
 			config.Log <- fmt.Sprintf("Error removing message/publication from database: %s", err)
 			break
@@ -341,7 +410,7 @@ func fPURGE(config *ApiConfig, frame quibit.Frame, purge *objects.Purge) {
 		fallthrough
 	// Add to database
 	case db.NOTFOUND:
-		err = db.AddPurge(config.Log, *purge)
+		err = config.Inventory.AddPurge(*purge)
 		if err != nil {
 			config.Log <- fmt.Sprintf("Error adding purge to database: ", err)
 			break
@@ -367,8 +436,8 @@ func fCHECKTXID(config *ApiConfig, frame quibit.Frame, hash *objects.Hash) {
 	// If object stored locally, send object as a objects.REPLY
 	var sending *quibit.Frame
 	if frame.Header.Type == objects.REQUEST {
-		if db.Contains(*hash) == db.PURGE {
-			sending = objects.MakeFrame(objects.PURGE, objects.REPLY, db.GetPurge(config.Log, *hash))
+		if config.Inventory.Contains(*hash) == db.PURGE {
+			sending = objects.MakeFrame(objects.PURGE, objects.REPLY, config.Inventory.GetPurge(*hash))
 			sending.Peer = frame.Peer
 			config.SendQueue <- *sending
 		} else {
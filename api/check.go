@@ -0,0 +1,267 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/msecret/emp/db"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Name of the profile configured by local, rpc.user and rpc.pass.
+const DefaultProfile = "default"
+
+// Event types that webhooks can subscribe to.
+var webhookEvents = []string{"message", "publication", "purged"}
+
+// Problems that stop the daemon from starting, as "key: problem".
+func (c *tomlConfig) validate() []string {
+	problems := make([]string, 0, 0)
+
+	if len(c.Inventory) == 0 {
+		problems = append(problems, "inventory: database file required")
+	}
+	known := len(c.InventoryBackend) == 0
+	for _, backend := range db.Backends {
+		known = known || backend == c.InventoryBackend
+	}
+	if !known {
+		problems = append(problems, fmt.Sprintf("inventory_backend: %q is not one of %s", c.InventoryBackend, strings.Join(db.Backends, ", ")))
+	}
+	if len(c.Local) == 0 {
+		problems = append(problems, "local: database file required")
+	}
+	if len(c.IP) > 0 && net.ParseIP(c.IP) == nil {
+		problems = append(problems, fmt.Sprintf("ip: %q is not an IP address", c.IP))
+	}
+	if c.Port == 0 {
+		problems = append(problems, "port: required")
+	}
+	if c.Padding < 0 {
+		problems = append(problems, "padding: must not be negative")
+	}
+
+	if c.RPCConf.Port == 0 {
+		problems = append(problems, "rpc.port: required")
+	} else if c.RPCConf.Port == c.Port {
+		problems = append(problems, "rpc.port: must differ from port")
+	}
+	if len(c.RPCConf.ClientCA) > 0 && !c.RPCConf.TLS {
+		problems = append(problems, "rpc.client_ca: requires tls = true")
+	}
+
+	if c.CoverConf.Interval < 0 {
+		problems = append(problems, "cover.interval: must not be negative")
+	}
+	if c.CoverConf.Budget < 0 {
+		problems = append(problems, "cover.budget: must not be negative")
+	}
+
+	if c.OutboxConf.Retry < 0 {
+		problems = append(problems, "outbox.retry: must not be negative")
+	}
+	if c.OutboxConf.Deadline < 0 {
+		problems = append(problems, "outbox.deadline: must not be negative")
+	}
+
+	for i, hook := range c.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			problems = append(problems, fmt.Sprintf("webhook[%d].url: %q is not an http or https URL", i, hook.URL))
+		}
+		if len(hook.Secret) == 0 {
+			problems = append(problems, fmt.Sprintf("webhook[%d].secret: required", i))
+		}
+	}
+
+	if len(c.SMTPConf.Listen) > 0 {
+		if _, _, err := net.SplitHostPort(c.SMTPConf.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("smtp.listen: %s", err))
+		}
+	}
+	if len(c.IMAPConf.Listen) > 0 {
+		if _, _, err := net.SplitHostPort(c.IMAPConf.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("imap.listen: %s", err))
+		}
+	}
+
+	names := map[string]bool{DefaultProfile: true}
+	users := map[string]bool{c.RPCConf.User: true}
+	files := map[string]bool{confPath(c.Local): true}
+	for i, p := range c.Profiles {
+		if len(p.Name) == 0 || strings.ContainsAny(p.Name, "/\\ ") {
+			problems = append(problems, fmt.Sprintf("profile[%d].name: required, without spaces or slashes", i))
+		} else if names[p.Name] {
+			problems = append(problems, fmt.Sprintf("profile[%d].name: %q is already used", i, p.Name))
+		}
+		if len(p.User) == 0 || len(p.Pass) == 0 {
+			problems = append(problems, fmt.Sprintf("profile[%d]: user and pass required", i))
+		} else if users[p.User] {
+			problems = append(problems, fmt.Sprintf("profile[%d].user: %q is already used by another profile", i, p.User))
+		}
+		if files[confPath(p.localDB())] {
+			problems = append(problems, fmt.Sprintf("profile[%d].local: %q is already used by another profile", i, p.localDB()))
+		}
+		names[p.Name], users[p.User], files[confPath(p.localDB())] = true, true, true
+	}
+
+	return problems
+}
+
+// Check a configuration file without starting anything. Errors stop the daemon from
+// starting, warnings are settings that are probably mistakes.
+func CheckConfig(confFile string) (problems []string, warnings []string) {
+	var c tomlConfig
+	warnings = make([]string, 0, 0)
+
+	meta, err := toml.DecodeFile(confFile, &c)
+	if err != nil {
+		return []string{err.Error()}, warnings
+	}
+
+	problems = c.validate()
+
+	for _, key := range meta.Undecoded() {
+		warnings = append(warnings, fmt.Sprintf("%s: unknown setting, ignored", key))
+	}
+
+	for _, peer := range c.Peers {
+		host, port, err := net.SplitHostPort(peer)
+		if _, portErr := strconv.ParseUint(port, 10, 16); err != nil || portErr != nil || net.ParseIP(host) == nil {
+			warnings = append(warnings, fmt.Sprintf("bootstrap: %q is not an <ip>:<port>, ignored", peer))
+		}
+	}
+	if len(c.Peers) == 0 {
+		warnings = append(warnings, "bootstrap: no nodes, the daemon can only wait for incoming connections")
+	}
+
+	if len(c.RPCConf.User) == 0 && len(c.RPCConf.Pass) == 0 {
+		warnings = append(warnings, "rpc: no user or pass, only API tokens can authenticate")
+	}
+	if !c.RPCConf.LocalOnly && !c.RPCConf.TLS {
+		warnings = append(warnings, "rpc: local_only is false without tls, credentials are sent in cleartext")
+	}
+	if len(c.RPCConf.Local) > 0 {
+		if _, err := os.Stat(confPath(c.RPCConf.Local)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("rpc.local_client: %s", err))
+		}
+	}
+
+	if c.RPCConf.TLS {
+		cert, key := c.RPCConf.Cert, c.RPCConf.Key
+		if len(cert) == 0 {
+			cert = "rpc.crt"
+		}
+		if len(key) == 0 {
+			key = "rpc.key"
+		}
+		_, certErr := os.Stat(confPath(cert))
+		_, keyErr := os.Stat(confPath(key))
+		if certErr == nil && keyErr != nil {
+			problems = append(problems, fmt.Sprintf("rpc.key: %s", keyErr))
+		} else if certErr != nil && keyErr == nil {
+			problems = append(problems, fmt.Sprintf("rpc.cert: %s", certErr))
+		}
+	}
+	if len(c.RPCConf.ClientCA) > 0 {
+		if _, err := os.Stat(confPath(c.RPCConf.ClientCA)); err != nil {
+			problems = append(problems, fmt.Sprintf("rpc.client_ca: %s", err))
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(c.SMTPConf.Listen); err == nil && !isLoopback(host) {
+		warnings = append(warnings, "smtp.listen: not a loopback address, passwords are sent in cleartext")
+	}
+	if host, _, err := net.SplitHostPort(c.IMAPConf.Listen); err == nil && !isLoopback(host) {
+		warnings = append(warnings, "imap.listen: not a loopback address, passwords and messages are sent in cleartext")
+	}
+
+	for i, hook := range c.Webhooks {
+		for _, event := range hook.Events {
+			known := false
+			for _, e := range webhookEvents {
+				known = known || e == event
+			}
+			if !known {
+				warnings = append(warnings, fmt.Sprintf("webhook[%d].events: unknown event %q", i, event))
+			}
+		}
+	}
+
+	return problems, warnings
+}
+
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+const defaultConfig = `# EMP configuration, paths are relative to this directory.
+
+inventory = "inventory.db"
+local = "local.db"
+nodes = "nodes.dat"
+
+# Address and port other nodes connect to. Set ip to your external address
+# if you run a backbone node.
+ip = "0.0.0.0"
+port = 4444
+
+# Nodes to connect to when no others are known, as "<ip>:<port>".
+bootstrap = []
+
+[rpc]
+user = "%s"
+pass = "%s"
+port = 8080
+local_client = "client/"
+local_only = true
+`
+
+// Create the config directory with a default msg.conf and random RPC credentials,
+// which are returned. An existing msg.conf is only replaced if force is set.
+func InitConfDir(force bool) (user, pass string, err error) {
+	dir := GetConfDir()
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", "", err
+	}
+
+	confFile := dir + "msg.conf"
+	if _, err := os.Stat(confFile); err == nil && !force {
+		return "", "", errors.New(fmt.Sprintf("%s already exists", confFile))
+	}
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", "", err
+	}
+	user, pass = "emp", hex.EncodeToString(random)
+
+	file, err := os.OpenFile(confFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, defaultConfig, user, pass)
+	return user, pass, err
+}
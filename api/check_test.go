@@ -0,0 +1,109 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emp_conf")
+	if err != nil {
+		fmt.Println("Error creating directory: ", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	SetConfDir(dir + "/emp/")
+	defer SetConfDir("")
+
+	user, pass, err := InitConfDir(false)
+	if err != nil || len(user) == 0 || len(pass) < 32 {
+		fmt.Println("Error initializing config: ", err)
+		t.FailNow()
+	}
+
+	_, _, err = InitConfDir(false)
+	if err == nil {
+		fmt.Println("Existing config replaced.")
+		t.Fail()
+	}
+
+	confFile := GetConfDir() + "msg.conf"
+	problems, _ := CheckConfig(confFile)
+	if len(problems) != 0 {
+		fmt.Println("Default config has problems: ", problems)
+		t.Fail()
+	}
+
+	info, err := os.Stat(confFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		fmt.Println("Config readable by others.")
+		t.Fail()
+	}
+
+	bad := `inventory = "inventory.db"
+inventory_backend = "mongo"
+ip = "not an ip"
+port = 4444
+bootstrap = ["1.2.3.4"]
+paddng = 10
+
+[rpc]
+port = 4444
+client_ca = "ca.pem"
+
+[outbox]
+retry = -1
+
+[[webhook]]
+url = "ftp://example.com"
+`
+	err = ioutil.WriteFile(confFile, []byte(bad), 0600)
+	if err != nil {
+		fmt.Println("Error writing config: ", err)
+		t.FailNow()
+	}
+
+	problems, warnings := CheckConfig(confFile)
+	expected := []string{"inventory_backend:", "local:", "ip:", "rpc.port:", "rpc.client_ca: requires", "outbox.retry:", "webhook[0].url:", "webhook[0].secret:"}
+	for _, prefix := range expected {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, prefix)
+		}
+		if !found {
+			fmt.Println("Missing problem ", prefix, " in: ", problems)
+			t.Fail()
+		}
+	}
+
+	expected = []string{"paddng:", "bootstrap:", "rpc:"}
+	for _, prefix := range expected {
+		found := false
+		for _, warning := range warnings {
+			found = found || strings.HasPrefix(warning, prefix)
+		}
+		if !found {
+			fmt.Println("Missing warning ", prefix, " in: ", warnings)
+			t.Fail()
+		}
+	}
+
+	if GetConfig(confFile) != nil {
+		fmt.Println("Invalid config loaded.")
+		t.Fail()
+	}
+}
@@ -13,14 +13,18 @@ package api
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/encryptedmessaging/quibit"
+	"github.com/msecret/emp/db"
 	"github.com/msecret/emp/objects"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -39,6 +43,12 @@ type ApiConfig struct {
 	NodeList     objects.NodeList // Active list of connected backbone nodes.
 	LocalVersion objects.Version  // Local version broadcast to nodes upon connection
 	Bootstrap    []string         // List of bootstrap nodes to use when all other nodes are disconnected.
+	PadStep      int              // Outgoing messages are padded to multiples of this, or powers of two if 0.
+	BlindTags    bool             // Tag outgoing messages with a per-message secret instead of the recipient's address hash.
+
+	// Inventory
+	InventoryBackend string       // Storage used for DbFile, one of db.Backends
+	Inventory        db.Inventory // Opened by Start() if nil
 
 	// Local Register
 	PubkeyRegister  chan objects.Hash    // Identifiers for incoming encrypted public keys are sent here.
@@ -56,7 +66,67 @@ type ApiConfig struct {
 	RPCPass   string // Password for RPC Server
 	LocalOnly bool   // If true, only allow RPC from 127.0.0.1
 
+	// TLS
+	TLS         bool   // Serve RPC and EMPLocal Client over HTTPS
+	TLSCert     string // PEM certificate, generated self-signed if missing
+	TLSKey      string // PEM private key of TLSCert
+	TLSClientCA string // If set, clients must present a certificate signed by one of these CAs
+
 	HttpRoot string // HTML Root of EMPLocal Client
+
+	// Cover Traffic
+	CoverInterval time.Duration // Average time between dummy messages, disabled if 0
+	CoverBudget   int           // Maximum bytes of dummy messages per hour, unlimited if 0
+
+	// Outbox
+	OutboxRetry    time.Duration // Delay before first re-request of a missing public key, doubled after each attempt
+	OutboxDeadline time.Duration // Queued messages are marked undeliverable after this long
+	MaxResends     int           // Times an unread message is rebroadcast before it expires, disabled if negative
+
+	// Webhooks
+	Webhooks []Webhook // URLs notified of mailbox events
+
+	// SMTP Gateway
+	SMTPListen string // Address of the SMTP listener, disabled if empty
+	SMTPDomain string // Recipients are written as <emp-address>@SMTPDomain
+
+	// IMAP Server
+	IMAPListen string // Address of the IMAP listener, disabled if empty
+
+	// Profiles besides the default one, which uses LocalDB, RPCUser and RPCPass
+	Profiles []Profile
+}
+
+// A separate addressbook and message store with its own RPC credentials. All
+// profiles share the daemon's node and inventory.
+type Profile struct {
+	Name    string // Shown in logs and used by "emp -profile"
+	RPCUser string
+	RPCPass string
+	LocalDB string // EMPLocal Database of this profile
+}
+
+// Look up a profile by name. DefaultProfile, or an empty name, is the one that uses
+// LocalDB, RPCUser and RPCPass.
+func (config *ApiConfig) GetProfile(name string) (*Profile, error) {
+	if len(name) == 0 || name == DefaultProfile {
+		return &Profile{DefaultProfile, config.RPCUser, config.RPCPass, config.LocalDB}, nil
+	}
+
+	for i := range config.Profiles {
+		if config.Profiles[i].Name == name {
+			return &config.Profiles[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("No profile named %s in msg.conf.", name))
+}
+
+// URL that mailbox events are POSTed to, signed with HMAC-SHA256 of Secret.
+type Webhook struct {
+	URL     string   `toml:"url"`
+	Secret  string   `toml:"secret"`
+	Events  []string `toml:"events"`  // Event types to send, all if empty
+	Content bool     `toml:"content"` // Include decrypted subject and content
 }
 
 // Returns Human-Readable string for a specific EMP command.
@@ -100,12 +170,29 @@ type tomlConfig struct {
 	Local     string `toml:"local"`
 	Nodes     string `toml:"nodes"`
 
+	InventoryBackend string `toml:"inventory_backend"`
+
 	IP   string
 	Port uint16
 
 	Peers []string `toml:"bootstrap"`
 
+	Padding   int  `toml:"padding"`
+	BlindTags bool `toml:"blinded_tags"`
+
 	RPCConf rpcConf `toml:"rpc"`
+
+	CoverConf coverConf `toml:"cover"`
+
+	OutboxConf outboxConf `toml:"outbox"`
+
+	Webhooks []Webhook `toml:"webhook"`
+
+	SMTPConf smtpConf `toml:"smtp"`
+
+	IMAPConf imapConf `toml:"imap"`
+
+	Profiles []profileConf `toml:"profile"`
 }
 
 type rpcConf struct {
@@ -114,13 +201,71 @@ type rpcConf struct {
 	Port      uint16
 	Local     string `toml:"local_client"`
 	LocalOnly bool   `toml:"local_only"`
+
+	TLS      bool   `toml:"tls"`
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	ClientCA string `toml:"client_ca"`
 }
 
+type smtpConf struct {
+	Listen string `toml:"listen"`
+	Domain string `toml:"domain"`
+}
+
+type imapConf struct {
+	Listen string `toml:"listen"`
+}
+
+type profileConf struct {
+	Name  string `toml:"name"`
+	User  string `toml:"user"`
+	Pass  string `toml:"pass"`
+	Local string `toml:"local"`
+}
+
+// Database file of a profile, local-<name>.db unless set.
+func (p *profileConf) localDB() string {
+	if len(p.Local) > 0 {
+		return p.Local
+	}
+	return "local-" + p.Name + ".db"
+}
+
+type coverConf struct {
+	Interval int `toml:"interval"`
+	Budget   int `toml:"budget"`
+}
+
+type outboxConf struct {
+	Retry      int `toml:"retry"`
+	Deadline   int `toml:"deadline"`
+	MaxResends int `toml:"max_resends"`
+}
+
+// Outbox defaults, in seconds
+const (
+	defaultRetry    = 300
+	defaultDeadline = 7 * 24 * 60 * 60
+	defaultResends  = 3
+)
+
 // Set Config Directory where databases and configuration are stored.
 func SetConfDir(conf string) {
+	if len(conf) > 0 && !strings.HasSuffix(conf, "/") {
+		conf += "/"
+	}
 	confDir = conf
 }
 
+// Paths in msg.conf are relative to the config directory unless absolute.
+func confPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return GetConfDir() + path
+}
+
 // Get Config Directory: Defaults to $(HOME)/.config/emp/
 func GetConfDir() string {
 	if len(confDir) != 0 {
@@ -145,6 +290,13 @@ func GetConfig(confFile string) *ApiConfig {
 		return nil
 	}
 
+	if problems := tomlConf.validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("Config Error: ", problem)
+		}
+		return nil
+	}
+
 	config := new(ApiConfig)
 
 	// Network Channels
@@ -154,11 +306,11 @@ func GetConfig(confFile string) *ApiConfig {
 
 	// Local Logic
 	config.DbFile = GetConfDir() + tomlConf.Inventory
-	config.LocalDB = GetConfDir() + tomlConf.Local
-	if len(config.DbFile) == 0 || len(config.LocalDB) == 0 {
-		fmt.Println("Database file not found in config!")
-		return nil
+	config.InventoryBackend = tomlConf.InventoryBackend
+	if len(config.InventoryBackend) == 0 {
+		config.InventoryBackend = db.SQLite
 	}
+	config.LocalDB = GetConfDir() + tomlConf.Local
 	config.NodeFile = GetConfDir() + tomlConf.Nodes
 
 	config.LocalVersion.Port = tomlConf.Port
@@ -168,6 +320,8 @@ func GetConfig(confFile string) *ApiConfig {
 	config.LocalVersion.Timestamp = time.Now().Round(time.Second)
 	config.LocalVersion.Version = objects.LOCAL_VERSION
 	config.LocalVersion.UserAgent = objects.LOCAL_USER
+	config.PadStep = tomlConf.Padding
+	config.BlindTags = tomlConf.BlindTags
 
 	// RPC
 	config.RPCPort = tomlConf.RPCConf.Port
@@ -176,6 +330,56 @@ func GetConfig(confFile string) *ApiConfig {
 	config.LocalOnly = tomlConf.RPCConf.LocalOnly
 	config.HttpRoot = GetConfDir() + tomlConf.RPCConf.Local
 
+	// TLS, relative paths are in the config directory
+	config.TLS = tomlConf.RPCConf.TLS
+	if len(tomlConf.RPCConf.Cert) == 0 {
+		tomlConf.RPCConf.Cert = "rpc.crt"
+	}
+	if len(tomlConf.RPCConf.Key) == 0 {
+		tomlConf.RPCConf.Key = "rpc.key"
+	}
+	config.TLSCert = confPath(tomlConf.RPCConf.Cert)
+	config.TLSKey = confPath(tomlConf.RPCConf.Key)
+	if len(tomlConf.RPCConf.ClientCA) > 0 {
+		config.TLSClientCA = confPath(tomlConf.RPCConf.ClientCA)
+	}
+
+	// Cover Traffic
+	config.CoverInterval = time.Duration(tomlConf.CoverConf.Interval) * time.Second
+	config.CoverBudget = tomlConf.CoverConf.Budget
+
+	// Outbox
+	if tomlConf.OutboxConf.Retry == 0 {
+		tomlConf.OutboxConf.Retry = defaultRetry
+	}
+	if tomlConf.OutboxConf.Deadline == 0 {
+		tomlConf.OutboxConf.Deadline = defaultDeadline
+	}
+	config.OutboxRetry = time.Duration(tomlConf.OutboxConf.Retry) * time.Second
+	config.OutboxDeadline = time.Duration(tomlConf.OutboxConf.Deadline) * time.Second
+	config.MaxResends = tomlConf.OutboxConf.MaxResends
+	if config.MaxResends == 0 {
+		config.MaxResends = defaultResends
+	}
+
+	// Webhooks
+	config.Webhooks = tomlConf.Webhooks
+
+	// SMTP Gateway
+	config.SMTPListen = tomlConf.SMTPConf.Listen
+	config.SMTPDomain = tomlConf.SMTPConf.Domain
+	if len(config.SMTPDomain) == 0 {
+		config.SMTPDomain = "emp.local"
+	}
+
+	// IMAP Server
+	config.IMAPListen = tomlConf.IMAPConf.Listen
+
+	// Profiles
+	for _, p := range tomlConf.Profiles {
+		config.Profiles = append(config.Profiles, Profile{Name: p.Name, RPCUser: p.User, RPCPass: p.Pass, LocalDB: confPath(p.localDB())})
+	}
+
 	// Local Registers
 	config.PubkeyRegister = make(chan objects.Hash, bufLen)
 	config.MessageRegister = make(chan objects.Message, bufLen)
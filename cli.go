@@ -0,0 +1,869 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/localapi"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client for the JSON-RPC API of a running daemon.
+type rpcClient struct {
+	url   string
+	user  string
+	pass  string
+	token string
+	http  *http.Client
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+// Call EMPService.<method> and decode its result into reply, unless reply is nil.
+func (c *rpcClient) call(method string, args, reply interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"method": "EMPService." + method, "params": []interface{}{args}, "id": 1})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("RPC server returned %s", resp.Status))
+	}
+
+	ret := new(rpcResponse)
+	err = json.NewDecoder(resp.Body).Decode(ret)
+	if err != nil {
+		return err
+	}
+	if ret.Error != nil {
+		return errors.New(fmt.Sprint(ret.Error))
+	}
+
+	if reply != nil {
+		return json.Unmarshal(ret.Result, reply)
+	}
+	return nil
+}
+
+// Flags shared by every command.
+type cliOptions struct {
+	conf       *string
+	profile    *string
+	token      *string
+	url        *string
+	clientCert *string
+	clientKey  *string
+	json       *bool
+}
+
+func cliFlags(name string) (*flag.FlagSet, *cliOptions) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	o := new(cliOptions)
+	o.conf = flags.String("conf", "", "configuration directory")
+	o.profile = flags.String("profile", os.Getenv("EMP_PROFILE"), "profile whose RPC credentials are used (default $EMP_PROFILE)")
+	o.token = flags.String("token", os.Getenv("EMP_TOKEN"), "API token instead of the RPC password (default $EMP_TOKEN)")
+	o.url = flags.String("url", "", "RPC URL (default the local daemon from msg.conf)")
+	o.clientCert = flags.String("client-cert", "", "client certificate, if the daemon requires one")
+	o.clientKey = flags.String("client-key", "", "key of the client certificate")
+	o.json = flags.Bool("json", false, "print results as JSON")
+	return flags, o
+}
+
+// Build a client from msg.conf. With TLS, the daemon's certificate in the config
+// directory is trusted, so self-signed certificates work without extra setup.
+func (o *cliOptions) connect() (*rpcClient, error) {
+	if len(*o.conf) > 0 {
+		api.SetConfDir(*o.conf)
+	}
+
+	config := api.GetConfig(api.GetConfDir() + "msg.conf")
+	if config == nil {
+		return nil, errors.New("Error Loading Config")
+	}
+
+	profile, err := config.GetProfile(*o.profile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rpcClient{user: profile.RPCUser, pass: profile.RPCPass, token: *o.token, http: new(http.Client)}
+
+	scheme := "http"
+	if config.TLS {
+		scheme = "https"
+
+		tlsConf := &tls.Config{ServerName: "localhost"}
+		pemData, err := ioutil.ReadFile(config.TLSCert)
+		if err == nil {
+			tlsConf.RootCAs = x509.NewCertPool()
+			tlsConf.RootCAs.AppendCertsFromPEM(pemData)
+		}
+
+		if len(*o.clientCert) > 0 {
+			cert, err := tls.LoadX509KeyPair(*o.clientCert, *o.clientKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsConf.Certificates = []tls.Certificate{cert}
+		}
+
+		c.http.Transport = &http.Transport{TLSClientConfig: tlsConf}
+	}
+
+	c.url = fmt.Sprintf("%s://127.0.0.1:%d/rpc", scheme, config.RPCPort)
+	if len(*o.url) > 0 {
+		c.url = *o.url
+	}
+
+	return c, nil
+}
+
+// Print v as JSON with -json, otherwise call human.
+func (o *cliOptions) print(v interface{}, human func()) {
+	if !*o.json {
+		human()
+		return
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+type cliCommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+var cliCommands map[string]cliCommand
+
+func init() {
+	cliCommands = map[string]cliCommand{
+		"status":    {"status                          network connection status", cmdStatus},
+		"version":   {"version                         daemon version", cmdVersion},
+		"address":   {"address <create|list|show|add|forget> ...", cmdAddress},
+		"send":      {"send -from <addr> [-subject s] [-at time] <recipient>...   content on stdin", cmdSend},
+		"publish":   {"publish -from <addr> [-subject s]   content on stdin", cmdPublish},
+		"inbox":     {"inbox [-limit n] [-cursor txid] [-asc]", boxCommand("Inbox")},
+		"outbox":    {"outbox [-limit n] [-cursor txid] [-asc]", boxCommand("Outbox")},
+		"sendbox":   {"sendbox [-limit n] [-cursor txid] [-asc]", boxCommand("Sendbox")},
+		"drafts":    {"drafts", boxCommand("Drafts")},
+		"scheduled": {"scheduled", boxCommand("Scheduled")},
+		"search":    {"search [-limit n] [-cursor txid] <query>", cmdSearch},
+		"counts":    {"counts                          messages per box and folder", cmdCounts},
+		"open":      {"open <txid_hash>                read a message, marking it as read", cmdOpen},
+		"purge":     {"purge <txid>                    tell the network a message was read", txidCommand("PurgeMessage", "Purged.")},
+		"delete":    {"delete <txid_hash>              delete a message", txidCommand("DeleteMessage", "Deleted.")},
+		"receipts":  {"receipts <txid_hash>            read status of each recipient", cmdReceipts},
+		"export":    {"export [-format f] [-box b] [-q query] <path>   write messages to mbox, maildir or eml", cmdExport},
+		"import":    {"import <path>                   add messages from an exported archive", cmdImport},
+		"backup":    {"backup <path>                   encrypted backup of keys, mail and settings", cmdBackup},
+		"restore":   {"restore [-replace] <path>       restore a backup, merging unless -replace", cmdRestore},
+		"rpc":       {"rpc <Method> [json_params]      call any EMPService method", cmdRPC},
+		"token":     {"token <create|list|revoke> ...  manage API tokens", nil},
+		"init":      {"init [-force]                   create the config directory and msg.conf", cmdInit},
+		"config":    {"config check                    validate msg.conf", cmdConfig},
+		"keygen":    {"keygen [-profile p] [-label l]  create an address without the daemon running", cmdKeygen},
+	}
+}
+
+func cliUsage() {
+	fmt.Println("Usage: emp [config_directory]      run the daemon")
+	fmt.Println("       emp <command> [flags] [args]")
+	fmt.Println()
+	fmt.Println("Commands:")
+
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println("  " + cliCommands[name].usage)
+	}
+
+	fmt.Println()
+	fmt.Println("Commands that talk to the daemon accept -conf, -profile, -token, -url, -client-cert, -client-key and -json.")
+}
+
+func runCommand(name string, args []string) int {
+	if name == "token" {
+		return tokenCommand(args)
+	}
+
+	err := cliCommands[name].run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func cmdStatus(args []string) error {
+	flags, o := cliFlags("status")
+	flags.Parse(args)
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	var status int
+	err = c.call("ConnectionStatus", localapi.NilParam{}, &status)
+	if err != nil {
+		return err
+	}
+
+	o.print(status, func() {
+		switch status {
+		case 0:
+			fmt.Println("Disconnected")
+		case 1:
+			fmt.Println("Connected to clients only")
+		case 2:
+			fmt.Println("Connected to backbone nodes")
+		default:
+			fmt.Printf("Status %d\n", status)
+		}
+	})
+	return nil
+}
+
+func cmdVersion(args []string) error {
+	flags, o := cliFlags("version")
+	flags.Parse(args)
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	version := new(objects.Version)
+	err = c.call("Version", localapi.NilParam{}, version)
+	if err != nil {
+		return err
+	}
+
+	o.print(version, func() {
+		fmt.Printf("Protocol %d, %s\n", version.Version, version.UserAgent)
+	})
+	return nil
+}
+
+func cmdAddress(args []string) error {
+	if len(args) == 0 {
+		return errors.New("address requires one of: create, list, show, add, forget")
+	}
+
+	flags, o := cliFlags("address " + args[0])
+	registered := flags.Bool("registered", false, "list: only addresses we receive messages for")
+	private := flags.Bool("private", false, "show: include the private key")
+	label := flags.String("label", "", "add: label of the address")
+	subscribe := flags.Bool("subscribe", false, "add: save publications from the address")
+	flags.Parse(args[1:])
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "create" && flags.NArg() == 0:
+		detail := new(objects.AddressDetail)
+		err = c.call("CreateAddress", localapi.NilParam{}, detail)
+		if err != nil {
+			return err
+		}
+		o.print(detail, func() { fmt.Println(detail.String) })
+
+	case args[0] == "list" && flags.NArg() == 0:
+		list := make([][2]string, 0, 0)
+		err = c.call("ListAddresses", *registered, &list)
+		if err != nil {
+			return err
+		}
+		o.print(list, func() {
+			for _, a := range list {
+				fmt.Printf("%s\t%s\n", a[0], a[1])
+			}
+		})
+
+	case args[0] == "show" && flags.NArg() == 1:
+		detail := new(objects.AddressDetail)
+		err = c.call("GetAddress", flags.Arg(0), detail)
+		if err != nil {
+			return err
+		}
+		if !*private {
+			detail.Privkey = nil
+			detail.EncPrivkey = nil
+		}
+		o.print(detail, func() {
+			fmt.Printf("Address:    %s\n", detail.String)
+			fmt.Printf("Label:      %s\n", detail.Label)
+			fmt.Printf("Registered: %t\n", detail.IsRegistered)
+			fmt.Printf("Subscribed: %t\n", detail.IsSubscribed)
+			fmt.Printf("Public Key: %x\n", detail.Pubkey)
+			if detail.Privkey != nil {
+				fmt.Printf("Private Key: %x\n", detail.Privkey)
+			}
+		})
+
+	case args[0] == "add" && flags.NArg() == 1:
+		detail := &objects.AddressDetail{String: flags.Arg(0), Label: *label, IsSubscribed: *subscribe}
+		err = c.call("AddUpdateAddress", detail, nil)
+		if err != nil {
+			return err
+		}
+		o.print(detail, func() { fmt.Println("Saved.") })
+
+	case args[0] == "forget" && flags.NArg() == 1:
+		err = c.call("ForgetAddress", flags.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		o.print(flags.Arg(0), func() { fmt.Println("Forgotten.") })
+
+	default:
+		return errors.New("Usage: emp " + cliCommands["address"].usage)
+	}
+
+	return nil
+}
+
+// Read message content from stdin, unless -body was given.
+func readContent(body string) (string, error) {
+	if len(body) > 0 {
+		return body, nil
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	return string(data), err
+}
+
+func cmdSend(args []string) error {
+	flags, o := cliFlags("send")
+	from := flags.String("from", "", "sending address")
+	subject := flags.String("subject", "", "subject")
+	body := flags.String("body", "", "content (default read from stdin)")
+	cc := flags.String("cc", "", "comma-separated copy recipients")
+	bcc := flags.String("bcc", "", "comma-separated hidden copy recipients")
+	at := flags.String("at", "", "send later, at an RFC 3339 time")
+	flags.Parse(args)
+
+	if len(*from) == 0 || flags.NArg() == 0 {
+		return errors.New("Usage: emp " + cliCommands["send"].usage)
+	}
+
+	msg := &localapi.SendMsg{Sender: *from, Recipient: flags.Arg(0), To: flags.Args()[1:], Subject: *subject}
+	if len(*cc) > 0 {
+		msg.CC = strings.Split(*cc, ",")
+	}
+	if len(*bcc) > 0 {
+		msg.BCC = strings.Split(*bcc, ",")
+	}
+	if len(*at) > 0 {
+		sendAt, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return errors.New("-at must be an RFC 3339 time, like 2014-06-01T09:00:00Z")
+		}
+		msg.SendAt = sendAt
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+	msg.Plaintext, err = readContent(*body)
+	if err != nil {
+		return err
+	}
+
+	reply := new(localapi.SendResponse)
+	err = c.call("SendMessage", msg, reply)
+	if err != nil {
+		return err
+	}
+
+	o.print(reply, func() {
+		if len(reply.Recipients) == 0 {
+			reply.Recipients = []localapi.RecipientStatus{{Recipient: msg.Recipient, TxidHash: reply.TxidHash, IsSent: reply.IsSent}}
+		}
+		for _, r := range reply.Recipients {
+			state := "Sent"
+			if !r.IsSent {
+				state = "Queued"
+			}
+			fmt.Printf("%s\t%x\t%s\n", state, r.TxidHash, r.Recipient)
+		}
+	})
+	return nil
+}
+
+func cmdPublish(args []string) error {
+	flags, o := cliFlags("publish")
+	from := flags.String("from", "", "publishing address")
+	subject := flags.String("subject", "", "subject")
+	body := flags.String("body", "", "content (default read from stdin)")
+	flags.Parse(args)
+
+	if len(*from) == 0 || flags.NArg() > 0 {
+		return errors.New("Usage: emp " + cliCommands["publish"].usage)
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+	msg := &localapi.SendMsg{Sender: *from, Subject: *subject}
+	msg.Plaintext, err = readContent(*body)
+	if err != nil {
+		return err
+	}
+
+	reply := new(localapi.SendResponse)
+	err = c.call("PublishMessage", msg, reply)
+	if err != nil {
+		return err
+	}
+
+	o.print(reply, func() { fmt.Printf("Published\t%x\n", reply.TxidHash) })
+	return nil
+}
+
+// Page flags shared by the box and search commands.
+func pageFlags(flags *flag.FlagSet) func() (*localdb.Page, error) {
+	limit := flags.Int("limit", 0, "messages per page (default all)")
+	cursor := flags.String("cursor", "", "txid_hash of the last message of the previous page")
+	asc := flags.Bool("asc", false, "oldest first")
+
+	return func() (*localdb.Page, error) {
+		page := &localdb.Page{Limit: *limit, Ascending: *asc}
+		if len(*cursor) > 0 {
+			var err error
+			page.Cursor, err = hex.DecodeString(*cursor)
+			if err != nil {
+				return nil, errors.New("-cursor must be hex encoded")
+			}
+		}
+		return page, nil
+	}
+}
+
+func printMessages(o *cliOptions, list []objects.MetaMessage, limit int) {
+	o.print(list, func() {
+		for _, msg := range list {
+			state := "unread"
+			if msg.Purged {
+				state = "read"
+			}
+			if len(msg.Failure) > 0 {
+				state = "failed: " + msg.Failure
+			}
+			fmt.Printf("%x  %s  %s -> %s  %s\n", msg.TxidHash.GetBytes(), msg.Timestamp.Local().Format("2006-01-02 15:04"), msg.Sender, msg.Recipient, state)
+		}
+		if limit > 0 && len(list) == limit {
+			fmt.Printf("Next page: -cursor %x\n", list[len(list)-1].TxidHash.GetBytes())
+		}
+	})
+}
+
+func boxCommand(method string) func(args []string) error {
+	return func(args []string) error {
+		flags, o := cliFlags(strings.ToLower(method))
+		page := pageFlags(flags)
+		flags.Parse(args)
+
+		p, err := page()
+		if err != nil {
+			return err
+		}
+		c, err := o.connect()
+		if err != nil {
+			return err
+		}
+
+		var params interface{} = p
+		if method == "Drafts" || method == "Scheduled" {
+			params = localapi.NilParam{}
+		}
+
+		list := make([]objects.MetaMessage, 0, 0)
+		err = c.call(method, params, &list)
+		if err != nil {
+			return err
+		}
+
+		printMessages(o, list, p.Limit)
+		return nil
+	}
+}
+
+func cmdSearch(args []string) error {
+	flags, o := cliFlags("search")
+	page := pageFlags(flags)
+	from := flags.String("from", "", "only messages from this address")
+	to := flags.String("to", "", "only messages to this address")
+	flags.Parse(args)
+
+	p, err := page()
+	if err != nil {
+		return err
+	}
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	search := &localapi.SearchArgs{Query: strings.Join(flags.Args(), " "), Page: *p}
+	search.Filter.Sender = *from
+	search.Filter.Recipient = *to
+
+	list := make([]objects.MetaMessage, 0, 0)
+	err = c.call("SearchMessages", search, &list)
+	if err != nil {
+		return err
+	}
+
+	printMessages(o, list, p.Limit)
+	return nil
+}
+
+func cmdCounts(args []string) error {
+	flags, o := cliFlags("counts")
+	flags.Parse(args)
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	counts := new(localdb.Counts)
+	err = c.call("MessageCounts", localapi.NilParam{}, counts)
+	if err != nil {
+		return err
+	}
+
+	boxes := []string{"Inbox", "Outbox", "Sendbox", "Drafts"}
+	o.print(counts, func() {
+		for _, count := range counts.Boxes {
+			if int(count.Id) < len(boxes) {
+				fmt.Printf("%-10s %5d  (%d unread)\n", boxes[count.Id], count.Total, count.Unread)
+			}
+		}
+		for _, count := range counts.Folders {
+			fmt.Printf("Folder %-3d %5d  (%d unread)\n", count.Id, count.Total, count.Unread)
+		}
+	})
+	return nil
+}
+
+// Parse the single hex argument of a command.
+func hexArg(flags *flag.FlagSet, name string) ([]byte, error) {
+	if flags.NArg() != 1 {
+		return nil, errors.New("Usage: emp " + cliCommands[name].usage)
+	}
+	data, err := hex.DecodeString(flags.Arg(0))
+	if err != nil {
+		return nil, errors.New("Identifier must be hex encoded")
+	}
+	return data, nil
+}
+
+func cmdOpen(args []string) error {
+	flags, o := cliFlags("open")
+	flags.Parse(args)
+	txid, err := hexArg(flags, "open")
+	if err != nil {
+		return err
+	}
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	msg := new(objects.FullMessage)
+	err = c.call("OpenMessage", txid, msg)
+	if err != nil {
+		return err
+	}
+
+	o.print(msg, func() {
+		fmt.Printf("From:    %s\n", msg.MetaMessage.Sender)
+		fmt.Printf("To:      %s\n", strings.Join(append([]string{msg.MetaMessage.Recipient}, msg.To...), ", "))
+		if len(msg.CC) > 0 {
+			fmt.Printf("CC:      %s\n", strings.Join(msg.CC, ", "))
+		}
+		fmt.Printf("Date:    %s\n", msg.MetaMessage.Timestamp.Local().Format(time.RFC1123))
+		if msg.Decrypted == nil {
+			fmt.Println("\n(Message could not be decrypted)")
+			return
+		}
+		fmt.Printf("Subject: %s\n", msg.Decrypted.Subject)
+		fmt.Printf("Txid:    %x\n\n", msg.Decrypted.Txid)
+		fmt.Println(msg.Decrypted.Content)
+	})
+	return nil
+}
+
+// Command that sends a hex identifier to method and has no result.
+func txidCommand(method, done string) func(args []string) error {
+	return func(args []string) error {
+		name := strings.ToLower(strings.TrimSuffix(method, "Message"))
+		flags, o := cliFlags(name)
+		flags.Parse(args)
+		txid, err := hexArg(flags, name)
+		if err != nil {
+			return err
+		}
+		c, err := o.connect()
+		if err != nil {
+			return err
+		}
+
+		err = c.call(method, txid, nil)
+		if err != nil {
+			return err
+		}
+
+		o.print(flags.Arg(0), func() { fmt.Println(done) })
+		return nil
+	}
+}
+
+func cmdReceipts(args []string) error {
+	flags, o := cliFlags("receipts")
+	flags.Parse(args)
+	txid, err := hexArg(flags, "receipts")
+	if err != nil {
+		return err
+	}
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	list := make([]objects.MetaMessage, 0, 0)
+	err = c.call("Receipts", txid, &list)
+	if err != nil {
+		return err
+	}
+
+	printMessages(o, list, 0)
+	return nil
+}
+
+// Call any method with raw JSON parameters, and print the raw result.
+func cmdExport(args []string) error {
+	flags, o := cliFlags("export")
+	format := flags.String("format", "mbox", "mbox, maildir or eml")
+	box := flags.String("box", "", "only inbox, outbox or sendbox (default all three)")
+	query := flags.String("q", "", "only messages matching a full-text query")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: emp " + cliCommands["export"].usage)
+	}
+
+	export := &localapi.ExportArgs{Format: *format, Path: flags.Arg(0), Query: *query}
+	if len(*box) > 0 {
+		id, ok := map[string]int{"inbox": localdb.INBOX, "outbox": localdb.OUTBOX, "sendbox": localdb.SENDBOX}[*box]
+		if !ok {
+			return errors.New("-box must be inbox, outbox or sendbox")
+		}
+		export.Filter.Box = &id
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	count := new(int)
+	err = c.call("ExportMessages", export, count)
+	if err != nil {
+		return err
+	}
+
+	o.print(count, func() { fmt.Printf("Exported %d messages.\n", *count) })
+	return nil
+}
+
+func cmdImport(args []string) error {
+	flags, o := cliFlags("import")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: emp " + cliCommands["import"].usage)
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	reply := new(localapi.ImportReply)
+	err = c.call("ImportMessages", localapi.ImportArgs{Path: flags.Arg(0)}, reply)
+	if err != nil {
+		return err
+	}
+
+	o.print(reply, func() {
+		fmt.Printf("Imported %d messages, %d already present, %d skipped.\n", reply.Imported, reply.Existing, reply.Skipped)
+	})
+	return nil
+}
+
+// Passphrase from the flag, or the first line of stdin.
+func readPassphrase(flag string) (string, error) {
+	if len(flag) > 0 {
+		return flag, nil
+	}
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", errors.New("Passphrase required, pass -passphrase or write it to stdin")
+	}
+	return line, nil
+}
+
+func cmdBackup(args []string) error {
+	flags, o := cliFlags("backup")
+	passphrase := flags.String("passphrase", os.Getenv("EMP_PASSPHRASE"), "encryption passphrase (default $EMP_PASSPHRASE, or read from stdin)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: emp " + cliCommands["backup"].usage)
+	}
+
+	backup := &localapi.BackupArgs{Path: flags.Arg(0)}
+	var err error
+	backup.Passphrase, err = readPassphrase(*passphrase)
+	if err != nil {
+		return err
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	counts := new(localdb.BackupCounts)
+	err = c.call("Backup", backup, counts)
+	if err != nil {
+		return err
+	}
+
+	o.print(counts, func() {
+		fmt.Printf("Backed up %d addresses, %d messages, %d folders and %d tokens.\n", counts.Addresses, counts.Messages, counts.Folders, counts.Tokens)
+	})
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	flags, o := cliFlags("restore")
+	passphrase := flags.String("passphrase", os.Getenv("EMP_PASSPHRASE"), "encryption passphrase (default $EMP_PASSPHRASE, or read from stdin)")
+	replace := flags.Bool("replace", false, "delete everything in the local database first")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: emp " + cliCommands["restore"].usage)
+	}
+
+	restore := &localapi.RestoreArgs{Path: flags.Arg(0), Replace: *replace}
+	var err error
+	restore.Passphrase, err = readPassphrase(*passphrase)
+	if err != nil {
+		return err
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	counts := new(localdb.BackupCounts)
+	err = c.call("Restore", restore, counts)
+	if err != nil {
+		return err
+	}
+
+	o.print(counts, func() {
+		fmt.Printf("Restored %d addresses, %d messages, %d folders and %d tokens, %d already present.\n", counts.Addresses, counts.Messages, counts.Folders, counts.Tokens, counts.Existing)
+	})
+	return nil
+}
+
+func cmdRPC(args []string) error {
+	flags, o := cliFlags("rpc")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("Usage: emp " + cliCommands["rpc"].usage)
+	}
+
+	var params interface{} = localapi.NilParam{}
+	if flags.NArg() == 2 {
+		params = json.RawMessage(flags.Arg(1))
+	}
+
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+
+	var result json.RawMessage
+	err = c.call(flags.Arg(0), params, &result)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if json.Indent(&out, result, "", "  ") != nil {
+		out.Write(result)
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -0,0 +1,291 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/msecret/emp/db/migrate"
+	"github.com/msecret/emp/objects"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Bolt buckets by object type. Keys are the same hashes as in the hash list, values
+// are the object's bytes (see objects), except for pubkeys which are IV | Payload.
+var boltBuckets = map[int][]byte{
+	PUBKEY: []byte("pubkey"),
+	PURGE:  []byte("purge"),
+	MSG:    []byte("msg"),
+	PUB:    []byte("pub"),
+}
+
+// Layout version of Bolt inventories, kept in the meta bucket. Files written by newer
+// versions of EMP are refused.
+const boltVersion = 1
+
+var boltMeta = []byte("meta")
+
+// Offset of the timestamp in objects.Message.GetBytes().
+const boltTimeOffset = 2 * 48
+
+type boltInventory struct {
+	hashIndex
+	log  chan string
+	conn *bolt.DB
+}
+
+// Open the Bolt file in dbFile (Absolute Path), creating it if necessary, and fill the hash list.
+func openBolt(log chan string, dbFile string) (Inventory, error) {
+	conn, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log <- fmt.Sprintf("Error opening bolt database at %s... %s", dbFile, err)
+		return nil, err
+	}
+
+	inv := &boltInventory{log: log, conn: conn}
+	inv.hashList = make(map[string]int)
+
+	err = conn.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get([]byte("version")); len(v) == 8 && binary.BigEndian.Uint64(v) > boltVersion {
+			return &migrate.VersionError{Version: int(binary.BigEndian.Uint64(v)), Known: boltVersion}
+		}
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, boltVersion)
+		err = meta.Put([]byte("version"), version)
+		if err != nil {
+			return err
+		}
+
+		for hashType, name := range boltBuckets {
+			bucket, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			bucket.ForEach(func(k, v []byte) error {
+				inv.hashList[string(k)] = hashType
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log <- fmt.Sprintf("Error setting up inventory buckets... %s", err)
+		conn.Close()
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// Closes the database file and empties the hash list.
+func (inv *boltInventory) Close() {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn != nil {
+		inv.conn.Close()
+		inv.conn = nil
+	}
+	inv.hashList = make(map[string]int)
+}
+
+// Store an object under hashObj, unless one of the same type is already there. Returns
+// an ETYPE error if one of another type is. Must be called with the mutex held.
+func (inv *boltInventory) put(hashType int, hashObj objects.Hash, value []byte) error {
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+	if ok, err := inv.checkAdd(hashObj, hashType); !ok {
+		return err
+	}
+
+	err := inv.conn.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBuckets[hashType]).Put(hashObj.GetBytes(), value)
+	})
+	if err != nil {
+		inv.log <- fmt.Sprintf("Error inserting object into db... %s", err)
+		return err
+	}
+
+	inv.add(hashObj, hashType)
+	return nil
+}
+
+// Value stored under hashObj if it has one of the given types. Must be called with the mutex held.
+func (inv *boltInventory) get(hashObj objects.Hash, hashTypes ...int) []byte {
+	if inv.conn == nil {
+		return nil
+	}
+
+	hashType := inv.typeOf(hashObj)
+	for _, t := range hashTypes {
+		if t != hashType {
+			continue
+		}
+
+		var value []byte
+		inv.conn.View(func(tx *bolt.Tx) error {
+			// Bolt values are only valid inside the transaction.
+			value = append([]byte(nil), tx.Bucket(boltBuckets[hashType]).Get(hashObj.GetBytes())...)
+			return nil
+		})
+		if len(value) == 0 {
+			return nil
+		}
+		return value
+	}
+	return nil
+}
+
+func (inv *boltInventory) Sweep(duration time.Duration) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+
+	deadline := time.Now().Add(-duration).Unix()
+	swept := make([]objects.Hash, 0, 0)
+
+	err := inv.conn.Update(func(tx *bolt.Tx) error {
+		for _, hashType := range []int{MSG, PUB} {
+			bucket := tx.Bucket(boltBuckets[hashType])
+
+			// Keys can't be deleted while iterating.
+			old := make([][]byte, 0, 0)
+			bucket.ForEach(func(k, v []byte) error {
+				if len(v) < boltTimeOffset+8 || int64(binary.BigEndian.Uint64(v[boltTimeOffset:])) <= deadline {
+					old = append(old, append([]byte(nil), k...))
+				}
+				return nil
+			})
+
+			for _, k := range old {
+				err := bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+				hashObj := new(objects.Hash)
+				hashObj.FromBytes(k)
+				swept = append(swept, *hashObj)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range swept {
+		inv.del(hash)
+	}
+	return nil
+}
+
+func (inv *boltInventory) AddPubkey(pubkey objects.EncryptedPubkey) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	return inv.put(PUBKEY, pubkey.AddrHash, append(pubkey.IV[:], pubkey.Payload...))
+}
+
+func (inv *boltInventory) GetPubkey(addrHash objects.Hash) *objects.EncryptedPubkey {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	payload := inv.get(addrHash, PUBKEY)
+	if payload == nil {
+		return nil
+	}
+	return pubkeyFromBytes(addrHash, payload)
+}
+
+func (inv *boltInventory) AddPurge(p objects.Purge) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	txid := p.GetBytes()
+	return inv.put(PURGE, objects.MakeHash(txid), txid)
+}
+
+func (inv *boltInventory) GetPurge(txidHash objects.Hash) *objects.Purge {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	txid := inv.get(txidHash, PURGE)
+	if txid == nil {
+		return nil
+	}
+	p := new(objects.Purge)
+	if p.FromBytes(txid) != nil {
+		return nil
+	}
+	return p
+}
+
+func (inv *boltInventory) AddPub(msg *objects.Message) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	return inv.put(PUB, msg.TxidHash, msg.GetBytes())
+}
+
+func (inv *boltInventory) AddMessage(msg *objects.Message) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	return inv.put(MSG, msg.TxidHash, msg.GetBytes())
+}
+
+func (inv *boltInventory) GetMessage(txidHash objects.Hash) *objects.Message {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	data := inv.get(txidHash, MSG, PUB)
+	if data == nil {
+		return nil
+	}
+	msg := new(objects.Message)
+	if msg.FromBytes(data) != nil {
+		return nil
+	}
+	return msg
+}
+
+func (inv *boltInventory) Remove(hashObj objects.Hash) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+
+	hashType := inv.typeOf(hashObj)
+	if name, ok := boltBuckets[hashType]; ok {
+		err := inv.conn.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(name).Delete(hashObj.GetBytes())
+		})
+		if err != nil {
+			inv.log <- fmt.Sprintf("Error deleting hash from db... %s", err)
+			return err
+		}
+	}
+
+	inv.del(hashObj)
+	return nil
+}
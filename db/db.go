@@ -1,6 +1,6 @@
 /**
     Copyright 2014 JARST, LLC.
-    
+
     This file is part of EMP.
 
     EMP is distributed in the hope that it will be useful,
@@ -9,125 +9,69 @@
     LICENSE file for more details.
 **/
 
-// Package db provides a connection to a local SQLite database to store the EMP inventory.
+// Package db stores the EMP inventory in a SQLite database, a Bolt file, or memory.
 package db
 
 import (
+	"errors"
 	"fmt"
-	"github.com/mxk/go-sqlite/sqlite3"
-	"sync"
+	"github.com/msecret/emp/objects"
+	"strings"
+	"time"
 )
 
-// Database Connection
-var dbConn *sqlite3.Conn
-var mutex *sync.Mutex
-
-// Initialize Database connection from Database File (Absolute Path), mutexes, and the global hash list.
-func Initialize(log chan string, dbFile string) error {
-	var err error
-	if dbConn != nil {
-		return nil
-	}
-
-	mutex = new(sync.Mutex)
+// Inventory backends, selected with inventory_backend in msg.conf.
+const (
+	SQLite = "sqlite" // Default
+	Bolt   = "bolt"   // Single-file key/value store, no cgo required
+	Memory = "memory" // Nothing is kept across restarts
+)
 
-	// Create Database Connection
-	dbConn, err = sqlite3.Open(dbFile)
-	if err != nil || dbConn == nil {
-		log <- fmt.Sprintf("Error opening sqlite database at %s... %s", dbFile, err)
-		dbConn = nil
-		return err
-	}
+var Backends = []string{SQLite, Bolt, Memory}
 
-	// Create Database Schema
-	err = dbConn.Exec("CREATE TABLE IF NOT EXISTS pubkey (hash BLOB NOT NULL UNIQUE, payload BLOB NOT NULL, PRIMARY KEY (hash))")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up pubkey schema... %s", err)
-		dbConn = nil
-		return err
-	}
+// Storage for every object relayed by the node. All methods are safe for concurrent use.
+type Inventory interface {
+	// Encrypted public keys, by address hash.
+	AddPubkey(pubkey objects.EncryptedPubkey) error
+	GetPubkey(addrHash objects.Hash) *objects.EncryptedPubkey
 
-	err = dbConn.Exec("CREATE TABLE IF NOT EXISTS purge (hash BLOB NOT NULL UNIQUE, txid BLOB NOT NULL UNIQUE, PRIMARY KEY (hash))")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up purge schema... %s", err)
-		dbConn = nil
-		return err
-	}
+	// Purge tokens, by the hash of the purged txid.
+	AddPurge(p objects.Purge) error
+	GetPurge(txidHash objects.Hash) *objects.Purge
 
-	err = dbConn.Exec("CREATE TABLE IF NOT EXISTS msg (hash BLOB NOT NULL UNIQUE, addrHash BLOB NOT NULL, timestamp INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (hash))")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up msg schema... %s", err)
-		dbConn = nil
-		return err
-	}
+	// Basic and published messages, both returned by GetMessage().
+	AddMessage(msg *objects.Message) error
+	AddPub(msg *objects.Message) error
+	GetMessage(txidHash objects.Hash) *objects.Message
 
-	err = dbConn.Exec("CREATE TABLE IF NOT EXISTS pub (hash BLOB NOT NULL UNIQUE, addrHash BLOB NOT NULL, timestamp INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (hash))")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up pub schema... %s", err)
-		dbConn = nil
-		return err
-	}
+	// Mark a public key as requested. Requests are only kept until the key arrives,
+	// and are lost on restart.
+	AddRequest(addrHash objects.Hash)
 
-	err = dbConn.Exec("CREATE TABLE IF NOT EXISTS peer (ip BLOB NOT NULL, port INTEGER NOT NULL, port_admin INTEGER NOT NULL, last_seen INTEGER NOT NULL, id INTEGER PRIMARY KEY AUTOINCREMENT)")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up peer schema... %s", err)
-		dbConn = nil
-		return err
-	}
+	// Type of a stored object (see constants), or NOTFOUND.
+	Contains(hash objects.Hash) int
 
-	err = dbConn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS ip_index ON peer (ip, port, port_admin)")
-	if err != nil {
-		log <- fmt.Sprintf("Error setting up peer index... %s", err)
-		dbConn = nil
-		return err
-	}
+	// Remove any object, including a public key request.
+	Remove(hash objects.Hash) error
 
-	if hashList == nil {
-		hashList = make(map[string]int)
-		return populateHashes()
-	}
+	// List of all hashes in the inventory.
+	List() *objects.Obj
 
-	if dbConn == nil || hashList == nil {
-		fmt.Println("ERROR! ERROR! WTF!!! SHOULD BE INITIALIZED!")
-	}
+	// Remove all basic and published messages older than (Current Time - duration).
+	Sweep(duration time.Duration) error
 
-	return nil
+	Close()
 }
 
-func populateHashes() error {
-	mutex.Lock()
-
-	for s, err := dbConn.Query("SELECT hash FROM pubkey"); err == nil; err = s.Next() {
-		var hash []byte
-		s.Scan(&hash) // Assigns 1st column to rowid, the rest to row
-		hashList[string(hash)] = PUBKEY
-	}
-
-	for s, err := dbConn.Query("SELECT hash FROM msg"); err == nil; err = s.Next() {
-		var hash []byte
-		s.Scan(&hash) // Assigns 1st column to rowid, the rest to row
-		hashList[string(hash)] = MSG
-	}
-
-	for s, err := dbConn.Query("SELECT hash FROM pub"); err == nil; err = s.Next() {
-		var hash []byte
-		s.Scan(&hash) // Assigns 1st column to rowid, the rest to row
-		hashList[string(hash)] = PUB
-	}
-
-	for s, err := dbConn.Query("SELECT hash FROM purge"); err == nil; err = s.Next() {
-		var hash []byte
-		s.Scan(&hash) // Assigns 1st column to rowid, the rest to row
-		hashList[string(hash)] = PURGE
+// Open the inventory in file with a backend. The file is ignored by the memory backend.
+func Open(log chan string, backend string, file string) (Inventory, error) {
+	switch backend {
+	case SQLite, "":
+		return openSQLite(log, file)
+	case Bolt:
+		return openBolt(log, file)
+	case Memory:
+		return openMemory(), nil
 	}
-
-	mutex.Unlock()
-	return nil
-}
-
-// Closes the database connection and de-initializes the global hash list.
-func Cleanup() {
-	dbConn.Close()
-	dbConn = nil
-	hashList = nil
+	return nil, errors.New(fmt.Sprintf("Unknown inventory backend %q, must be one of: %s", backend, strings.Join(Backends, ", ")))
 }
@@ -1,6 +1,6 @@
 /**
     Copyright 2014 JARST, LLC.
-    
+
     This file is part of EMP.
 
     EMP is distributed in the hope that it will be useful,
@@ -12,9 +12,10 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
-	"os/exec"
-	"emp/objects"
+	"github.com/msecret/emp/objects"
+	"os"
 	"testing"
 	"time"
 )
@@ -29,77 +30,170 @@ func TestDatabase(t *testing.T) {
 		}
 	}()
 
-	err := Initialize(log, "testdb.db")
-	if dbConn == nil || hashList == nil {
-		fmt.Println("ERROR! ERROR! WTF!!!")
+	for _, backend := range Backends {
+		dbFile := os.TempDir() + "/emp_testdb_" + backend + ".db"
+		os.Remove(dbFile)
+
+		inv, err := Open(log, backend, dbFile)
+		if err != nil {
+			fmt.Printf("ERROR: %s: %s\n", backend, err)
+			t.FailNow()
+		}
+
+		testInventory(t, backend, inv)
+		inv.Close()
+
+		// Whatever is left must still be there after reopening.
+		if backend != Memory {
+			inv, _ = Open(log, backend, dbFile)
+			if inv.Contains(objects.MakeHash([]byte("kept"))) != MSG || inv.GetMessage(objects.MakeHash([]byte("kept"))) == nil {
+				fmt.Println(backend, ": Message lost after reopening")
+				t.Fail()
+			}
+			inv.Close()
+		}
+
+		os.Remove(dbFile)
 	}
 
-	if err != nil {
-		fmt.Printf("ERROR: %s\n", err)
-		t.FailNow()
+	if _, err := Open(log, "nosuchbackend", ""); err == nil {
+		fmt.Println("Unknown backend opened")
+		t.Fail()
 	}
+}
 
+func testInventory(t *testing.T, backend string, inv Inventory) {
 	txid := []byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p'}
 	purgeHash := objects.MakeHash(txid)
 	pubHash := objects.MakeHash([]byte{'e', 'f', 'g', 'h'})
 
-	if Contains(purgeHash) != NOTFOUND {
-		fmt.Println("Purge Hash already in list...")
+	if inv.Contains(purgeHash) != NOTFOUND {
+		fmt.Println(backend, ": Purge Hash already in list...")
+		t.FailNow()
+	}
+	if inv.Contains(pubHash) != NOTFOUND {
+		fmt.Println(backend, ": Pubkey Hash already in list...")
 		t.FailNow()
 	}
-	if Contains(pubHash) != NOTFOUND {
-		fmt.Println("Pubkey Hash already in list...")
+
+	inv.AddRequest(pubHash)
+	if inv.Contains(pubHash) != PUBKEYRQ || len(inv.List().HashList) != 1 {
+		fmt.Println(backend, ": Pubkey request not in hash list")
 		t.FailNow()
 	}
+	inv.Remove(pubHash)
 
 	pub := new(objects.EncryptedPubkey)
 	pub.AddrHash = pubHash
 	pub.IV = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 	pub.Payload = []byte{'a', 'b', 'c', 'd'}
 
-	err = AddPubkey(log, *pub)
+	err := inv.AddPubkey(*pub)
 	if err != nil {
-		fmt.Printf("ERROR: %s\n", err)
+		fmt.Printf("ERROR: %s: %s\n", backend, err)
 		t.FailNow()
 	}
 
-	if Contains(pubHash) != PUBKEY {
-		fmt.Println("Pubkey not in hash list")
-		time.Sleep(time.Millisecond)
+	if inv.Contains(pubHash) != PUBKEY {
+		fmt.Println(backend, ": Pubkey not in hash list")
 		t.FailNow()
 	}
+	if got := inv.GetPubkey(pubHash); got == nil || got.IV != pub.IV || !bytes.Equal(got.Payload, pub.Payload) {
+		fmt.Println(backend, ": Wrong pubkey returned: ", got)
+		t.Fail()
+	}
 
-	RemoveHash(log, pubHash)
+	inv.Remove(pubHash)
 
-	if Contains(pubHash) != NOTFOUND {
-		fmt.Println("Pubkey stuck in hash list")
+	if inv.Contains(pubHash) != NOTFOUND || inv.GetPubkey(pubHash) != nil {
+		fmt.Println(backend, ": Pubkey stuck in hash list")
 		t.FailNow()
 	}
 
 	purge := new(objects.Purge)
 	copy(purge.Txid[:], txid)
 
-	err = AddPurge(log, *purge)
+	err = inv.AddPurge(*purge)
 	if err != nil {
-		fmt.Printf("ERROR: %s\n", err)
+		fmt.Printf("ERROR: %s: %s\n", backend, err)
 		t.FailNow()
 	}
 
-	if Contains(purgeHash) != PURGE {
-		fmt.Println("Purge not in hash list")
+	if inv.Contains(purgeHash) != PURGE {
+		fmt.Println(backend, ": Purge not in hash list")
 		t.FailNow()
 	}
+	if got := inv.GetPurge(purgeHash); got == nil || got.Txid != purge.Txid {
+		fmt.Println(backend, ": Wrong purge returned: ", got)
+		t.Fail()
+	}
 
-	RemoveHash(log, purgeHash)
+	inv.Remove(purgeHash)
 
-	if Contains(purgeHash) != NOTFOUND {
-		fmt.Println("Purge stuck in hash list")
+	if inv.Contains(purgeHash) != NOTFOUND {
+		fmt.Println(backend, ": Purge stuck in hash list")
 		t.FailNow()
 	}
 
-	Cleanup()
+	// Messages and publications, one of each too old to keep.
+	now := time.Now().Round(time.Second)
+	msgs := make(map[string]*objects.Message)
+	for _, name := range []string{"kept", "old", "publication", "old publication"} {
+		msg := new(objects.Message)
+		msg.TxidHash = objects.MakeHash([]byte(name))
+		msg.AddrHash = pubHash
+		msg.Timestamp = now
+		msg.Content.CipherText = msg.TxidHash.GetBytes()[:16]
+		msgs[name] = msg
+	}
+	msgs["old"].Timestamp = now.Add(-2 * time.Hour)
+	msgs["old publication"].Timestamp = now.Add(-2 * time.Hour)
 
-	// Remove DB
-	err = exec.Command("rm", "testdb.db").Run()
+	inv.AddMessage(msgs["kept"])
+	inv.AddMessage(msgs["old"])
+	inv.AddPub(msgs["publication"])
+	inv.AddPub(msgs["old publication"])
 
+	if inv.Contains(msgs["kept"].TxidHash) != MSG || inv.Contains(msgs["publication"].TxidHash) != PUB {
+		fmt.Println(backend, ": Messages not in hash list")
+		t.FailNow()
+	}
+
+	// Nothing is stored over an object of another type.
+	if err := inv.AddPub(msgs["kept"]); err != DBError(ETYPE) || inv.Contains(msgs["kept"].TxidHash) != MSG {
+		fmt.Println(backend, ": Message replaced by a publication: ", err)
+		t.Fail()
+	}
+	if err := inv.AddMessage(msgs["kept"]); err != nil {
+		fmt.Println(backend, ": Adding a message twice failed: ", err)
+		t.Fail()
+	}
+
+	for name, msg := range msgs {
+		got := inv.GetMessage(msg.TxidHash)
+		if got == nil || !got.Timestamp.Equal(msg.Timestamp) || got.AddrHash != msg.AddrHash || !bytes.Equal(got.Content.CipherText, msg.Content.CipherText) {
+			fmt.Println(backend, ": Wrong message returned for ", name, ": ", got)
+			t.Fail()
+		}
+	}
+
+	err = inv.Sweep(time.Hour)
+	if err != nil {
+		fmt.Printf("ERROR: %s: %s\n", backend, err)
+		t.FailNow()
+	}
+	if inv.Contains(msgs["old"].TxidHash) != NOTFOUND || inv.Contains(msgs["old publication"].TxidHash) != NOTFOUND || inv.GetMessage(msgs["old"].TxidHash) != nil {
+		fmt.Println(backend, ": Old messages not swept")
+		t.Fail()
+	}
+	if inv.Contains(msgs["kept"].TxidHash) != MSG || inv.Contains(msgs["publication"].TxidHash) != PUB {
+		fmt.Println(backend, ": New messages swept")
+		t.Fail()
+	}
+
+	inv.Remove(msgs["publication"].TxidHash)
+	if inv.GetMessage(msgs["publication"].TxidHash) != nil || len(inv.List().HashList) != 1 {
+		fmt.Println(backend, ": Publication stuck in inventory")
+		t.Fail()
+	}
 }
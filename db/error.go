@@ -13,6 +13,7 @@ package db
 
 const (
 	EUNINIT = iota
+	ETYPE   = iota
 )
 
 type DBError int
@@ -20,7 +21,9 @@ type DBError int
 func (e DBError) Error() string {
 	switch int(e) {
 	case EUNINIT:
-		return "Database or hash list not initialized! Please call Initialize()"
+		return "Inventory is closed! Please call Open()"
+	case ETYPE:
+		return "An object of another type is stored under this hash!"
 	default:
 		return "Unknown error..."
 	}
@@ -0,0 +1,97 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package db
+
+import (
+	"github.com/msecret/emp/objects"
+	"sync"
+)
+
+const (
+	PUBKEY   = iota // Encrypted Public Key
+	PURGE    = iota // Purged Message
+	MSG      = iota // Basic Message
+	PUBKEYRQ = iota // Public Key Request
+	PUB      = iota // Published Message
+	NOTFOUND = iota // Object not in hash list.
+)
+
+// Hash list shared by every backend, so Contains() and List() never touch storage.
+// Backends lock the mutex around every method, and use the unexported methods inside.
+type hashIndex struct {
+	mutex    sync.Mutex
+	hashList map[string]int
+}
+
+// Add an object to the hash list with a given type.
+func (index *hashIndex) add(hashObj objects.Hash, hashType int) {
+	index.hashList[string(hashObj.GetBytes())] = hashType
+}
+
+// Whether an object of hashType should be stored under hashObj: not if one of that type
+// already is, and an ETYPE error if one of another type is. Public key requests are
+// only in the hash list, so they are replaced.
+func (index *hashIndex) checkAdd(hashObj objects.Hash, hashType int) (bool, error) {
+	switch index.typeOf(hashObj) {
+	case NOTFOUND, PUBKEYRQ:
+		return true, nil
+	case hashType:
+		return false, nil
+	}
+	return false, DBError(ETYPE)
+}
+
+// Remove an object from the hash list.
+func (index *hashIndex) del(hashObj objects.Hash) {
+	delete(index.hashList, string(hashObj.GetBytes()))
+}
+
+// Return the type the item in the hash list (see constants).
+func (index *hashIndex) typeOf(hashObj objects.Hash) int {
+	hashType, ok := index.hashList[string(hashObj.GetBytes())]
+	if !ok {
+		return NOTFOUND
+	}
+	return hashType
+}
+
+func (index *hashIndex) Contains(hashObj objects.Hash) int {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	return index.typeOf(hashObj)
+}
+
+func (index *hashIndex) AddRequest(addrHash objects.Hash) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.typeOf(addrHash) == NOTFOUND {
+		index.add(addrHash, PUBKEYRQ)
+	}
+}
+
+func (index *hashIndex) List() *objects.Obj {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	ret := new(objects.Obj)
+	ret.HashList = make([]objects.Hash, 0, len(index.hashList))
+
+	hash := new(objects.Hash)
+
+	for key, _ := range index.hashList {
+		hash.FromBytes([]byte(key))
+		ret.HashList = append(ret.HashList, *hash)
+	}
+	return ret
+}
@@ -0,0 +1,162 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package db
+
+import (
+	"github.com/msecret/emp/objects"
+	"time"
+)
+
+// Inventory kept in memory, for tests and nodes that don't need to remember
+// anything across restarts.
+type memoryInventory struct {
+	hashIndex
+	pubkeys  map[string]objects.EncryptedPubkey
+	purges   map[string]objects.Purge
+	messages map[string]objects.Message // Basic and published, told apart by the hash list
+}
+
+func openMemory() *memoryInventory {
+	inv := new(memoryInventory)
+	inv.reset()
+	return inv
+}
+
+func (inv *memoryInventory) reset() {
+	inv.hashList = make(map[string]int)
+	inv.pubkeys = make(map[string]objects.EncryptedPubkey)
+	inv.purges = make(map[string]objects.Purge)
+	inv.messages = make(map[string]objects.Message)
+}
+
+// Everything stored is forgotten.
+func (inv *memoryInventory) Close() {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	inv.reset()
+}
+
+func (inv *memoryInventory) Sweep(duration time.Duration) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	deadline := time.Now().Add(-duration).Unix()
+
+	for key, msg := range inv.messages {
+		if msg.Timestamp.Unix() <= deadline {
+			delete(inv.messages, key)
+			inv.del(msg.TxidHash)
+		}
+	}
+	return nil
+}
+
+func (inv *memoryInventory) AddPubkey(pubkey objects.EncryptedPubkey) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if ok, err := inv.checkAdd(pubkey.AddrHash, PUBKEY); !ok {
+		return err
+	}
+
+	inv.pubkeys[string(pubkey.AddrHash.GetBytes())] = pubkey
+	inv.add(pubkey.AddrHash, PUBKEY)
+	return nil
+}
+
+func (inv *memoryInventory) GetPubkey(addrHash objects.Hash) *objects.EncryptedPubkey {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	pubkey, ok := inv.pubkeys[string(addrHash.GetBytes())]
+	if !ok {
+		return nil
+	}
+	return &pubkey
+}
+
+func (inv *memoryInventory) AddPurge(p objects.Purge) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hashObj := objects.MakeHash(p.GetBytes())
+	if ok, err := inv.checkAdd(hashObj, PURGE); !ok {
+		return err
+	}
+
+	inv.purges[string(hashObj.GetBytes())] = p
+	inv.add(hashObj, PURGE)
+	return nil
+}
+
+func (inv *memoryInventory) GetPurge(txidHash objects.Hash) *objects.Purge {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	p, ok := inv.purges[string(txidHash.GetBytes())]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+func (inv *memoryInventory) AddPub(msg *objects.Message) error {
+	return inv.addMessage(PUB, msg)
+}
+
+func (inv *memoryInventory) AddMessage(msg *objects.Message) error {
+	return inv.addMessage(MSG, msg)
+}
+
+func (inv *memoryInventory) addMessage(hashType int, msg *objects.Message) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if ok, err := inv.checkAdd(msg.TxidHash, hashType); !ok {
+		return err
+	}
+
+	inv.messages[string(msg.TxidHash.GetBytes())] = *msg
+	inv.add(msg.TxidHash, hashType)
+	return nil
+}
+
+func (inv *memoryInventory) GetMessage(txidHash objects.Hash) *objects.Message {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	msg, ok := inv.messages[string(txidHash.GetBytes())]
+	if !ok {
+		return nil
+	}
+	return &msg
+}
+
+func (inv *memoryInventory) Remove(hashObj objects.Hash) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := string(hashObj.GetBytes())
+
+	switch inv.typeOf(hashObj) {
+	case PUBKEY:
+		delete(inv.pubkeys, hash)
+	case MSG, PUB:
+		delete(inv.messages, hash)
+	case PURGE:
+		delete(inv.purges, hash)
+	}
+
+	inv.del(hashObj)
+	return nil
+}
@@ -0,0 +1,121 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+// Package migrate upgrades SQLite schemas with ordered, versioned migrations.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// One schema change. Migration N (counting from 1) brings a database from version N-1
+// to N, and is never changed once released: add a new one instead.
+type Migration struct {
+	Description string
+	Up          func(conn *sqlite3.Conn) error
+}
+
+// Returned when a database was upgraded by a newer version of EMP.
+type VersionError struct {
+	Version int // Schema version of the database
+	Known   int // Newest version this binary has migrations for
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Database schema version %d is newer than this version of EMP understands (%d). Please upgrade EMP.", e.Version, e.Known)
+}
+
+// Schema version of a database, 0 if it was never migrated.
+func Version(conn *sqlite3.Conn) (int, error) {
+	err := conn.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	s, err := conn.Query("SELECT version FROM schema_version")
+	if err == nil {
+		s.Scan(&version)
+		s.Close()
+	}
+	return version, nil
+}
+
+// Apply every migration the database hasn't seen yet, in order. Each one runs in its
+// own transaction together with the version update, so a failed migration leaves the
+// database at the previous version. Returns the version the database had before.
+func Run(conn *sqlite3.Conn, migrations []Migration) (int, error) {
+	version, err := Version(conn)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return version, &VersionError{version, len(migrations)}
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err = conn.Begin()
+		if err != nil {
+			return version, err
+		}
+
+		err = migrations[i].Up(conn)
+		if err == nil {
+			err = setVersion(conn, i+1)
+		}
+		if err == nil {
+			err = conn.Commit()
+		}
+		if err != nil {
+			conn.Rollback()
+			return version, errors.New(fmt.Sprintf("Migration %d (%s) failed: %s", i+1, migrations[i].Description, err))
+		}
+	}
+	return version, nil
+}
+
+func setVersion(conn *sqlite3.Conn, version int) error {
+	err := conn.Exec("DELETE FROM schema_version")
+	if err != nil {
+		return err
+	}
+	return conn.Exec("INSERT INTO schema_version (version) VALUES (?)", version)
+}
+
+// Up function that runs each statement in order.
+func Exec(statements ...string) func(conn *sqlite3.Conn) error {
+	return func(conn *sqlite3.Conn) error {
+		for _, sql := range statements {
+			err := conn.Exec(sql)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Add a column unless the table already has it. Versions of EMP before schema versions
+// added columns without recording it, so the first migration can't know which exist.
+func AddColumn(conn *sqlite3.Conn, table, column, definition string) error {
+	for s, err := conn.Query("PRAGMA table_info(" + table + ")"); err == nil; err = s.Next() {
+		var cid int
+		var name string
+		s.Scan(&cid, &name)
+		if name == column {
+			s.Close()
+			return nil
+		}
+	}
+	return conn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+}
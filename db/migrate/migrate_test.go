@@ -0,0 +1,92 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"os"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	dbFile := os.TempDir() + "/emp_migrate_test.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	conn, err := sqlite3.Open(dbFile)
+	if err != nil {
+		fmt.Println("Error opening database: ", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// A table from before schema versions, with one of the later columns.
+	conn.Exec("CREATE TABLE item (id INTEGER PRIMARY KEY, name TEXT)")
+	conn.Exec("ALTER TABLE item ADD COLUMN color TEXT")
+
+	migrations := []Migration{
+		{Description: "Base", Up: func(conn *sqlite3.Conn) error {
+			err := conn.Exec("CREATE TABLE IF NOT EXISTS item (id INTEGER PRIMARY KEY, name TEXT)")
+			if err == nil {
+				err = AddColumn(conn, "item", "color", "TEXT")
+			}
+			return err
+		}},
+		{Description: "Sizes", Up: Exec("ALTER TABLE item ADD COLUMN size INTEGER NOT NULL DEFAULT 0", "INSERT INTO item (name, size) VALUES ('first', 1)")},
+	}
+
+	from, err := Run(conn, migrations)
+	if err != nil || from != 0 {
+		fmt.Println("Error migrating legacy database: ", from, err)
+		t.FailNow()
+	}
+	if version, _ := Version(conn); version != 2 {
+		fmt.Println("Wrong version after migrating: ", version)
+		t.Fail()
+	}
+
+	// Nothing runs twice.
+	from, err = Run(conn, migrations)
+	if err != nil || from != 2 {
+		fmt.Println("Migrations ran again: ", from, err)
+		t.Fail()
+	}
+
+	// A failing migration leaves the database as it was.
+	broken := append(migrations, Migration{Description: "Broken", Up: func(conn *sqlite3.Conn) error {
+		conn.Exec("DELETE FROM item")
+		return errors.New("Failed on purpose.")
+	}})
+	if _, err = Run(conn, broken); err == nil {
+		fmt.Println("Failed migration not reported.")
+		t.Fail()
+	}
+	if version, _ := Version(conn); version != 2 {
+		fmt.Println("Version changed by failed migration: ", version)
+		t.Fail()
+	}
+	if s, err := conn.Query("SELECT name FROM item WHERE size=1"); err != nil {
+		fmt.Println("Failed migration wasn't rolled back.")
+		t.Fail()
+	} else {
+		s.Close()
+	}
+
+	// Older binaries refuse the database.
+	_, err = Run(conn, migrations[:1])
+	if e, ok := err.(*VersionError); !ok || e.Version != 2 || e.Known != 1 {
+		fmt.Println("Expected VersionError, got: ", err)
+		t.Fail()
+	}
+}
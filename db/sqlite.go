@@ -0,0 +1,324 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package db
+
+import (
+	"fmt"
+	"github.com/msecret/emp/db/migrate"
+	"github.com/msecret/emp/objects"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+type sqliteInventory struct {
+	hashIndex
+	log  chan string
+	conn *sqlite3.Conn
+}
+
+// Schema history of the SQLite inventory, see package migrate.
+var sqliteMigrations = []migrate.Migration{
+	{Description: "Inventory tables", Up: migrate.Exec(
+		"CREATE TABLE IF NOT EXISTS pubkey (hash BLOB NOT NULL UNIQUE, payload BLOB NOT NULL, PRIMARY KEY (hash))",
+		"CREATE TABLE IF NOT EXISTS purge (hash BLOB NOT NULL UNIQUE, txid BLOB NOT NULL UNIQUE, PRIMARY KEY (hash))",
+		"CREATE TABLE IF NOT EXISTS msg (hash BLOB NOT NULL UNIQUE, addrHash BLOB NOT NULL, timestamp INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (hash))",
+		"CREATE TABLE IF NOT EXISTS pub (hash BLOB NOT NULL UNIQUE, addrHash BLOB NOT NULL, timestamp INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (hash))",
+		"CREATE TABLE IF NOT EXISTS peer (ip BLOB NOT NULL, port INTEGER NOT NULL, port_admin INTEGER NOT NULL, last_seen INTEGER NOT NULL, id INTEGER PRIMARY KEY AUTOINCREMENT)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS ip_index ON peer (ip, port, port_admin)",
+	)},
+}
+
+// Open the SQLite database in dbFile (Absolute Path), creating or upgrading it as needed, and fill the hash list.
+func openSQLite(log chan string, dbFile string) (Inventory, error) {
+	conn, err := sqlite3.Open(dbFile)
+	if err != nil || conn == nil {
+		log <- fmt.Sprintf("Error opening sqlite database at %s... %s", dbFile, err)
+		return nil, err
+	}
+
+	_, err = migrate.Run(conn, sqliteMigrations)
+	if err != nil {
+		log <- fmt.Sprintf("Error setting up inventory schema... %s", err)
+		conn.Close()
+		return nil, err
+	}
+
+	inv := &sqliteInventory{log: log, conn: conn}
+	inv.hashList = make(map[string]int)
+	inv.populateHashes()
+	return inv, nil
+}
+
+func (inv *sqliteInventory) populateHashes() {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	for table, hashType := range map[string]int{"pubkey": PUBKEY, "msg": MSG, "pub": PUB, "purge": PURGE} {
+		for s, err := inv.conn.Query("SELECT hash FROM " + table); err == nil; err = s.Next() {
+			var hash []byte
+			s.Scan(&hash)
+			inv.hashList[string(hash)] = hashType
+		}
+	}
+}
+
+// Closes the database connection and empties the hash list.
+func (inv *sqliteInventory) Close() {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn != nil {
+		inv.conn.Close()
+		inv.conn = nil
+	}
+	inv.hashList = make(map[string]int)
+}
+
+func (inv *sqliteInventory) Sweep(duration time.Duration) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+
+	deadline := time.Now().Add(-duration).Unix()
+
+	for table, hashType := range map[string]int{"msg": MSG, "pub": PUB} {
+		hashes := make([]objects.Hash, 0, 0)
+		for s, err := inv.conn.Query("SELECT hash FROM "+table+" WHERE timestamp <= ?", deadline); err == nil; err = s.Next() {
+			var hash []byte
+			s.Scan(&hash)
+			hashObj := new(objects.Hash)
+			hashObj.FromBytes(hash)
+			hashes = append(hashes, *hashObj)
+		}
+
+		err := inv.conn.Exec("DELETE FROM "+table+" WHERE timestamp <= ?", deadline)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if inv.typeOf(hash) == hashType {
+				inv.del(hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (inv *sqliteInventory) AddPubkey(pubkey objects.EncryptedPubkey) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := pubkey.AddrHash.GetBytes()
+	payload := append(pubkey.IV[:], pubkey.Payload...)
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+	if ok, err := inv.checkAdd(pubkey.AddrHash, PUBKEY); !ok {
+		return err
+	}
+
+	err := inv.conn.Exec("INSERT INTO pubkey VALUES (?, ?)", hash, payload)
+	if err != nil {
+		inv.log <- fmt.Sprintf("Error inserting pubkey into db... %s", err)
+		return err
+	}
+
+	inv.add(pubkey.AddrHash, PUBKEY)
+	return nil
+}
+
+func (inv *sqliteInventory) GetPubkey(addrHash objects.Hash) *objects.EncryptedPubkey {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := addrHash.GetBytes()
+
+	if inv.conn == nil || inv.typeOf(addrHash) != PUBKEY {
+		return nil
+	}
+
+	for s, err := inv.conn.Query("SELECT payload FROM pubkey WHERE hash=?", hash); err == nil; err = s.Next() {
+		var payload []byte
+		s.Scan(&payload)
+		return pubkeyFromBytes(addrHash, payload)
+	}
+	// Not Found
+	return nil
+}
+
+func (inv *sqliteInventory) AddPurge(p objects.Purge) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	txid := p.GetBytes()
+	hashObj := objects.MakeHash(txid)
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+	if ok, err := inv.checkAdd(hashObj, PURGE); !ok {
+		return err
+	}
+
+	err := inv.conn.Exec("INSERT INTO purge VALUES (?, ?)", hashObj.GetBytes(), txid)
+	if err != nil {
+		inv.log <- fmt.Sprintf("Error inserting purge into db... %s", err)
+		return err
+	}
+
+	inv.add(hashObj, PURGE)
+	return nil
+}
+
+func (inv *sqliteInventory) GetPurge(txidHash objects.Hash) *objects.Purge {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := txidHash.GetBytes()
+
+	if inv.conn == nil || inv.typeOf(txidHash) != PURGE {
+		return nil
+	}
+
+	for s, err := inv.conn.Query("SELECT txid FROM purge WHERE hash=?", hash); err == nil; err = s.Next() {
+		var txid []byte
+		s.Scan(&txid)
+		p := new(objects.Purge)
+		p.FromBytes(txid)
+		return p
+	}
+	// Not Found
+	return nil
+}
+
+func (inv *sqliteInventory) AddPub(msg *objects.Message) error {
+	return inv.addMessage("pub", PUB, msg)
+}
+
+func (inv *sqliteInventory) AddMessage(msg *objects.Message) error {
+	return inv.addMessage("msg", MSG, msg)
+}
+
+func (inv *sqliteInventory) addMessage(table string, hashType int, msg *objects.Message) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+	if ok, err := inv.checkAdd(msg.TxidHash, hashType); !ok {
+		return err
+	}
+
+	err := inv.conn.Exec("INSERT INTO "+table+" VALUES (?, ?, ?, ?)", msg.TxidHash.GetBytes(), msg.AddrHash.GetBytes(), msg.Timestamp.Unix(), msg.Content.GetBytes())
+	if err != nil {
+		inv.log <- fmt.Sprintf("Error inserting message into db... %s", err)
+		return err
+	}
+
+	inv.add(msg.TxidHash, hashType)
+	return nil
+}
+
+func (inv *sqliteInventory) GetMessage(txidHash objects.Hash) *objects.Message {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := txidHash.GetBytes()
+
+	if inv.conn == nil {
+		return nil
+	}
+
+	var table string
+	switch inv.typeOf(txidHash) {
+	case MSG:
+		table = "msg"
+	case PUB:
+		table = "pub"
+	default:
+		return nil
+	}
+
+	msg := new(objects.Message)
+
+	for s, err := inv.conn.Query("SELECT hash, addrHash, timestamp, payload FROM "+table+" WHERE hash=?", hash); err == nil; err = s.Next() {
+		var timestamp int64
+		encrypted := make([]byte, 0, 0)
+		txidhash := make([]byte, 0, 0)
+		addrhash := make([]byte, 0, 0)
+		s.Scan(&txidhash, &addrhash, &timestamp, &encrypted)
+
+		msg.TxidHash.FromBytes(txidhash)
+		msg.AddrHash.FromBytes(addrhash)
+		msg.Timestamp = time.Unix(timestamp, 0)
+		msg.Content.FromBytes(encrypted)
+
+		return msg
+	}
+	// Not Found
+	return nil
+}
+
+func (inv *sqliteInventory) Remove(hashObj objects.Hash) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	hash := hashObj.GetBytes()
+
+	if inv.conn == nil {
+		return DBError(EUNINIT)
+	}
+
+	var sql string
+
+	switch inv.typeOf(hashObj) {
+	case PUBKEY:
+		sql = "DELETE FROM pubkey WHERE hash=?"
+	case MSG:
+		sql = "DELETE FROM msg WHERE hash=?"
+	case PUB:
+		sql = "DELETE FROM pub WHERE hash=?"
+	case PURGE:
+		sql = "DELETE FROM purge WHERE hash=?"
+	case PUBKEYRQ:
+		inv.del(hashObj)
+		return nil
+	default:
+		return nil
+	}
+
+	err := inv.conn.Exec(sql, hash)
+	if err != nil {
+		inv.log <- fmt.Sprintf("Error deleting hash from db... %s", err)
+		return err
+	}
+
+	inv.del(hashObj)
+	return nil
+}
+
+// Encrypted public keys are stored as IV (16 bytes) | Payload.
+func pubkeyFromBytes(addrHash objects.Hash, payload []byte) *objects.EncryptedPubkey {
+	if len(payload) < 16 {
+		return nil
+	}
+	pub := new(objects.EncryptedPubkey)
+	pub.AddrHash = addrHash
+	copy(pub.IV[:], payload[:16])
+	pub.Payload = payload[16:]
+	return pub
+}
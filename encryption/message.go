@@ -1,6 +1,6 @@
 /**
     Copyright 2014 JARST, LLC.
-    
+
     This file is part of EMP.
 
     EMP is distributed in the hope that it will be useful,
@@ -9,7 +9,7 @@
     LICENSE file for more details.
 **/
 
-// Package encryption wraps around Go's native crypto library to provide 
+// Package encryption wraps around Go's native crypto library to provide
 // ECIES and AES-256 encryption for EMP Basic and Published Messages.
 package encryption
 
@@ -20,9 +20,47 @@ import (
 	"crypto/sha512"
 )
 
-
 // Encrypt plainText into an Encrypted Message using the given public key.
 func Encrypt(log chan string, dest_pubkey []byte, plainText string) *EncryptedMessage {
+	ret, _ := encrypt(log, dest_pubkey, plainText)
+	return ret
+}
+
+// Encrypt plainText like Encrypt(), and also return a 48-byte recipient tag.
+// The tag is derived from the secret shared by the random key and the destination key,
+// so it changes with every message and can only be recognized with RecipientTag().
+func EncryptTagged(log chan string, dest_pubkey []byte, plainText string) (*EncryptedMessage, []byte) {
+	ret, PubHash := encrypt(log, dest_pubkey, plainText)
+	return ret, makeTag(PubHash)
+}
+
+// Compute the recipient tag of an Encrypted Message using the given private key.
+// If the message was created with EncryptTagged() for the matching public key,
+// the result is equal to the tag returned there.
+func RecipientTag(privKey []byte, encrypted *EncryptedMessage) []byte {
+	if encrypted == nil || privKey == nil {
+		return nil
+	}
+
+	// Unmarshal the Sender's Pubkey
+	X2, Y2 := elliptic.Unmarshal(elliptic.P256(), encrypted.PublicKey[:])
+	if X2 == nil {
+		return nil
+	}
+
+	// Point Multiply to get the new Pubkey
+	PubX, PubY := elliptic.P256().ScalarMult(X2, Y2, privKey)
+
+	PubHash := sha512.Sum512(elliptic.Marshal(elliptic.P256(), PubX, PubY))
+	return makeTag(PubHash[:])
+}
+
+func makeTag(PubHash []byte) []byte {
+	tag := sha512.Sum384(append([]byte("EMP recipient tag"), PubHash...))
+	return tag[:]
+}
+
+func encrypt(log chan string, dest_pubkey []byte, plainText string) (*EncryptedMessage, []byte) {
 	// Generate New Public/Private Key Pair
 	D1, X1, Y1 := CreateKey(log)
 	// Unmarshal the Destination's Pubkey
@@ -49,7 +87,7 @@ func Encrypt(log chan string, dest_pubkey []byte, plainText string) *EncryptedMe
 	ret.CipherText = cipherText
 	copy(ret.HMAC[:], HMAC)
 
-	return ret
+	return ret, PubHash[:]
 }
 
 // Encrypt plainText into an Encrypted Published Message using the given private key.
@@ -89,7 +127,7 @@ func checkMAC(message, messageMAC, key []byte) bool {
 	return hmac.Equal(messageMAC, expectedMAC)
 }
 
-// Decrypt a given Encrypted Message using the given private key. 
+// Decrypt a given Encrypted Message using the given private key.
 // <Nil> is returned if the key fails the HMAC-SHA256 test.
 func Decrypt(log chan string, privKey []byte, encrypted *EncryptedMessage) []byte {
 	if encrypted == nil || privKey == nil || log == nil {
@@ -116,7 +154,7 @@ func Decrypt(log chan string, privKey []byte, encrypted *EncryptedMessage) []byt
 	return SymmetricDecrypt(encrypted.IV, PubHash_E, encrypted.CipherText)
 }
 
-// Decrypt the given Published Message using the given Pubkey. 
+// Decrypt the given Published Message using the given Pubkey.
 // <Nil> is returned if the HMAC-SHA256 test fails.
 func DecryptPub(log chan string, pubkey []byte, encrypted *EncryptedMessage) []byte {
 	if encrypted == nil || pubkey == nil || log == nil {
@@ -141,4 +179,49 @@ func DecryptPub(log chan string, pubkey []byte, encrypted *EncryptedMessage) []b
 	}
 
 	return SymmetricDecrypt(encrypted.IV, PubHash_E, encrypted.CipherText)
-}
\ No newline at end of file
+}
+
+// Encrypt plainText with a 64-byte shared key: AES-256 key followed by HMAC-SHA256 key.
+// The public key field is filled with a random key, so the result looks like any other
+// Encrypted Message.
+func EncryptShared(log chan string, key []byte, plainText string) *EncryptedMessage {
+	if len(key) != 64 {
+		return nil
+	}
+
+	_, X1, Y1 := CreateKey(log)
+
+	IV, cipherText, err := SymmetricEncrypt(key[:32], plainText)
+	if err != nil {
+		return nil
+	}
+
+	// Generate HMAC
+	mac := hmac.New(sha256.New, key[32:])
+	mac.Write(cipherText)
+	HMAC := mac.Sum(nil)
+
+	ret := new(EncryptedMessage)
+	copy(ret.IV[:], IV[:])
+	copy(ret.PublicKey[:], elliptic.Marshal(elliptic.P256(), X1, Y1))
+	ret.CipherText = cipherText
+	copy(ret.HMAC[:], HMAC)
+
+	return ret
+}
+
+// Decrypt a message created by EncryptShared() with the same 64-byte key.
+// <Nil> is returned if the HMAC-SHA256 test fails.
+func DecryptShared(log chan string, key []byte, encrypted *EncryptedMessage) []byte {
+	if encrypted == nil || len(key) != 64 || log == nil {
+		return nil
+	}
+
+	// Check HMAC
+	if !checkMAC(encrypted.CipherText[:], encrypted.HMAC[:], key[32:]) {
+		log <- "Invalid HMAC Message"
+		return nil
+	}
+
+	return SymmetricDecrypt(encrypted.IV, key[:32], encrypted.CipherText)
+}
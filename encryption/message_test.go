@@ -81,3 +81,60 @@ func TestSampleAddr(t *testing.T) {
 	}
 
 }
+
+func TestSymmetricPadding(t *testing.T) {
+	key := make([]byte, 32, 32)
+
+	for i := 0; i < 40; i++ {
+		message := string(bytes.Repeat([]byte{'a'}, i))
+
+		IV, cipherText, err := SymmetricEncrypt(key, message)
+		if err != nil {
+			fmt.Println("Error encrypting: ", err)
+			t.FailNow()
+		}
+
+		if len(cipherText) != (i/16+1)*16 {
+			fmt.Println("Incorrect ciphertext length: ", len(cipherText))
+			t.Fail()
+		}
+
+		plainText := SymmetricDecrypt(IV, key, cipherText)
+		if string(plainText) != message {
+			fmt.Println("Padding not stripped: ", plainText)
+			t.Fail()
+		}
+	}
+}
+
+func TestRecipientTag(t *testing.T) {
+	log := make(chan string, 5)
+
+	priv, x, y := CreateKey(log)
+	priv2, _, _ := CreateKey(log)
+	pub := elliptic.Marshal(elliptic.P256(), x, y)
+
+	enc, tag := EncryptTagged(log, pub, "Hello World!")
+	enc2, tag2 := EncryptTagged(log, pub, "Hello World!")
+
+	if len(tag) != 48 || bytes.Equal(tag, tag2) {
+		fmt.Println("Tags must be 48 bytes and differ per message: ", tag, tag2)
+		t.Fail()
+	}
+
+	if !bytes.Equal(RecipientTag(priv, enc), tag) || !bytes.Equal(RecipientTag(priv, enc2), tag2) {
+		fmt.Println("Recipient could not match tag.")
+		t.Fail()
+	}
+
+	if bytes.Equal(RecipientTag(priv2, enc), tag) {
+		fmt.Println("Tag matched wrong private key.")
+		t.Fail()
+	}
+
+	plainBytes := Decrypt(log, priv, enc)
+	if string(plainBytes) != "Hello World!" {
+		fmt.Println("Tagged message could not be decrypted: ", plainBytes)
+		t.Fail()
+	}
+}
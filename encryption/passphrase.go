@@ -0,0 +1,87 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package encryption
+
+import (
+	"code.google.com/p/go.crypto/scrypt"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Keys for passphrase streams are derived with scrypt. The parameters and salt are
+// written in front of the stream, so they can be raised later without breaking old ones.
+//
+// Header Layout: log2(N) (1 byte) | r (1 byte) | p (1 byte) | Salt (16 bytes)
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+	saltLen    = 16
+
+	maxScryptLogN = 22 // Refuse headers that would need gigabytes of memory
+)
+
+var ErrPassphraseHeader = errors.New("Invalid key derivation parameters in encrypted stream.")
+
+func passphraseKeys(passphrase string, header []byte) ([]byte, []byte, error) {
+	key, err := scrypt.Key([]byte(passphrase), header[3:], 1<<uint(header[0]), int(header[1]), int(header[2]), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[:32], key[32:], nil
+}
+
+// Everything written to the returned Writer is encrypted onto w with a key derived
+// from passphrase. Close() must be called to write the final chunk.
+func EncryptPassphraseStream(passphrase string, w io.Writer) (io.WriteCloser, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("Passphrase required.")
+	}
+
+	header := make([]byte, 3+saltLen, 3+saltLen)
+	header[0], header[1], header[2] = scryptLogN, scryptR, scryptP
+	_, err := io.ReadFull(rand.Reader, header[3:])
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, macKey, err := passphraseKeys(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamWriter(w, encKey, macKey), nil
+}
+
+// Reads a stream created by EncryptPassphraseStream(). A wrong passphrase makes the
+// first Read fail with ErrStreamAuth.
+func DecryptPassphraseStream(passphrase string, r io.Reader) (io.Reader, error) {
+	header := make([]byte, 3+saltLen, 3+saltLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] == 0 || header[0] > maxScryptLogN || header[1] == 0 || header[2] == 0 {
+		return nil, ErrPassphraseHeader
+	}
+
+	encKey, macKey, err := passphraseKeys(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamReader(r, encKey, macKey), nil
+}
@@ -0,0 +1,300 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// Streams are split into chunks of at most StreamChunkSize bytes of plaintext.
+// Each chunk is encrypted with AES-256 under a fresh IV and authenticated on its own,
+// so neither side has to hold the whole payload in memory.
+//
+// Chunk Layout: Length (4 bytes, high bit set on the last chunk) | IV (16 bytes) | CipherText | HMAC-SHA256 (32 bytes)
+//
+// The HMAC covers the chunk's sequence number as well, so chunks can't be reordered,
+// dropped or truncated without failing authentication.
+const (
+	StreamChunkSize = 64 * 1024
+
+	finalFlag = 1 << 31
+	chunkHead = 4 + aes.BlockSize
+)
+
+var (
+	ErrStreamAuth      = errors.New("Invalid HMAC in encrypted stream.")
+	ErrStreamTruncated = errors.New("Encrypted stream ended before the final chunk.")
+	ErrStreamCorrupt   = errors.New("Invalid chunk in encrypted stream.")
+)
+
+type streamWriter struct {
+	w      io.Writer
+	encKey []byte
+	macKey []byte
+	seq    uint64
+	buf    []byte
+	closed bool
+}
+
+// Create a Writer that encrypts everything written to it onto w using the given
+// 32-byte AES and HMAC keys. Close() must be called to write the final chunk,
+// it does not close w.
+func NewStreamWriter(w io.Writer, encKey, macKey []byte) io.WriteCloser {
+	ret := new(streamWriter)
+	ret.w = w
+	ret.encKey = encKey
+	ret.macKey = macKey
+	ret.buf = make([]byte, 0, StreamChunkSize)
+	return ret
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("Write to closed stream.")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(s.buf) == StreamChunkSize {
+			err := s.flush(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(s.buf[len(s.buf):StreamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+func (s *streamWriter) flush(final bool) error {
+	IV, cipherText, err := SymmetricEncrypt(s.encKey, string(s.buf))
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, chunkHead, chunkHead)
+	length := uint32(len(s.buf))
+	if final {
+		length |= finalFlag
+	}
+	binary.BigEndian.PutUint32(head[:4], length)
+	copy(head[4:], IV[:])
+
+	chunk := append(head, cipherText...)
+	chunk = append(chunk, chunkMAC(s.macKey, s.seq, chunk)...)
+
+	_, err = s.w.Write(chunk)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+type streamReader struct {
+	r      io.Reader
+	encKey []byte
+	macKey []byte
+	seq    uint64
+	buf    []byte
+	done   bool
+	err    error
+}
+
+// Create a Reader that decrypts and authenticates a stream created with NewStreamWriter().
+// Plaintext is only returned after the chunk containing it has been authenticated.
+func NewStreamReader(r io.Reader, encKey, macKey []byte) io.Reader {
+	ret := new(streamReader)
+	ret.r = r
+	ret.encKey = encKey
+	ret.macKey = macKey
+	return ret
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.next()
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Read, authenticate and decrypt the next chunk.
+func (s *streamReader) next() error {
+	head := make([]byte, chunkHead, chunkHead)
+	_, err := io.ReadFull(s.r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	} else if err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(head[:4])
+	final := length&finalFlag != 0
+	length &^= finalFlag
+	if length > StreamChunkSize {
+		return ErrStreamCorrupt
+	}
+
+	cipherLen := (int(length)/aes.BlockSize + 1) * aes.BlockSize
+	rest := make([]byte, cipherLen+hmacLen, cipherLen+hmacLen)
+	_, err = io.ReadFull(s.r, rest)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	} else if err != nil {
+		return err
+	}
+
+	chunk := append(head, rest[:cipherLen]...)
+	if !hmac.Equal(rest[cipherLen:], chunkMAC(s.macKey, s.seq, chunk)) {
+		return ErrStreamAuth
+	}
+
+	var IV [aes.BlockSize]byte
+	copy(IV[:], head[4:])
+	plainText := SymmetricDecrypt(IV, s.encKey, rest[:cipherLen])
+	if len(plainText) != int(length) {
+		return ErrStreamCorrupt
+	}
+
+	s.seq++
+	s.buf = plainText
+	s.done = final
+	return nil
+}
+
+// HMAC-SHA256 of a chunk and its sequence number.
+func chunkMAC(key []byte, seq uint64, chunk []byte) []byte {
+	seqBytes := make([]byte, 8, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(seqBytes)
+	mac.Write(chunk)
+	return mac.Sum(nil)
+}
+
+// Split the hash of a shared ECC point into AES and HMAC keys, like Encrypt() does.
+func streamKeys(X, Y *big.Int, priv []byte) ([]byte, []byte) {
+	PubX, PubY := elliptic.P256().ScalarMult(X, Y, priv)
+
+	PubHash := sha512.Sum512(elliptic.Marshal(elliptic.P256(), PubX, PubY))
+	return PubHash[:32], PubHash[32:64]
+}
+
+// Streaming version of Encrypt(). The random 65-byte public key is written to w,
+// and everything written to the returned Writer is encrypted for dest_pubkey.
+func EncryptStream(log chan string, dest_pubkey []byte, w io.Writer) (io.WriteCloser, error) {
+	X2, Y2 := elliptic.Unmarshal(elliptic.P256(), dest_pubkey)
+	if X2 == nil {
+		return nil, errors.New("Invalid destination public key.")
+	}
+
+	D1, X1, Y1 := CreateKey(log)
+	if D1 == nil {
+		return nil, errors.New("Key Generation Error")
+	}
+
+	_, err := w.Write(elliptic.Marshal(elliptic.P256(), X1, Y1))
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, macKey := streamKeys(X2, Y2, D1)
+	return NewStreamWriter(w, encKey, macKey), nil
+}
+
+// Streaming version of EncryptPub(). Everything written to the returned Writer can be
+// decrypted by anyone with the public key matching src_privkey.
+func EncryptPubStream(log chan string, src_privkey []byte, w io.Writer) (io.WriteCloser, error) {
+	D1, X1, Y1 := CreateKey(log)
+	if D1 == nil {
+		return nil, errors.New("Key Generation Error")
+	}
+
+	header := make([]byte, pubkeyLen, pubkeyLen)
+	copy(header, D1)
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, macKey := streamKeys(X1, Y1, src_privkey)
+	return NewStreamWriter(w, encKey, macKey), nil
+}
+
+// Streaming version of Decrypt(), reads a stream created by EncryptStream().
+// Reads from the returned Reader fail with ErrStreamAuth if the key is wrong
+// or the stream has been tampered with.
+func DecryptStream(log chan string, privKey []byte, r io.Reader) (io.Reader, error) {
+	header := make([]byte, pubkeyLen, pubkeyLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	X2, Y2 := elliptic.Unmarshal(elliptic.P256(), header)
+	if X2 == nil {
+		return nil, errors.New("Invalid public key in encrypted stream.")
+	}
+
+	encKey, macKey := streamKeys(X2, Y2, privKey)
+	return NewStreamReader(r, encKey, macKey), nil
+}
+
+// Streaming version of DecryptPub(), reads a stream created by EncryptPubStream().
+func DecryptPubStream(log chan string, pubkey []byte, r io.Reader) (io.Reader, error) {
+	header := make([]byte, pubkeyLen, pubkeyLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	X2, Y2 := elliptic.Unmarshal(elliptic.P256(), pubkey)
+	if X2 == nil {
+		return nil, errors.New("Invalid public key.")
+	}
+
+	encKey, macKey := streamKeys(X2, Y2, header[:32])
+	return NewStreamReader(r, encKey, macKey), nil
+}
@@ -0,0 +1,157 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	log := make(chan string, 5)
+
+	priv, x, y := CreateKey(log)
+	pub := elliptic.Marshal(elliptic.P256(), x, y)
+
+	for _, size := range []int{0, 1, StreamChunkSize, 2*StreamChunkSize + 5} {
+		plainText := make([]byte, size, size)
+		rand.Read(plainText)
+
+		// Private Stream
+		buf := new(bytes.Buffer)
+		w, err := EncryptStream(log, pub, buf)
+		if err != nil {
+			fmt.Println("Error creating stream: ", err)
+			t.FailNow()
+		}
+		io.Copy(w, bytes.NewReader(plainText))
+		w.Close()
+
+		r, err := DecryptStream(log, priv, buf)
+		if err != nil {
+			fmt.Println("Error opening stream: ", err)
+			t.FailNow()
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plainText) {
+			fmt.Println("Stream decryption failed: ", size, err)
+			t.Fail()
+		}
+
+		// Published Stream
+		buf = new(bytes.Buffer)
+		w, err = EncryptPubStream(log, priv, buf)
+		if err != nil {
+			fmt.Println("Error creating published stream: ", err)
+			t.FailNow()
+		}
+		io.Copy(w, bytes.NewReader(plainText))
+		w.Close()
+
+		r, err = DecryptPubStream(log, pub, buf)
+		if err != nil {
+			fmt.Println("Error opening published stream: ", err)
+			t.FailNow()
+		}
+		decrypted, err = ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plainText) {
+			fmt.Println("Published stream decryption failed: ", size, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestStreamTamper(t *testing.T) {
+	log := make(chan string, 5)
+
+	priv, x, y := CreateKey(log)
+	pub := elliptic.Marshal(elliptic.P256(), x, y)
+
+	buf := new(bytes.Buffer)
+	w, _ := EncryptStream(log, pub, buf)
+	w.Write(make([]byte, StreamChunkSize+100, StreamChunkSize+100))
+	w.Close()
+	stream := buf.Bytes()
+
+	// Flipped bit in the second chunk
+	tampered := append([]byte{}, stream...)
+	tampered[len(tampered)-40] ^= 1
+	r, _ := DecryptStream(log, priv, bytes.NewReader(tampered))
+	_, err := ioutil.ReadAll(r)
+	if err != ErrStreamAuth {
+		fmt.Println("Tampered stream not detected: ", err)
+		t.Fail()
+	}
+
+	// Final chunk missing
+	truncated := stream[:pubkeyLen+chunkHead+StreamChunkSize+16+hmacLen]
+	r, _ = DecryptStream(log, priv, bytes.NewReader(truncated))
+	_, err = ioutil.ReadAll(r)
+	if err != ErrStreamTruncated {
+		fmt.Println("Truncated stream not detected: ", err)
+		t.Fail()
+	}
+
+	// Wrong key
+	priv2, _, _ := CreateKey(log)
+	r, _ = DecryptStream(log, priv2, bytes.NewReader(stream))
+	_, err = ioutil.ReadAll(r)
+	if err != ErrStreamAuth {
+		fmt.Println("Wrong key not detected: ", err)
+		t.Fail()
+	}
+}
+
+func TestPassphraseStream(t *testing.T) {
+	plainText := make([]byte, StreamChunkSize+100, StreamChunkSize+100)
+	rand.Read(plainText)
+
+	buf := new(bytes.Buffer)
+	w, err := EncryptPassphraseStream("correct horse", buf)
+	if err != nil {
+		fmt.Println("Error creating passphrase stream: ", err)
+		t.FailNow()
+	}
+	io.Copy(w, bytes.NewReader(plainText))
+	w.Close()
+	encrypted := buf.Bytes()
+
+	r, err := DecryptPassphraseStream("correct horse", bytes.NewReader(encrypted))
+	if err != nil {
+		fmt.Println("Error opening passphrase stream: ", err)
+		t.FailNow()
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(decrypted, plainText) {
+		fmt.Println("Passphrase stream decryption failed: ", err)
+		t.Fail()
+	}
+
+	r, err = DecryptPassphraseStream("wrong horse", bytes.NewReader(encrypted))
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if err != ErrStreamAuth {
+		fmt.Println("Expected ErrStreamAuth for a wrong passphrase, got: ", err)
+		t.Fail()
+	}
+
+	if _, err := EncryptPassphraseStream("", buf); err == nil {
+		fmt.Println("Empty passphrase accepted.")
+		t.Fail()
+	}
+}
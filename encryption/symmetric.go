@@ -12,6 +12,7 @@
 package encryption
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -20,6 +21,9 @@ import (
 
 // Symmetrically encryptes plainText using AES-256 and the given key. Returns the IV and ciphertext. 
 //
+// The plaintext is padded to a multiple of the AES block size with PKCS#7 padding, which
+// SymmetricDecrypt strips again.
+//
 // Special Case: If the key is length 25-bytes (an address), it is padded to 32-bytes with 0x00.
 func SymmetricEncrypt(key []byte, plainText string) ([aes.BlockSize]byte, []byte, error) {
 
@@ -35,7 +39,7 @@ func SymmetricEncrypt(key []byte, plainText string) ([aes.BlockSize]byte, []byte
 
 	pad_len := aes.BlockSize - (len(plainBytes) % aes.BlockSize)
 
-	padding := make([]byte, pad_len, pad_len)
+	padding := bytes.Repeat([]byte{byte(pad_len)}, pad_len)
 	plainBytes = append(plainBytes, padding...)
 
 	// Generate AES Cipher
@@ -60,20 +64,44 @@ func SymmetricEncrypt(key []byte, plainText string) ([aes.BlockSize]byte, []byte
 
 
 // Decrypted cipherText encrypted with AES-256 using the given IV and key.
+//
+// PKCS#7 padding is removed. Ciphertext from older clients that padded with 0x00 bytes
+// can't carry valid PKCS#7 padding, and is returned with the zero padding intact.
 func SymmetricDecrypt(IV [aes.BlockSize]byte, key, cipherText []byte) []byte {
-	plainText := make([]byte, len(cipherText), len(cipherText))
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return nil
+	}
 
 	if len(key) == 25 {
 		key = append(key, make([]byte, 7, 7)...)
 	}
 
 	// Generate AES Cipher
-	block, _ := aes.NewCipher(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
 	mode := cipher.NewCBCDecrypter(block, IV[:])
 
 	// Do decryption
-	plainText = make([]byte, len(cipherText), len(cipherText))
+	plainText := make([]byte, len(cipherText), len(cipherText))
 	mode.CryptBlocks(plainText, cipherText[:])
 
-	return plainText
+	return unpad(plainText)
+}
+
+// Strip PKCS#7 padding from plainText, or return it unchanged if the padding is invalid.
+func unpad(plainText []byte) []byte {
+	pad_len := int(plainText[len(plainText)-1])
+	if pad_len == 0 || pad_len > aes.BlockSize || pad_len > len(plainText) {
+		return plainText
+	}
+
+	for _, b := range plainText[len(plainText)-pad_len:] {
+		if int(b) != pad_len {
+			return plainText
+		}
+	}
+
+	return plainText[:len(plainText)-pad_len]
 }
@@ -0,0 +1,1278 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+// Package imapd serves a Backend's messages to local IMAP4rev1 clients. There are two
+// mailboxes, INBOX and Sent, and addresses are shown as <emp-address>@<domain>.
+package imapd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where messages come from.
+type Backend interface {
+	// Check the credentials given with LOGIN or AUTHENTICATE and return the user whose
+	// messages the session sees. It's passed to every other call.
+	Authenticate(username, password string) (string, error)
+
+	// List the messages in Inbox or Sent.
+	List(user, mailbox string) ([]Summary, error)
+
+	// Load a message without opening it, Subject and Body are empty if it hasn't been read yet.
+	Peek(user, id string) (*Message, error)
+
+	// Load a message, opening it and marking it seen.
+	Open(user, id string) (*Message, error)
+
+	// Remove a message.
+	Delete(user, id string) error
+}
+
+const (
+	Inbox = "INBOX"
+	Sent  = "Sent"
+)
+
+var mailboxes = []string{Inbox, Sent}
+
+type Summary struct {
+	ID   string
+	Date time.Time
+	Seen bool
+}
+
+type Message struct {
+	ID       string
+	Date     time.Time
+	Seen     bool
+	Sender   string
+	To       []string
+	CC       []string
+	Subject  string
+	MimeType string
+	Body     string
+}
+
+type Server struct {
+	Domain   string // Addresses are shown as <address>@Domain
+	Hostname string // Name in the greeting
+	Timeout  time.Duration
+	Backend  Backend
+	Log      chan string
+
+	mutex    sync.Mutex
+	validity uint32
+	boxes    map[boxKey]*mailboxState
+}
+
+type boxKey struct {
+	user    string
+	mailbox string
+}
+
+// UIDs are handed out in the order messages are first listed, and are valid until
+// the server restarts.
+type mailboxState struct {
+	next    uint32
+	uids    map[string]uint32
+	deleted map[string]bool
+}
+
+const (
+	capabilities   = "IMAP4rev1 AUTH=PLAIN SPECIAL-USE"
+	defaultTimeout = 30 * time.Minute
+	maxLiteral     = 1 << 20
+)
+
+var errSyntax = errors.New("Syntax error")
+
+// Accept connections until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) log(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log <- fmt.Sprintf(format, args...)
+	}
+}
+
+// Must hold s.mutex.
+func (s *Server) state(user, mailbox string) *mailboxState {
+	if s.boxes == nil {
+		s.boxes = make(map[boxKey]*mailboxState)
+		s.validity = uint32(time.Now().Unix())
+	}
+
+	state, ok := s.boxes[boxKey{user, mailbox}]
+	if !ok {
+		state = &mailboxState{next: 1, uids: make(map[string]uint32), deleted: make(map[string]bool)}
+		s.boxes[boxKey{user, mailbox}] = state
+	}
+	return state
+}
+
+// One message as seen by a session.
+type entry struct {
+	id   string
+	uid  uint32
+	date time.Time
+	seen bool
+}
+
+type byUID []entry
+
+func (v byUID) Len() int           { return len(v) }
+func (v byUID) Less(i, j int) bool { return v[i].uid < v[j].uid }
+func (v byUID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+type byDate []Summary
+
+func (v byDate) Len() int { return len(v) }
+func (v byDate) Less(i, j int) bool {
+	if v[i].Date.Equal(v[j].Date) {
+		return v[i].ID < v[j].ID
+	}
+	return v[i].Date.Before(v[j].Date)
+}
+func (v byDate) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+// List a mailbox from the backend, giving new messages UIDs. Returns the messages in UID order.
+func (s *Server) sync(user, mailbox string) ([]entry, error) {
+	summaries, err := s.Backend.List(user, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byDate(summaries))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state(user, mailbox)
+	present := make(map[string]bool)
+	view := make([]entry, 0, len(summaries))
+
+	for _, summary := range summaries {
+		uid, ok := state.uids[summary.ID]
+		if !ok {
+			uid = state.next
+			state.next++
+			state.uids[summary.ID] = uid
+		}
+		present[summary.ID] = true
+		view = append(view, entry{summary.ID, uid, summary.Date, summary.Seen})
+	}
+
+	for id := range state.uids {
+		if !present[id] {
+			delete(state.uids, id)
+			delete(state.deleted, id)
+		}
+	}
+
+	sort.Sort(byUID(view))
+	return view, nil
+}
+
+// UIDVALIDITY and UIDNEXT of a mailbox.
+func (s *Server) uidInfo(user, mailbox string) (uint32, uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state(user, mailbox)
+	return s.validity, state.next
+}
+
+func (s *Server) isDeleted(user, mailbox, id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state(user, mailbox).deleted[id]
+}
+
+func (s *Server) setDeleted(user, mailbox, id string, deleted bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if deleted {
+		s.state(user, mailbox).deleted[id] = true
+	} else {
+		delete(s.state(user, mailbox).deleted, id)
+	}
+}
+
+// Canonical name of a mailbox, or "" if there's no such mailbox.
+func mailboxName(name string) string {
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(name, mailbox) {
+			return mailbox
+		}
+	}
+	return ""
+}
+
+// State of one IMAP session.
+type session struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	eol    bool // Whether the current command line has been read to the end
+
+	authed   bool
+	user     string // Returned by Backend.Authenticate
+	mailbox  string // Selected mailbox, "" if none
+	readOnly bool
+	view     []entry
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c := &session{server: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	c.untagged("OK [CAPABILITY %s] %s EMP IMAP server ready", capabilities, s.Hostname)
+	c.w.Flush()
+
+	for {
+		c.deadline()
+		args, err := c.readArgs()
+		if err == errSyntax {
+			if !c.eol {
+				c.r.ReadString('\n')
+			}
+			c.untagged("BAD %s", err)
+			c.w.Flush()
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if len(args) < 2 {
+			c.untagged("BAD Missing command")
+			c.w.Flush()
+			continue
+		}
+		tag, ok := args[0].(string)
+		cmd, ok2 := args[1].(string)
+		if !ok || !ok2 {
+			c.untagged("BAD Invalid command")
+			c.w.Flush()
+			continue
+		}
+
+		more := c.command(tag, strings.ToUpper(cmd), args[2:])
+		c.w.Flush()
+		if !more {
+			return
+		}
+	}
+}
+
+func (c *session) deadline() {
+	timeout := c.server.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (c *session) untagged(format string, args ...interface{}) {
+	c.w.WriteString("* " + fmt.Sprintf(format, args...) + "\r\n")
+}
+
+func (c *session) tagged(tag, status, format string, args ...interface{}) {
+	c.w.WriteString(tag + " " + status + " " + fmt.Sprintf(format, args...) + "\r\n")
+}
+
+// Run a command, returns false when the connection should be closed.
+func (c *session) command(tag, cmd string, args []interface{}) bool {
+	uid := false
+	if cmd == "UID" && len(args) > 0 {
+		if sub, ok := args[0].(string); ok {
+			cmd, args, uid = strings.ToUpper(sub), args[1:], true
+		}
+		if cmd != "FETCH" && cmd != "STORE" && cmd != "SEARCH" {
+			c.tagged(tag, "BAD", "Unknown UID command")
+			return true
+		}
+	}
+
+	switch cmd {
+	case "CAPABILITY":
+		c.untagged("CAPABILITY %s", capabilities)
+		c.tagged(tag, "OK", "CAPABILITY completed")
+		return true
+	case "NOOP":
+		if len(c.mailbox) > 0 {
+			c.refresh()
+		}
+		c.tagged(tag, "OK", "NOOP completed")
+		return true
+	case "LOGOUT":
+		c.untagged("BYE Logging out")
+		c.tagged(tag, "OK", "LOGOUT completed")
+		return false
+	}
+
+	if !c.authed {
+		switch cmd {
+		case "LOGIN":
+			params, ok := strArgs(args)
+			if !ok || len(params) != 2 {
+				c.tagged(tag, "BAD", "Syntax: LOGIN <username> <password>")
+				return true
+			}
+			c.login(tag, params[0], params[1])
+		case "AUTHENTICATE":
+			c.authenticate(tag, args)
+		default:
+			c.tagged(tag, "BAD", "Log in first")
+		}
+		return true
+	}
+
+	switch cmd {
+	case "LOGIN", "AUTHENTICATE":
+		c.tagged(tag, "BAD", "Already authenticated")
+	case "SELECT", "EXAMINE":
+		c.selectMailbox(tag, cmd, args)
+	case "LIST", "LSUB":
+		c.list(tag, cmd, args)
+	case "STATUS":
+		c.status(tag, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		c.tagged(tag, "OK", "%s completed", cmd)
+	case "CREATE", "DELETE", "RENAME", "APPEND", "COPY", "MOVE":
+		c.tagged(tag, "NO", "[CANNOT] Mailboxes can't be changed")
+
+	case "CHECK", "CLOSE", "EXPUNGE", "SEARCH", "FETCH", "STORE":
+		if len(c.mailbox) == 0 {
+			c.tagged(tag, "BAD", "No mailbox selected")
+			return true
+		}
+
+		switch cmd {
+		case "CHECK":
+			c.refresh()
+			c.tagged(tag, "OK", "CHECK completed")
+		case "CLOSE":
+			if !c.readOnly {
+				c.expunge(false)
+			}
+			c.mailbox, c.view = "", nil
+			c.tagged(tag, "OK", "CLOSE completed")
+		case "EXPUNGE":
+			if c.readOnly {
+				c.tagged(tag, "NO", "Mailbox is read-only")
+				return true
+			}
+			if err := c.expunge(true); err != nil {
+				c.tagged(tag, "NO", "%s", err)
+				return true
+			}
+			c.tagged(tag, "OK", "EXPUNGE completed")
+		case "SEARCH":
+			c.search(tag, args, uid)
+		case "FETCH":
+			c.fetch(tag, args, uid)
+		case "STORE":
+			c.store(tag, args, uid)
+		}
+
+	default:
+		c.tagged(tag, "BAD", "Unknown command")
+	}
+	return true
+}
+
+func strArgs(args []interface{}) ([]string, bool) {
+	ret := make([]string, 0, len(args))
+	for _, arg := range args {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, false
+		}
+		ret = append(ret, str)
+	}
+	return ret, true
+}
+
+func (c *session) login(tag, username, password string) {
+	user, err := c.server.Backend.Authenticate(username, password)
+	if err != nil {
+		c.server.log("IMAP authentication failed for %s from %s", username, c.conn.RemoteAddr())
+		c.tagged(tag, "NO", "[AUTHENTICATIONFAILED] Authentication failed")
+		return
+	}
+
+	c.authed = true
+	c.user = user
+	c.tagged(tag, "OK", "Logged in")
+}
+
+func (c *session) authenticate(tag string, args []interface{}) {
+	params, ok := strArgs(args)
+	if !ok || len(params) == 0 || len(params) > 2 {
+		c.tagged(tag, "BAD", "Syntax: AUTHENTICATE <mechanism>")
+		return
+	}
+	if !strings.EqualFold(params[0], "PLAIN") {
+		c.tagged(tag, "NO", "Unsupported mechanism")
+		return
+	}
+
+	var response string
+	if len(params) == 2 {
+		response = params[1]
+	} else {
+		c.w.WriteString("+ \r\n")
+		c.w.Flush()
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		response = strings.TrimSpace(line)
+	}
+	if response == "*" {
+		c.tagged(tag, "BAD", "Authentication cancelled")
+		return
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	parts := strings.Split(string(decoded), "\x00")
+	if err != nil || len(parts) != 3 {
+		c.tagged(tag, "BAD", "Invalid PLAIN response")
+		return
+	}
+
+	c.login(tag, parts[1], parts[2])
+}
+
+func (c *session) selectMailbox(tag, cmd string, args []interface{}) {
+	params, ok := strArgs(args)
+	if !ok || len(params) != 1 {
+		c.tagged(tag, "BAD", "Syntax: %s <mailbox>", cmd)
+		return
+	}
+
+	// A failed SELECT leaves no mailbox selected.
+	c.mailbox, c.view = "", nil
+
+	name := mailboxName(params[0])
+	if len(name) == 0 {
+		c.tagged(tag, "NO", "[NONEXISTENT] No such mailbox")
+		return
+	}
+
+	view, err := c.server.sync(c.user, name)
+	if err != nil {
+		c.tagged(tag, "NO", "%s", err)
+		return
+	}
+	c.mailbox, c.readOnly, c.view = name, cmd == "EXAMINE", view
+
+	c.untagged(`FLAGS (\Seen \Deleted)`)
+	if c.readOnly {
+		c.untagged("OK [PERMANENTFLAGS ()] Read-only")
+	} else {
+		c.untagged(`OK [PERMANENTFLAGS (\Seen \Deleted)] Limited`)
+	}
+	c.untagged("%d EXISTS", len(view))
+	c.untagged("0 RECENT")
+	for i, e := range view {
+		if !e.seen {
+			c.untagged("OK [UNSEEN %d] First unseen", i+1)
+			break
+		}
+	}
+
+	validity, next := c.server.uidInfo(c.user, name)
+	c.untagged("OK [UIDVALIDITY %d] UIDs valid", validity)
+	c.untagged("OK [UIDNEXT %d] Predicted next UID", next)
+
+	if c.readOnly {
+		c.tagged(tag, "OK", "[READ-ONLY] EXAMINE completed")
+	} else {
+		c.tagged(tag, "OK", "[READ-WRITE] SELECT completed")
+	}
+}
+
+// Whether name matches a LIST pattern, * and % match anything as there's no hierarchy.
+func matchPattern(pattern, name string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == '*' || pattern[0] == '%' {
+		for i := 0; i <= len(name); i++ {
+			if matchPattern(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(name) > 0 && pattern[0] == name[0] && matchPattern(pattern[1:], name[1:])
+}
+
+func (c *session) list(tag, cmd string, args []interface{}) {
+	params, ok := strArgs(args)
+	if !ok || len(params) != 2 {
+		c.tagged(tag, "BAD", "Syntax: %s <reference> <pattern>", cmd)
+		return
+	}
+
+	pattern := params[0] + params[1]
+	if len(params[1]) == 0 {
+		if cmd == "LIST" {
+			c.untagged(`LIST (\Noselect) "/" ""`)
+		}
+		c.tagged(tag, "OK", "%s completed", cmd)
+		return
+	}
+
+	for _, name := range mailboxes {
+		matched := matchPattern(pattern, name)
+		if name == Inbox {
+			matched = matchPattern(strings.ToUpper(pattern), name)
+		}
+		if !matched {
+			continue
+		}
+
+		attributes := ""
+		if name == Sent {
+			attributes = `\Sent`
+		}
+		c.untagged(`%s (%s) "/" %s`, cmd, attributes, quote(name))
+	}
+	c.tagged(tag, "OK", "%s completed", cmd)
+}
+
+func (c *session) status(tag string, args []interface{}) {
+	var items []interface{}
+	name, ok := "", len(args) == 2
+	if ok {
+		name, ok = args[0].(string)
+		items, ok = args[1].([]interface{})
+	}
+	if !ok {
+		c.tagged(tag, "BAD", "Syntax: STATUS <mailbox> (<items>)")
+		return
+	}
+
+	name = mailboxName(name)
+	if len(name) == 0 {
+		c.tagged(tag, "NO", "[NONEXISTENT] No such mailbox")
+		return
+	}
+
+	view, err := c.server.sync(c.user, name)
+	if err != nil {
+		c.tagged(tag, "NO", "%s", err)
+		return
+	}
+	validity, next := c.server.uidInfo(c.user, name)
+
+	unseen := 0
+	for _, e := range view {
+		if !e.seen {
+			unseen++
+		}
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		str, _ := item.(string)
+		switch strings.ToUpper(str) {
+		case "MESSAGES":
+			values = append(values, fmt.Sprintf("MESSAGES %d", len(view)))
+		case "RECENT":
+			values = append(values, "RECENT 0")
+		case "UIDNEXT":
+			values = append(values, fmt.Sprintf("UIDNEXT %d", next))
+		case "UIDVALIDITY":
+			values = append(values, fmt.Sprintf("UIDVALIDITY %d", validity))
+		case "UNSEEN":
+			values = append(values, fmt.Sprintf("UNSEEN %d", unseen))
+		default:
+			c.tagged(tag, "BAD", "Unknown status item")
+			return
+		}
+	}
+
+	c.untagged("STATUS %s (%s)", quote(name), strings.Join(values, " "))
+	c.tagged(tag, "OK", "STATUS completed")
+}
+
+// Tell the client about messages removed, added or opened since it last looked.
+func (c *session) refresh() {
+	view, err := c.server.sync(c.user, c.mailbox)
+	if err != nil {
+		return
+	}
+
+	current := make(map[string]entry)
+	for _, e := range view {
+		current[e.id] = e
+	}
+
+	for i := len(c.view) - 1; i >= 0; i-- {
+		if _, ok := current[c.view[i].id]; !ok {
+			c.untagged("%d EXPUNGE", i+1)
+			c.view = append(c.view[:i], c.view[i+1:]...)
+		}
+	}
+
+	for i, e := range c.view {
+		if current[e.id].seen != e.seen {
+			c.view[i].seen = current[e.id].seen
+			c.untagged("%d FETCH (FLAGS %s)", i+1, c.flags(c.view[i]))
+		}
+	}
+
+	// Messages still listed keep their order, new ones come after them.
+	if len(view) != len(c.view) {
+		c.untagged("%d EXISTS", len(view))
+	}
+	c.view = view
+}
+
+// Remove messages flagged \Deleted, telling the client if verbose is set.
+func (c *session) expunge(verbose bool) error {
+	var err error
+
+	for i := len(c.view) - 1; i >= 0; i-- {
+		id := c.view[i].id
+		if !c.server.isDeleted(c.user, c.mailbox, id) {
+			continue
+		}
+
+		err = c.server.Backend.Delete(c.user, id)
+		if err != nil {
+			c.server.log("IMAP error deleting message %s: %s", id, err)
+			continue
+		}
+
+		c.server.setDeleted(c.user, c.mailbox, id, false)
+		c.view = append(c.view[:i], c.view[i+1:]...)
+		if verbose {
+			c.untagged("%d EXPUNGE", i+1)
+		}
+	}
+
+	return err
+}
+
+func (c *session) flags(e entry) string {
+	flags := make([]string, 0, 2)
+	if e.seen {
+		flags = append(flags, `\Seen`)
+	}
+	if c.server.isDeleted(c.user, c.mailbox, e.id) {
+		flags = append(flags, `\Deleted`)
+	}
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+func seqNumber(s string, max uint32) (uint32, error) {
+	if s == "*" {
+		return max, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, errors.New("Invalid sequence set")
+	}
+	return uint32(n), nil
+}
+
+// Indexes into the view of a sequence set of message numbers or UIDs.
+func (c *session) resolve(set string, uid bool) ([]int, error) {
+	max := uint32(len(c.view))
+	if uid && len(c.view) > 0 {
+		max = c.view[len(c.view)-1].uid
+	}
+
+	selected := make(map[int]bool)
+
+	for _, r := range strings.Split(set, ",") {
+		bounds := strings.SplitN(r, ":", 2)
+		lo, err := seqNumber(bounds[0], max)
+		hi := lo
+		if err == nil && len(bounds) == 2 {
+			hi, err = seqNumber(bounds[1], max)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		if uid {
+			for i, e := range c.view {
+				if e.uid >= lo && e.uid <= hi {
+					selected[i] = true
+				}
+			}
+			continue
+		}
+
+		if len(c.view) == 0 {
+			continue
+		}
+		if lo == 0 || hi > max {
+			return nil, errors.New("Invalid message number")
+		}
+		for n := lo; n <= hi; n++ {
+			selected[int(n)-1] = true
+		}
+	}
+
+	ret := make([]int, 0, len(selected))
+	for i := range selected {
+		ret = append(ret, i)
+	}
+	sort.Ints(ret)
+	return ret, nil
+}
+
+func (c *session) fetch(tag string, args []interface{}, uid bool) {
+	name := "FETCH"
+	if uid {
+		name = "UID FETCH"
+	}
+
+	var set string
+	ok := len(args) == 2
+	if ok {
+		set, ok = args[0].(string)
+	}
+	if !ok {
+		c.tagged(tag, "BAD", "Syntax: %s <set> <items>", name)
+		return
+	}
+
+	items, err := fetchItems(args[1], uid)
+	if err != nil {
+		c.tagged(tag, "BAD", "%s", err)
+		return
+	}
+	indexes, err := c.resolve(set, uid)
+	if err != nil {
+		c.tagged(tag, "BAD", "%s", err)
+		return
+	}
+
+	var failed error
+	for _, i := range indexes {
+		response, err := c.fetchOne(i, items)
+		if err != nil {
+			c.server.log("IMAP error fetching message %s: %s", c.view[i].id, err)
+			failed = err
+			continue
+		}
+		c.w.WriteString(response)
+	}
+
+	if failed != nil {
+		c.tagged(tag, "NO", "Some messages could not be fetched: %s", failed)
+		return
+	}
+	c.tagged(tag, "OK", "%s completed", name)
+}
+
+func (c *session) fetchOne(i int, items []*fetchItem) (string, error) {
+	e := &c.view[i]
+	f := &fetcher{server: c.server, user: c.user, id: e.id}
+	wasSeen := e.seen
+	flagsAt := -1
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		var value string
+		var msg *Message
+		var p *part
+		var err error
+
+		switch item.name {
+		case "UID":
+			value = fmt.Sprintf("%d", e.uid)
+		case "FLAGS":
+			// Filled in last, opening the message changes them.
+			flagsAt = len(values)
+		case "INTERNALDATE":
+			value = `"` + e.date.Format("02-Jan-2006 15:04:05 -0700") + `"`
+		case "RFC822.SIZE":
+			if _, p, err = f.load(false); err == nil {
+				value = fmt.Sprintf("%d", len(p.raw))
+			}
+		case "ENVELOPE":
+			if msg, _, err = f.load(false); err == nil {
+				value = c.server.envelope(msg)
+			}
+		case "BODY", "BODYSTRUCTURE":
+			if _, p, err = f.load(false); err == nil {
+				value = p.structure()
+			}
+		case "RFC822":
+			if _, p, err = f.load(true); err == nil {
+				value = literal(p.raw)
+			}
+		case "RFC822.TEXT":
+			if _, p, err = f.load(true); err == nil {
+				value = literal(p.body)
+			}
+		case "RFC822.HEADER":
+			if _, p, err = f.load(false); err == nil {
+				value = literal(p.header)
+			}
+		default:
+			// Only the message's own header can be read without opening it.
+			if _, p, err = f.load(!strings.HasPrefix(strings.ToUpper(item.section), "HEADER")); err == nil {
+				var data []byte
+				data, err = p.section(item.section)
+				value = literal(partial(data, item.offset, item.length))
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+
+		values = append(values, item.name+" "+value)
+	}
+
+	if f.opened {
+		e.seen = f.msg.Seen
+	}
+	if flagsAt >= 0 {
+		values[flagsAt] = "FLAGS " + c.flags(*e)
+	} else if e.seen != wasSeen {
+		values = append(values, "FLAGS "+c.flags(*e))
+	}
+
+	return fmt.Sprintf("* %d FETCH (%s)\r\n", i+1, strings.Join(values, " ")), nil
+}
+
+func (c *session) store(tag string, args []interface{}, uid bool) {
+	name := "STORE"
+	if uid {
+		name = "UID STORE"
+	}
+
+	var set, item string
+	var flags []string
+	ok := len(args) >= 3
+	if ok {
+		set, ok = args[0].(string)
+	}
+	if ok {
+		item, ok = args[1].(string)
+	}
+	if ok {
+		flagArgs := args[2:]
+		if list, isList := args[2].([]interface{}); isList && len(args) == 3 {
+			flagArgs = list
+		}
+		flags, ok = strArgs(flagArgs)
+	}
+	if !ok {
+		c.tagged(tag, "BAD", "Syntax: %s <set> <item> <flags>", name)
+		return
+	}
+
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		c.tagged(tag, "BAD", "Unknown store item")
+		return
+	}
+	if c.readOnly {
+		c.tagged(tag, "NO", "Mailbox is read-only")
+		return
+	}
+
+	indexes, err := c.resolve(set, uid)
+	if err != nil {
+		c.tagged(tag, "BAD", "%s", err)
+		return
+	}
+
+	seen, deleted := false, false
+	for _, flag := range flags {
+		seen = seen || strings.EqualFold(flag, `\Seen`)
+		deleted = deleted || strings.EqualFold(flag, `\Deleted`)
+	}
+
+	var failed error
+	for _, i := range indexes {
+		e := &c.view[i]
+
+		// Opening a message can't be undone, so \Seen is never removed.
+		if seen && item != "-FLAGS" && !e.seen {
+			msg, err := c.server.Backend.Open(c.user, e.id)
+			if err != nil {
+				c.server.log("IMAP error opening message %s: %s", e.id, err)
+				failed = err
+			} else {
+				e.seen = msg.Seen
+			}
+		}
+
+		switch {
+		case item == "FLAGS":
+			c.server.setDeleted(c.user, c.mailbox, e.id, deleted)
+		case deleted:
+			c.server.setDeleted(c.user, c.mailbox, e.id, item == "+FLAGS")
+		}
+
+		if !silent {
+			if uid {
+				c.untagged("%d FETCH (UID %d FLAGS %s)", i+1, e.uid, c.flags(*e))
+			} else {
+				c.untagged("%d FETCH (FLAGS %s)", i+1, c.flags(*e))
+			}
+		}
+	}
+
+	if failed != nil {
+		c.tagged(tag, "NO", "Some messages could not be opened: %s", failed)
+		return
+	}
+	c.tagged(tag, "OK", "%s completed", name)
+}
+
+type matcher func(i int) bool
+
+func (c *session) search(tag string, args []interface{}, uid bool) {
+	if len(args) >= 2 {
+		if str, ok := args[0].(string); ok && strings.EqualFold(str, "CHARSET") {
+			args = args[2:]
+		}
+	}
+
+	match, err := c.searchAll(args)
+	if err != nil {
+		c.tagged(tag, "BAD", "%s", err)
+		return
+	}
+
+	results := ""
+	for i, e := range c.view {
+		if !match(i) {
+			continue
+		}
+		if uid {
+			results += fmt.Sprintf(" %d", e.uid)
+		} else {
+			results += fmt.Sprintf(" %d", i+1)
+		}
+	}
+
+	c.untagged("SEARCH%s", results)
+	if uid {
+		c.tagged(tag, "OK", "UID SEARCH completed")
+	} else {
+		c.tagged(tag, "OK", "SEARCH completed")
+	}
+}
+
+// Messages matching all keys.
+func (c *session) searchAll(args []interface{}) (matcher, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Missing search key")
+	}
+
+	matchers := make([]matcher, 0, len(args))
+	for len(args) > 0 {
+		m, rest, err := c.searchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		args = rest
+	}
+
+	return func(i int) bool {
+		for _, m := range matchers {
+			if !m(i) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Parse one search key, returning the arguments after it.
+func (c *session) searchKey(args []interface{}) (matcher, []interface{}, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		m, err := c.searchAll(list)
+		return m, args[1:], err
+	}
+
+	key, _ := args[0].(string)
+	args = args[1:]
+
+	// Keys that take an argument
+	var arg string
+	switch strings.ToUpper(key) {
+	case "UID", "BEFORE", "ON", "SINCE":
+		ok := len(args) > 0
+		if ok {
+			arg, ok = args[0].(string)
+		}
+		if !ok {
+			return nil, nil, errors.New("Missing search argument")
+		}
+		args = args[1:]
+	}
+
+	switch strings.ToUpper(key) {
+	case "ALL", "OLD":
+		return func(i int) bool { return true }, args, nil
+	case "NEW", "RECENT":
+		return func(i int) bool { return false }, args, nil
+	case "SEEN":
+		return func(i int) bool { return c.view[i].seen }, args, nil
+	case "UNSEEN":
+		return func(i int) bool { return !c.view[i].seen }, args, nil
+	case "DELETED":
+		return func(i int) bool { return c.server.isDeleted(c.user, c.mailbox, c.view[i].id) }, args, nil
+	case "UNDELETED":
+		return func(i int) bool { return !c.server.isDeleted(c.user, c.mailbox, c.view[i].id) }, args, nil
+
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, errors.New("Missing search key")
+		}
+		m, rest, err := c.searchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int) bool { return !m(i) }, rest, nil
+
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, errors.New("Missing search key")
+		}
+		a, rest, err := c.searchKey(args)
+		if err == nil && len(rest) == 0 {
+			err = errors.New("Missing search key")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		b, rest, err := c.searchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int) bool { return a(i) || b(i) }, rest, nil
+
+	case "UID":
+		indexes, err := c.resolve(arg, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		return inIndexes(indexes), args, nil
+
+	case "BEFORE", "ON", "SINCE":
+		date, err := time.Parse("2-Jan-2006", arg)
+		if err != nil {
+			return nil, nil, errors.New("Invalid date")
+		}
+		day := date.Format("2006-01-02")
+		cmp := strings.ToUpper(key)
+
+		return func(i int) bool {
+			d := c.view[i].date.Format("2006-01-02")
+			return (cmp == "BEFORE" && d < day) || (cmp == "ON" && d == day) || (cmp == "SINCE" && d >= day)
+		}, args, nil
+	}
+
+	if len(key) > 0 && (key[0] == '*' || (key[0] >= '0' && key[0] <= '9')) {
+		indexes, err := c.resolve(key, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return inIndexes(indexes), args, nil
+	}
+
+	return nil, nil, errors.New(fmt.Sprintf("Unsupported search key %s", key))
+}
+
+func inIndexes(indexes []int) matcher {
+	set := make(map[int]bool)
+	for _, i := range indexes {
+		set[i] = true
+	}
+	return func(i int) bool { return set[i] }
+}
+
+// Read a command line, answering continuation requests for literals. Lists are
+// returned as []interface{}, everything else as strings.
+func (c *session) readArgs() ([]interface{}, error) {
+	c.eol = false
+	return c.readList(0)
+}
+
+func (c *session) readList(end byte) ([]interface{}, error) {
+	list := make([]interface{}, 0, 4)
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case b == ' ' || b == '\r':
+		case b == '\n':
+			c.eol = true
+			if end != 0 {
+				return nil, errSyntax
+			}
+			return list, nil
+		case end != 0 && b == end:
+			return list, nil
+		case b == ')':
+			return nil, errSyntax
+		case b == '(':
+			sub, err := c.readList(')')
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sub)
+		case b == '"':
+			str, err := c.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, str)
+		case b == '{':
+			str, err := c.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, str)
+		default:
+			c.r.UnreadByte()
+			atom, err := c.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, atom)
+		}
+	}
+}
+
+func (c *session) readQuoted() (string, error) {
+	str := make([]byte, 0, 16)
+	escaped := false
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case b == '\n':
+			c.eol = true
+			return "", errSyntax
+		case escaped:
+			str = append(str, b)
+			escaped = false
+		case b == '\\':
+			escaped = true
+		case b == '"':
+			return string(str), nil
+		default:
+			str = append(str, b)
+		}
+	}
+}
+
+func (c *session) readLiteral() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	c.eol = true
+
+	spec := strings.TrimSuffix(strings.TrimSpace(line), "}")
+	sync := !strings.HasSuffix(spec, "+")
+	size, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+	if err != nil || size < 0 || size > maxLiteral || !strings.HasSuffix(strings.TrimSpace(line), "}") {
+		return "", errSyntax
+	}
+
+	if sync {
+		c.w.WriteString("+ Ready for literal data\r\n")
+		c.w.Flush()
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.r, data)
+	if err != nil {
+		return "", err
+	}
+
+	// The command continues after the literal.
+	c.eol = false
+	return string(data), nil
+}
+
+// Read an atom, which may include a bracketed section like BODY[HEADER.FIELDS (To)].
+func (c *session) readAtom() (string, error) {
+	atom := make([]byte, 0, 16)
+	depth := 0
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if depth == 0 && (b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n') {
+			c.r.UnreadByte()
+			return string(atom), nil
+		}
+		if b == '\n' {
+			c.r.UnreadByte()
+			return "", errSyntax
+		}
+
+		switch b {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		atom = append(atom, b)
+	}
+}
@@ -0,0 +1,204 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package imapd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBackend struct {
+	sync.Mutex
+	messages map[string]*Message
+	inbox    []string
+	deleted  []string
+}
+
+func (b *testBackend) Authenticate(username, password string) (string, error) {
+	if username == "emp" && password == "pass word" {
+		return username, nil
+	}
+	return "", errors.New("Unauthorized")
+}
+
+func (b *testBackend) List(user, mailbox string) ([]Summary, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	ret := make([]Summary, 0, 0)
+	if mailbox != Inbox {
+		return ret, nil
+	}
+	for _, id := range b.inbox {
+		msg := b.messages[id]
+		ret = append(ret, Summary{msg.ID, msg.Date, msg.Seen})
+	}
+	return ret, nil
+}
+
+func (b *testBackend) Peek(user, id string) (*Message, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	msg := *b.messages[id]
+	if !msg.Seen {
+		msg.Subject, msg.Body = "", ""
+	}
+	return &msg, nil
+}
+
+func (b *testBackend) Open(user, id string) (*Message, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.messages[id].Seen = true
+	msg := *b.messages[id]
+	return &msg, nil
+}
+
+func (b *testBackend) Delete(user, id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.deleted = append(b.deleted, id)
+	for i, inboxID := range b.inbox {
+		if inboxID == id {
+			b.inbox = append(b.inbox[:i], b.inbox[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// Send a command and return the lines of the response, the last being the tagged one.
+func command(t *testing.T, conn *textproto.Conn, tag, cmd string) []string {
+	conn.PrintfLine("%s %s", tag, cmd)
+	return response(t, conn, tag)
+}
+
+func response(t *testing.T, conn *textproto.Conn, tag string) []string {
+	lines := make([]string, 0, 4)
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			fmt.Println("Error reading response to", tag, ":", err)
+			t.FailNow()
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return lines
+		}
+	}
+}
+
+func expect(t *testing.T, lines []string, want ...string) {
+	response := strings.Join(lines, "\n")
+	for _, w := range want {
+		if !strings.Contains(response, w) {
+			fmt.Printf("Expected %q in response:\n%s\n", w, response)
+			t.Fail()
+		}
+	}
+}
+
+func TestIMAP(t *testing.T) {
+	date := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend := &testBackend{
+		messages: map[string]*Message{
+			"aa": {ID: "aa", Date: date, Seen: true, Sender: "Alice", To: []string{"Bob"}, Subject: "Hello", Body: "First\nmessage"},
+			"bb": {ID: "bb", Date: date.Add(time.Hour), Sender: "Carol", To: []string{"Bob"}, Subject: "Secret", Body: "Second message"},
+		},
+		inbox: []string{"bb", "aa"},
+	}
+	server := &Server{Domain: "emp.local", Hostname: "localhost", Backend: backend}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error listening: ", err)
+		t.FailNow()
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		fmt.Println("Error connecting: ", err)
+		t.FailNow()
+	}
+	conn := textproto.NewConn(c)
+	defer conn.Close()
+
+	greeting, _ := conn.ReadLine()
+	if !strings.HasPrefix(greeting, "* OK") {
+		fmt.Println("Bad greeting: ", greeting)
+		t.FailNow()
+	}
+
+	expect(t, command(t, conn, "a1", "SELECT INBOX"), "a1 BAD")
+	expect(t, command(t, conn, "a2", `LOGIN emp "wrong"`), "a2 NO")
+
+	// Password sent as a literal
+	conn.PrintfLine("a3 LOGIN emp {9}")
+	if line, _ := conn.ReadLine(); !strings.HasPrefix(line, "+") {
+		fmt.Println("Expected continuation, got: ", line)
+		t.FailNow()
+	}
+	conn.PrintfLine("pass word")
+	expect(t, response(t, conn, "a3"), "a3 OK")
+
+	expect(t, command(t, conn, "a4", `LIST "" "*"`), `LIST () "/" "INBOX"`, `LIST (\Sent) "/" "Sent"`)
+	expect(t, command(t, conn, "a5", "SELECT inbox"), "* 2 EXISTS", "[UNSEEN 2]", "a5 OK [READ-WRITE]")
+
+	// Messages are numbered by date, peeking doesn't open them.
+	lines := command(t, conn, "a6", "FETCH 1:* (UID FLAGS BODY.PEEK[HEADER.FIELDS (From Subject)])")
+	expect(t, lines, `* 1 FETCH (UID 1 FLAGS (\Seen) BODY[HEADER.FIELDS (From Subject)]`, "From: Alice@emp.local", "Subject: Hello", "* 2 FETCH (UID 2 FLAGS ()", "a6 OK")
+	if backend.messages["bb"].Seen {
+		fmt.Println("Peeking opened the message.")
+		t.Fail()
+	}
+
+	expect(t, command(t, conn, "a7", "UID SEARCH UNSEEN"), "* SEARCH 2", "a7 OK")
+	expect(t, command(t, conn, "a8", "FETCH 2 ENVELOPE"), `"Carol" "emp.local"`)
+
+	// Reading the body opens the message and sets \Seen.
+	lines = command(t, conn, "a9", "UID FETCH 2 (BODY[TEXT] BODYSTRUCTURE)")
+	expect(t, lines, "* 2 FETCH (UID 2 BODY[TEXT] {14}", "Second message", `BODYSTRUCTURE ("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "8BIT" 14 0)`, `FLAGS (\Seen)`, "a9 OK")
+	if !backend.messages["bb"].Seen {
+		fmt.Println("Fetching the body didn't open the message.")
+		t.Fail()
+	}
+
+	expect(t, command(t, conn, "b1", "FETCH 1 BODY[]<0.10>"), "BODY[]<0> {10}")
+	expect(t, command(t, conn, "b2", `STORE 1 +FLAGS (\Deleted)`), `* 1 FETCH (FLAGS (\Seen \Deleted))`, "b2 OK")
+	expect(t, command(t, conn, "b3", "SEARCH DELETED"), "* SEARCH 1")
+	expect(t, command(t, conn, "b4", "EXPUNGE"), "* 1 EXPUNGE", "b4 OK")
+	if len(backend.deleted) != 1 || backend.deleted[0] != "aa" {
+		fmt.Println("Wrong messages deleted: ", backend.deleted)
+		t.Fail()
+	}
+
+	// New messages get the next UID.
+	backend.Lock()
+	backend.messages["cc"] = &Message{ID: "cc", Date: date, Sender: "Dave", Subject: "Late", Body: "Third"}
+	backend.inbox = append(backend.inbox, "cc")
+	backend.Unlock()
+	expect(t, command(t, conn, "b5", "NOOP"), "* 2 EXISTS")
+	expect(t, command(t, conn, "b6", "FETCH 2 UID"), "* 2 FETCH (UID 3)")
+
+	expect(t, command(t, conn, "b7", "STATUS Sent (MESSAGES UNSEEN)"), `* STATUS "Sent" (MESSAGES 0 UNSEEN 0)`)
+	expect(t, command(t, conn, "b8", "LOGOUT"), "* BYE", "b8 OK")
+}
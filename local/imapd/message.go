@@ -0,0 +1,419 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSection = errors.New("Invalid section")
+
+// A FETCH data item. Sections are read from BODY[<section>]<<offset>.<length>>.
+type fetchItem struct {
+	name    string // As written in the response
+	section string
+	offset  int // -1 for the whole section
+	length  int
+}
+
+func parseFetchItem(item string) (*fetchItem, error) {
+	upper := strings.ToUpper(item)
+	switch upper {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return &fetchItem{name: upper}, nil
+	}
+
+	open, close := strings.Index(item, "["), strings.LastIndex(item, "]")
+	if open < 0 || close < open || (upper[:open] != "BODY" && upper[:open] != "BODY.PEEK") {
+		return nil, errors.New(fmt.Sprintf("Unknown fetch item %s", item))
+	}
+
+	ret := &fetchItem{section: item[open+1 : close], offset: -1}
+	ret.name = "BODY[" + ret.section + "]"
+
+	if rest := item[close+1:]; len(rest) > 0 {
+		_, err := fmt.Sscanf(rest, "<%d.%d>", &ret.offset, &ret.length)
+		if err != nil || ret.offset < 0 || ret.length < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid partial fetch %s", item))
+		}
+		ret.name += fmt.Sprintf("<%d>", ret.offset)
+	}
+
+	return ret, nil
+}
+
+// Parse the items of a FETCH command, expanding macros. UID FETCH always returns the UID.
+func fetchItems(arg interface{}, uid bool) ([]*fetchItem, error) {
+	var names []string
+
+	switch arg := arg.(type) {
+	case string:
+		switch strings.ToUpper(arg) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{arg}
+		}
+	case []interface{}:
+		var ok bool
+		names, ok = strArgs(arg)
+		if !ok {
+			return nil, errSyntax
+		}
+	}
+
+	items := make([]*fetchItem, 0, len(names)+1)
+	hasUID := false
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		hasUID = hasUID || item.name == "UID"
+		items = append(items, item)
+	}
+
+	if uid && !hasUID {
+		items = append([]*fetchItem{{name: "UID"}}, items...)
+	}
+	return items, nil
+}
+
+// Loads a message once per FETCH, opening it if any item needs the body.
+type fetcher struct {
+	server *Server
+	user   string
+	id     string
+	msg    *Message
+	part   *part
+	opened bool
+}
+
+func (f *fetcher) load(open bool) (*Message, *part, error) {
+	if f.msg != nil && (f.opened || !open) {
+		return f.msg, f.part, nil
+	}
+
+	var msg *Message
+	var err error
+	if open {
+		msg, err = f.server.Backend.Open(f.user, f.id)
+	} else {
+		msg, err = f.server.Backend.Peek(f.user, f.id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f.msg, f.part, f.opened = msg, parsePart(f.server.render(msg)), open
+	return f.msg, f.part, nil
+}
+
+func (s *Server) mailbox(address string) string {
+	return address + "@" + s.Domain
+}
+
+func writeHeader(b *bytes.Buffer, name, value string) {
+	b.WriteString(name + ": " + value + "\r\n")
+}
+
+// Render a message as RFC 5322 data.
+func (s *Server) render(msg *Message) []byte {
+	var b bytes.Buffer
+
+	writeHeader(&b, "Date", msg.Date.Format(time.RFC1123Z))
+	if len(msg.Sender) > 0 {
+		writeHeader(&b, "From", s.mailbox(msg.Sender))
+	}
+
+	for _, header := range []struct {
+		name string
+		list []string
+	}{{"To", msg.To}, {"Cc", msg.CC}} {
+		if len(header.list) == 0 {
+			continue
+		}
+		addresses := make([]string, 0, len(header.list))
+		for _, address := range header.list {
+			addresses = append(addresses, s.mailbox(address))
+		}
+		writeHeader(&b, header.name, strings.Join(addresses, ", "))
+	}
+
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader(&b, "Message-ID", "<"+s.mailbox(msg.ID)+">")
+	writeHeader(&b, "MIME-Version", "1.0")
+
+	mimeType := msg.MimeType
+	if len(mimeType) == 0 {
+		mimeType = "text/plain"
+	}
+	if strings.HasPrefix(mimeType, "text/") && !strings.Contains(mimeType, "charset") {
+		mimeType += "; charset=utf-8"
+	}
+	writeHeader(&b, "Content-Type", mimeType)
+	writeHeader(&b, "Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+
+	body := strings.Replace(msg.Body, "\r\n", "\n", -1)
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return b.Bytes()
+}
+
+func (s *Server) addressList(list []string) string {
+	if len(list) == 0 {
+		return "NIL"
+	}
+
+	ret := "("
+	for _, address := range list {
+		ret += fmt.Sprintf("(NIL NIL %s %s)", quote(address), quote(s.Domain))
+	}
+	return ret + ")"
+}
+
+func (s *Server) envelope(msg *Message) string {
+	subject := "NIL"
+	if len(msg.Subject) > 0 {
+		subject = quote(mime.QEncoding.Encode("utf-8", msg.Subject))
+	}
+
+	from := "NIL"
+	if len(msg.Sender) > 0 {
+		from = s.addressList([]string{msg.Sender})
+	}
+
+	// Date, subject, from, sender, reply-to, to, cc, bcc, in-reply-to and message-id
+	return fmt.Sprintf("(%s %s %s %s %s %s %s NIL NIL %s)", quote(msg.Date.Format(time.RFC1123Z)), subject,
+		from, from, from, s.addressList(msg.To), s.addressList(msg.CC), quote("<"+s.mailbox(msg.ID)+">"))
+}
+
+// Quoted string, or a literal if it can't be quoted.
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' || s[i] >= 0x80 {
+			return literal([]byte(s))
+		}
+	}
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+func partial(data []byte, offset, length int) []byte {
+	if offset < 0 {
+		return data
+	}
+	if offset > len(data) {
+		return nil
+	}
+	data = data[offset:]
+	if length < len(data) {
+		data = data[:length]
+	}
+	return data
+}
+
+// A MIME entity, with the parts of a multipart body.
+type part struct {
+	raw    []byte
+	header []byte // Including the blank line that ends it
+	body   []byte
+
+	mediaType string
+	params    map[string]string
+	encoding  string
+	parts     []*part
+}
+
+func parsePart(data []byte) *part {
+	p := &part{raw: data, header: data, body: nil}
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		p.header, p.body = data[:2], data[2:]
+	} else if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		p.header, p.body = data[:i+4], data[i+4:]
+	}
+
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header))).ReadMIMEHeader()
+
+	p.mediaType, p.params = "text/plain", map[string]string{"charset": "us-ascii"}
+	if contentType := header.Get("Content-Type"); len(contentType) > 0 {
+		if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+			p.mediaType, p.params = mediaType, params
+		}
+	}
+
+	p.encoding = header.Get("Content-Transfer-Encoding")
+	if len(p.encoding) == 0 {
+		p.encoding = "7bit"
+	}
+
+	if boundary := p.params["boundary"]; strings.HasPrefix(p.mediaType, "multipart/") && len(boundary) > 0 {
+		for _, chunk := range splitParts(p.body, boundary) {
+			p.parts = append(p.parts, parsePart(chunk))
+		}
+	}
+
+	return p
+}
+
+func splitParts(body []byte, boundary string) [][]byte {
+	chunks := bytes.Split(append([]byte("\r\n"), body...), []byte("\r\n--"+boundary))
+	ret := make([][]byte, 0, len(chunks))
+
+	// The first chunk is the preamble, the rest start with the end of the boundary line.
+	for _, chunk := range chunks[1:] {
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			break
+		}
+		i := bytes.Index(chunk, []byte("\r\n"))
+		if i < 0 {
+			break
+		}
+		ret = append(ret, chunk[i+2:])
+	}
+
+	return ret
+}
+
+// BODYSTRUCTURE of a part. Extension data is left out.
+func (p *part) structure() string {
+	if len(p.parts) > 0 {
+		ret := "("
+		for _, child := range p.parts {
+			ret += child.structure()
+		}
+		return ret + " " + quote(strings.ToUpper(strings.TrimPrefix(p.mediaType, "multipart/"))) + ")"
+	}
+
+	// Attached messages are described as plain data, their envelope isn't parsed.
+	mediaType := p.mediaType
+	if mediaType == "message/rfc822" {
+		mediaType = "application/octet-stream"
+	}
+	major, minor := mediaType, ""
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		major, minor = mediaType[:i], mediaType[i+1:]
+	}
+
+	params := "NIL"
+	if len(p.params) > 0 {
+		keys := make([]string, 0, len(p.params))
+		for key := range p.params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		values := make([]string, 0, 2*len(keys))
+		for _, key := range keys {
+			values = append(values, quote(strings.ToUpper(key)), quote(p.params[key]))
+		}
+		params = "(" + strings.Join(values, " ") + ")"
+	}
+
+	ret := fmt.Sprintf("(%s %s %s NIL NIL %s %d", quote(strings.ToUpper(major)), quote(strings.ToUpper(minor)),
+		params, quote(strings.ToUpper(p.encoding)), len(p.body))
+	if major == "text" {
+		ret += fmt.Sprintf(" %d", bytes.Count(p.body, []byte("\n")))
+	}
+	return ret + ")"
+}
+
+// Data of a section like "", "1.2", "HEADER", "TEXT" or "1.MIME".
+func (p *part) section(spec string) ([]byte, error) {
+	nested := false
+
+	for len(spec) > 0 && spec[0] >= '0' && spec[0] <= '9' {
+		num, rest := spec, ""
+		if i := strings.Index(spec, "."); i >= 0 {
+			num, rest = spec[:i], spec[i+1:]
+		}
+
+		n, err := strconv.Atoi(num)
+		switch {
+		case err != nil || n < 1:
+			return nil, errSection
+		case len(p.parts) >= n:
+			p = p.parts[n-1]
+		case len(p.parts) > 0 || n != 1:
+			return nil, errors.New(fmt.Sprintf("No part %d", n))
+		}
+		// A body that isn't multipart is its own part 1.
+
+		nested = true
+		spec = rest
+	}
+
+	text := strings.ToUpper(spec)
+	switch {
+	case len(text) == 0 && !nested:
+		return p.raw, nil
+	case len(text) == 0 || text == "TEXT":
+		return p.body, nil
+	case text == "HEADER" || (text == "MIME" && nested):
+		return p.header, nil
+	case strings.HasPrefix(text, "HEADER.FIELDS"):
+		return p.fields(spec)
+	}
+	return nil, errSection
+}
+
+// Header lines for HEADER.FIELDS (<names>) or HEADER.FIELDS.NOT (<names>).
+func (p *part) fields(spec string) ([]byte, error) {
+	open, close := strings.Index(spec, "("), strings.LastIndex(spec, ")")
+	if open < 0 || close < open {
+		return nil, errSection
+	}
+
+	exclude := strings.HasPrefix(strings.ToUpper(spec), "HEADER.FIELDS.NOT")
+	names := make(map[string]bool)
+	for _, name := range strings.Fields(spec[open+1 : close]) {
+		names[strings.ToUpper(strings.Trim(name, `"`))] = true
+	}
+
+	var b bytes.Buffer
+	keep := false
+	for _, line := range strings.SplitAfter(string(p.header), "\r\n") {
+		if len(line) == 0 || line == "\r\n" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := strings.Index(line, ":"); i >= 0 {
+				name = line[:i]
+			}
+			keep = names[strings.ToUpper(strings.TrimSpace(name))] != exclude
+		}
+		if keep {
+			b.WriteString(line)
+		}
+	}
+	b.WriteString("\r\n")
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,262 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/local/mailfmt"
+	"github.com/msecret/emp/objects"
+	"math/big"
+	"net/http"
+)
+
+type ExportArgs struct {
+	Format string         `json:"format"` // mbox, maildir or eml
+	Path   string         `json:"path"`   // On the daemon's machine, a file for mbox and a directory otherwise
+	Query  string         `json:"query"`  // Full-text query, as for SearchMessages
+	Filter localdb.Filter `json:"filter"`
+}
+
+type ImportArgs struct {
+	Path string `json:"path"` // mbox or .eml file, Maildir, or directory of .eml files
+}
+
+type ImportReply struct {
+	Imported int `json:"imported"`
+	Existing int `json:"existing"` // Already in the local database
+	Skipped  int `json:"skipped"`  // Mail that isn't from EMP
+}
+
+// Recipient of publications. It isn't an address, so the local database stores them
+// without a recipient.
+const publicationRecipient = "<Subscription Message>"
+
+func isPublication(msg *objects.FullMessage) bool {
+	return len(msg.MetaMessage.Recipient) == 0 || msg.MetaMessage.Recipient == publicationRecipient
+}
+
+// Check the sender's signature of an opened message. Publications, and bodies shared by
+// several recipients before they had a txid of their own, are signed without a txid.
+func signatureStatus(msg *objects.FullMessage) string {
+	d := msg.Decrypted
+	if d == nil {
+		return mailfmt.SignatureNone
+	}
+
+	signed := *d
+	txidHash := objects.MakeHash(d.Txid[:])
+	if isPublication(msg) || len(msg.BodyHash) > 0 && d.MimeType != objects.MultiMimeType && !bytes.Equal(txidHash.GetBytes(), msg.BodyHash) {
+		signed.Txid = [16]byte{}
+	}
+	data := signed.GetBytes()
+	hash := objects.MakeHash(data[:len(data)-65])
+
+	x, y := encryption.UnmarshalPubkey(d.Pubkey[:])
+	if x == nil {
+		return mailfmt.SignatureInvalid
+	}
+	r := new(big.Int).SetBytes(d.Signature[1:33])
+	s := new(big.Int).SetBytes(d.Signature[33:65])
+
+	if ecdsa.Verify(&ecdsa.PublicKey{Curve: encryption.GetCurve(), X: x, Y: y}, hash.GetBytes(), r, s) {
+		return mailfmt.SignatureValid
+	}
+	return mailfmt.SignatureInvalid
+}
+
+func (service *EMPService) archiveMessage(msg *objects.FullMessage, box int) *mailfmt.Message {
+	txidHash := msg.MetaMessage.TxidHash
+
+	ret := new(mailfmt.Message)
+	ret.TxidHash = txidHash.GetBytes()
+	for name, b := range boxNames {
+		if b == box {
+			ret.Box = name
+		}
+	}
+	ret.Timestamp = msg.MetaMessage.Timestamp
+	ret.Read = msg.MetaMessage.Purged
+	ret.Sender = msg.MetaMessage.Sender
+	ret.Recipient = msg.MetaMessage.Recipient
+	ret.To = msg.To
+	ret.CC = msg.CC
+	ret.BodyHash = msg.BodyHash
+	ret.Folder, ret.Archived = service.Store.GetFiling(txidHash)
+	ret.Tags = service.Store.GetTags(&txidHash)
+	ret.Signature = signatureStatus(msg)
+	ret.Decrypted = msg.Decrypted
+
+	if msg.Encrypted != nil && len(msg.Encrypted.CipherText) > 0 {
+		ret.Encrypted = msg.Encrypted.GetBytes()
+	}
+	return ret
+}
+
+// Write messages matching a search to an mbox, Maildir or .eml archive, oldest first.
+// Messages aren't opened, unopened ones are exported encrypted. Drafts are left out.
+func (service *EMPService) ExportMessages(r *http.Request, args *ExportArgs, reply *int) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	list, err := service.Store.SearchMessages(args.Query, &args.Filter, &localdb.Page{Ascending: true})
+	if err != nil {
+		return err
+	}
+
+	w, err := mailfmt.Create(args.Format, args.Path)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, meta := range list {
+		box := service.Store.Contains(meta.TxidHash)
+		if box > localdb.SENDBOX {
+			continue
+		}
+
+		msg, err := service.Store.GetMessageDetail(meta.TxidHash)
+		if err == nil {
+			err = w.Add(service.archiveMessage(msg, box))
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+		count++
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	service.Config.Log <- fmt.Sprintf("Exported %d messages to %s", count, args.Path)
+	*reply = count
+	return nil
+}
+
+// Add an archived message to the local database. Returns false if it was already there.
+func (service *EMPService) importMessage(msg *mailfmt.Message) (bool, error) {
+	full := new(objects.FullMessage)
+	full.MetaMessage.TxidHash.FromBytes(msg.TxidHash)
+	txidHash := full.MetaMessage.TxidHash
+
+	if service.Store.Contains(txidHash) <= localdb.DRAFTS {
+		return false, nil
+	}
+
+	box, ok := boxNames[msg.Box]
+	if !ok || box == localdb.DRAFTS {
+		return false, errors.New(fmt.Sprintf("Message %x has an unknown box %q!", msg.TxidHash, msg.Box))
+	}
+	if msg.Decrypted == nil && len(msg.Encrypted) == 0 {
+		return false, errors.New(fmt.Sprintf("Message %x has no content!", msg.TxidHash))
+	}
+
+	full.MetaMessage.Timestamp = msg.Timestamp
+	full.MetaMessage.Purged = msg.Read
+	full.MetaMessage.Sender = msg.Sender
+	full.MetaMessage.Recipient = msg.Recipient
+	full.To = msg.To
+	full.CC = msg.CC
+	full.BodyHash = msg.BodyHash
+	full.Decrypted = msg.Decrypted
+
+	if len(msg.Encrypted) > 0 {
+		full.Encrypted = new(encryption.EncryptedMessage)
+		err := full.Encrypted.FromBytes(msg.Encrypted)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err := service.Store.AddUpdateMessage(full, box)
+	if err != nil {
+		return false, err
+	}
+
+	if len(msg.Folder) > 0 {
+		var id int64
+		for _, folder := range service.Store.ListFolders() {
+			if folder.Name == msg.Folder {
+				id = folder.Id
+			}
+		}
+		if id == 0 {
+			id, err = service.Store.CreateFolder(msg.Folder)
+		}
+		if err == nil {
+			err = service.Store.MoveMessage(txidHash, id)
+		}
+	}
+	for _, tag := range msg.Tags {
+		if err == nil {
+			err = service.Store.AddTag(txidHash, tag)
+		}
+	}
+	if err == nil && msg.Archived {
+		err = service.Store.SetArchived(txidHash, true)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	// Remember the sender's key, as opening the message did.
+	if d := msg.Decrypted; d != nil && box == localdb.INBOX && d.MimeType != objects.MultiMimeType {
+		x, y := encryption.UnmarshalPubkey(d.Pubkey[:])
+		if x != nil {
+			address := encryption.GetAddress(service.Config.Log, x, y)
+			if _, err := service.Store.GetAddressDetail(objects.MakeHash(address)); err != nil {
+				detail := new(objects.AddressDetail)
+				detail.Address = address
+				detail.String = encryption.AddressToString(address)
+				detail.Pubkey = d.Pubkey[:]
+				service.Store.AddUpdateAddress(detail)
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Add the messages of an archive written by ExportMessages to the local database.
+// Messages that are already there are left as they are.
+func (service *EMPService) ImportMessages(r *http.Request, args *ImportArgs, reply *ImportReply) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	ret := new(ImportReply)
+	skipped, err := mailfmt.ReadAll(args.Path, func(msg *mailfmt.Message) error {
+		imported, err := service.importMessage(msg)
+		if imported {
+			ret.Imported++
+		} else if err == nil {
+			ret.Existing++
+		}
+		return err
+	})
+	ret.Skipped = skipped
+
+	service.Config.Log <- fmt.Sprintf("Imported %d messages from %s", ret.Imported, args.Path)
+	*reply = *ret
+	return err
+}
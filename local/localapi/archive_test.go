@@ -0,0 +1,104 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/local/mailfmt"
+	"github.com/msecret/emp/objects"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExportPublication(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_archive_test.db"
+	os.Remove(config.LocalDB)
+	defer os.Remove(config.LocalDB)
+
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error opening profile: ", err)
+		t.FailNow()
+	}
+	defer service.Store.Close()
+
+	priv, x, y := encryption.CreateKey(config.Log)
+	detail := new(objects.AddressDetail)
+	detail.Address = encryption.GetAddress(config.Log, x, y)
+	detail.String = encryption.AddressToString(detail.Address)
+	detail.Pubkey = encryption.MarshalPubkey(x, y)
+	detail.Privkey = priv
+	detail.IsRegistered = true
+	service.Store.AddUpdateAddress(detail)
+
+	// Stored like PublishMessage does: signed without the txid, which is added afterwards.
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = objects.MakeHash([]byte("archive test"))
+	msg.MetaMessage.Timestamp = time.Unix(1400000000, 0)
+	msg.MetaMessage.Sender = detail.String
+	msg.MetaMessage.Recipient = publicationRecipient
+	msg.Decrypted = &objects.DecryptedMessage{Subject: "News", MimeType: "text/plain", Length: 17, Content: "Published content"}
+	copy(msg.Decrypted.Pubkey[:], detail.Pubkey)
+
+	data := msg.Decrypted.GetBytes()
+	hash := objects.MakeHash(data[:len(data)-65])
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: encryption.GetCurve(), X: x, Y: y}, D: new(big.Int).SetBytes(priv)}
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, hash.GetBytes())
+	if err != nil {
+		fmt.Println("Error signing publication: ", err)
+		t.FailNow()
+	}
+	msg.Decrypted.Signature[0] = 4
+	copy(msg.Decrypted.Signature[33-len(sigR.Bytes()):33], sigR.Bytes())
+	copy(msg.Decrypted.Signature[65-len(sigS.Bytes()):65], sigS.Bytes())
+	copy(msg.Decrypted.Txid[:], "publication txid")
+
+	err = service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
+	if err != nil {
+		fmt.Println("Error adding publication: ", err)
+		t.FailNow()
+	}
+
+	r, _ := http.NewRequest("POST", "/rpc", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.SetBasicAuth("alice", "alice pass")
+
+	path := os.TempDir() + "/emp_archive_test"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	var count int
+	err = service.ExportMessages(r, &ExportArgs{Format: mailfmt.EML, Path: path}, &count)
+	if err != nil || count != 1 {
+		fmt.Println("Error exporting publication: ", count, err)
+		t.FailNow()
+	}
+
+	mailfmt.ReadAll(path, func(msg *mailfmt.Message) error {
+		if msg.Signature != mailfmt.SignatureValid {
+			fmt.Println("Publication exported with signature: ", msg.Signature)
+			t.Fail()
+		}
+		return nil
+	})
+}
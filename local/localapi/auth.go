@@ -0,0 +1,213 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/local/localdb"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token Scopes
+const (
+	ScopeRead      = "read-mail"        // Read, search and organize messages
+	ScopeDelete    = "delete-mail"      // Delete messages and purge them from the network
+	ScopeSend      = "send"             // Send messages and manage drafts
+	ScopeAddresses = "manage-addresses" // Create, change and forget addresses, including private keys
+	ScopeAdmin     = "admin"            // Everything, including managing tokens
+)
+
+var Scopes = []string{ScopeRead, ScopeDelete, ScopeSend, ScopeAddresses, ScopeAdmin}
+
+// Tokens are shown once, prefixed so they're easy to recognize in configuration files.
+const tokenPrefix = "emp_"
+
+var ErrUnauthorized = errors.New("Unauthorized")
+var ErrForbidden = errors.New("Forbidden: token lacks the required scope")
+
+type TokenArgs struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Expires time.Time `json:"expires"` // Zero for a token that never expires
+}
+
+// Check the credentials of a request. Clients send either a token, as "Authorization:
+// Bearer <token>" or as the password of basic auth, or the RPC username and password
+// of the profile from msg.conf, which have every scope. An empty scope accepts any
+// valid credential. Tokens are only valid for the profile they were created in.
+func (service *EMPService) authorize(r *http.Request, scope string) error {
+	if service == nil || service.Config == nil || r == nil {
+		return ErrUnauthorized
+	}
+
+	if service.Config.LocalOnly {
+		ip, _, error := net.SplitHostPort(r.RemoteAddr)
+		if error != nil {
+			return ErrUnauthorized
+		}
+		if ip != "127.0.0.1" && ip != "::1" {
+			return ErrUnauthorized
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return service.checkToken(strings.TrimPrefix(auth, "Bearer "), scope)
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return ErrUnauthorized
+	}
+
+	if len(service.Config.RPCUser) > 0 || len(service.Config.RPCPass) > 0 {
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(service.Config.RPCUser))
+		passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(service.Config.RPCPass))
+		if userOk&passOk == 1 {
+			return nil
+		}
+	}
+
+	return service.checkToken(pass, scope)
+}
+
+// Check an API token of this profile against a scope.
+func (service *EMPService) checkToken(secret string, scope string) error {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return ErrUnauthorized
+	}
+
+	token := service.Store.LookupToken(hashToken(secret))
+	if token == nil || token.Expired() {
+		return ErrUnauthorized
+	}
+
+	if len(scope) == 0 || hasScope(token.Scopes, scope) || hasScope(token.Scopes, ScopeAdmin) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// The profile whose credentials a request carries: the one with the basic auth
+// username, or else the one that issued the token. Anything else goes to the default
+// profile, which rejects it.
+func serviceFor(r *http.Request) *EMPService {
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, service := range profiles {
+			if len(service.Config.RPCUser) > 0 && subtle.ConstantTimeCompare([]byte(user), []byte(service.Config.RPCUser)) == 1 {
+				return service
+			}
+		}
+		secret = pass
+	}
+
+	if strings.HasPrefix(secret, tokenPrefix) {
+		hash := hashToken(secret)
+		for _, service := range profiles {
+			if service.Store.LookupToken(hash) != nil {
+				return service
+			}
+		}
+	}
+
+	return profiles[0]
+}
+
+// Serve JSON-RPC requests with the service of the profile making them.
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	serviceFor(r).rpc.ServeHTTP(w, r)
+}
+
+func hashToken(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// Create a token in store and return its secret, which isn't stored anywhere.
+func NewToken(store *localdb.Store, args *TokenArgs) (string, error) {
+	if len(args.Scopes) == 0 {
+		return "", errors.New("At least one scope required!")
+	}
+	for _, scope := range args.Scopes {
+		if !hasScope(Scopes, scope) {
+			return "", errors.New(fmt.Sprintf("Unknown scope %s, must be one of: %s", scope, strings.Join(Scopes, ", ")))
+		}
+	}
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(random)
+
+	token := &localdb.Token{Name: args.Name, Scopes: args.Scopes, Created: time.Now().Round(time.Second), Expires: args.Expires}
+	err = store.CreateToken(token, hashToken(secret))
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// Create an API token. The reply is the token itself, which can't be retrieved later.
+func (service *EMPService) CreateToken(r *http.Request, args *TokenArgs, reply *string) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	secret, err := NewToken(service.Store, args)
+	if err != nil {
+		return err
+	}
+
+	*reply = secret
+	return nil
+}
+
+func (service *EMPService) ListTokens(r *http.Request, args *NilParam, reply *[]localdb.Token) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = service.Store.ListTokens()
+	return nil
+}
+
+func (service *EMPService) RevokeToken(r *http.Request, args *string, reply *NilParam) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	return service.Store.RevokeToken(*args)
+}
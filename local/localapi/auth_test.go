@@ -0,0 +1,128 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/api"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RPCUser, config.RPCPass = "user", "pass"
+
+	dbFile := os.TempDir() + "/emp_auth_test.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	config.LocalDB = dbFile
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error initializing database: ", err)
+		t.FailNow()
+	}
+	defer service.Store.Close()
+
+	request := func(auth string) *http.Request {
+		r, _ := http.NewRequest("POST", "/rpc", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		if len(auth) > 0 {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	// Configured credentials have every scope
+	r := request("")
+	r.SetBasicAuth("user", "pass")
+	if service.authorize(r, ScopeAdmin) != nil {
+		fmt.Println("RPC password rejected.")
+		t.Fail()
+	}
+	r.SetBasicAuth("user", "wrong")
+	if service.authorize(r, "") != ErrUnauthorized {
+		fmt.Println("Wrong RPC password accepted.")
+		t.Fail()
+	}
+
+	reader, err := NewToken(service.Store, &TokenArgs{Name: "reader", Scopes: []string{ScopeRead}})
+	if err != nil {
+		fmt.Println("Error creating token: ", err)
+		t.FailNow()
+	}
+	_, err = NewToken(service.Store, &TokenArgs{Name: "reader", Scopes: []string{ScopeRead}})
+	if err == nil {
+		fmt.Println("Duplicate token name accepted.")
+		t.Fail()
+	}
+	_, err = NewToken(service.Store, &TokenArgs{Name: "bad", Scopes: []string{"everything"}})
+	if err == nil {
+		fmt.Println("Unknown scope accepted.")
+		t.Fail()
+	}
+
+	if service.authorize(request("Bearer "+reader), ScopeRead) != nil {
+		fmt.Println("Token rejected.")
+		t.Fail()
+	}
+	if service.authorize(request("Bearer "+reader), ScopeSend) != ErrForbidden {
+		fmt.Println("Token accepted outside its scope.")
+		t.Fail()
+	}
+	// Reading mail doesn't allow deleting or purging it.
+	txid := make([]byte, 16)
+	if service.PurgeMessage(request("Bearer "+reader), &txid, new(NilParam)) != ErrForbidden || service.DeleteMessage(request("Bearer "+reader), &txid, new(NilParam)) != ErrForbidden {
+		fmt.Println("Read-only token allowed to delete messages.")
+		t.Fail()
+	}
+	if service.authorize(request("Bearer "+reader+"0"), "") != ErrUnauthorized {
+		fmt.Println("Wrong token accepted.")
+		t.Fail()
+	}
+
+	// Tokens also work as the password of basic auth
+	r = request("")
+	r.SetBasicAuth("reader", reader)
+	if service.authorize(r, ScopeRead) != nil {
+		fmt.Println("Token rejected as basic auth password.")
+		t.Fail()
+	}
+
+	admin, _ := NewToken(service.Store, &TokenArgs{Name: "admin", Scopes: []string{ScopeAdmin}})
+	if service.authorize(request("Bearer "+admin), ScopeAddresses) != nil {
+		fmt.Println("Admin token rejected.")
+		t.Fail()
+	}
+
+	expired, _ := NewToken(service.Store, &TokenArgs{Name: "expired", Scopes: []string{ScopeAdmin}, Expires: time.Now().Add(-time.Minute)})
+	if service.authorize(request("Bearer "+expired), "") != ErrUnauthorized {
+		fmt.Println("Expired token accepted.")
+		t.Fail()
+	}
+
+	if len(service.Store.ListTokens()) != 3 {
+		fmt.Println("Wrong number of tokens: ", service.Store.ListTokens())
+		t.Fail()
+	}
+
+	err = service.Store.RevokeToken("reader")
+	if err != nil || service.authorize(request("Bearer "+reader), ScopeRead) != ErrUnauthorized {
+		fmt.Println("Revoked token accepted: ", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,166 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Backups start with backupMagic and a version byte, followed by a passphrase stream
+// (see encryption.EncryptPassphraseStream) of gzipped JSON localdb.BackupRecords.
+const (
+	backupMagic   = "EMPBACKUP"
+	BackupVersion = 1
+)
+
+var (
+	ErrNotBackup        = errors.New("Not an EMP backup.")
+	ErrBackupVersion    = errors.New("Backup was written by a newer version of EMP.")
+	ErrBackupPassphrase = errors.New("Wrong passphrase, or the backup is damaged.")
+)
+
+type BackupArgs struct {
+	Path       string `json:"path"` // On the daemon's machine, must not exist yet
+	Passphrase string `json:"passphrase"`
+}
+
+type RestoreArgs struct {
+	Path       string `json:"path"`
+	Passphrase string `json:"passphrase"`
+	Replace    bool   `json:"replace"` // Delete everything in the local database first
+}
+
+// Write every address, message, folder and token in store to w, encrypted with passphrase.
+func WriteBackup(store *localdb.Store, w io.Writer, passphrase string) (*localdb.BackupCounts, error) {
+	_, err := w.Write(append([]byte(backupMagic), BackupVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := encryption.EncryptPassphraseStream(passphrase, w)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(stream)
+	encoder := json.NewEncoder(zw)
+
+	counts, err := store.Dump(func(rec *localdb.BackupRecord) error {
+		return encoder.Encode(rec)
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = stream.Close()
+	}
+	return counts, err
+}
+
+// Restore a backup written by WriteBackup. Unless replace is set, it's merged with
+// what's already in store.
+func ReadBackup(store *localdb.Store, r io.Reader, passphrase string, replace bool) (*localdb.BackupCounts, error) {
+	head := make([]byte, len(backupMagic)+1)
+	_, err := io.ReadFull(r, head)
+	if err != nil || string(head[:len(backupMagic)]) != backupMagic {
+		return nil, ErrNotBackup
+	}
+	if head[len(backupMagic)] > BackupVersion {
+		return nil, ErrBackupVersion
+	}
+
+	stream, err := encryption.DecryptPassphraseStream(passphrase, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(stream)
+	if err == encryption.ErrStreamAuth {
+		return nil, ErrBackupPassphrase
+	} else if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(zr)
+
+	return store.Restore(replace, func() (*localdb.BackupRecord, error) {
+		rec := new(localdb.BackupRecord)
+		err := decoder.Decode(rec)
+		if err == encryption.ErrStreamAuth {
+			err = ErrBackupPassphrase
+		}
+		return rec, err
+	})
+}
+
+// Write an encrypted backup of the local database to a new file.
+func (service *EMPService) Backup(r *http.Request, args *BackupArgs, reply *localdb.BackupCounts) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	file, err := os.OpenFile(args.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	counts, err := WriteBackup(service.Store, w, args.Passphrase)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(args.Path)
+		return err
+	}
+
+	service.Config.Log <- fmt.Sprintf("Backed up %d addresses and %d messages to %s", counts.Addresses, counts.Messages, args.Path)
+	*reply = *counts
+	return nil
+}
+
+// Restore a backup into the local database. Nothing is changed if it fails.
+func (service *EMPService) Restore(r *http.Request, args *RestoreArgs, reply *localdb.BackupCounts) error {
+	if err := service.authorize(r, ScopeAdmin); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	file, err := os.Open(args.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counts, err := ReadBackup(service.Store, bufio.NewReader(file), args.Passphrase, args.Replace)
+	if err != nil {
+		return err
+	}
+
+	// Restored private keys receive messages from now on.
+	service.refreshTagKeys()
+
+	service.Config.Log <- fmt.Sprintf("Restored %d addresses and %d messages from %s", counts.Addresses, counts.Messages, args.Path)
+	*reply = *counts
+	return nil
+}
@@ -0,0 +1,144 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	log := make(chan string, 100)
+
+	dbFile := os.TempDir() + "/emp_backup_test.db"
+	os.Remove(dbFile)
+	defer os.Remove(dbFile)
+
+	store, err := localdb.Open(log, dbFile)
+	if err != nil {
+		fmt.Println("Error initializing database: ", err)
+		t.FailNow()
+	}
+
+	priv, x, y := encryption.CreateKey(log)
+	detail := new(objects.AddressDetail)
+	detail.Address = encryption.GetAddress(log, x, y)
+	detail.String = encryption.AddressToString(detail.Address)
+	detail.Pubkey = encryption.MarshalPubkey(x, y)
+	detail.Privkey = priv
+	detail.IsRegistered = true
+	store.AddUpdateAddress(detail)
+	addrHash := objects.MakeHash(detail.Address)
+
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = objects.MakeHash([]byte("backup test"))
+	msg.MetaMessage.Timestamp = time.Unix(1400000000, 0)
+	msg.MetaMessage.Recipient = detail.String
+	msg.Decrypted = &objects.DecryptedMessage{Subject: "Kept", MimeType: "text/plain", Length: 18, Content: "searchable content"}
+	err = store.AddUpdateMessage(msg, localdb.INBOX)
+	if err != nil {
+		fmt.Println("Error adding message: ", err)
+		t.FailNow()
+	}
+	txidHash := msg.MetaMessage.TxidHash
+
+	folder, _ := store.CreateFolder("Saved")
+	store.CreateFolder("Empty")
+	store.MoveMessage(txidHash, folder)
+	store.AddTag(txidHash, "important")
+	store.CreateToken(&localdb.Token{Name: "phone", Scopes: []string{ScopeRead}, Created: time.Now()}, hashToken("secret"))
+
+	buf := new(bytes.Buffer)
+	counts, err := WriteBackup(store, buf, "passphrase")
+	if err != nil || counts.Addresses != 1 || counts.Messages != 1 || counts.Folders != 2 || counts.Tokens != 1 {
+		fmt.Println("Error writing backup: ", counts, err)
+		t.FailNow()
+	}
+	backup := buf.Bytes()
+
+	// Start over with an empty database.
+	store.Close()
+	os.Remove(dbFile)
+	store, _ = localdb.Open(log, dbFile)
+	defer store.Close()
+
+	_, err = ReadBackup(store, bytes.NewReader(backup), "wrong", false)
+	if err != ErrBackupPassphrase || store.Contains(addrHash) != localdb.NOTFOUND {
+		fmt.Println("Expected nothing restored with a wrong passphrase, got: ", err)
+		t.Fail()
+	}
+
+	newer := append([]byte(nil), backup...)
+	newer[len(backupMagic)] = BackupVersion + 1
+	if _, err = ReadBackup(store, bytes.NewReader(newer), "passphrase", false); err != ErrBackupVersion {
+		fmt.Println("Expected ErrBackupVersion, got: ", err)
+		t.Fail()
+	}
+
+	if _, err = ReadBackup(store, bytes.NewReader(backup[:len(backup)-10]), "passphrase", false); err == nil {
+		fmt.Println("Truncated backup restored.")
+		t.Fail()
+	}
+
+	counts, err = ReadBackup(store, bytes.NewReader(backup), "passphrase", false)
+	if err != nil || counts.Addresses != 1 || counts.Messages != 1 || counts.Existing != 0 {
+		fmt.Println("Error restoring backup: ", counts, err)
+		t.FailNow()
+	}
+
+	// The hash list is rebuilt, so restored data can be looked up.
+	restored, err := store.GetAddressDetail(addrHash)
+	if err != nil || !bytes.Equal(restored.Privkey, priv) {
+		fmt.Println("Private key not restored: ", err)
+		t.Fail()
+	}
+	if store.Contains(txidHash) != localdb.INBOX {
+		fmt.Println("Message not restored.")
+		t.Fail()
+	}
+	if name, _ := store.GetFiling(txidHash); name != "Saved" || len(store.ListFolders()) != 2 {
+		fmt.Println("Folders not restored: ", name, store.ListFolders())
+		t.Fail()
+	}
+	if tags := store.GetTags(&txidHash); len(tags) != 1 || tags[0] != "important" {
+		fmt.Println("Tags not restored: ", tags)
+		t.Fail()
+	}
+	if token := store.LookupToken(hashToken("secret")); token == nil || token.Name != "phone" {
+		fmt.Println("Token not restored.")
+		t.Fail()
+	}
+	if found, _ := store.SearchMessages("searchable", nil, nil); len(found) != 1 {
+		fmt.Println("Search index not rebuilt: ", found)
+		t.Fail()
+	}
+
+	// Merging again changes nothing, replacing removes what isn't in the backup.
+	counts, err = ReadBackup(store, bytes.NewReader(backup), "passphrase", false)
+	if err != nil || counts.Messages != 0 || counts.Existing != 5 {
+		fmt.Println("Merge added duplicates: ", counts, err)
+		t.Fail()
+	}
+
+	store.CreateFolder("Extra")
+	counts, err = ReadBackup(store, bytes.NewReader(backup), "passphrase", true)
+	if err != nil || counts.Messages != 1 || counts.Existing != 0 || len(store.ListFolders()) != 2 {
+		fmt.Println("Replace didn't start from an empty database: ", counts, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,156 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxCoverLen = 4096 // Maximum content length of a dummy message before padding
+)
+
+var (
+	padMutex sync.Mutex
+	padSizes = make(map[int]int) // Padded length of real outgoing messages -> number sent
+	padCount int
+)
+
+// Record the padded length of a real outgoing message, so dummies follow the same sizes.
+func recordPadded(n int) {
+	padMutex.Lock()
+	defer padMutex.Unlock()
+
+	padSizes[n]++
+	padCount++
+}
+
+// Pick the padded length of the next dummy with the same distribution as real messages.
+// Until a real message is sent, content lengths are uniform up to maxCoverLen.
+func coverBucket(base, step int) int {
+	padMutex.Lock()
+	defer padMutex.Unlock()
+
+	if padCount > 0 {
+		n := randomInt(padCount)
+		for size, count := range padSizes {
+			if n < count {
+				return size
+			}
+			n -= count
+		}
+	}
+
+	return objects.PaddedLength(base+randomInt(maxCoverLen)+2, step)
+}
+
+// Inject dummy messages into the network at random intervals, so observers can't tell
+// when the local user is sending real messages.
+func coverTraffic(config *api.ApiConfig) {
+	var sent int
+	window := time.Now()
+
+	for {
+		time.Sleep(randomDelay(config.CoverInterval))
+
+		if time.Since(window) >= time.Hour {
+			window = time.Now()
+			sent = 0
+		}
+
+		msg := dummyMessage(config)
+		if msg == nil {
+			continue
+		}
+
+		frame := objects.MakeFrame(objects.MSG, objects.BROADCAST, msg)
+		if config.CoverBudget > 0 && sent+len(frame.Payload) > config.CoverBudget {
+			continue
+		}
+		sent += len(frame.Payload)
+
+		config.RecvQueue <- *frame
+	}
+}
+
+// Create a message addressed to a random hash and encrypted to a throwaway key.
+// Content is random and padded exactly like a real message.
+func dummyMessage(config *api.ApiConfig) *objects.Message {
+	_, x, y := encryption.CreateKey(config.Log)
+	if x == nil {
+		return nil
+	}
+
+	decrypted := new(objects.DecryptedMessage)
+	decrypted.MimeType = "text/plain"
+
+	// Any content length that pads to the chosen bucket: GetBytes() plus the two pad bytes.
+	base := len(decrypted.GetBytes())
+	bucket := coverBucket(base, config.PadStep)
+	hi := bucket - base - 2
+	if hi < 0 {
+		return nil
+	}
+	lo := sort.Search(hi+1, func(n int) bool {
+		return objects.PaddedLength(base+n+2, config.PadStep) >= bucket
+	})
+
+	addr := make([]byte, 25, 25)
+	content := make([]byte, lo+randomInt(hi-lo+1))
+
+	for _, b := range [][]byte{addr, content, decrypted.Txid[:], decrypted.Pubkey[:], decrypted.Signature[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return nil
+		}
+	}
+	decrypted.Content = string(content)
+	decrypted.Length = uint32(len(decrypted.Content))
+
+	msg := new(objects.Message)
+	msg.AddrHash = objects.MakeHash(addr)
+	msg.TxidHash = objects.MakeHash(decrypted.Txid[:])
+	msg.Timestamp = time.Now().Round(time.Second)
+	msg.Content = *encryption.Encrypt(config.Log, encryption.MarshalPubkey(x, y), string(decrypted.GetPaddedBytes(config.PadStep)))
+
+	return msg
+}
+
+// Exponentially distributed delay with the given mean.
+func randomDelay(mean time.Duration) time.Duration {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return mean
+	}
+
+	// Uniform in [0, 1)
+	u := float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+
+	return time.Duration(-math.Log(1-u) * float64(mean))
+}
+
+// Uniformly distributed integer in [0, n).
+func randomInt(n int) int {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint32(b[:]) % uint32(n))
+}
@@ -0,0 +1,109 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/encryptedmessaging/quibit"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"testing"
+	"time"
+)
+
+func TestDummyMessage(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+
+	_, x, y := encryption.CreateKey(config.Log)
+	pubkey := encryption.MarshalPubkey(x, y)
+
+	// Encrypted length of a real message padded to each bucket.
+	buckets := make(map[int]int)
+	for n := 0; n <= 2*maxCoverLen; n++ {
+		size := objects.PaddedLength(n, config.PadStep)
+		if _, ok := buckets[size]; !ok {
+			buckets[size] = len(encryption.Encrypt(config.Log, pubkey, string(make([]byte, size))).GetBytes())
+		}
+	}
+	encrypted := make(map[int]bool)
+	for _, l := range buckets {
+		encrypted[l] = true
+	}
+
+	padMutex.Lock()
+	padSizes, padCount = make(map[int]int), 0
+	padMutex.Unlock()
+
+	// Before any real message, dummies still fall in a real bucket.
+	for i := 0; i < 20; i++ {
+		msg := dummyMessage(config)
+		if msg == nil || !encrypted[len(msg.Content.GetBytes())] {
+			fmt.Println("Dummy message outside the padding buckets: ", msg)
+			t.FailNow()
+		}
+	}
+
+	// Once real messages are sent, dummies only use their sizes.
+	recordPadded(1024)
+	recordPadded(2048)
+	for i := 0; i < 20; i++ {
+		msg := dummyMessage(config)
+		l := len(msg.Content.GetBytes())
+		if l != buckets[1024] && l != buckets[2048] {
+			fmt.Println("Dummy message size not used by real messages: ", l)
+			t.Fail()
+		}
+	}
+
+	padMutex.Lock()
+	padSizes, padCount = make(map[int]int), 0
+	padMutex.Unlock()
+}
+
+func TestCoverTraffic(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RecvQueue = make(chan quibit.Frame, 10)
+	config.CoverInterval = time.Millisecond
+
+	go coverTraffic(config)
+
+	select {
+	case frame := <-config.RecvQueue:
+		msg := new(objects.Message)
+		if msg.FromBytes(frame.Payload) != nil {
+			fmt.Println("Cover traffic isn't a message.")
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		fmt.Println("No cover traffic sent.")
+		t.Fail()
+	}
+
+	// No dummy fits in the budget, so nothing is sent.
+	budget := new(api.ApiConfig)
+	budget.Log = make(chan string, 100)
+	budget.RecvQueue = make(chan quibit.Frame, 10)
+	budget.CoverInterval = time.Millisecond
+	budget.CoverBudget = 1
+
+	go coverTraffic(budget)
+
+	select {
+	case <-budget.RecvQueue:
+		fmt.Println("Cover traffic sent over budget.")
+		t.Fail()
+	case <-time.After(200 * time.Millisecond):
+	}
+}
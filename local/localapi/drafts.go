@@ -0,0 +1,193 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"time"
+)
+
+// How often the scheduler checks for drafts that are due.
+const scheduleInterval = 10 * time.Second
+
+// Create a draft with a random identifier from a message.
+func newDraft(args *SendMsg) *objects.Draft {
+	var txid [16]byte
+	rand.Read(txid[:])
+
+	ret := new(objects.Draft)
+	ret.TxidHash = objects.MakeHash(txid[:])
+	ret.Timestamp = time.Now().Round(time.Second)
+	ret.Sender = args.Sender
+	ret.Recipient = args.Recipient
+	ret.To = uniqueAddresses(args.To)
+	ret.CC = uniqueAddresses(args.CC)
+	ret.BCC = uniqueAddresses(args.BCC)
+	ret.Subject = args.Subject
+	ret.MimeType = args.MimeType
+	ret.Content = args.Plaintext
+	ret.SendAt = args.SendAt
+	return ret
+}
+
+// Send a draft now. It's taken out of the drafts box first, so it can't be sent twice;
+// if sending fails the draft is returned with the error, for the caller to save again.
+func (service *EMPService) sendDraft(txidHash objects.Hash, reply *SendResponse) (*objects.Draft, error) {
+	draft, err := service.Store.TakeDraft(txidHash)
+	if err != nil {
+		return nil, err
+	}
+
+	args := new(SendMsg)
+	args.Sender = draft.Sender
+	args.Recipient = draft.Recipient
+	args.To = draft.To
+	args.CC = draft.CC
+	args.BCC = draft.BCC
+	args.Subject = draft.Subject
+	args.MimeType = draft.MimeType
+	args.Plaintext = draft.Content
+
+	err = service.sendMessage(args, reply)
+	if err != nil {
+		return draft, err
+	}
+	return nil, nil
+}
+
+// Send scheduled drafts when they're due. Schedules are stored in the local database,
+// so anything that came due while the client was down is sent on startup.
+func (service *EMPService) scheduler() {
+	for {
+		for _, metamsg := range service.Store.GetDueDrafts(time.Now()) {
+			draft, err := service.sendDraft(metamsg.TxidHash, new(SendResponse))
+			if draft != nil {
+				// Keep it as an unscheduled draft so it isn't retried forever.
+				service.Config.Log <- fmt.Sprintf("Error sending scheduled message, moved to drafts: %s", err)
+				draft.SendAt = time.Time{}
+				service.Store.SaveDraft(draft)
+			} else if _, ok := err.(localdb.NotFoundError); err != nil && !ok {
+				service.Config.Log <- fmt.Sprintf("Error loading scheduled message: %s", err)
+			}
+		}
+
+		time.Sleep(scheduleInterval)
+	}
+}
+
+// Save a new draft, returns its txid_hash. If send_at is set, it will be sent at that time.
+func (service *EMPService) SaveDraft(r *http.Request, args *SendMsg, reply *[]byte) error {
+	if err := service.authorize(r, ScopeSend); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	draft := newDraft(args)
+	err := service.Store.SaveDraft(draft)
+	if err != nil {
+		return err
+	}
+
+	*reply = draft.TxidHash.GetBytes()
+	return nil
+}
+
+// Replace the contents and schedule of an existing draft.
+func (service *EMPService) UpdateDraft(r *http.Request, args *objects.Draft, reply *NilParam) error {
+	if err := service.authorize(r, ScopeSend); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	if service.Store.Contains(args.TxidHash) != localdb.DRAFTS {
+		return localdb.NotFoundError("Draft not found!")
+	}
+
+	args.Timestamp = time.Now().Round(time.Second)
+	args.To = uniqueAddresses(args.To)
+	args.CC = uniqueAddresses(args.CC)
+	args.BCC = uniqueAddresses(args.BCC)
+
+	return service.Store.SaveDraft(args)
+}
+
+func (service *EMPService) DeleteDraft(r *http.Request, args *[]byte, reply *NilParam) error {
+	if err := service.authorize(r, ScopeSend); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(*args)
+
+	return service.Store.DeleteDraft(txidHash)
+}
+
+func (service *EMPService) GetDraft(r *http.Request, args *[]byte, reply *objects.Draft) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(*args)
+
+	draft, err := service.Store.GetDraft(txidHash)
+	if err != nil {
+		return err
+	}
+
+	*reply = *draft
+	return nil
+}
+
+// Send a draft immediately, whether or not it's scheduled.
+func (service *EMPService) SendDraft(r *http.Request, args *[]byte, reply *SendResponse) error {
+	if err := service.authorize(r, ScopeSend); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(*args)
+
+	draft, err := service.sendDraft(txidHash, reply)
+	if draft != nil {
+		service.Store.SaveDraft(draft)
+	}
+	return err
+}
+
+func (service *EMPService) Drafts(r *http.Request, args *NilParam, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = service.Store.GetBox(localdb.DRAFTS)
+	return nil
+}
+
+// List scheduled messages, the sent time of each is when it will be sent.
+func (service *EMPService) Scheduled(r *http.Request, args *NilParam, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = service.Store.GetScheduled()
+	return nil
+}
@@ -0,0 +1,73 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestDrafts(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_drafts_test.db"
+	os.Remove(config.LocalDB)
+	defer os.Remove(config.LocalDB)
+
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error opening profile: ", err)
+		t.FailNow()
+	}
+	defer service.Store.Close()
+
+	r, _ := http.NewRequest("POST", "/rpc", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.SetBasicAuth("alice", "alice pass")
+
+	var txid []byte
+	err = service.SaveDraft(r, &SendMsg{Subject: "Page", MimeType: "text/html", Plaintext: "<p>Hi</p>"}, &txid)
+	if err != nil {
+		fmt.Println("Error saving draft: ", err)
+		t.FailNow()
+	}
+
+	draft := new(objects.Draft)
+	err = service.GetDraft(r, &txid, draft)
+	if err != nil || draft.MimeType != "text/html" || draft.Content != "<p>Hi</p>" {
+		fmt.Println("Wrong draft returned: ", draft, err)
+		t.Fail()
+	}
+
+	// Only the first caller gets the draft to send.
+	var txidHash objects.Hash
+	txidHash.FromBytes(txid)
+	taken, err := service.Store.TakeDraft(txidHash)
+	if err != nil || taken.MimeType != "text/html" {
+		fmt.Println("Error taking draft: ", taken, err)
+		t.FailNow()
+	}
+	if _, err = service.Store.TakeDraft(txidHash); err == nil {
+		fmt.Println("Draft taken twice.")
+		t.Fail()
+	}
+	if _, ok := err.(localdb.NotFoundError); !ok || service.Store.Contains(txidHash) != localdb.NOTFOUND {
+		fmt.Println("Taken draft still in the database: ", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,157 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/encryptedmessaging/quibit"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event Types
+const (
+	EventMessage     = "message"     // New message in the inbox
+	EventPublication = "publication" // New publication from a subscribed address
+	EventSent        = "sent"        // Outgoing message encrypted and broadcast
+	EventPurged      = "purged"      // Message read by its recipient, or by us
+	EventStatus      = "status"      // Network connection status changed
+)
+
+const (
+	eventBuffer    = 32               // Events queued per client before new ones are dropped
+	eventKeepAlive = 30 * time.Second // Comment sent to idle clients so proxies keep the connection
+	statusInterval = 5 * time.Second  // How often the connection status is checked
+)
+
+type Event struct {
+	Type      string               `json:"type"`
+	Timestamp time.Time            `json:"time"`
+	Message   *objects.MetaMessage `json:"message,omitempty"`
+	Status    *int                 `json:"status,omitempty"`
+
+	service *EMPService // Profile the event happened in, nil for events of every profile
+}
+
+var eventClients = make(map[chan Event]bool)
+var eventMutex = new(sync.Mutex)
+
+func subscribe() chan Event {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	eventClients[ch] = true
+	return ch
+}
+
+func unsubscribe(ch chan Event) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	delete(eventClients, ch)
+}
+
+// Send an event to every client connected to this profile, and queue it for webhooks.
+// Never blocks, slow clients miss events but webhooks don't.
+func (service *EMPService) publish(eventType string, msg *objects.MetaMessage) {
+	e := Event{Type: eventType, Timestamp: time.Now().Round(time.Second), Message: msg, service: service}
+	publishEvent(e)
+	service.queueWebhooks(e)
+}
+
+func publishEvent(e Event) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	for ch := range eventClients {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Publish an event whenever the network connection status changes.
+func watchStatus() {
+	status := quibit.Status()
+
+	for {
+		time.Sleep(statusInterval)
+
+		newStatus := quibit.Status()
+		if newStatus != status {
+			status = newStatus
+			publishEvent(Event{Type: EventStatus, Timestamp: time.Now().Round(time.Second), Status: &newStatus})
+		}
+	}
+}
+
+// Stream events of the client's profile to it as Server-Sent Events.
+func eventHandler(config *api.ApiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service := serviceFor(r)
+		if service.authorize(r, ScopeRead) != nil {
+			config.Log <- fmt.Sprintf("Unauthorized Event Request from: %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"EMP\"")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		events := subscribe()
+		defer unsubscribe(events)
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case e := <-events:
+				if e.service != nil && e.service != service {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+				if err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				_, err := fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
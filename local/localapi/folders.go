@@ -0,0 +1,187 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+)
+
+// Filter and page fields are given side by side.
+type ListArgs struct {
+	localdb.Filter
+	localdb.Page
+}
+
+type FolderArgs struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type MoveArgs struct {
+	TxidHash []byte `json:"txid_hash"`
+	Folder   int64  `json:"folder"` // 0 to remove from all folders
+}
+
+type ArchiveArgs struct {
+	TxidHash []byte `json:"txid_hash"`
+	Archived bool   `json:"archived"`
+}
+
+type TagArgs struct {
+	TxidHash []byte   `json:"txid_hash"`
+	Tags     []string `json:"tags"`
+}
+
+// Create a folder, returns its id.
+func (service *EMPService) CreateFolder(r *http.Request, args *string, reply *int64) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	id, err := service.Store.CreateFolder(*args)
+	if err != nil {
+		return err
+	}
+
+	*reply = id
+	return nil
+}
+
+func (service *EMPService) RenameFolder(r *http.Request, args *FolderArgs, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	return service.Store.RenameFolder(args.Id, args.Name)
+}
+
+// Delete a folder, messages in it aren't deleted.
+func (service *EMPService) DeleteFolder(r *http.Request, args *int64, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	return service.Store.DeleteFolder(*args)
+}
+
+func (service *EMPService) ListFolders(r *http.Request, args *NilParam, reply *[]localdb.Folder) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = service.Store.ListFolders()
+	return nil
+}
+
+func (service *EMPService) MoveMessage(r *http.Request, args *MoveArgs, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(args.TxidHash)
+
+	return service.Store.MoveMessage(txidHash, args.Folder)
+}
+
+// Archive a message out of the inbox, or bring it back.
+func (service *EMPService) ArchiveMessage(r *http.Request, args *ArchiveArgs, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(args.TxidHash)
+
+	return service.Store.SetArchived(txidHash, args.Archived)
+}
+
+func (service *EMPService) TagMessage(r *http.Request, args *TagArgs, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(args.TxidHash)
+
+	for _, tag := range args.Tags {
+		err := service.Store.AddTag(txidHash, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (service *EMPService) UntagMessage(r *http.Request, args *TagArgs, reply *NilParam) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(args.TxidHash)
+
+	for _, tag := range args.Tags {
+		err := service.Store.RemoveTag(txidHash, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List tags of a message, or every tag in use if args is empty.
+func (service *EMPService) ListTags(r *http.Request, args *[]byte, reply *[]string) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	if len(*args) == 0 {
+		*reply = service.Store.GetTags(nil)
+		return nil
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(*args)
+	*reply = service.Store.GetTags(&txidHash)
+	return nil
+}
+
+// List messages by box, folder, tag, archive and read state.
+func (service *EMPService) ListMessages(r *http.Request, args *ListArgs, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	list, err := service.Store.SearchMessages("", &args.Filter, &args.Page)
+	if err != nil {
+		return err
+	}
+
+	*reply = list
+	return nil
+}
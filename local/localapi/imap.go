@@ -0,0 +1,175 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/imapd"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net"
+	"os"
+)
+
+// Serves the inbox and sendbox over IMAP. Log in with the RPC user and password of a
+// profile, or any username and a token with the read-mail scope.
+type imapBackend struct{}
+
+var imapBoxes = map[string]int{imapd.Inbox: localdb.INBOX, imapd.Sent: localdb.SENDBOX}
+
+// The IMAP user is the name of the profile whose messages are served.
+func (b *imapBackend) Authenticate(username, password string) (string, error) {
+	for _, service := range profiles {
+		if len(service.Config.RPCPass) > 0 && subtle.ConstantTimeCompare([]byte(username), []byte(service.Config.RPCUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(service.Config.RPCPass)) == 1 {
+			return service.Profile, nil
+		}
+	}
+
+	for _, service := range profiles {
+		err := service.checkToken(password, ScopeRead)
+		if err == nil {
+			return service.Profile, nil
+		}
+		if err != ErrUnauthorized {
+			return "", err
+		}
+	}
+	return "", ErrUnauthorized
+}
+
+func (b *imapBackend) service(user string) (*EMPService, error) {
+	for _, service := range profiles {
+		if service.Profile == user {
+			return service, nil
+		}
+	}
+	return nil, errors.New("Mailbox not found!")
+}
+
+func (b *imapBackend) List(user, mailbox string) ([]imapd.Summary, error) {
+	service, err := b.service(user)
+	if err != nil {
+		return nil, err
+	}
+	box, ok := imapBoxes[mailbox]
+	if !ok {
+		return nil, errors.New("Mailbox not found!")
+	}
+
+	messages := service.Store.GetBox(box)
+	ret := make([]imapd.Summary, 0, len(messages))
+	for _, meta := range messages {
+		ret = append(ret, imapd.Summary{ID: hex.EncodeToString(meta.TxidHash.GetBytes()), Date: meta.Timestamp, Seen: meta.Purged})
+	}
+	return ret, nil
+}
+
+// Hash of a message in the inbox or sendbox of user.
+func (b *imapBackend) txid(user, id string) (*EMPService, objects.Hash, error) {
+	var txidHash objects.Hash
+
+	service, err := b.service(user)
+	if err != nil {
+		return nil, txidHash, err
+	}
+
+	txid, err := hex.DecodeString(id)
+	if err != nil || len(txid) != len(txidHash) {
+		return nil, txidHash, errors.New("Message not found!")
+	}
+	txidHash.FromBytes(txid)
+
+	if box := service.Store.Contains(txidHash); box != localdb.INBOX && box != localdb.SENDBOX {
+		return nil, txidHash, errors.New("Message not found!")
+	}
+	return service, txidHash, nil
+}
+
+func imapMessage(id string, msg *objects.FullMessage) *imapd.Message {
+	ret := &imapd.Message{ID: id, Date: msg.MetaMessage.Timestamp, Seen: msg.MetaMessage.Purged, Sender: msg.MetaMessage.Sender}
+
+	ret.To, ret.CC = msg.To, msg.CC
+	if len(ret.To) == 0 && len(msg.MetaMessage.Recipient) > 0 {
+		ret.To = []string{msg.MetaMessage.Recipient}
+	}
+
+	if msg.Decrypted != nil {
+		ret.Subject = msg.Decrypted.Subject
+		ret.MimeType = msg.Decrypted.MimeType
+		ret.Body = msg.Decrypted.Content
+	}
+	return ret
+}
+
+func (b *imapBackend) Peek(user, id string) (*imapd.Message, error) {
+	service, txidHash, err := b.txid(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := service.Store.GetMessageDetail(txidHash)
+	if err != nil {
+		return nil, err
+	}
+	return imapMessage(id, msg), nil
+}
+
+func (b *imapBackend) Open(user, id string) (*imapd.Message, error) {
+	service, txidHash, err := b.txid(user, id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := service.openMessage(txidHash)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := imapMessage(id, msg)
+	if msg.Decrypted == nil {
+		ret.Body = "This message could not be decrypted, the private key of its recipient isn't available."
+	}
+	return ret, nil
+}
+
+func (b *imapBackend) Delete(user, id string) error {
+	service, txidHash, err := b.txid(user, id)
+	if err != nil {
+		return err
+	}
+	return service.Store.DeleteMessage(&txidHash)
+}
+
+// Serve the mailbox to local IMAP clients on config.IMAPListen, over TLS if tlsConf is set.
+func imapServer(config *api.ApiConfig, tlsConf *tls.Config) error {
+	l, err := net.Listen("tcp", config.IMAPListen)
+	if err != nil {
+		config.Log <- fmt.Sprintf("IMAP Listen Error: %s", err)
+		return err
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	hostname, _ := os.Hostname()
+	server := &imapd.Server{Domain: config.SMTPDomain, Hostname: hostname, Backend: &imapBackend{}, Log: config.Log}
+
+	config.Log <- fmt.Sprintf("Started IMAP Server on: %s", config.IMAPListen)
+	go server.Serve(l)
+	return nil
+}
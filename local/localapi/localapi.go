@@ -14,8 +14,7 @@
 package localapi
 
 import (
-	"encoding/base64"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
@@ -23,66 +22,95 @@ import (
 	"github.com/msecret/emp/db"
 	"github.com/msecret/emp/encryption"
 	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/local/mailfmt"
 	"github.com/msecret/emp/objects"
 	"net"
 	"net/http"
-	"time"
+	"sync"
 )
 
+// Every profile has its own EMPService, with its own local database and RPC credentials.
 type EMPService struct {
-	Config *api.ApiConfig
+	Config  *api.ApiConfig // Copy of the daemon's config, with this profile's RPCUser, RPCPass and LocalDB
+	Profile string
+	Store   *localdb.Store
+
+	rpc        *rpc.Server
+	tagKeys    []objects.AddressDetail // Registered addresses with private keys, to recognize blinded recipient tags
+	tagMutex   sync.Mutex
+	hookQueues []*webhookQueue // One per webhook, only set up in the default profile
 }
 
+// Every profile being served, the default profile first.
+var profiles []*EMPService
+
 type NilParam struct{}
 
 func (s *EMPService) Version(r *http.Request, args *NilParam, reply *objects.Version) error {
-	if !basicAuth(s.Config, r) {
+	if err := s.authorize(r, ""); err != nil {
 		s.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	*reply = s.Config.LocalVersion
 	return nil
 }
 
-func basicAuth(config *api.ApiConfig, r *http.Request) bool {
-	if config == nil || r == nil {
-		return false
-	}
-
-	if config.LocalOnly {
-		ip, _, error := net.SplitHostPort(r.RemoteAddr)
-		if error != nil {
-			return false
-		}
-		if ip != "127.0.0.1" && ip != "::1" {
-			return false
-		}
+// Open the local database of a profile and create its RPC service.
+func newService(config *api.ApiConfig, profile api.Profile) (*EMPService, error) {
+	service := new(EMPService)
+	service.Config = new(api.ApiConfig)
+	*service.Config = *config
+	service.Config.RPCUser = profile.RPCUser
+	service.Config.RPCPass = profile.RPCPass
+	service.Config.LocalDB = profile.LocalDB
+	service.Profile = profile.Name
+
+	var err error
+	service.Store, err = localdb.Open(config.Log, profile.LocalDB)
+	if err != nil {
+		return nil, err
 	}
 
-	auth := r.Header.Get("Authorization")
-
-	auth2 := "Basic " + base64.StdEncoding.EncodeToString([]byte(config.RPCUser+":"+config.RPCPass))
+	service.refreshTagKeys()
 
-	return (auth == auth2)
+	service.rpc = rpc.NewServer()
+	service.rpc.RegisterCodec(json.NewCodec(), "application/json")
+	service.rpc.RegisterService(service, "EMPService")
+	return service, nil
 }
 
 func Initialize(config *api.ApiConfig) error {
 
-	e := localdb.Initialize(config.Log, config.LocalDB)
+	defaultProfile, _ := config.GetProfile(api.DefaultProfile)
 
-	if e != nil {
-		return e
+	for _, profile := range append([]api.Profile{*defaultProfile}, config.Profiles...) {
+		service, e := newService(config, profile)
+		if e != nil {
+			config.Log <- fmt.Sprintf("Error opening profile %s: %s", profile.Name, e)
+			Cleanup()
+			return e
+		}
+		profiles = append(profiles, service)
 	}
 
-	s := rpc.NewServer()
-	s.RegisterCodec(json.NewCodec(), "application/json")
-	service := new(EMPService)
-	service.Config = config
-	s.RegisterService(service, "EMPService")
+	mailfmt.Domain = config.SMTPDomain
+
+	// Addresses created offline with "emp keygen"
+	for _, service := range profiles {
+		for _, detail := range service.Store.ListUnannounced() {
+			service.announceAddress(&detail)
+		}
+	}
 
 	// Register RPC Services
-	http.Handle("/rpc", s)
+	http.HandleFunc("/rpc", rpcHandler)
+
+	// Register REST API
+	http.Handle(restPrefix, restHandler())
+
+	// Register Event Stream
+	http.Handle("/events", eventHandler(config))
 
 	// Register JS Client
 	http.Handle("/", http.FileServer(http.Dir(config.HttpRoot)))
@@ -93,21 +121,72 @@ func Initialize(config *api.ApiConfig) error {
 		return e
 	}
 
+	scheme := "http"
+	var tlsConf *tls.Config
+	if config.TLS {
+		tlsConf, e = tlsConfig(config)
+		if e != nil {
+			l.Close()
+			config.Log <- fmt.Sprintf("RPC TLS Error: %s", e)
+			return e
+		}
+		l = tls.NewListener(l, tlsConf)
+		scheme = "https"
+	}
+
+	// Webhooks are configured for the whole daemon, they only see the default profile.
+	// Their queues must exist before anything publishes events.
+	profiles[0].startWebhooks()
+
 	go http.Serve(l, nil)
 
 	go register(config)
 
+	for _, service := range profiles {
+		go service.scheduler()
+
+		go service.retryOutbox()
+
+		if config.MaxResends > 0 {
+			go service.rebroadcast()
+		}
+	}
+
+	go watchStatus()
+
+	if config.CoverInterval > 0 {
+		go coverTraffic(config)
+	}
+
+	if len(config.SMTPListen) > 0 {
+		e = smtpServer(config, tlsConf)
+		if e != nil {
+			return e
+		}
+	}
+
+	if len(config.IMAPListen) > 0 {
+		e = imapServer(config, tlsConf)
+		if e != nil {
+			return e
+		}
+	}
+
 	portStr := fmt.Sprintf(":%d", config.RPCPort)
 
-	config.Log <- fmt.Sprintf("Started RPC Server on: %s", portStr)
+	config.Log <- fmt.Sprintf("Started RPC Server on: %s (%s, %d profiles)", portStr, scheme, len(profiles))
 	return nil
 }
 
 func Cleanup() {
-	localdb.Cleanup()
+	for _, service := range profiles {
+		service.Store.Close()
+	}
+	profiles = nil
 }
 
-// Handle Pubkey, Message, and Purge Registration
+// Handle Pubkey, Message, and Purge Registration. Everything is passed to every
+// profile, each stores what's meant for its own addresses.
 func register(config *api.ApiConfig) {
 	var message objects.Message
 	var txid [16]byte
@@ -115,153 +194,182 @@ func register(config *api.ApiConfig) {
 	for {
 		select {
 		case pubHash := <-config.PubkeyRegister:
-
-			// Check if pubkey is in database...
-			pubkey := checkPubkey(config, pubHash)
-
-			if pubkey == nil {
-				break
+			for _, service := range profiles {
+				service.registerPubkey(pubHash)
 			}
-
-			outbox := localdb.GetBox(localdb.OUTBOX)
-			for _, metamsg := range outbox {
-				recvHash := objects.MakeHash([]byte(metamsg.Recipient))
-				if string(pubHash.GetBytes()) == string(recvHash.GetBytes()) {
-					// Send message and move to sendbox
-					msg, err := localdb.GetMessageDetail(metamsg.TxidHash)
-					if err != nil {
-						config.Log <- err.Error()
-						break
-					}
-					msg.Encrypted = encryption.Encrypt(config.Log, pubkey, string(msg.Decrypted.GetBytes()))
-					msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
-					err = localdb.AddUpdateMessage(msg, localdb.SENDBOX)
-					if err != nil {
-						config.Log <- err.Error()
-						break
-					}
-
-					sendMsg := new(objects.Message)
-					sendMsg.Timestamp = msg.MetaMessage.Timestamp
-					sendMsg.TxidHash = msg.MetaMessage.TxidHash
-					sendMsg.AddrHash = recvHash
-					sendMsg.Content = *msg.Encrypted
-
-					config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, sendMsg)
-				}
-			}
-
 		case message = <-config.MessageRegister:
-			// If address is registered, store message in inbox
-			detail, err := localdb.GetAddressDetail(message.AddrHash)
-			if err != nil {
-				config.Log <- "Message address not in database..."
-				break
+			found := false
+			for _, service := range profiles {
+				if service.registerMessage(&message) {
+					found = true
+				}
 			}
-			if !detail.IsRegistered {
+			if !found {
 				config.Log <- "Message not for registered address..."
-				break
-			}
-
-			config.Log <- "Registering new encrypted message..."
-
-			msg := new(objects.FullMessage)
-			msg.MetaMessage.TxidHash = message.TxidHash
-			msg.MetaMessage.Timestamp = message.Timestamp
-			msg.MetaMessage.Recipient = detail.String
-			msg.Encrypted = &message.Content
-
-			err = localdb.AddUpdateMessage(msg, localdb.INBOX)
-			if err != nil {
-				config.Log <- err.Error()
 			}
 		case message = <-config.PubRegister:
-			// If address is registered, store message in inbox
-			detail, err := localdb.GetAddressDetail(message.AddrHash)
-			if err != nil {
-				config.Log <- "Message address not in database..."
-				break
+			found := false
+			for _, service := range profiles {
+				if service.registerPublication(&message) {
+					found = true
+				}
 			}
-			if !detail.IsSubscribed {
+			if !found {
 				config.Log <- "Not Subscribed to Address..."
-				break
-			}
-
-			config.Log <- "Registering new publication..."
-
-			msg := new(objects.FullMessage)
-			msg.MetaMessage.TxidHash = message.TxidHash
-			msg.MetaMessage.Timestamp = message.Timestamp
-			msg.MetaMessage.Sender = detail.String
-			msg.MetaMessage.Recipient = "<Subscription Message>"
-			msg.Encrypted = &message.Content
-
-			msg.Decrypted = new(objects.DecryptedMessage)
-			msg.Decrypted.FromBytes(encryption.DecryptPub(config.Log, detail.Pubkey, msg.Encrypted))
-
-			err = localdb.AddUpdateMessage(msg, localdb.INBOX)
-			if err != nil {
-				config.Log <- err.Error()
 			}
 		case txid = <-config.PurgeRegister:
-			// If Message in database, mark as purged
-			detail, err := localdb.GetMessageDetail(objects.MakeHash(txid[:]))
-			if err != nil {
-				break
-			}
-			detail.MetaMessage.Purged = true
-			err = localdb.AddUpdateMessage(detail, -1)
-			if err != nil {
-				config.Log <- fmt.Sprintf("Error registering purge: %s", err)
+			for _, service := range profiles {
+				service.registerPurge(txid)
 			}
 		} // End select
 	} // End for
 } // End register
 
-func checkPubkey(config *api.ApiConfig, addrHash objects.Hash) []byte {
+// Send messages in the outbox that were waiting for a public key that just arrived.
+func (service *EMPService) registerPubkey(pubHash objects.Hash) {
+	// Check if pubkey is in database...
+	pubkey := service.checkPubkey(pubHash)
+
+	if pubkey == nil {
+		return
+	}
+
+	outbox := service.Store.GetBox(localdb.OUTBOX)
+	for _, metamsg := range outbox {
+		recvHash := objects.MakeHash(encryption.StringToAddress(metamsg.Recipient))
+		if string(pubHash.GetBytes()) == string(recvHash.GetBytes()) {
+			// Send message and move to sendbox
+			err := service.sendOutbox(metamsg.TxidHash, metamsg.Recipient, pubkey)
+			if err != nil {
+				service.Config.Log <- err.Error()
+			}
+		}
+	}
+}
+
+// Store a message in the inbox if it's for one of our registered addresses.
+func (service *EMPService) registerMessage(message *objects.Message) bool {
+	detail, err := service.Store.GetAddressDetail(message.AddrHash)
+	if err != nil {
+		// Check for a blinded recipient tag
+		detail = service.matchTag(message)
+	}
+	if detail == nil || !detail.IsRegistered {
+		return false
+	}
+
+	service.Config.Log <- fmt.Sprintf("Registering new encrypted message for profile %s...", service.Profile)
+
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = message.TxidHash
+	msg.MetaMessage.Timestamp = message.Timestamp
+	msg.MetaMessage.Recipient = detail.String
+	msg.Encrypted = &message.Content
+
+	err = service.Store.AddUpdateMessage(msg, localdb.INBOX)
+	if err != nil {
+		service.Config.Log <- err.Error()
+		return true
+	}
+	service.publish(EventMessage, &msg.MetaMessage)
+	return true
+}
+
+// Store a publication in the inbox if we're subscribed to its sender.
+func (service *EMPService) registerPublication(message *objects.Message) bool {
+	detail, err := service.Store.GetAddressDetail(message.AddrHash)
+	if err != nil || !detail.IsSubscribed {
+		return false
+	}
+
+	service.Config.Log <- fmt.Sprintf("Registering new publication for profile %s...", service.Profile)
+
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = message.TxidHash
+	msg.MetaMessage.Timestamp = message.Timestamp
+	msg.MetaMessage.Sender = detail.String
+	msg.MetaMessage.Recipient = publicationRecipient
+	msg.Encrypted = &message.Content
+
+	msg.Decrypted = new(objects.DecryptedMessage)
+	msg.Decrypted.FromPaddedBytes(encryption.DecryptPub(service.Config.Log, detail.Pubkey, msg.Encrypted))
+
+	err = service.Store.AddUpdateMessage(msg, localdb.INBOX)
+	if err != nil {
+		service.Config.Log <- err.Error()
+		return true
+	}
+	service.publish(EventPublication, &msg.MetaMessage)
+	return true
+}
+
+// If the message is in the database, mark it as purged.
+func (service *EMPService) registerPurge(txid [16]byte) {
+	detail, err := service.Store.GetMessageDetail(objects.MakeHash(txid[:]))
+	if err != nil {
+		return
+	}
+	detail.MetaMessage.Purged = true
+	err = service.Store.AddUpdateMessage(detail, -1)
+	if err != nil {
+		service.Config.Log <- fmt.Sprintf("Error registering purge: %s", err)
+		return
+	}
+	service.publish(EventPurged, &detail.MetaMessage)
+}
+
+func (service *EMPService) checkPubkey(addrHash objects.Hash) []byte {
 
 	// First check local DB
-	detail, err := localdb.GetAddressDetail(addrHash)
+	detail, err := service.Store.GetAddressDetail(addrHash)
 	if err != nil {
 		// If not in database, won't be able to decrypt anyway!
 		return nil
 	}
 	if len(detail.Pubkey) > 0 {
-		if db.Contains(addrHash) != db.PUBKEY {
+		if service.Config.Inventory.Contains(addrHash) != db.PUBKEY {
 			enc := new(objects.EncryptedPubkey)
 
 			enc.IV, enc.Payload, _ = encryption.SymmetricEncrypt(detail.Address, string(detail.Pubkey))
 			enc.AddrHash = objects.MakeHash(detail.Address)
 
-			config.RecvQueue <- *objects.MakeFrame(objects.PUBKEY, objects.BROADCAST, enc)
+			service.Config.RecvQueue <- *objects.MakeFrame(objects.PUBKEY, objects.BROADCAST, enc)
 		}
 		return detail.Pubkey
 	}
 
 	// If not there, check local database
-	if db.Contains(addrHash) == db.PUBKEY {
-		enc := db.GetPubkey(config.Log, addrHash)
+	if service.Config.Inventory.Contains(addrHash) == db.PUBKEY {
+		enc := service.Config.Inventory.GetPubkey(addrHash)
+		if enc == nil {
+			return nil
+		}
 
+		// The key may be followed by padding, anything shorter than a key is invalid
 		pubkey := encryption.SymmetricDecrypt(enc.IV, detail.Address, enc.Payload)
+		if len(pubkey) < 65 {
+			service.Config.Log <- "Decrypted Public Key Invalid"
+			return nil
+		}
 		pubkey = pubkey[:65]
 
 		// Check public Key
 		x, y := encryption.UnmarshalPubkey(pubkey)
 		if x == nil {
-			config.Log <- "Decrypted Public Key Invalid"
+			service.Config.Log <- "Decrypted Public Key Invalid"
 			return nil
 		}
 
-		address2 := encryption.GetAddress(config.Log, x, y)
+		address2 := encryption.GetAddress(service.Config.Log, x, y)
 		if string(detail.Address) != string(address2) {
-			config.Log <- "Decrypted Public Key doesn't match provided address!"
+			service.Config.Log <- "Decrypted Public Key doesn't match provided address!"
 			return nil
 		}
 
 		detail.Pubkey = pubkey
-		err := localdb.AddUpdateAddress(detail)
+		err := service.Store.AddUpdateAddress(detail)
 		if err != nil {
-			config.Log <- "Error adding pubkey to local database!"
+			service.Config.Log <- "Error adding pubkey to local database!"
 			return nil
 		}
 
@@ -269,6 +377,6 @@ func checkPubkey(config *api.ApiConfig, addrHash objects.Hash) []byte {
 	}
 
 	// If not there, send a pubkey request
-	config.RecvQueue <- *objects.MakeFrame(objects.PUBKEY_REQUEST, objects.BROADCAST, &addrHash)
+	service.Config.RecvQueue <- *objects.MakeFrame(objects.PUBKEY_REQUEST, objects.BROADCAST, &addrHash)
 	return nil
 }
@@ -0,0 +1,215 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"time"
+)
+
+// Send one message to several recipients. The body is encrypted once under a random
+// content key and broadcast to a random address hash, signed with its own txid. Each
+// recipient then gets their own small message with the content key and their own
+// txid, so read receipts are reported per recipient. A recipient that fails doesn't
+// stop the others, it's reported in reply.Recipients.
+func (service *EMPService) sendMulti(sender *objects.AddressDetail, recipients []*objects.AddressDetail, to, cc []string, args *SendMsg, reply *SendResponse) error {
+	var err error
+
+	body := new(objects.MultiBody)
+	body.To = to
+	body.CC = cc
+
+	decrypted, err := newDecrypted(sender, args.Subject, args.mimeType(), args.Plaintext, true)
+	if err != nil {
+		return err
+	}
+	body.Message = *decrypted
+
+	wrap := new(objects.KeyWrap)
+	bodyAddr := make([]byte, 25, 25)
+	for _, b := range [][]byte{wrap.Key[:], bodyAddr} {
+		n, err := rand.Read(b)
+		if n < len(b) || err != nil {
+			return errors.New(fmt.Sprintf("Problem with random reader: %s", err))
+		}
+	}
+
+	bodyMsg := new(objects.Message)
+	bodyMsg.AddrHash = objects.MakeHash(bodyAddr)
+	bodyMsg.TxidHash = objects.MakeHash(decrypted.Txid[:])
+	bodyMsg.Timestamp = time.Now().Round(time.Second)
+	padded := objects.Pad(body.GetBytes(), service.Config.PadStep)
+	recordPadded(len(padded))
+	enc := encryption.EncryptShared(service.Config.Log, wrap.Key[:], string(padded))
+	if enc == nil {
+		return errors.New("Could not encrypt message body.")
+	}
+	bodyMsg.Content = *enc
+
+	// Body goes out first, so it's in the inventory before any recipient asks for it.
+	service.Config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, bodyMsg)
+
+	wrap.BodyHash = bodyMsg.TxidHash
+
+	reply.IsSent = true
+	reply.TxidHash = bodyMsg.TxidHash.GetBytes()
+	reply.Recipients = make([]RecipientStatus, 0, len(recipients))
+
+	stored := false
+	for _, recipient := range recipients {
+		status, err := service.sendWrap(sender, recipient, decrypted, wrap, to, cc, args.Subject)
+		if err != nil {
+			service.Config.Log <- fmt.Sprintf("Error sending to %s: %s", recipient.String, err)
+			status.Failure = err.Error()
+		}
+		stored = stored || status.stored
+
+		reply.IsSent = reply.IsSent && status.IsSent
+		reply.Recipients = append(reply.Recipients, status.RecipientStatus)
+	}
+
+	// Nothing refers to the body, take it off the network again.
+	if !stored {
+		purge := new(objects.Purge)
+		purge.Txid = decrypted.Txid
+		service.Config.RecvQueue <- *objects.MakeFrame(objects.PURGE, objects.BROADCAST, purge)
+		return errors.New(fmt.Sprintf("Message could not be sent to any recipient: %s", reply.Recipients[0].Failure))
+	}
+
+	return nil
+}
+
+type wrapStatus struct {
+	RecipientStatus
+	stored bool // Whether the key wrap is in the outbox or sendbox
+}
+
+// Send the key wrap of a shared body to one recipient of sendMulti().
+func (service *EMPService) sendWrap(sender, recipient *objects.AddressDetail, body *objects.DecryptedMessage, wrap *objects.KeyWrap, to, cc []string, subject string) (wrapStatus, error) {
+	var err error
+	ret := wrapStatus{RecipientStatus: RecipientStatus{Recipient: recipient.String}}
+
+	msg := new(objects.FullMessage)
+	msg.Decrypted, err = newDecrypted(sender, subject, objects.MultiMimeType, string(wrap.GetBytes()), true)
+	if err != nil {
+		return ret, err
+	}
+
+	msg.MetaMessage.Purged = false
+	msg.MetaMessage.TxidHash = objects.MakeHash(msg.Decrypted.Txid[:])
+	msg.MetaMessage.Sender = sender.String
+	msg.MetaMessage.Recipient = recipient.String
+	msg.To = to
+	msg.CC = cc
+	msg.BodyHash = wrap.BodyHash.GetBytes()
+	ret.TxidHash = msg.MetaMessage.TxidHash.GetBytes()
+
+	ret.IsSent, err = service.sendTo(msg, recipient)
+	if err != nil {
+		return ret, err
+	}
+	ret.stored = true
+
+	// Once the key wrap is sent, our copy keeps the body itself, so it can still be
+	// read after the shared body has left the inventory.
+	if ret.IsSent {
+		own := *body
+		msg.Decrypted = &own
+		err = service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
+	}
+	return ret, err
+}
+
+// Txid that purges msg from the network. Copies of a message sent to several
+// addresses hold the shared body, so the txid is taken from the key wrap if we can
+// still decrypt it.
+func (service *EMPService) purgeTxid(msg *objects.FullMessage) ([16]byte, bool) {
+	if msg.Decrypted != nil && objects.MakeHash(msg.Decrypted.Txid[:]) == msg.MetaMessage.TxidHash {
+		return msg.Decrypted.Txid, true
+	}
+
+	if msg.Encrypted != nil {
+		recipient, err := service.Store.GetAddressDetail(objects.MakeHash(encryption.StringToAddress(msg.MetaMessage.Recipient)))
+		if err == nil && recipient.Privkey != nil {
+			plainText := encryption.Decrypt(service.Config.Log, recipient.Privkey, msg.Encrypted)
+			if len(plainText) > 0 {
+				decrypted := new(objects.DecryptedMessage)
+				decrypted.FromPaddedBytes(plainText)
+				if objects.MakeHash(decrypted.Txid[:]) == msg.MetaMessage.TxidHash {
+					return decrypted.Txid, true
+				}
+			}
+		}
+	}
+
+	return [16]byte{}, false
+}
+
+// If msg carries a key wrap, replace it with the shared body from the inventory. The
+// body keeps its own txid, which its signature covers, see purgeTxid().
+func expandMulti(config *api.ApiConfig, msg *objects.FullMessage) error {
+	if msg.Decrypted == nil || msg.Decrypted.MimeType != objects.MultiMimeType {
+		return nil
+	}
+
+	wrap := new(objects.KeyWrap)
+	err := wrap.FromBytes([]byte(msg.Decrypted.Content))
+	if err != nil {
+		return err
+	}
+
+	bodyMsg := config.Inventory.GetMessage(wrap.BodyHash)
+	if bodyMsg == nil {
+		return errors.New("Message body has not been received yet.")
+	}
+
+	plainText := encryption.DecryptShared(config.Log, wrap.Key[:], &bodyMsg.Content)
+	if plainText == nil {
+		return errors.New("Could not decrypt message body.")
+	}
+
+	body := new(objects.MultiBody)
+	err = body.FromBytes(objects.Unpad(plainText))
+	if err != nil {
+		return err
+	}
+
+	// Bodies sent before they had a txid of their own are signed without one.
+	if body.Message.Txid != [16]byte{} && objects.MakeHash(body.Message.Txid[:]) != wrap.BodyHash {
+		return errors.New("Message body doesn't match its key wrap.")
+	}
+
+	msg.Decrypted = &body.Message
+	msg.To = body.To
+	msg.CC = body.CC
+	msg.BodyHash = wrap.BodyHash.GetBytes()
+	return nil
+}
+
+// List the read status of every recipient of a message sent to several addresses.
+// Takes the txid_hash returned by SendMessage().
+func (service *EMPService) Receipts(r *http.Request, args *[]byte, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = service.Store.GetByBody(*args)
+	return nil
+}
@@ -0,0 +1,129 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/db"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/local/mailfmt"
+	"github.com/msecret/emp/objects"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpandMulti(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.Inventory, _ = db.Open(config.Log, db.Memory, "")
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_multi_test.db"
+	os.Remove(config.LocalDB)
+	defer os.Remove(config.LocalDB)
+
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error opening profile: ", err)
+		t.FailNow()
+	}
+	defer service.Store.Close()
+
+	priv, x, y := encryption.CreateKey(config.Log)
+	detail := new(objects.AddressDetail)
+	detail.Address = encryption.GetAddress(config.Log, x, y)
+	detail.String = encryption.AddressToString(detail.Address)
+	detail.Pubkey = encryption.MarshalPubkey(x, y)
+	detail.Privkey = priv
+	detail.IsRegistered = true
+	service.Store.AddUpdateAddress(detail)
+
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: encryption.GetCurve(), X: x, Y: y}, D: new(big.Int).SetBytes(priv)}
+	sign := func(d *objects.DecryptedMessage) {
+		data := d.GetBytes()
+		hash := objects.MakeHash(data[:len(data)-65])
+		sigR, sigS, err := ecdsa.Sign(rand.Reader, key, hash.GetBytes())
+		if err != nil {
+			fmt.Println("Error signing message: ", err)
+			t.FailNow()
+		}
+		d.Signature[0] = 4
+		copy(d.Signature[33-len(sigR.Bytes()):33], sigR.Bytes())
+		copy(d.Signature[65-len(sigS.Bytes()):65], sigS.Bytes())
+	}
+
+	// Shared body, signed with its own txid as sendMulti() does.
+	body := new(objects.MultiBody)
+	body.To = []string{detail.String, "other"}
+	body.Message = objects.DecryptedMessage{Subject: "Hi all", MimeType: "text/plain", Length: 5, Content: "Hello"}
+	copy(body.Message.Pubkey[:], detail.Pubkey)
+	copy(body.Message.Txid[:], "body txid")
+	sign(&body.Message)
+
+	wrap := new(objects.KeyWrap)
+	rand.Read(wrap.Key[:])
+	bodyMsg := new(objects.Message)
+	bodyMsg.TxidHash = objects.MakeHash(body.Message.Txid[:])
+	bodyMsg.Timestamp = time.Now().Round(time.Second)
+	bodyMsg.Content = *encryption.EncryptShared(config.Log, wrap.Key[:], string(objects.Pad(body.GetBytes(), 0)))
+	config.Inventory.AddMessage(bodyMsg)
+	wrap.BodyHash = bodyMsg.TxidHash
+
+	// Our own key wrap, as received.
+	own := &objects.DecryptedMessage{Subject: "Hi all", MimeType: objects.MultiMimeType, Content: string(wrap.GetBytes())}
+	own.Length = uint32(len(own.Content))
+	copy(own.Pubkey[:], detail.Pubkey)
+	copy(own.Txid[:], "own txid")
+	sign(own)
+
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = objects.MakeHash(own.Txid[:])
+	msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
+	msg.MetaMessage.Recipient = detail.String
+	msg.Encrypted = encryption.Encrypt(config.Log, detail.Pubkey, string(own.GetPaddedBytes(0)))
+	msg.Decrypted = own
+	service.Store.AddUpdateMessage(msg, localdb.INBOX)
+
+	err = expandMulti(config, msg)
+	if err != nil || msg.Decrypted.Content != "Hello" {
+		fmt.Println("Error expanding message: ", err)
+		t.FailNow()
+	}
+	if msg.Decrypted.Txid != body.Message.Txid {
+		fmt.Println("Body txid was replaced: ", msg.Decrypted.Txid)
+		t.Fail()
+	}
+	if status := signatureStatus(msg); status != mailfmt.SignatureValid {
+		fmt.Println("Expanded body has signature: ", status)
+		t.Fail()
+	}
+
+	// Purges use our own txid, never the shared body's.
+	if txid, ok := service.purgeTxid(msg); !ok || txid != own.Txid {
+		fmt.Println("Wrong purge txid: ", txid, ok)
+		t.Fail()
+	}
+
+	// A body that isn't the one the key wrap names is refused.
+	wrap.BodyHash = objects.MakeHash([]byte("other txid"))
+	config.Inventory.AddMessage(&objects.Message{TxidHash: wrap.BodyHash, Timestamp: bodyMsg.Timestamp, Content: bodyMsg.Content})
+	msg.Decrypted = &objects.DecryptedMessage{MimeType: objects.MultiMimeType, Content: string(wrap.GetBytes())}
+	if expandMulti(config, msg) == nil {
+		fmt.Println("Body with the wrong txid was accepted.")
+		t.Fail()
+	}
+}
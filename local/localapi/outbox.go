@@ -0,0 +1,100 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/db"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"time"
+)
+
+// How often the outbox is checked for messages due for another public key request.
+const retryInterval = time.Minute
+
+// Encrypt and broadcast a message from the outbox, moving it to the sendbox.
+func (service *EMPService) sendOutbox(txidHash objects.Hash, recipient string, pubkey []byte) error {
+	msg, err := service.Store.GetMessageDetail(txidHash)
+	if err != nil {
+		return err
+	}
+
+	sendMsg := new(objects.Message)
+	encryptTo(service.Config, sendMsg, msg, encryption.StringToAddress(recipient), pubkey)
+	msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
+
+	// Keep the shared body instead of the key wrap, as sendMulti() does.
+	expandMulti(service.Config, msg)
+
+	err = service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
+	if err != nil {
+		return err
+	}
+	service.Store.SetFailure(txidHash, "")
+	service.Store.SetAddrHash(txidHash, sendMsg.AddrHash)
+
+	sendMsg.Timestamp = msg.MetaMessage.Timestamp
+	sendMsg.TxidHash = msg.MetaMessage.TxidHash
+
+	service.Config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, sendMsg)
+	service.publish(EventSent, &msg.MetaMessage)
+	return nil
+}
+
+// Time to wait after the given number of public key requests, doubling each time.
+func retryDelay(config *api.ApiConfig, attempts int) time.Duration {
+	delay := config.OutboxRetry
+	for i := 0; i < attempts && delay < config.OutboxDeadline; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// Re-request missing public keys for messages in the outbox, backing off after each
+// attempt. Messages still waiting after config.OutboxDeadline are marked undeliverable.
+func (service *EMPService) retryOutbox() {
+	for {
+		now := time.Now()
+
+		for _, retry := range service.Store.GetDueRetries(now) {
+			addrHash := objects.MakeHash(encryption.StringToAddress(retry.Recipient))
+
+			// Our own request is in the inventory, remove it so it's broadcast again.
+			if service.Config.Inventory.Contains(addrHash) == db.PUBKEYRQ {
+				service.Config.Inventory.Remove(addrHash)
+			}
+
+			pubkey := service.checkPubkey(addrHash)
+			if pubkey != nil {
+				err := service.sendOutbox(retry.TxidHash, retry.Recipient, pubkey)
+				if err != nil {
+					service.Config.Log <- fmt.Sprintf("Error sending queued message: %s", err)
+				}
+				continue
+			}
+
+			if now.Sub(retry.Queued) > service.Config.OutboxDeadline {
+				reason := fmt.Sprintf("No public key received for %s after %s.", retry.Recipient, service.Config.OutboxDeadline)
+				service.Config.Log <- fmt.Sprintf("Message undeliverable: %s", reason)
+				service.Store.SetFailure(retry.TxidHash, reason)
+				continue
+			}
+
+			service.Store.SetRetry(retry.TxidHash, retry.Attempts+1, now.Add(retryDelay(service.Config, retry.Attempts)))
+		}
+
+		time.Sleep(retryInterval)
+	}
+}
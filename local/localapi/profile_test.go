@@ -0,0 +1,111 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_profile_test.db"
+	config.Profiles = []api.Profile{
+		{Name: "bob", RPCUser: "bob", RPCPass: "bob pass", LocalDB: os.TempDir() + "/emp_profile_test_bob.db"},
+		{Name: "carol", RPCUser: "carol", RPCPass: "carol pass", LocalDB: os.TempDir() + "/emp_profile_test_carol.db"},
+	}
+	config.MessageRegister = make(chan objects.Message)
+
+	defaultProfile, _ := config.GetProfile(api.DefaultProfile)
+	for _, profile := range append([]api.Profile{*defaultProfile}, config.Profiles...) {
+		os.Remove(profile.LocalDB)
+		defer os.Remove(profile.LocalDB)
+
+		service, err := newService(config, profile)
+		if err != nil {
+			fmt.Println("Error opening profile: ", err)
+			t.FailNow()
+		}
+		profiles = append(profiles, service)
+	}
+	defer Cleanup()
+	alice, bob, carol := profiles[0], profiles[1], profiles[2]
+
+	request := func(user, pass string) *http.Request {
+		r, _ := http.NewRequest("POST", "/rpc", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		if len(user) > 0 {
+			r.SetBasicAuth(user, pass)
+		} else if len(pass) > 0 {
+			r.Header.Set("Authorization", "Bearer "+pass)
+		}
+		return r
+	}
+
+	// Requests go to the profile of their credentials, which only work there.
+	if r := request("bob", "bob pass"); serviceFor(r) != bob || bob.authorize(r, ScopeAdmin) != nil {
+		fmt.Println("Profile credentials rejected.")
+		t.Fail()
+	}
+	if r := request("bob", "alice pass"); serviceFor(r) != bob || bob.authorize(r, "") != ErrUnauthorized {
+		fmt.Println("Password of another profile accepted.")
+		t.Fail()
+	}
+	if serviceFor(request("", "")) != alice {
+		fmt.Println("Request without credentials not sent to the default profile.")
+		t.Fail()
+	}
+
+	token, _ := NewToken(carol.Store, &TokenArgs{Name: "phone", Scopes: []string{ScopeRead}})
+	if r := request("", token); serviceFor(r) != carol || carol.authorize(r, ScopeRead) != nil || alice.authorize(r, "") != ErrUnauthorized {
+		fmt.Println("Token not limited to its profile.")
+		t.Fail()
+	}
+
+	// Alice and Bob both registered the same address, Carol didn't.
+	priv, x, y := encryption.CreateKey(config.Log)
+	detail := new(objects.AddressDetail)
+	detail.Address = encryption.GetAddress(config.Log, x, y)
+	detail.String = encryption.AddressToString(detail.Address)
+	detail.Pubkey = encryption.MarshalPubkey(x, y)
+	detail.Privkey = priv
+	detail.IsRegistered = true
+	alice.Store.AddUpdateAddress(detail)
+	bob.Store.AddUpdateAddress(detail)
+
+	go register(config)
+
+	message := objects.Message{AddrHash: objects.MakeHash(detail.Address), TxidHash: objects.MakeHash([]byte("profile test")), Timestamp: time.Now().Round(time.Second)}
+	message.Content = *encryption.Encrypt(config.Log, detail.Pubkey, "profile test")
+	config.MessageRegister <- message
+
+	for i := 0; i < 100 && bob.Store.Contains(message.TxidHash) == localdb.NOTFOUND; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if alice.Store.Contains(message.TxidHash) != localdb.INBOX || bob.Store.Contains(message.TxidHash) != localdb.INBOX {
+		fmt.Println("Message not delivered to every profile with the address.")
+		t.Fail()
+	}
+	if carol.Store.Contains(message.TxidHash) != localdb.NOTFOUND {
+		fmt.Println("Message delivered to a profile without the address.")
+		t.Fail()
+	}
+}
@@ -0,0 +1,77 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/objects"
+	"time"
+)
+
+const (
+	resendInterval = time.Hour      // How often the sendbox is checked for expiring messages.
+	resendMargin   = 48 * time.Hour // Unread messages are rebroadcast this long before they expire.
+)
+
+// Rebroadcast unread messages before they're swept from the network, at most
+// config.MaxResends times each.
+func (service *EMPService) rebroadcast() {
+	for {
+		now := time.Now()
+		bodies := make(map[string]bool)
+
+		for _, resend := range service.Store.GetExpiring(now.Add(resendMargin-api.MessageLifetime), service.Config.MaxResends) {
+			// Without the recorded address hash we can't tell whether the message was
+			// sent with a blinded tag, and mustn't reveal the recipient.
+			var fallback *objects.Message
+			if len(resend.AddrHash) > 0 && resend.Encrypted != nil {
+				fallback = new(objects.Message)
+				fallback.TxidHash = resend.TxidHash
+				fallback.AddrHash.FromBytes(resend.AddrHash)
+				fallback.Content = *resend.Encrypted
+			}
+
+			if !refreshMessage(service.Config, resend.TxidHash, fallback) {
+				service.Config.Log <- "Could not rebroadcast expiring message, not in inventory."
+				continue
+			}
+			service.Store.SetResent(resend.TxidHash, resend.Resends+1, now)
+
+			// Shared body of a message sent to several addresses
+			if len(resend.BodyHash) > 0 && !bodies[string(resend.BodyHash)] {
+				var bodyHash objects.Hash
+				bodyHash.FromBytes(resend.BodyHash)
+				bodies[string(resend.BodyHash)] = refreshMessage(service.Config, bodyHash, nil)
+			}
+		}
+
+		time.Sleep(resendInterval)
+	}
+}
+
+// Broadcast a message again with a fresh timestamp. Nodes holding it restart its
+// MessageLifetime (see api fMSG), and nodes that swept it store it again. If our own
+// node has already swept it, fallback is sent instead. Returns false if there was
+// nothing to send.
+func refreshMessage(config *api.ApiConfig, txidHash objects.Hash, fallback *objects.Message) bool {
+	msg := config.Inventory.GetMessage(txidHash)
+	if msg == nil {
+		msg = fallback
+	}
+	if msg == nil || len(msg.Content.CipherText) == 0 {
+		return false
+	}
+
+	msg.Timestamp = time.Now().Round(time.Second)
+	config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, msg)
+	return true
+}
@@ -0,0 +1,808 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The REST API exposes the same operations as the JSON-RPC service, as resources
+// under restPrefix. Every handler calls the matching EMPService method, so both APIs
+// share authentication and behavior. Messages are identified by the hex encoding of
+// their txid_hash, addresses by their string form.
+const restPrefix = "/api/v1/"
+
+// Error with an HTTP status code.
+type restError struct {
+	status int
+	msg    string
+}
+
+func (e restError) Error() string {
+	return e.msg
+}
+
+type restRoute struct {
+	Method  string
+	Path    string // Segments in braces are variables, like /messages/{txid}
+	Summary string
+	Query   []string    // Accepted query parameters
+	Body    interface{} // Value of the request body type, nil if there is no body
+	Reply   interface{} // Value of the response type, nil if there is no content
+	Status  int         // Status code on success
+
+	handle func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error)
+}
+
+var pageQuery = []string{"cursor", "limit", "order"}
+var filterQuery = []string{"box", "sender", "recipient", "after", "before", "read", "folder", "tag", "archived"}
+
+var boxNames = map[string]int{
+	"inbox":   localdb.INBOX,
+	"outbox":  localdb.OUTBOX,
+	"sendbox": localdb.SENDBOX,
+	"drafts":  localdb.DRAFTS,
+}
+
+// Set in init() because the schema route refers to the list itself.
+var restRoutes []restRoute
+
+func init() {
+	restRoutes = []restRoute{
+		{"GET", "/version", "Version of this client", nil, nil, objects.Version{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new(objects.Version)
+				return reply, s.Version(r, new(NilParam), reply)
+			}},
+		{"GET", "/status", "Network connection status", nil, nil, 0, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new(int)
+				return reply, s.ConnectionStatus(r, new(NilParam), reply)
+			}},
+		{"GET", "/schema", "OpenAPI description of this API", nil, nil, map[string]interface{}{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				return restSchema(s), nil
+			}},
+
+		// Addresses
+		{"GET", "/addresses", "List addresses, registered ones if registered=true", []string{"registered"}, nil, [][2]string{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				registered := r.URL.Query().Get("registered") == "true"
+				reply := new([][2]string)
+				return reply, s.ListAddresses(r, &registered, reply)
+			}},
+		{"POST", "/addresses", "Create and register a new address", nil, nil, objects.AddressDetail{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new(objects.AddressDetail)
+				return reply, s.CreateAddress(r, new(NilParam), reply)
+			}},
+		{"GET", "/addresses/{address}", "Get an address", nil, nil, objects.AddressDetail{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				address := vars["address"]
+				reply := new(objects.AddressDetail)
+				return reply, s.GetAddress(r, &address, reply)
+			}},
+		{"PUT", "/addresses/{address}", "Add or update an address", nil, objects.AddressDetail{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(objects.AddressDetail)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				args.String = vars["address"]
+				args.Address = nil
+				return nil, s.AddUpdateAddress(r, args, new(NilParam))
+			}},
+		{"DELETE", "/addresses/{address}", "Forget an address", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				address := vars["address"]
+				return nil, s.ForgetAddress(r, &address, new(NilParam))
+			}},
+
+		// Boxes
+		{"GET", "/boxes/{box}", "List inbox, outbox, sendbox, drafts or scheduled", pageQuery, nil, []objects.MetaMessage{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				page, err := pageFromQuery(r)
+				if err != nil {
+					return nil, err
+				}
+				reply := new([]objects.MetaMessage)
+				switch vars["box"] {
+				case "inbox":
+					err = s.Inbox(r, page, reply)
+				case "outbox":
+					err = s.Outbox(r, page, reply)
+				case "sendbox":
+					err = s.Sendbox(r, page, reply)
+				case "drafts":
+					err = s.Drafts(r, new(NilParam), reply)
+				case "scheduled":
+					err = s.Scheduled(r, new(NilParam), reply)
+				default:
+					err = restError{http.StatusNotFound, "Box not found!"}
+				}
+				return reply, err
+			}},
+		{"GET", "/counts", "Total and unread messages per box and folder", nil, nil, localdb.Counts{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new(localdb.Counts)
+				return reply, s.MessageCounts(r, new(NilParam), reply)
+			}},
+
+		// Messages
+		{"GET", "/messages", "Search messages, q is a full-text query", append(append([]string{"q"}, filterQuery...), pageQuery...), nil, []objects.MetaMessage{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(SearchArgs)
+				args.Query = r.URL.Query().Get("q")
+				filter, err := filterFromQuery(r)
+				if err != nil {
+					return nil, err
+				}
+				page, err := pageFromQuery(r)
+				if err != nil {
+					return nil, err
+				}
+				args.Filter, args.Page = *filter, *page
+				reply := new([]objects.MetaMessage)
+				return reply, s.SearchMessages(r, args, reply)
+			}},
+		{"POST", "/messages", "Send a message, 202 if it was queued or scheduled", nil, SendMsg{}, SendResponse{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(SendMsg)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(SendResponse)
+				return reply, s.SendMessage(r, args, reply)
+			}},
+		{"GET", "/messages/{txid}", "Get a message without marking it as read", nil, nil, objects.FullMessage{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(objects.FullMessage)
+				return reply, s.PeekMessage(r, &txid, reply)
+			}},
+		{"POST", "/messages/{txid}/open", "Open a message, marking it as read", nil, nil, objects.FullMessage{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(objects.FullMessage)
+				return reply, s.OpenMessage(r, &txid, reply)
+			}},
+		{"DELETE", "/messages/{txid}", "Delete a message", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.DeleteMessage(r, &txid, new(NilParam))
+			}},
+		{"GET", "/messages/{txid}/receipts", "Read status of each recipient of a message sent to several addresses", nil, nil, []objects.MetaMessage{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new([]objects.MetaMessage)
+				return reply, s.Receipts(r, &txid, reply)
+			}},
+		{"PUT", "/messages/{txid}/folder", "Move a message into a folder, 0 for none", nil, MoveArgs{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(MoveArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				args.TxidHash, err = txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.MoveMessage(r, args, new(NilParam))
+			}},
+		{"PUT", "/messages/{txid}/archived", "Archive or unarchive a message", nil, ArchiveArgs{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(ArchiveArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				args.TxidHash, err = txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.ArchiveMessage(r, args, new(NilParam))
+			}},
+		{"GET", "/messages/{txid}/tags", "List tags of a message", nil, nil, []string{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new([]string)
+				return reply, s.ListTags(r, &txid, reply)
+			}},
+		{"POST", "/messages/{txid}/tags", "Tag a message", nil, TagArgs{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(TagArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				args.TxidHash, err = txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.TagMessage(r, args, new(NilParam))
+			}},
+		{"DELETE", "/messages/{txid}/tags/{tag}", "Remove a tag from a message", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.UntagMessage(r, &TagArgs{txid, []string{vars["tag"]}}, new(NilParam))
+			}},
+
+		// Folders and Tags
+		{"GET", "/folders", "List folders", nil, nil, []localdb.Folder{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new([]localdb.Folder)
+				return reply, s.ListFolders(r, new(NilParam), reply)
+			}},
+		{"POST", "/folders", "Create a folder", nil, FolderArgs{}, localdb.Folder{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(FolderArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				err = s.CreateFolder(r, &args.Name, &args.Id)
+				return &localdb.Folder{Id: args.Id, Name: args.Name}, err
+			}},
+		{"PUT", "/folders/{id}", "Rename a folder", nil, FolderArgs{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(FolderArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				args.Id, err = strconv.ParseInt(vars["id"], 10, 64)
+				if err != nil {
+					return nil, restError{http.StatusNotFound, "Folder not found!"}
+				}
+				return nil, s.RenameFolder(r, args, new(NilParam))
+			}},
+		{"DELETE", "/folders/{id}", "Delete a folder, its messages are kept", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				id, err := strconv.ParseInt(vars["id"], 10, 64)
+				if err != nil {
+					return nil, restError{http.StatusNotFound, "Folder not found!"}
+				}
+				return nil, s.DeleteFolder(r, &id, new(NilParam))
+			}},
+		{"GET", "/tags", "List tags in use", nil, nil, []string{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new([]string)
+				return reply, s.ListTags(r, new([]byte), reply)
+			}},
+
+		// Archives
+		{"POST", "/export", "Export messages to an mbox, Maildir or .eml archive on the daemon's machine", nil, ExportArgs{}, 0, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(ExportArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(int)
+				return reply, s.ExportMessages(r, args, reply)
+			}},
+		{"POST", "/import", "Import messages from an archive written by /export", nil, ImportArgs{}, ImportReply{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(ImportArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(ImportReply)
+				return reply, s.ImportMessages(r, args, reply)
+			}},
+		{"POST", "/backup", "Write an encrypted backup of addresses, messages and settings on the daemon's machine", nil, BackupArgs{}, localdb.BackupCounts{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(BackupArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(localdb.BackupCounts)
+				return reply, s.Backup(r, args, reply)
+			}},
+		{"POST", "/restore", "Restore a backup, merged with the local database unless replace is set", nil, RestoreArgs{}, localdb.BackupCounts{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(RestoreArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(localdb.BackupCounts)
+				return reply, s.Restore(r, args, reply)
+			}},
+
+		// Tokens
+		{"GET", "/tokens", "List API tokens", nil, nil, []localdb.Token{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				reply := new([]localdb.Token)
+				return reply, s.ListTokens(r, new(NilParam), reply)
+			}},
+		{"POST", "/tokens", "Create an API token, the reply is the only copy of its secret", nil, TokenArgs{}, "", http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(TokenArgs)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(string)
+				return reply, s.CreateToken(r, args, reply)
+			}},
+		{"DELETE", "/tokens/{name}", "Revoke an API token", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				name := vars["name"]
+				return nil, s.RevokeToken(r, &name, new(NilParam))
+			}},
+
+		// Drafts
+		{"POST", "/drafts", "Save a draft, send_at schedules it", nil, SendMsg{}, objects.Draft{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(SendMsg)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				txid := new([]byte)
+				err = s.SaveDraft(r, args, txid)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(objects.Draft)
+				return reply, s.GetDraft(r, txid, reply)
+			}},
+		{"GET", "/drafts/{txid}", "Get a draft", nil, nil, objects.Draft{}, http.StatusOK,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(objects.Draft)
+				return reply, s.GetDraft(r, &txid, reply)
+			}},
+		{"PUT", "/drafts/{txid}", "Replace a draft", nil, objects.Draft{}, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				args := new(objects.Draft)
+				err := decodeBody(body, args)
+				if err != nil {
+					return nil, err
+				}
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				args.TxidHash.FromBytes(txid)
+				return nil, s.UpdateDraft(r, args, new(NilParam))
+			}},
+		{"DELETE", "/drafts/{txid}", "Delete a draft", nil, nil, nil, http.StatusNoContent,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				return nil, s.DeleteDraft(r, &txid, new(NilParam))
+			}},
+		{"POST", "/drafts/{txid}/send", "Send a draft now", nil, nil, SendResponse{}, http.StatusCreated,
+			func(s *EMPService, r *http.Request, vars map[string]string, body []byte) (interface{}, error) {
+				txid, err := txidParam(vars)
+				if err != nil {
+					return nil, err
+				}
+				reply := new(SendResponse)
+				return reply, s.SendDraft(r, &txid, reply)
+			}},
+	}
+}
+
+// Serve the REST API under restPrefix, with the service of the profile making the request.
+func restHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := serviceFor(r)
+
+		// Checked before routing so unauthenticated clients can't probe the API.
+		if service.authorize(r, "") != nil {
+			service.Config.Log <- fmt.Sprintf("Unauthorized REST Request from: %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"EMP\"")
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		path := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, restPrefix), "/")
+
+		route, vars, allowed := matchRoute(r.Method, path)
+		if route == nil {
+			if len(allowed) > 0 {
+				w.Header().Set("Allow", strings.Join(allowed, ", "))
+				writeError(w, restError{http.StatusMethodNotAllowed, "Method not allowed"})
+			} else {
+				writeError(w, restError{http.StatusNotFound, "Not found"})
+			}
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, restError{http.StatusBadRequest, err.Error()})
+			return
+		}
+
+		reply, err := route.handle(service, r, vars, body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if route.Status == http.StatusNoContent || reply == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		status := route.Status
+		if sent, ok := reply.(*SendResponse); ok && !sent.IsSent {
+			status = http.StatusAccepted // Queued until the recipient's key arrives, or scheduled
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(reply)
+	})
+}
+
+// Find the route for a request. If only the method doesn't match, the methods
+// allowed on the path are returned.
+func matchRoute(method, path string) (*restRoute, map[string]string, []string) {
+	allowed := make([]string, 0, 0)
+	segments := strings.Split(path, "/")
+
+	for i := range restRoutes {
+		route := &restRoutes[i]
+		pattern := strings.Split(route.Path, "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+
+		vars := make(map[string]string)
+		match := true
+		for j, p := range pattern {
+			if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+				vars[p[1:len(p)-1]] = segments[j]
+			} else if p != segments[j] {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		if route.Method == method {
+			return route, vars, nil
+		}
+		allowed = append(allowed, route.Method)
+	}
+
+	return nil, nil, allowed
+}
+
+// Status code for an error returned by an EMPService method.
+func restStatus(err error) int {
+	if e, ok := err.(restError); ok {
+		return e.status
+	}
+	if err == ErrUnauthorized {
+		return http.StatusUnauthorized
+	}
+	if err == ErrForbidden {
+		return http.StatusForbidden
+	}
+	if _, ok := err.(localdb.NotFoundError); ok {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(restStatus(err))
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func decodeBody(body []byte, v interface{}) error {
+	if len(body) == 0 {
+		return nil
+	}
+
+	err := json.Unmarshal(body, v)
+	if err != nil {
+		return restError{http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %s", err)}
+	}
+	return nil
+}
+
+func txidParam(vars map[string]string) ([]byte, error) {
+	txid, err := hex.DecodeString(vars["txid"])
+	if err != nil || len(txid) != len(objects.Hash{}) {
+		return nil, restError{http.StatusNotFound, "Invalid txid_hash, must be hex encoded."}
+	}
+	return txid, nil
+}
+
+// Parse cursor (hex txid_hash), limit and order (asc or desc).
+func pageFromQuery(r *http.Request) (*localdb.Page, error) {
+	q := r.URL.Query()
+	page := new(localdb.Page)
+	var err error
+
+	if len(q.Get("cursor")) > 0 {
+		page.Cursor, err = hex.DecodeString(q.Get("cursor"))
+		if err != nil {
+			return nil, restError{http.StatusBadRequest, "Invalid cursor, must be hex encoded."}
+		}
+	}
+
+	if len(q.Get("limit")) > 0 {
+		page.Limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || page.Limit < 0 {
+			return nil, restError{http.StatusBadRequest, "Invalid limit."}
+		}
+	}
+
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		page.Ascending = true
+	default:
+		return nil, restError{http.StatusBadRequest, "Order must be asc or desc."}
+	}
+
+	return page, nil
+}
+
+// Parse filter parameters. Times are RFC 3339, booleans true or false.
+func filterFromQuery(r *http.Request) (*localdb.Filter, error) {
+	q := r.URL.Query()
+	filter := new(localdb.Filter)
+	filter.Sender = q.Get("sender")
+	filter.Recipient = q.Get("recipient")
+	filter.Tag = q.Get("tag")
+
+	if name := q.Get("box"); len(name) > 0 {
+		box, ok := boxNames[name]
+		if !ok {
+			return nil, restError{http.StatusBadRequest, "Unknown box."}
+		}
+		filter.Box = &box
+	}
+
+	if len(q.Get("folder")) > 0 {
+		folder, err := strconv.ParseInt(q.Get("folder"), 10, 64)
+		if err != nil {
+			return nil, restError{http.StatusBadRequest, "Invalid folder."}
+		}
+		filter.Folder = &folder
+	}
+
+	for name, t := range map[string]*time.Time{"after": &filter.After, "before": &filter.Before} {
+		if len(q.Get(name)) == 0 {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, q.Get(name))
+		if err != nil {
+			return nil, restError{http.StatusBadRequest, fmt.Sprintf("Invalid time for %s.", name)}
+		}
+		*t = parsed
+	}
+
+	for name, b := range map[string]**bool{"read": &filter.Read, "archived": &filter.Archived} {
+		if len(q.Get(name)) == 0 {
+			continue
+		}
+		parsed, err := strconv.ParseBool(q.Get(name))
+		if err != nil {
+			return nil, restError{http.StatusBadRequest, fmt.Sprintf("Invalid value for %s.", name)}
+		}
+		*b = &parsed
+	}
+
+	return filter, nil
+}
+
+// OpenAPI 3.0 description generated from the route table.
+func restSchema(service *EMPService) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range restRoutes {
+		op := map[string]interface{}{"summary": route.Summary}
+
+		params := make([]interface{}, 0, 0)
+		for _, segment := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				params = append(params, map[string]interface{}{
+					"name": segment[1 : len(segment)-1], "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, name := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if route.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"content": jsonContent(typeSchema(reflect.TypeOf(route.Body), schemas)),
+			}
+		}
+
+		response := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Reply != nil {
+			response["content"] = jsonContent(typeSchema(reflect.TypeOf(route.Reply), schemas))
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): response,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/Error"}),
+			},
+		}
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+
+	schemas["Error"] = map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "EMP Client API",
+			"version": strconv.Itoa(int(service.Config.LocalVersion.Version)),
+		},
+		"servers":  []interface{}{map[string]string{"url": strings.TrimSuffix(restPrefix, "/")}},
+		"paths":    paths,
+		"security": []interface{}{map[string][]string{"basic": {}}, map[string][]string{"bearer": {}}},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basic":  map[string]string{"type": "http", "scheme": "basic"},
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema of the JSON encoding of t. Named structs are added to schemas and referenced.
+func typeSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]interface{}{} // Placeholder for recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	addFields(t, properties, schemas)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// Add the JSON fields of a struct, including those of embedded structs.
+func addFields(t reflect.Type, properties, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && len(name) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addFields(embedded, properties, schemas)
+				continue
+			}
+		}
+		if len(field.PkgPath) > 0 {
+			continue // Unexported
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		properties[name] = typeSchema(field.Type, schemas)
+	}
+}
@@ -0,0 +1,154 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"quibit"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestREST(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RecvQueue = make(chan quibit.Frame, 10)
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_rest_test.db"
+	os.Remove(config.LocalDB)
+	defer os.Remove(config.LocalDB)
+
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error opening profile: ", err)
+		t.FailNow()
+	}
+	profiles = append(profiles, service)
+	defer Cleanup()
+
+	server := httptest.NewServer(restHandler())
+	defer server.Close()
+
+	token, _ := NewToken(service.Store, &TokenArgs{Name: "reader", Scopes: []string{ScopeRead}})
+
+	request := func(method, path, auth, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+restPrefix+path, strings.NewReader(body))
+		switch auth {
+		case "":
+		case "alice":
+			req.SetBasicAuth("alice", "alice pass")
+		default:
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("Error sending request: ", err)
+			t.FailNow()
+		}
+		return resp
+	}
+
+	// An unopened message for one of our addresses.
+	priv, x, y := encryption.CreateKey(config.Log)
+	detail := new(objects.AddressDetail)
+	detail.Address = encryption.GetAddress(config.Log, x, y)
+	detail.String = encryption.AddressToString(detail.Address)
+	detail.Pubkey = encryption.MarshalPubkey(x, y)
+	detail.Privkey = priv
+	detail.IsRegistered = true
+	service.Store.AddUpdateAddress(detail)
+
+	decrypted := &objects.DecryptedMessage{Subject: "Hi", MimeType: "text/plain", Length: 5, Content: "Hello"}
+	copy(decrypted.Pubkey[:], detail.Pubkey)
+	msg := new(objects.FullMessage)
+	msg.MetaMessage.TxidHash = objects.MakeHash([]byte("rest test"))
+	msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
+	msg.MetaMessage.Recipient = detail.String
+	msg.Encrypted = encryption.Encrypt(config.Log, detail.Pubkey, string(decrypted.GetPaddedBytes(0)))
+	service.Store.AddUpdateMessage(msg, localdb.INBOX)
+	txid := hex.EncodeToString(msg.MetaMessage.TxidHash.GetBytes())
+
+	for _, c := range []struct {
+		method, path, auth, body string
+		status                   int
+	}{
+		{"GET", "version", "", "", http.StatusUnauthorized},
+		{"GET", "version", "alice", "", http.StatusOK},
+		{"GET", "schema", token, "", http.StatusOK},
+		{"POST", "addresses", token, "", http.StatusForbidden},
+		{"GET", "nothing/here", "alice", "", http.StatusNotFound},
+		{"DELETE", "version", "alice", "", http.StatusMethodNotAllowed},
+		{"GET", "boxes/nobox", "alice", "", http.StatusNotFound},
+		{"GET", "messages?limit=-1", "alice", "", http.StatusBadRequest},
+		{"GET", "messages?q=%22unterminated", "alice", "", http.StatusBadRequest},
+		{"GET", "messages?q=hello", "alice", "", http.StatusOK},
+		{"GET", "messages/zz", "alice", "", http.StatusNotFound},
+		{"GET", "messages/" + strings.Repeat("00", 48), "alice", "", http.StatusNotFound},
+		{"DELETE", "folders/123", "alice", "", http.StatusNotFound},
+		{"POST", "folders", "alice", "{", http.StatusBadRequest},
+		{"POST", "folders", "alice", `{"name": "Saved"}`, http.StatusCreated},
+		{"PUT", "messages/" + txid + "/archived", "alice", `{"archived": true}`, http.StatusNoContent},
+		{"DELETE", "messages/" + txid, token, "", http.StatusForbidden},
+	} {
+		resp := request(c.method, c.path, c.auth, c.body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			fmt.Println("Wrong status for ", c.method, c.path, ": ", resp.StatusCode, c.status)
+			t.Fail()
+		}
+		if c.status == http.StatusUnauthorized && len(resp.Header.Get("WWW-Authenticate")) == 0 {
+			fmt.Println("No WWW-Authenticate header.")
+			t.Fail()
+		}
+		if c.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != "GET" {
+			fmt.Println("Wrong Allow header: ", resp.Header.Get("Allow"))
+			t.Fail()
+		}
+	}
+
+	// Getting a message doesn't open it.
+	got := new(objects.FullMessage)
+	resp := request("GET", "messages/"+txid, token, "")
+	json.NewDecoder(resp.Body).Decode(got)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || got.Decrypted == nil || got.Decrypted.Content != "Hello" {
+		fmt.Println("Error getting message: ", resp.StatusCode, got.Decrypted)
+		t.Fail()
+	}
+	if stored, _ := service.Store.GetMessageDetail(msg.MetaMessage.TxidHash); stored.Decrypted != nil || stored.MetaMessage.Purged || len(config.RecvQueue) > 0 {
+		fmt.Println("Message was opened by GET.")
+		t.Fail()
+	}
+
+	got = new(objects.FullMessage)
+	resp = request("POST", "messages/"+txid+"/open", token, "")
+	json.NewDecoder(resp.Body).Decode(got)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || got.Decrypted == nil || got.Decrypted.Content != "Hello" {
+		fmt.Println("Error opening message: ", resp.StatusCode, got.Decrypted)
+		t.Fail()
+	}
+	if stored, _ := service.Store.GetMessageDetail(msg.MetaMessage.TxidHash); stored.Decrypted == nil || len(config.RecvQueue) != 1 {
+		fmt.Println("Message wasn't opened.")
+		t.Fail()
+	}
+}
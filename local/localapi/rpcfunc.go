@@ -24,9 +24,9 @@ import (
 var logChan chan string
 
 func (service *EMPService) ForgetAddress(r *http.Request, args *string, reply *NilParam) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeAddresses); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	address := encryption.StringToAddress(*args)
@@ -36,13 +36,15 @@ func (service *EMPService) ForgetAddress(r *http.Request, args *string, reply *N
 
 	addrHash := objects.MakeHash(address)
 
-	return localdb.DeleteAddress(&addrHash)
+	err := service.Store.DeleteAddress(&addrHash)
+	service.refreshTagKeys()
+	return err
 }
 
 func (service *EMPService) ConnectionStatus(r *http.Request, args *NilParam, reply *int) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ""); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	*reply = quibit.Status()
@@ -50,9 +52,9 @@ func (service *EMPService) ConnectionStatus(r *http.Request, args *NilParam, rep
 }
 
 func (service *EMPService) GetLabel(r *http.Request, args *string, reply *string) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	var err error
@@ -64,7 +66,7 @@ func (service *EMPService) GetLabel(r *http.Request, args *string, reply *string
 
 	addrHash := objects.MakeHash(address)
 
-	detail, err := localdb.GetAddressDetail(addrHash)
+	detail, err := service.Store.GetAddressDetail(addrHash)
 	if err != nil {
 		return err
 	}
@@ -77,60 +79,80 @@ func (service *EMPService) GetLabel(r *http.Request, args *string, reply *string
 	return nil
 }
 
-func (service *EMPService) CreateAddress(r *http.Request, args *NilParam, reply *objects.AddressDetail) error {
-	if !basicAuth(service.Config, r) {
-		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
-	}
-
-	// Create Address
+// Generate a registered address and add it to store.
+func NewAddress(store *localdb.Store, log chan string) (*objects.AddressDetail, error) {
+	ret := new(objects.AddressDetail)
 
-	priv, x, y := encryption.CreateKey(service.Config.Log)
-	reply.Privkey = priv
+	priv, x, y := encryption.CreateKey(log)
+	ret.Privkey = priv
 	if x == nil {
-		return errors.New("Key Pair Generation Error")
+		return nil, errors.New("Key Pair Generation Error")
 	}
 
-	reply.Pubkey = encryption.MarshalPubkey(x, y)
+	ret.Pubkey = encryption.MarshalPubkey(x, y)
 
-	reply.IsRegistered = true
+	ret.IsRegistered = true
 
-	reply.Address = encryption.GetAddress(service.Config.Log, x, y)
+	ret.Address = encryption.GetAddress(log, x, y)
 
-	if reply.Address == nil {
-		return errors.New("Could not create address, function returned nil.")
+	if ret.Address == nil {
+		return nil, errors.New("Could not create address, function returned nil.")
 	}
 
-	reply.String = encryption.AddressToString(reply.Address)
+	ret.String = encryption.AddressToString(ret.Address)
 
 	// Add Address to Database
-	err := localdb.AddUpdateAddress(reply)
+	err := store.AddUpdateAddress(ret)
 	if err != nil {
-		service.Config.Log <- fmt.Sprintf("Error Adding Address: ", err)
-		return err
+		log <- fmt.Sprintf("Error Adding Address: %s", err)
+		return nil, err
 	}
 
-	// Send Pubkey to Network
+	return ret, nil
+}
+
+// Broadcast the encrypted public key of an address, so others can message it.
+func (service *EMPService) announceAddress(detail *objects.AddressDetail) error {
 	encPub := new(objects.EncryptedPubkey)
 
-	encPub.AddrHash = objects.MakeHash(reply.Address)
+	encPub.AddrHash = objects.MakeHash(detail.Address)
 
-	encPub.IV, encPub.Payload, err = encryption.SymmetricEncrypt(reply.Address, string(reply.Pubkey))
+	var err error
+	encPub.IV, encPub.Payload, err = encryption.SymmetricEncrypt(detail.Address, string(detail.Pubkey))
 	if err != nil {
-		service.Config.Log <- fmt.Sprintf("Error Encrypting Pubkey: ", err)
-		return nil
+		service.Config.Log <- fmt.Sprintf("Error Encrypting Pubkey: %s", err)
+		return err
 	}
 
 	// Record Pubkey for Network
 	service.Config.RecvQueue <- *objects.MakeFrame(objects.PUBKEY, objects.BROADCAST, encPub)
+	return service.Store.SetAnnounced(encPub.AddrHash, true)
+}
+
+func (service *EMPService) CreateAddress(r *http.Request, args *NilParam, reply *objects.AddressDetail) error {
+	if err := service.authorize(r, ScopeAddresses); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	detail, err := NewAddress(service.Store, service.Config.Log)
+	if err != nil {
+		return err
+	}
+	service.refreshTagKeys()
+
+	*reply = *detail
+
+	// Send Pubkey to Network
+	service.announceAddress(detail)
 	return nil
 }
 
 func (service *EMPService) GetAddress(r *http.Request, args *string, reply *objects.AddressDetail) error {
 
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeAddresses); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	var err error
@@ -142,14 +164,14 @@ func (service *EMPService) GetAddress(r *http.Request, args *string, reply *obje
 
 	addrHash := objects.MakeHash(address)
 
-	detail, err := localdb.GetAddressDetail(addrHash)
+	detail, err := service.Store.GetAddressDetail(addrHash)
 	if err != nil {
 		return err
 	}
 
 	// Check for pubkey
 	if len(detail.Pubkey) == 0 {
-		detail.Pubkey = checkPubkey(service.Config, objects.MakeHash(detail.Address))
+		detail.Pubkey = service.checkPubkey(objects.MakeHash(detail.Address))
 	}
 
 	*reply = *detail
@@ -158,28 +180,29 @@ func (service *EMPService) GetAddress(r *http.Request, args *string, reply *obje
 }
 
 func (service *EMPService) AddUpdateAddress(r *http.Request, args *objects.AddressDetail, reply *NilParam) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeAddresses); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	err := localdb.AddUpdateAddress(args)
+	err := service.Store.AddUpdateAddress(args)
 	if err != nil {
 		return err
 	}
+	service.refreshTagKeys()
 
-	checkPubkey(service.Config, objects.MakeHash(args.Address))
+	service.checkPubkey(objects.MakeHash(args.Address))
 
 	return nil
 }
 
 func (service *EMPService) ListAddresses(r *http.Request, args *bool, reply *([][2]string)) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	strs := localdb.ListAddresses(*args)
+	strs := service.Store.ListAddresses(*args)
 	*reply = strs
 	return nil
 }
@@ -14,6 +14,7 @@ package localapi
 import (
 	"crypto/ecdsa"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/msecret/emp/encryption"
@@ -25,15 +26,35 @@ import (
 )
 
 type SendMsg struct {
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
-	Subject   string `json:"subject"`
-	Plaintext string `json:"content"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	To        []string  `json:"to"`  // Additional visible recipients
+	CC        []string  `json:"cc"`  // Visible copy recipients
+	BCC       []string  `json:"bcc"` // Hidden copy recipients
+	Subject   string    `json:"subject"`
+	Plaintext string    `json:"content"`
+	MimeType  string    `json:"mime_type,omitempty"` // Type of content, text/plain if empty
+	SendAt    time.Time `json:"send_at"`             // Send at this time instead of now, if in the future
+}
+
+func (m *SendMsg) mimeType() string {
+	if len(m.MimeType) == 0 {
+		return "text/plain"
+	}
+	return m.MimeType
 }
 
 type SendResponse struct {
-	TxidHash []byte `json:"txid_hash"`
-	IsSent   bool   `json:"sent"`
+	TxidHash   []byte            `json:"txid_hash"`
+	IsSent     bool              `json:"sent"`
+	Recipients []RecipientStatus `json:"recipients,omitempty"` // Only set for messages with several recipients
+}
+
+type RecipientStatus struct {
+	Recipient string `json:"recipient"`
+	TxidHash  []byte `json:"txid_hash"`
+	IsSent    bool   `json:"sent"`
+	Failure   string `json:"failure,omitempty"` // Why the message couldn't be sent or queued
 }
 
 type PubMsg struct {
@@ -42,6 +63,27 @@ type PubMsg struct {
 	Plaintext string `json:"content"`
 }
 
+type SearchArgs struct {
+	Query  string         `json:"query"` // Full-text query on subject and content
+	Filter localdb.Filter `json:"filter"`
+	Page   localdb.Page   `json:"page"`
+}
+
+// Address with an optional page. A plain address string is accepted too.
+type AddressPage struct {
+	Address string `json:"address"`
+	localdb.Page
+}
+
+func (a *AddressPage) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &a.Address)
+	}
+
+	type plain AddressPage
+	return json.Unmarshal(data, (*plain)(a))
+}
+
 type RawMsg struct {
 	Message      objects.Message `json:"message"`
 	SendAddress  string          `json:"sender"`
@@ -49,9 +91,9 @@ type RawMsg struct {
 }
 
 func (service *EMPService) PublishMessage(r *http.Request, args *SendMsg, reply *SendResponse) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeSend); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	// Nil Check
@@ -67,7 +109,7 @@ func (service *EMPService) PublishMessage(r *http.Request, args *SendMsg, reply
 		return errors.New("Invalid sender address!")
 	}
 
-	sender, err := localdb.GetAddressDetail(objects.MakeHash(sendAddr))
+	sender, err := service.Store.GetAddressDetail(objects.MakeHash(sendAddr))
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error pulling send address from Database: %s", err))
 	}
@@ -77,53 +119,35 @@ func (service *EMPService) PublishMessage(r *http.Request, args *SendMsg, reply
 
 	// Create New Message
 	msg := new(objects.FullMessage)
-	msg.Decrypted = new(objects.DecryptedMessage)
 	msg.Encrypted = nil
 
-	txid := make([]byte, len(msg.Decrypted.Txid), cap(msg.Decrypted.Txid))
+	txid := make([]byte, 16, 16)
 
-	// Fill out decrypted message
 	n, err := rand.Read(txid)
-	if n < len(msg.Decrypted.Txid[:]) || err != nil {
+	if n < len(txid) || err != nil {
 		return errors.New(fmt.Sprintf("Problem with random reader: %s", err))
 	}
-	copy(msg.Decrypted.Pubkey[:], sender.Pubkey)
-	msg.Decrypted.Subject = args.Subject
-	msg.Decrypted.MimeType = "text/plain"
-	msg.Decrypted.Content = args.Plaintext
-	msg.Decrypted.Length = uint32(len(msg.Decrypted.Content))
 
-	// Fill Out Meta Message (save timestamp)
-	msg.MetaMessage.Purged = false
-	msg.MetaMessage.TxidHash = objects.MakeHash(txid)
-	msg.MetaMessage.Sender = sender.String
-	msg.MetaMessage.Recipient = "<Subscription Message>"
-
-	// Get Signature
-	priv := new(ecdsa.PrivateKey)
-	priv.PublicKey.Curve = encryption.GetCurve()
-	priv.D = new(big.Int)
-	priv.D.SetBytes(sender.Privkey)
-
-	sign := msg.Decrypted.GetBytes()
-	sign = sign[:len(sign)-65]
-	signHash := objects.MakeHash(sign)
-
-	x, y, err := ecdsa.Sign(rand.Reader, priv, signHash.GetBytes())
+	// Sign decrypted message without the txid
+	msg.Decrypted, err = newDecrypted(sender, args.Subject, args.mimeType(), args.Plaintext, false)
 	if err != nil {
 		return err
 	}
 
-	copy(msg.Decrypted.Signature[:], encryption.MarshalPubkey(x, y))
+	// Fill Out Meta Message (save timestamp)
+	msg.MetaMessage.Purged = false
+	msg.MetaMessage.TxidHash = objects.MakeHash(txid)
+	msg.MetaMessage.Sender = sender.String
+	msg.MetaMessage.Recipient = publicationRecipient
 
 	// Send message and add to sendbox...
-	msg.Encrypted = encryption.EncryptPub(service.Config.Log, sender.Privkey, string(msg.Decrypted.GetBytes()))
+	msg.Encrypted = encryption.EncryptPub(service.Config.Log, sender.Privkey, string(msg.Decrypted.GetPaddedBytes(service.Config.PadStep)))
 	msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
 
 	// Now Add Txid
 	copy(msg.Decrypted.Txid[:], txid)
 
-	err = localdb.AddUpdateMessage(msg, localdb.SENDBOX)
+	err = service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
 	if err != nil {
 		return err
 	}
@@ -145,45 +169,66 @@ func (service *EMPService) PublishMessage(r *http.Request, args *SendMsg, reply
 }
 
 func (service *EMPService) PurgeMessage(r *http.Request, args *[]byte, reply *NilParam) error {
+	if err := service.authorize(r, ScopeDelete); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
 	if len(*args) != 16 {
 		return errors.New("Invalid Txid: Bad Length")
 	}
 
 	txidHash := objects.MakeHash(*args)
 
-	if localdb.Contains(txidHash) <= localdb.SENDBOX {
-		msg, err := localdb.GetMessageDetail(txidHash)
+	if service.Store.Contains(txidHash) <= localdb.SENDBOX {
+		msg, err := service.Store.GetMessageDetail(txidHash)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Problem Retrieving Message: %s", err))
 		}
 		msg.MetaMessage.Purged = true
-		localdb.AddUpdateMessage(msg, -1)
+		service.Store.AddUpdateMessage(msg, -1)
+		service.publish(EventPurged, &msg.MetaMessage)
 
 		// Send Purge Request
+		txid, ok := service.purgeTxid(msg)
+		if !ok {
+			service.Config.Log <- fmt.Sprintf("Txid of %x is unknown, only purged locally.", *args)
+			return nil
+		}
 		purge := new(objects.Purge)
-		purge.Txid = msg.Decrypted.Txid
+		purge.Txid = txid
 
 		service.Config.RecvQueue <- *objects.MakeFrame(objects.PURGE, objects.BROADCAST, purge)
 
 		return nil
 	}
 
-	return errors.New("Txid Not Found")
+	return localdb.NotFoundError("Txid Not Found")
 }
 
 func (service *EMPService) DeleteMessage(r *http.Request, args *[]byte, reply *NilParam) error {
+	if err := service.authorize(r, ScopeDelete); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
 	txidHash := new(objects.Hash)
 	txidHash.FromBytes(*args)
 
-	return localdb.DeleteMessage(txidHash)
+	return service.Store.DeleteMessage(txidHash)
 }
 
 func (service *EMPService) SendRawMsg(r *http.Request, args *RawMsg, reply *NilParam) error {
+	if err := service.authorize(r, ScopeSend); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
 	if args == nil {
 		return errors.New("Cannot work with nil message object!")
 	}
 
-	detail, err := localdb.GetAddressDetail(args.Message.AddrHash)
+	detail, err := service.Store.GetAddressDetail(args.Message.AddrHash)
 	if err != nil {
 		return err
 	}
@@ -207,7 +252,7 @@ func (service *EMPService) SendRawMsg(r *http.Request, args *RawMsg, reply *NilP
 		msg.MetaMessage.Recipient = detail.String
 	}
 
-	err = localdb.AddUpdateMessage(msg, localdb.SENDBOX)
+	err = service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
 	if err != nil {
 		return err
 	}
@@ -215,6 +260,7 @@ func (service *EMPService) SendRawMsg(r *http.Request, args *RawMsg, reply *NilP
 	if args.Subscription {
 		service.Config.RecvQueue <- *objects.MakeFrame(objects.PUB, objects.BROADCAST, &(args.Message))
 	} else {
+		service.Store.SetAddrHash(msg.MetaMessage.TxidHash, args.Message.AddrHash)
 		service.Config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, &(args.Message))
 	}
 
@@ -222,13 +268,23 @@ func (service *EMPService) SendRawMsg(r *http.Request, args *RawMsg, reply *NilP
 }
 
 func (service *EMPService) SendMessage(r *http.Request, args *SendMsg, reply *SendResponse) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeSend); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
+	return service.sendMessage(args, reply)
+}
+
+// Send a message from one of our addresses. Messages with a SendAt time in the future
+// are stored as scheduled drafts, and reply.TxidHash identifies the draft.
+func (service *EMPService) sendMessage(args *SendMsg, reply *SendResponse) error {
+	to := uniqueAddresses(append([]string{args.Recipient}, args.To...))
+	cc := uniqueAddresses(args.CC)
+	bcc := uniqueAddresses(args.BCC)
+
 	// Nil Check
-	if len(args.Sender) == 0 || len(args.Recipient) == 0 || len(args.Plaintext) == 0 {
+	if len(args.Sender) == 0 || len(to)+len(cc)+len(bcc) == 0 || len(args.Plaintext) == 0 {
 		return errors.New("All fields required except signature.")
 	}
 
@@ -240,17 +296,12 @@ func (service *EMPService) SendMessage(r *http.Request, args *SendMsg, reply *Se
 		return errors.New("Invalid sender address!")
 	}
 
-	recvAddr := encryption.StringToAddress(args.Recipient)
-	if len(recvAddr) == 0 {
-		return errors.New("Invalid recipient address!")
-	}
-
-	sender, err := localdb.GetAddressDetail(objects.MakeHash(sendAddr))
+	sender, err := service.Store.GetAddressDetail(objects.MakeHash(sendAddr))
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error pulling send address from Database: %s", err))
 	}
 	if sender.Pubkey == nil {
-		sender.Pubkey = checkPubkey(service.Config, objects.MakeHash(sendAddr))
+		sender.Pubkey = service.checkPubkey(objects.MakeHash(sendAddr))
 		if sender.Pubkey == nil {
 			return errors.New("Sender's Public Key is required to send message!")
 		}
@@ -259,32 +310,77 @@ func (service *EMPService) SendMessage(r *http.Request, args *SendMsg, reply *Se
 		return errors.New("SendMsg() requires a stored private key. Use SendRawMsg() instead.")
 	}
 
-	recipient, err := localdb.GetAddressDetail(objects.MakeHash(recvAddr))
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error pulling recipient address from Database: %s", err))
+	recipients := make([]*objects.AddressDetail, 0, len(to)+len(cc)+len(bcc))
+	for _, str := range append(append(to, cc...), bcc...) {
+		recvAddr := encryption.StringToAddress(str)
+		if len(recvAddr) == 0 {
+			return errors.New(fmt.Sprintf("Invalid recipient address: %s", str))
+		}
+
+		recipient, err := service.Store.GetAddressDetail(objects.MakeHash(recvAddr))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error pulling recipient address from Database: %s", err))
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if args.SendAt.After(time.Now()) {
+		draft := newDraft(args)
+		err = service.Store.SaveDraft(draft)
+		if err != nil {
+			return err
+		}
+
+		reply.IsSent = false
+		reply.TxidHash = draft.TxidHash.GetBytes()
+		return nil
+	}
+
+	if len(recipients) > 1 {
+		return service.sendMulti(sender, recipients, to, cc, args, reply)
 	}
 
 	// Create New Message
 	msg := new(objects.FullMessage)
-	msg.Decrypted = new(objects.DecryptedMessage)
 	msg.Encrypted = nil
-
-	// Fill out decrypted message
-	n, err := rand.Read(msg.Decrypted.Txid[:])
-	if n < len(msg.Decrypted.Txid[:]) || err != nil {
-		return errors.New(fmt.Sprintf("Problem with random reader: %s", err))
+	msg.Decrypted, err = newDecrypted(sender, args.Subject, args.mimeType(), args.Plaintext, true)
+	if err != nil {
+		return err
 	}
-	copy(msg.Decrypted.Pubkey[:], sender.Pubkey)
-	msg.Decrypted.Subject = args.Subject
-	msg.Decrypted.MimeType = "text/plain"
-	msg.Decrypted.Content = args.Plaintext
-	msg.Decrypted.Length = uint32(len(msg.Decrypted.Content))
 
 	// Fill Out Meta Message (save timestamp)
 	msg.MetaMessage.Purged = false
 	msg.MetaMessage.TxidHash = objects.MakeHash(msg.Decrypted.Txid[:])
 	msg.MetaMessage.Sender = sender.String
-	msg.MetaMessage.Recipient = recipient.String
+	msg.MetaMessage.Recipient = recipients[0].String
+
+	reply.IsSent, err = service.sendTo(msg, recipients[0])
+	if err != nil {
+		return err
+	}
+
+	// Finish by setting msg's txid
+	reply.TxidHash = msg.MetaMessage.TxidHash.GetBytes()
+	return nil
+}
+
+// Create a new message from sender with a random Txid, and sign it.
+// If withTxid is false, the Txid is left empty while signing, as for publications.
+func newDecrypted(sender *objects.AddressDetail, subject, mimeType, content string, withTxid bool) (*objects.DecryptedMessage, error) {
+	ret := new(objects.DecryptedMessage)
+
+	// Fill out decrypted message
+	if withTxid {
+		n, err := rand.Read(ret.Txid[:])
+		if n < len(ret.Txid[:]) || err != nil {
+			return nil, errors.New(fmt.Sprintf("Problem with random reader: %s", err))
+		}
+	}
+	copy(ret.Pubkey[:], sender.Pubkey)
+	ret.Subject = subject
+	ret.MimeType = mimeType
+	ret.Content = content
+	ret.Length = uint32(len(ret.Content))
 
 	// Get Signature
 	priv := new(ecdsa.PrivateKey)
@@ -292,117 +388,192 @@ func (service *EMPService) SendMessage(r *http.Request, args *SendMsg, reply *Se
 	priv.D = new(big.Int)
 	priv.D.SetBytes(sender.Privkey)
 
-	sign := msg.Decrypted.GetBytes()
+	sign := ret.GetBytes()
 	sign = sign[:len(sign)-65]
 	signHash := objects.MakeHash(sign)
 
 	x, y, err := ecdsa.Sign(rand.Reader, priv, signHash.GetBytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	copy(msg.Decrypted.Signature[:], encryption.MarshalPubkey(x, y))
+	copy(ret.Signature[:], encryption.MarshalPubkey(x, y))
+	return ret, nil
+}
 
+// Encrypt and broadcast msg, moving it to the sendbox. If the recipient's public key
+// isn't known yet, msg is stored in the outbox and sent when the key arrives.
+// Returns whether the message was sent.
+func (service *EMPService) sendTo(msg *objects.FullMessage, recipient *objects.AddressDetail) (bool, error) {
 	// Check for pubkey
 	if recipient.Pubkey == nil {
-		recipient.Pubkey = checkPubkey(service.Config, objects.MakeHash(recipient.Address))
+		recipient.Pubkey = service.checkPubkey(objects.MakeHash(recipient.Address))
 	}
 
 	if recipient.Pubkey == nil {
-		reply.IsSent = false
-		// Add message to outbox...
-		err = localdb.AddUpdateMessage(msg, localdb.OUTBOX)
+		// Add message to outbox, the deadline for delivery starts now. checkPubkey() just
+		// requested the key, so the next request is due after the retry interval...
+		msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
+		err := service.Store.AddUpdateMessage(msg, localdb.OUTBOX)
 		if err != nil {
-			return err
+			return false, err
 		}
+		return false, service.Store.SetRetry(msg.MetaMessage.TxidHash, 0, msg.MetaMessage.Timestamp.Add(service.Config.OutboxRetry))
+	}
 
-	} else {
-		// Send message and add to sendbox...
-		msg.Encrypted = encryption.Encrypt(service.Config.Log, recipient.Pubkey, string(msg.Decrypted.GetBytes()))
-		msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
+	// Send message and add to sendbox...
+	sendMsg := new(objects.Message)
+	encryptTo(service.Config, sendMsg, msg, recipient.Address, recipient.Pubkey)
+	msg.MetaMessage.Timestamp = time.Now().Round(time.Second)
 
-		err = localdb.AddUpdateMessage(msg, localdb.SENDBOX)
-		if err != nil {
-			return err
+	err := service.Store.AddUpdateMessage(msg, localdb.SENDBOX)
+	if err != nil {
+		return false, err
+	}
+	service.Store.SetAddrHash(msg.MetaMessage.TxidHash, sendMsg.AddrHash)
+
+	sendMsg.TxidHash = msg.MetaMessage.TxidHash
+	sendMsg.Timestamp = msg.MetaMessage.Timestamp
+
+	service.Config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, sendMsg)
+	service.publish(EventSent, &msg.MetaMessage)
+	return true, nil
+}
+
+// Remove empty and duplicate addresses, keeping the order.
+func uniqueAddresses(addrs []string) []string {
+	ret := make([]string, 0, len(addrs))
+	seen := make(map[string]bool)
+
+	for _, addr := range addrs {
+		if len(addr) == 0 || seen[addr] {
+			continue
 		}
+		seen[addr] = true
+		ret = append(ret, addr)
+	}
 
-		sendMsg := new(objects.Message)
-		sendMsg.TxidHash = msg.MetaMessage.TxidHash
-		sendMsg.AddrHash = objects.MakeHash(recipient.Address)
-		sendMsg.Timestamp = msg.MetaMessage.Timestamp
-		sendMsg.Content = *msg.Encrypted
+	return ret
+}
 
-		service.Config.RecvQueue <- *objects.MakeFrame(objects.MSG, objects.BROADCAST, sendMsg)
+// Search decrypted messages, newest first. Encrypted messages only match if the query is empty.
+func (service *EMPService) SearchMessages(r *http.Request, args *SearchArgs, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
 
-		reply.IsSent = true
+	list, err := service.Store.SearchMessages(args.Query, &args.Filter, &args.Page)
+	if err != nil {
+		return err
 	}
 
-	// Finish by setting msg's txid
-	reply.TxidHash = msg.MetaMessage.TxidHash.GetBytes()
+	*reply = list
 	return nil
 }
 
-func (service *EMPService) ListMessagesBySender(r *http.Request, args *string, reply *[]objects.MetaMessage) error {
-	if !basicAuth(service.Config, r) {
+func (service *EMPService) ListMessagesBySender(r *http.Request, args *AddressPage, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	*reply = localdb.GetBySender(*args)
+	list, err := service.Store.SearchMessages("", &localdb.Filter{Sender: args.Address}, &args.Page)
+	if err != nil {
+		return err
+	}
+
+	*reply = list
 	return nil
 }
 
-func (service *EMPService) ListMessagesByRecpient(r *http.Request, args *string, reply *[]objects.MetaMessage) error {
-	if !basicAuth(service.Config, r) {
+func (service *EMPService) ListMessagesByRecpient(r *http.Request, args *AddressPage, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	*reply = localdb.GetByRecipient(*args)
+	list, err := service.Store.SearchMessages("", &localdb.Filter{Recipient: args.Address}, &args.Page)
+	if err != nil {
+		return err
+	}
+
+	*reply = list
 	return nil
 }
 
-func (service *EMPService) Inbox(r *http.Request, args *NilParam, reply *[]objects.MetaMessage) error {
-	if !basicAuth(service.Config, r) {
+func (service *EMPService) Inbox(r *http.Request, args *localdb.Page, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	*reply = localdb.GetBox(localdb.INBOX)
+	// Archived messages are left out
+	box := localdb.INBOX
+	archived := false
+	list, err := service.Store.SearchMessages("", &localdb.Filter{Box: &box, Archived: &archived}, args)
+	if err != nil {
+		return err
+	}
+
+	*reply = list
 	return nil
 }
 
-func (service *EMPService) Outbox(r *http.Request, args *NilParam, reply *[]objects.MetaMessage) error {
-	if !basicAuth(service.Config, r) {
+func (service *EMPService) Outbox(r *http.Request, args *localdb.Page, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
-	*reply = localdb.GetBox(localdb.OUTBOX)
+	box := localdb.OUTBOX
+	list, err := service.Store.SearchMessages("", &localdb.Filter{Box: &box}, args)
+	if err != nil {
+		return err
+	}
+
+	*reply = list
 	return nil
 }
 
-func (service *EMPService) Sendbox(r *http.Request, args *NilParam, reply *[]objects.MetaMessage) error {
-	if !basicAuth(service.Config, r) {
+func (service *EMPService) Sendbox(r *http.Request, args *localdb.Page, reply *[]objects.MetaMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
+	}
+
+	box := localdb.SENDBOX
+	list, err := service.Store.SearchMessages("", &localdb.Filter{Box: &box}, args)
+	if err != nil {
+		return err
 	}
 
-	*reply = localdb.GetBox(localdb.SENDBOX)
+	*reply = list
+	return nil
+}
+
+// Count total and unread messages in each box and folder.
+func (service *EMPService) MessageCounts(r *http.Request, args *NilParam, reply *localdb.Counts) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	*reply = *service.Store.GetCounts()
 	return nil
 }
 
 func (service *EMPService) GetEncrypted(r *http.Request, args *[]byte, reply *encryption.EncryptedMessage) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	var txidHash objects.Hash
 	txidHash.FromBytes(*args)
 
 	// Get Message from Database
-	msg, err := localdb.GetMessageDetail(txidHash)
+	msg, err := service.Store.GetMessageDetail(txidHash)
 	if err != nil {
 		return err
 	}
@@ -412,45 +583,106 @@ func (service *EMPService) GetEncrypted(r *http.Request, args *[]byte, reply *en
 }
 
 func (service *EMPService) OpenMessage(r *http.Request, args *[]byte, reply *objects.FullMessage) error {
-	if !basicAuth(service.Config, r) {
+	if err := service.authorize(r, ScopeRead); err != nil {
 		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
-		return errors.New("Unauthorized")
+		return err
 	}
 
 	var txidHash objects.Hash
 	txidHash.FromBytes(*args)
 
-	// Get Message from Database
-	msg, err := localdb.GetMessageDetail(txidHash)
+	msg, err := service.openMessage(txidHash)
 	if err != nil {
 		return err
 	}
 
+	*reply = *msg
+	return nil
+}
+
+// Get a message without marking it as read. Unopened messages are decrypted if they
+// can be, but neither stored decrypted nor purged.
+func (service *EMPService) PeekMessage(r *http.Request, args *[]byte, reply *objects.FullMessage) error {
+	if err := service.authorize(r, ScopeRead); err != nil {
+		service.Config.Log <- fmt.Sprintf("Unauthorized RPC Request from: %s", r.RemoteAddr)
+		return err
+	}
+
+	var txidHash objects.Hash
+	txidHash.FromBytes(*args)
+
+	msg, err := service.peekMessage(txidHash)
+	if err != nil {
+		return err
+	}
+
+	*reply = *msg
+	return nil
+}
+
+// Load a message, decrypting it without storing the result or sending the purge.
+func (service *EMPService) peekMessage(txidHash objects.Hash) (*objects.FullMessage, error) {
+	msg, err := service.Store.GetMessageDetail(txidHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Decrypted == nil && msg.Encrypted != nil {
+		recipient, err := service.Store.GetAddressDetail(objects.MakeHash(encryption.StringToAddress(msg.MetaMessage.Recipient)))
+		if err == nil && recipient.Privkey != nil {
+			decrypted := encryption.Decrypt(service.Config.Log, recipient.Privkey, msg.Encrypted)
+			if len(decrypted) > 0 {
+				msg.Decrypted = new(objects.DecryptedMessage)
+				msg.Decrypted.FromPaddedBytes(decrypted)
+			}
+		}
+	}
+
+	// The key wrap is kept if the shared body hasn't arrived yet
+	if msg.Decrypted != nil && msg.Decrypted.MimeType == objects.MultiMimeType {
+		expandMulti(service.Config, msg)
+	}
+
+	return msg, nil
+}
+
+// Load a message, decrypting it and sending the purge if it hasn't been opened yet.
+func (service *EMPService) openMessage(txidHash objects.Hash) (*objects.FullMessage, error) {
+	// Get Message from Database
+	msg, err := service.Store.GetMessageDetail(txidHash)
+	if err != nil {
+		return nil, err
+	}
+
 	if msg.Encrypted == nil {
-		*reply = *msg
-		return nil
+		return msg, nil
 	}
 
 	// If not decrypted, decrypt message and purge
 	if msg.Decrypted == nil {
-		recipient, err := localdb.GetAddressDetail(objects.MakeHash(encryption.StringToAddress(msg.MetaMessage.Recipient)))
+		recipient, err := service.Store.GetAddressDetail(objects.MakeHash(encryption.StringToAddress(msg.MetaMessage.Recipient)))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if recipient.Privkey == nil {
-			*reply = *msg
-			return nil
+			return msg, nil
 		}
 
 		// Decrypt Message
 		decrypted := encryption.Decrypt(service.Config.Log, recipient.Privkey, msg.Encrypted)
 		if len(decrypted) == 0 {
-			*reply = *msg
-			return nil
+			return msg, nil
 		}
 		msg.Decrypted = new(objects.DecryptedMessage)
-		msg.Decrypted.FromBytes(decrypted)
+		msg.Decrypted.FromPaddedBytes(decrypted)
+		txid := msg.Decrypted.Txid
+
+		// Pull shared body, don't purge until it has arrived
+		err = expandMulti(service.Config, msg)
+		if err != nil {
+			return nil, err
+		}
 
 		// Update Sender
 
@@ -459,7 +691,7 @@ func (service *EMPService) OpenMessage(r *http.Request, args *[]byte, reply *obj
 		addrStr := encryption.AddressToString(address)
 		addrHash := objects.MakeHash(address)
 
-		detail, _ := localdb.GetAddressDetail(addrHash)
+		detail, _ := service.Store.GetAddressDetail(addrHash)
 		if detail == nil {
 			detail = new(objects.AddressDetail)
 		}
@@ -467,24 +699,32 @@ func (service *EMPService) OpenMessage(r *http.Request, args *[]byte, reply *obj
 		detail.String = addrStr
 		detail.Pubkey = msg.Decrypted.Pubkey[:]
 
-		localdb.AddUpdateAddress(detail)
+		service.Store.AddUpdateAddress(detail)
 		msg.MetaMessage.Sender = detail.String
 
 		// Send Purge Request
 		purge := new(objects.Purge)
-		purge.Txid = msg.Decrypted.Txid
+		purge.Txid = txid
 
 		service.Config.RecvQueue <- *objects.MakeFrame(objects.PURGE, objects.BROADCAST, purge)
 		msg.MetaMessage.Purged = true
 
-		localdb.AddUpdateMessage(msg, localdb.Contains(msg.MetaMessage.TxidHash))
+		service.Store.AddUpdateMessage(msg, service.Store.Contains(msg.MetaMessage.TxidHash))
+		service.publish(EventPurged, &msg.MetaMessage)
 	} else {
-		if msg.MetaMessage.Purged == false && localdb.Contains(txidHash) == localdb.INBOX {
+		// Store the shared body in place of the key wrap, if there is one. Outbox copies
+		// must keep the key wrap until they are encrypted
+		wrapped := msg.Decrypted != nil && msg.Decrypted.MimeType == objects.MultiMimeType
+		if wrapped && expandMulti(service.Config, msg) == nil && service.Store.Contains(txidHash) != localdb.OUTBOX {
+			service.Store.AddUpdateMessage(msg, service.Store.Contains(msg.MetaMessage.TxidHash))
+		}
+
+		if msg.MetaMessage.Purged == false && service.Store.Contains(txidHash) == localdb.INBOX {
 			msg.MetaMessage.Purged = true
-			localdb.AddUpdateMessage(msg, localdb.Contains(msg.MetaMessage.TxidHash))
+			service.Store.AddUpdateMessage(msg, service.Store.Contains(msg.MetaMessage.TxidHash))
+			service.publish(EventPurged, &msg.MetaMessage)
 		}
 	}
 
-	*reply = *msg
-	return nil
+	return msg, nil
 }
@@ -0,0 +1,124 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/local/smtpd"
+	"github.com/msecret/emp/objects"
+	"net"
+	"os"
+)
+
+// Sends mail submitted over SMTP. The SMTP username is the sending address, or the
+// label of one, and the password is the RPC password of the profile holding it or a
+// token of that profile with the send scope.
+type smtpBackend struct{}
+
+func (b *smtpBackend) Authenticate(username, password string) (string, error) {
+	err := ErrUnauthorized
+
+	for _, service := range profiles {
+		if len(service.Config.RPCPass) == 0 || subtle.ConstantTimeCompare([]byte(password), []byte(service.Config.RPCPass)) != 1 {
+			e := service.checkToken(password, ScopeSend)
+			if e != nil {
+				if e != ErrUnauthorized {
+					err = e
+				}
+				continue
+			}
+		}
+
+		for _, detail := range service.Store.ListRegisteredKeys() {
+			if detail.String == username || (len(detail.Label) > 0 && detail.Label == username) {
+				return detail.String, nil
+			}
+		}
+		err = errors.New("Sender not found!")
+	}
+
+	return "", err
+}
+
+func (b *smtpBackend) Send(msg *smtpd.Message) error {
+	args := new(SendMsg)
+	args.Sender = msg.Sender
+	args.To = msg.To
+	args.CC = msg.CC
+	args.BCC = msg.BCC
+	args.Subject = msg.Subject
+	args.Plaintext = msg.Body
+	args.MimeType = msg.MimeType
+
+	recipients := append(append(msg.To, msg.CC...), msg.BCC...)
+	for _, address := range recipients {
+		if len(encryption.StringToAddress(address)) == 0 {
+			return errors.New(fmt.Sprintf("Invalid recipient address: %s", address))
+		}
+	}
+
+	// Sent from the profile with the sender's private key
+	sendHash := objects.MakeHash(encryption.StringToAddress(msg.Sender))
+	for _, service := range profiles {
+		detail, err := service.Store.GetAddressDetail(sendHash)
+		if err == nil && detail.Privkey != nil {
+			// Mail can go to any EMP address, save unknown ones like the web client does.
+			for _, address := range recipients {
+				err = service.addContact(address)
+				if err != nil {
+					return err
+				}
+			}
+			return service.sendMessage(args, new(SendResponse))
+		}
+	}
+	return errors.New("Sender not found!")
+}
+
+// Save an address to the addressbook unless it's already there. Its public key is
+// requested when a message is sent to it.
+func (service *EMPService) addContact(address string) error {
+	detail := new(objects.AddressDetail)
+	detail.String = address
+	detail.Address = encryption.StringToAddress(address)
+	addrHash := objects.MakeHash(detail.Address)
+
+	if _, err := service.Store.GetAddressDetail(addrHash); err == nil {
+		return nil
+	}
+
+	return service.Store.AddUpdateAddress(detail)
+}
+
+// Accept mail from local SMTP clients on config.SMTPListen, over TLS if tlsConf is set.
+func smtpServer(config *api.ApiConfig, tlsConf *tls.Config) error {
+	l, err := net.Listen("tcp", config.SMTPListen)
+	if err != nil {
+		config.Log <- fmt.Sprintf("SMTP Listen Error: %s", err)
+		return err
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	hostname, _ := os.Hostname()
+	server := &smtpd.Server{Domain: config.SMTPDomain, Hostname: hostname, Backend: &smtpBackend{}, Log: config.Log}
+
+	config.Log <- fmt.Sprintf("Started SMTP Gateway on: %s", config.SMTPListen)
+	go server.Serve(l)
+	return nil
+}
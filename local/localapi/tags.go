@@ -0,0 +1,65 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bytes"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+)
+
+// Reload the registered keys from the local database. Must be called whenever
+// an address is added, changed or forgotten.
+func (service *EMPService) refreshTagKeys() {
+	keys := service.Store.ListRegisteredKeys()
+
+	service.tagMutex.Lock()
+	service.tagKeys = keys
+	service.tagMutex.Unlock()
+}
+
+// Find the registered address a message with a blinded recipient tag is meant for.
+// Returns nil if the message isn't for any local address.
+func (service *EMPService) matchTag(message *objects.Message) *objects.AddressDetail {
+	// Copy the keys so refreshTagKeys() isn't blocked while we do the point multiplications.
+	service.tagMutex.Lock()
+	keys := make([]objects.AddressDetail, len(service.tagKeys))
+	copy(keys, service.tagKeys)
+	service.tagMutex.Unlock()
+
+	for i := range keys {
+		tag := encryption.RecipientTag(keys[i].Privkey, &message.Content)
+		if bytes.Equal(tag, message.AddrHash.GetBytes()) {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
+
+// Encrypt a message to the given public key and set the recipient tag on the
+// outgoing network message, blinded if enabled in the config.
+func encryptTo(config *api.ApiConfig, sendMsg *objects.Message, msg *objects.FullMessage, recvAddr, pubkey []byte) {
+	padded := msg.Decrypted.GetPaddedBytes(config.PadStep)
+	recordPadded(len(padded))
+
+	if config.BlindTags {
+		var tag []byte
+		msg.Encrypted, tag = encryption.EncryptTagged(config.Log, pubkey, string(padded))
+		sendMsg.AddrHash.FromBytes(tag)
+	} else {
+		msg.Encrypted = encryption.Encrypt(config.Log, pubkey, string(padded))
+		sendMsg.AddrHash = objects.MakeHash(recvAddr)
+	}
+	sendMsg.Content = *msg.Encrypted
+}
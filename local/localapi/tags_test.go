@@ -0,0 +1,85 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"os"
+	"testing"
+)
+
+func TestMatchTag(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.RPCUser, config.RPCPass, config.LocalDB = "alice", "alice pass", os.TempDir()+"/emp_tags_test.db"
+	os.Remove(config.LocalDB)
+	defer os.Remove(config.LocalDB)
+
+	profile, _ := config.GetProfile(api.DefaultProfile)
+	service, err := newService(config, *profile)
+	if err != nil {
+		fmt.Println("Error opening profile: ", err)
+		t.FailNow()
+	}
+	defer service.Store.Close()
+
+	details := make([]*objects.AddressDetail, 3)
+	for i := range details {
+		priv, x, y := encryption.CreateKey(config.Log)
+		details[i] = new(objects.AddressDetail)
+		details[i].Address = encryption.GetAddress(config.Log, x, y)
+		details[i].String = encryption.AddressToString(details[i].Address)
+		details[i].Pubkey = encryption.MarshalPubkey(x, y)
+		details[i].Privkey = priv
+		details[i].IsRegistered = true
+		service.Store.AddUpdateAddress(details[i])
+	}
+	service.refreshTagKeys()
+
+	// Keys may be reloaded while messages are matched.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			service.refreshTagKeys()
+		}
+		done <- true
+	}()
+
+	for _, detail := range details {
+		msg := new(objects.Message)
+		enc, tag := encryption.EncryptTagged(config.Log, detail.Pubkey, "Hello")
+		msg.Content = *enc
+		msg.AddrHash.FromBytes(tag)
+
+		match := service.matchTag(msg)
+		if match == nil || match.String != detail.String {
+			fmt.Println("Wrong address matched: ", match)
+			t.Fail()
+		}
+	}
+
+	// Tagged for a key we don't hold.
+	_, x, y := encryption.CreateKey(config.Log)
+	msg := new(objects.Message)
+	enc, tag := encryption.EncryptTagged(config.Log, encryption.MarshalPubkey(x, y), "Hello")
+	msg.Content = *enc
+	msg.AddrHash.FromBytes(tag)
+	if match := service.matchTag(msg); match != nil {
+		fmt.Println("Tag for another key matched: ", match.String)
+		t.Fail()
+	}
+
+	<-done
+}
@@ -0,0 +1,132 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Lifetime of generated self-signed certificates.
+const selfSignedLifetime = 5 * 365 * 24 * time.Hour
+
+// Load the RPC server certificate, generating a self-signed one if neither the
+// certificate nor the key exist. If a client CA is configured, clients must present
+// a certificate it signed, in addition to their credentials.
+func tlsConfig(config *api.ApiConfig) (*tls.Config, error) {
+	_, certErr := os.Stat(config.TLSCert)
+	_, keyErr := os.Stat(config.TLSKey)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		config.Log <- fmt.Sprintf("Generating self-signed RPC certificate at %s", config.TLSCert)
+		err := generateCert(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config.Log <- fmt.Sprintf("RPC certificate SHA-256 fingerprint: %s", fingerprint(cert.Certificate[0]))
+
+	ret := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if len(config.TLSClientCA) > 0 {
+		pemData, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", config.TLSClientCA))
+		}
+
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return ret, nil
+}
+
+// Create a self-signed P-256 certificate for localhost, and write it and its key as PEM.
+func generateCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "EMP Local Client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if len(hostname) > 0 && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// SHA-256 of a DER certificate as colon-separated hex, the format browsers show.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
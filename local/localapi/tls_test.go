@@ -0,0 +1,174 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emp_tls")
+	if err != nil {
+		fmt.Println("Error creating directory: ", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.TLS = true
+	config.TLSCert = dir + "/rpc.crt"
+	config.TLSKey = dir + "/rpc.key"
+
+	serverConf, err := tlsConfig(config)
+	if err != nil {
+		fmt.Println("Error generating certificate: ", err)
+		t.FailNow()
+	}
+	first := fingerprint(serverConf.Certificates[0].Certificate[0])
+
+	// The generated certificate is reused
+	serverConf, err = tlsConfig(config)
+	if err != nil || fingerprint(serverConf.Certificates[0].Certificate[0]) != first {
+		fmt.Println("Certificate regenerated: ", err)
+		t.Fail()
+	}
+
+	info, err := os.Stat(config.TLSKey)
+	if err != nil || info.Mode().Perm() != 0600 {
+		fmt.Println("Private key readable by others: ", info.Mode())
+		t.Fail()
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		fmt.Println("Error listening: ", err)
+		t.FailNow()
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		fmt.Println("Error connecting: ", err)
+		t.FailNow()
+	}
+	if fingerprint(conn.ConnectionState().PeerCertificates[0].Raw) != first {
+		fmt.Println("Server presented the wrong certificate.")
+		t.Fail()
+	}
+	conn.Close()
+
+	// Clients must present a certificate once a client CA is configured
+	config.TLSClientCA = config.TLSCert
+	serverConf, err = tlsConfig(config)
+	if err != nil || serverConf.ClientAuth != tls.RequireAndVerifyClientCert {
+		fmt.Println("Client certificates not required: ", err)
+		t.Fail()
+	}
+
+	config.TLSClientCA = dir + "/missing.pem"
+	_, err = tlsConfig(config)
+	if err == nil {
+		fmt.Println("Missing client CA accepted.")
+		t.Fail()
+	}
+}
+
+// Address of a free local port.
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return ""
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestMailTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emp_tls")
+	if err != nil {
+		fmt.Println("Error creating directory: ", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+	config.TLS = true
+	config.TLSCert = dir + "/rpc.crt"
+	config.TLSKey = dir + "/rpc.key"
+
+	tlsConf, err := tlsConfig(config)
+	if err != nil {
+		fmt.Println("Error generating certificate: ", err)
+		t.FailNow()
+	}
+
+	// Listen errors are returned.
+	config.SMTPListen = "256.0.0.1:25"
+	if smtpServer(config, tlsConf) == nil {
+		fmt.Println("SMTP listen error ignored.")
+		t.Fail()
+	}
+
+	config.SMTPListen = freeAddr()
+	if err := smtpServer(config, tlsConf); err != nil {
+		fmt.Println("Error starting SMTP server: ", err)
+		t.FailNow()
+	}
+
+	config.IMAPListen = "256.0.0.1:143"
+	if imapServer(config, tlsConf) == nil {
+		fmt.Println("IMAP listen error ignored.")
+		t.Fail()
+	}
+
+	config.IMAPListen = freeAddr()
+	if err := imapServer(config, tlsConf); err != nil {
+		fmt.Println("Error starting IMAP server: ", err)
+		t.FailNow()
+	}
+
+	for name, addr := range map[string]string{"SMTP": config.SMTPListen, "IMAP": config.IMAPListen} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			fmt.Println(name, " not served over TLS: ", err)
+			t.Fail()
+			continue
+		}
+		greeting, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.HasPrefix(greeting, "220 ") && !strings.HasPrefix(greeting, "* OK") {
+			fmt.Println(name, " greeting over TLS: ", greeting)
+			t.Fail()
+		}
+	}
+}
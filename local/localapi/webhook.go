@@ -0,0 +1,226 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Deliveries are retried webhookAttempts times, waiting webhookRetry after the first
+// failure and doubling the wait after each one. At most webhookQueueLen events wait
+// for each webhook, the oldest are dropped when more arrive.
+var (
+	webhookAttempts = 6
+	webhookRetry    = 10 * time.Second
+	webhookQueueLen = 1024
+	webhookClient   = &http.Client{Timeout: 30 * time.Second}
+)
+
+type WebhookContent struct {
+	Subject  string `json:"subject"`
+	MimeType string `json:"mime_type"`
+	Content  string `json:"content"`
+}
+
+type WebhookPayload struct {
+	Event     string              `json:"event"`
+	Timestamp time.Time           `json:"time"`
+	Message   objects.MetaMessage `json:"message"`
+	Content   *WebhookContent     `json:"content,omitempty"`
+}
+
+// Events waiting for delivery to one webhook. Push never blocks, and drops the oldest
+// event if webhookQueueLen are waiting. Pop waits for the next event.
+type webhookQueue struct {
+	hook    api.Webhook
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	events  []Event
+	dropped int // Events dropped since the last pop
+}
+
+func newWebhookQueue(hook api.Webhook) *webhookQueue {
+	q := &webhookQueue{hook: hook}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *webhookQueue) push(e Event) {
+	q.mutex.Lock()
+	if len(q.events) >= webhookQueueLen {
+		q.events = q.events[1:]
+		q.dropped++
+	}
+	q.events = append(q.events, e)
+	q.mutex.Unlock()
+	q.cond.Signal()
+}
+
+// Next event, and the number of events dropped before it.
+func (q *webhookQueue) pop() (Event, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.events) == 0 {
+		q.cond.Wait()
+	}
+	e := q.events[0]
+	q.events = q.events[1:]
+
+	dropped := q.dropped
+	q.dropped = 0
+	return e, dropped
+}
+
+// Start a worker for each configured webhook, so a slow or failing one only delays
+// its own events.
+func (service *EMPService) startWebhooks() {
+	for _, hook := range service.Config.Webhooks {
+		q := newWebhookQueue(hook)
+		service.hookQueues = append(service.hookQueues, q)
+		go service.deliverWebhooks(q)
+	}
+}
+
+// Queue a mailbox event for every webhook that wants it. Called by publish().
+func (service *EMPService) queueWebhooks(e Event) {
+	if e.Message == nil {
+		return
+	}
+	if e.Type != EventMessage && e.Type != EventPublication && e.Type != EventPurged {
+		return
+	}
+
+	for _, q := range service.hookQueues {
+		if hookWants(q.hook, e.Type) {
+			q.push(e)
+		}
+	}
+}
+
+// Deliver the events in q in order. Only purges of our own sent messages are
+// forwarded, not messages we've read.
+func (service *EMPService) deliverWebhooks(q *webhookQueue) {
+	for {
+		e, dropped := q.pop()
+		if dropped > 0 {
+			service.Config.Log <- fmt.Sprintf("Webhook %s is too slow, dropped %d events.", q.hook.URL, dropped)
+		}
+		if e.Type == EventPurged && service.Store.Contains(e.Message.TxidHash) != localdb.SENDBOX {
+			continue
+		}
+
+		payload := WebhookPayload{e.Type, e.Timestamp, *e.Message, nil}
+		if q.hook.Content {
+			payload.Content = service.peekContent(e.Message.TxidHash)
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			service.Config.Log <- fmt.Sprintf("Error encoding webhook payload: %s", err)
+			continue
+		}
+
+		deliverWithRetry(service.Config, q.hook, e.Type, body)
+	}
+}
+
+func hookWants(hook api.Webhook, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt a message for a webhook without marking it as read.
+func (service *EMPService) peekContent(txidHash objects.Hash) *WebhookContent {
+	msg, err := service.peekMessage(txidHash)
+	if err != nil || msg.Decrypted == nil || msg.Decrypted.MimeType == objects.MultiMimeType {
+		return nil
+	}
+
+	return &WebhookContent{msg.Decrypted.Subject, msg.Decrypted.MimeType, msg.Decrypted.Content}
+}
+
+// Hex HMAC-SHA256 of the X-EMP-Timestamp header, a period and body, sent in the
+// X-EMP-Signature header as "sha256=<hmac>". Signing the time lets receivers refuse
+// old deliveries replayed to them.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST body to a webhook once, signed with the current time. Any 2xx response is a success.
+func deliver(hook api.Webhook, eventType string, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-EMP-Event", eventType)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-EMP-Timestamp", timestamp)
+	req.Header.Set("X-EMP-Signature", webhookSignature(hook.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Webhook returned %s", resp.Status))
+	}
+	return nil
+}
+
+func deliverWithRetry(config *api.ApiConfig, hook api.Webhook, eventType string, body []byte) bool {
+	delay := webhookRetry
+
+	for attempt := 1; ; attempt++ {
+		err := deliver(hook, eventType, body)
+		if err == nil {
+			return true
+		}
+
+		if attempt >= webhookAttempts {
+			config.Log <- fmt.Sprintf("Webhook delivery to %s failed, giving up: %s", hook.URL, err)
+			return false
+		}
+
+		config.Log <- fmt.Sprintf("Webhook delivery to %s failed, retrying in %s: %s", hook.URL, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,167 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/objects"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+
+	webhookRetry = time.Millisecond
+
+	var attempts int
+	var body []byte
+	var signature, event, timestamp string
+
+	// Fails twice before accepting the delivery
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-EMP-Signature")
+		timestamp = r.Header.Get("X-EMP-Timestamp")
+		event = r.Header.Get("X-EMP-Event")
+	}))
+	defer server.Close()
+
+	hook := api.Webhook{URL: server.URL, Secret: "secret"}
+
+	payload := WebhookPayload{Event: EventMessage, Timestamp: time.Now()}
+	payload.Message.TxidHash = objects.MakeHash([]byte("txid"))
+	payload.Message.Sender = "sender"
+	sent, _ := json.Marshal(payload)
+
+	if !deliverWithRetry(config, hook, EventMessage, sent) {
+		fmt.Println("Webhook delivery failed.")
+		t.FailNow()
+	}
+	if attempts != 3 {
+		fmt.Println("Wrong number of attempts: ", attempts)
+		t.Fail()
+	}
+	if event != EventMessage || signature != webhookSignature("secret", timestamp, body) || signature == webhookSignature("other", timestamp, body) {
+		fmt.Println("Invalid webhook headers: ", event, signature)
+		t.Fail()
+	}
+
+	// The signature covers the delivery time, so it can't be replayed with a new one.
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		fmt.Println("Invalid webhook timestamp: ", timestamp)
+		t.Fail()
+	}
+	if signature == webhookSignature("secret", "0", body) {
+		fmt.Println("Signature doesn't cover the timestamp.")
+		t.Fail()
+	}
+
+	received := new(WebhookPayload)
+	err := json.Unmarshal(body, received)
+	if err != nil || received.Message.Sender != "sender" || received.Message.TxidHash != payload.Message.TxidHash {
+		fmt.Println("Invalid webhook payload: ", string(body))
+		t.Fail()
+	}
+
+	// Gives up after webhookAttempts
+	var failures int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		http.Error(w, "Down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	hook.URL = failing.URL
+	if deliverWithRetry(config, hook, EventMessage, sent) {
+		fmt.Println("Failing webhook reported as delivered.")
+		t.Fail()
+	}
+	if failures != webhookAttempts {
+		fmt.Println("Wrong number of attempts: ", failures)
+		t.Fail()
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	config := new(api.ApiConfig)
+	config.Log = make(chan string, 100)
+
+	received := make(chan string, 2*eventBuffer)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := new(WebhookPayload)
+		json.NewDecoder(r.Body).Decode(payload)
+		received <- payload.Message.Sender
+	}))
+	defer server.Close()
+
+	config.Webhooks = []api.Webhook{{URL: server.URL, Events: []string{EventMessage}}}
+	service := &EMPService{Config: config}
+	service.startWebhooks()
+
+	// More events than a subscription buffers, published faster than they're delivered.
+	count := 2 * eventBuffer
+	for i := 0; i < count; i++ {
+		service.publish(EventMessage, &objects.MetaMessage{Sender: fmt.Sprint(i)})
+		service.publish(EventSent, &objects.MetaMessage{Sender: "sent"})
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case sender := <-received:
+			if sender != fmt.Sprint(i) {
+				fmt.Println("Event delivered out of order: ", sender, i)
+				t.FailNow()
+			}
+		case <-time.After(5 * time.Second):
+			fmt.Println("Events dropped, delivered: ", i)
+			t.FailNow()
+		}
+	}
+}
+
+func TestWebhookQueueBound(t *testing.T) {
+	defer func(n int) { webhookQueueLen = n }(webhookQueueLen)
+	webhookQueueLen = 3
+
+	q := newWebhookQueue(api.Webhook{})
+	for i := 0; i < 5; i++ {
+		q.push(Event{Type: EventMessage, Message: &objects.MetaMessage{Sender: fmt.Sprint(i)}})
+	}
+	if len(q.events) != webhookQueueLen {
+		fmt.Println("Queue not bounded: ", len(q.events))
+		t.FailNow()
+	}
+
+	// The oldest events are the ones dropped, and reported once.
+	e, dropped := q.pop()
+	if e.Message.Sender != "2" || dropped != 2 {
+		fmt.Println("Wrong event after dropping: ", e.Message.Sender, dropped)
+		t.Fail()
+	}
+	if e, dropped = q.pop(); e.Message.Sender != "3" || dropped != 0 {
+		fmt.Println("Dropped events reported twice: ", e.Message.Sender, dropped)
+		t.Fail()
+	}
+}
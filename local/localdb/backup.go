@@ -0,0 +1,312 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"errors"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"io"
+	"strings"
+)
+
+// Addressbook entry with everything needed to restore it.
+type AddressRow struct {
+	objects.AddressDetail
+	Announced bool `json:"announced"`
+}
+
+// Everything stored for a message. Folder and tags are kept by name, as ids differ
+// between databases.
+type MessageRow struct {
+	TxidHash  []byte   `json:"txid_hash"`
+	Box       int      `json:"box"`
+	Recipient []byte   `json:"recipient"`
+	Sender    []byte   `json:"sender"`
+	Timestamp int64    `json:"timestamp"`
+	Encrypted []byte   `json:"encrypted"`
+	Decrypted []byte   `json:"decrypted"`
+	Purged    bool     `json:"purged"`
+	To        string   `json:"to"`
+	CC        string   `json:"cc"`
+	BCC       string   `json:"bcc"`
+	BodyHash  []byte   `json:"body_hash"`
+	AddrHash  []byte   `json:"addr_hash,omitempty"`
+	SendAt    int64    `json:"send_at"`
+	Attempts  int      `json:"attempts"`
+	NextRetry int64    `json:"next_retry"`
+	Failure   string   `json:"failure"`
+	Resends   int      `json:"resends"`
+	Broadcast int64    `json:"broadcast"`
+	Folder    string   `json:"folder"`
+	Archived  bool     `json:"archived"`
+	Tags      []string `json:"tags"`
+}
+
+// API token with the hash of its secret.
+type TokenRow struct {
+	Token
+	Hash []byte `json:"hash"`
+}
+
+// One entry of a backup, exactly one field is set.
+type BackupRecord struct {
+	Address *AddressRow `json:"address,omitempty"`
+	Message *MessageRow `json:"message,omitempty"`
+	Folder  string      `json:"folder,omitempty"` // Kept so empty folders aren't lost
+	Token   *TokenRow   `json:"token,omitempty"`
+}
+
+// Records written or restored. Existing counts records left alone because they were
+// already in the database.
+type BackupCounts struct {
+	Addresses int `json:"addresses"`
+	Messages  int `json:"messages"`
+	Folders   int `json:"folders"`
+	Tokens    int `json:"tokens"`
+	Existing  int `json:"existing"`
+}
+
+// Call fn with every address, folder, message and token. The database is locked
+// until Dump returns, so the records are a consistent snapshot.
+func (store *Store) Dump(fn func(rec *BackupRecord) error) (*BackupCounts, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := new(BackupCounts)
+	var err error
+
+	for s, e := store.conn.Query("SELECT address, registered, pubkey, privkey, label, subscribed, encprivkey, announced FROM addressbook"); e == nil && err == nil; e = s.Next() {
+		row := new(AddressRow)
+		s.Scan(&row.Address, &row.IsRegistered, &row.Pubkey, &row.Privkey, &row.Label, &row.IsSubscribed, &row.EncPrivkey, &row.Announced)
+		row.String = encryption.AddressToString(row.Address)
+
+		err = fn(&BackupRecord{Address: row})
+		ret.Addresses++
+	}
+
+	for s, e := store.conn.Query("SELECT name FROM folder ORDER BY id"); e == nil && err == nil; e = s.Next() {
+		var name string
+		s.Scan(&name)
+
+		err = fn(&BackupRecord{Folder: name})
+		ret.Folders++
+	}
+
+	for s, e := store.conn.Query("SELECT msg.txid_hash, box, recipient, sender, timestamp, encrypted, decrypted, purged, to_list, cc_list, bcc_list, body_hash, send_at, attempts, next_retry, failure, resends, broadcast, ifnull(folder.name, ''), archived, addr_hash FROM msg LEFT JOIN folder ON folder.id=msg.folder ORDER BY timestamp"); e == nil && err == nil; e = s.Next() {
+		row := new(MessageRow)
+		s.Scan(&row.TxidHash, &row.Box, &row.Recipient, &row.Sender, &row.Timestamp, &row.Encrypted, &row.Decrypted, &row.Purged, &row.To, &row.CC, &row.BCC,
+			&row.BodyHash, &row.SendAt, &row.Attempts, &row.NextRetry, &row.Failure, &row.Resends, &row.Broadcast, &row.Folder, &row.Archived, &row.AddrHash)
+
+		for t, e := store.conn.Query("SELECT tag.name FROM tag JOIN msg_tag ON msg_tag.tag=tag.id WHERE msg_tag.txid_hash=? ORDER BY tag.name", row.TxidHash); e == nil; e = t.Next() {
+			var tag string
+			t.Scan(&tag)
+			row.Tags = append(row.Tags, tag)
+		}
+
+		err = fn(&BackupRecord{Message: row})
+		ret.Messages++
+	}
+
+	for s, e := store.conn.Query("SELECT name, hash, scopes, created, expires FROM token ORDER BY name"); e == nil && err == nil; e = s.Next() {
+		row := new(TokenRow)
+		var scopes string
+		var created, expires int64
+		s.Scan(&row.Name, &row.Hash, &scopes, &created, &expires)
+		scanToken(&row.Token, scopes, created, expires)
+
+		err = fn(&BackupRecord{Token: row})
+		ret.Tokens++
+	}
+
+	return ret, err
+}
+
+// Whether a query returns any rows. Must be called with the store locked.
+func (store *Store) exists(sql string, args ...interface{}) bool {
+	s, err := store.conn.Query(sql, args...)
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
+
+// Add the records returned by next, until it returns io.EOF, to the database. If
+// replace is set everything in the database is deleted first, otherwise records
+// already present are kept, except that missing private keys are filled in.
+// Nothing is changed if an error is returned.
+func (store *Store) Restore(replace bool, next func() (*BackupRecord, error)) (*BackupCounts, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := store.restore(replace, next)
+	if err != nil {
+		store.conn.Rollback()
+		return nil, err
+	}
+
+	err = store.conn.Commit()
+	if err != nil {
+		store.conn.Rollback()
+		return nil, err
+	}
+
+	return ret, store.populateHashes()
+}
+
+// Must be called with the store locked, inside a transaction.
+func (store *Store) restore(replace bool, next func() (*BackupRecord, error)) (*BackupCounts, error) {
+	if replace {
+		for _, table := range []string{"addressbook", "msg", "msg_search", "msg_tag", "tag", "folder", "token"} {
+			err := store.conn.Exec("DELETE FROM " + table)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ret := new(BackupCounts)
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var added bool
+		switch {
+		case rec.Address != nil:
+			added, err = store.restoreAddress(rec.Address)
+			if added {
+				ret.Addresses++
+			}
+		case rec.Message != nil:
+			added, err = store.restoreMessage(rec.Message)
+			if added {
+				ret.Messages++
+			}
+		case rec.Token != nil:
+			added, err = store.restoreToken(rec.Token)
+			if added {
+				ret.Tokens++
+			}
+		case len(rec.Folder) > 0:
+			err = store.conn.Exec("INSERT OR IGNORE INTO folder (name) VALUES (?)", rec.Folder)
+			added = store.conn.RowsAffected() > 0
+			if added {
+				ret.Folders++
+			}
+		default:
+			err = errors.New("Empty backup record!")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !added {
+			ret.Existing++
+		}
+	}
+}
+
+func (store *Store) restoreAddress(row *AddressRow) (bool, error) {
+	if len(row.Address) == 0 {
+		return false, errors.New("Invalid address in backup!")
+	}
+	addrHash := objects.MakeHash(row.Address)
+	hash := addrHash.GetBytes()
+
+	if store.exists("SELECT hash FROM addressbook WHERE hash=?", hash) {
+		if len(row.Privkey) > 0 && !store.exists("SELECT hash FROM addressbook WHERE hash=? AND length(privkey)>0", hash) {
+			return false, store.conn.Exec("UPDATE addressbook SET privkey=?, pubkey=?, registered=1 WHERE hash=?", row.Privkey, row.Pubkey, hash)
+		}
+		if len(row.EncPrivkey) > 0 && !store.exists("SELECT hash FROM addressbook WHERE hash=? AND length(encprivkey)>0", hash) {
+			return false, store.conn.Exec("UPDATE addressbook SET encprivkey=? WHERE hash=?", row.EncPrivkey, hash)
+		}
+		return false, nil
+	}
+
+	return true, store.conn.Exec("INSERT INTO addressbook (hash, address, registered, pubkey, privkey, label, subscribed, encprivkey, announced) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hash, row.Address, row.IsRegistered, row.Pubkey, row.Privkey, row.Label, row.IsSubscribed, row.EncPrivkey, row.Announced)
+}
+
+func (store *Store) restoreMessage(row *MessageRow) (bool, error) {
+	var txidHash objects.Hash
+	if len(row.TxidHash) != len(txidHash) || row.Box < INBOX || row.Box > DRAFTS {
+		return false, errors.New("Invalid message in backup!")
+	}
+	txidHash.FromBytes(row.TxidHash)
+
+	if store.exists("SELECT txid_hash FROM msg WHERE txid_hash=?", row.TxidHash) {
+		return false, nil
+	}
+
+	var folder int64
+	if len(row.Folder) > 0 {
+		err := store.conn.Exec("INSERT OR IGNORE INTO folder (name) VALUES (?)", row.Folder)
+		if err != nil {
+			return false, err
+		}
+		s, err := store.conn.Query("SELECT id FROM folder WHERE name=?", row.Folder)
+		if err == nil {
+			s.Scan(&folder)
+			s.Close()
+		}
+	}
+
+	err := store.conn.Exec("INSERT INTO msg (txid_hash, box, recipient, sender, timestamp, encrypted, decrypted, purged, to_list, cc_list, bcc_list, body_hash, send_at, attempts, next_retry, failure, resends, broadcast, folder, archived, addr_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		row.TxidHash, row.Box, row.Recipient, row.Sender, row.Timestamp, row.Encrypted, row.Decrypted, row.Purged, row.To, row.CC, row.BCC,
+		row.BodyHash, row.SendAt, row.Attempts, row.NextRetry, row.Failure, row.Resends, row.Broadcast, folder, row.Archived, row.AddrHash)
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range row.Tags {
+		err = store.conn.Exec("INSERT OR IGNORE INTO tag (name) VALUES (?)", tag)
+		if err == nil {
+			err = store.conn.Exec("INSERT OR IGNORE INTO msg_tag (txid_hash, tag) SELECT ?, id FROM tag WHERE name=?", row.TxidHash, tag)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(row.Decrypted) > 0 {
+		decrypted := new(objects.DecryptedMessage)
+		decrypted.FromBytes(row.Decrypted)
+		err = store.indexMessage(txidHash, decrypted)
+	}
+	return true, err
+}
+
+func (store *Store) restoreToken(row *TokenRow) (bool, error) {
+	if len(row.Name) == 0 || len(row.Hash) == 0 {
+		return false, errors.New("Invalid token in backup!")
+	}
+	if store.exists("SELECT name FROM token WHERE name=?", row.Name) {
+		return false, nil
+	}
+
+	var expires int64
+	if !row.Expires.IsZero() {
+		expires = row.Expires.Unix()
+	}
+
+	return true, store.conn.Exec("INSERT INTO token (name, hash, scopes, created, expires) VALUES (?, ?, ?, ?, ?)", row.Name, row.Hash, strings.Join(row.Scopes, ","), row.Created.Unix(), expires)
+}
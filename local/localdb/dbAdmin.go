@@ -15,12 +15,14 @@ import (
 	"errors"
 	"github.com/msecret/emp/encryption"
 	"github.com/msecret/emp/objects"
+	"io"
+	"strings"
 	"time"
 )
 
-func AddUpdateAddress(address *objects.AddressDetail) error {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+func (store *Store) AddUpdateAddress(address *objects.AddressDetail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
 	var err error
 
@@ -34,55 +36,55 @@ func AddUpdateAddress(address *objects.AddressDetail) error {
 
 	addrHash := objects.MakeHash(address.Address)
 
-	if Contains(addrHash) == ADDRESS { // Exists in message database, update pubkey, privkey, and registration
-		err = LocalDB.Exec("UPDATE addressbook SET registered=?, subscribed=?, label=? WHERE hash=?", address.IsRegistered, address.IsSubscribed, address.Label, addrHash.GetBytes())
+	if store.Contains(addrHash) == ADDRESS { // Exists in message database, update pubkey, privkey, and registration
+		err = store.conn.Exec("UPDATE addressbook SET registered=?, subscribed=?, label=? WHERE hash=?", address.IsRegistered, address.IsSubscribed, address.Label, addrHash.GetBytes())
 		if err != nil {
 			return err
 		}
 
 		if address.Pubkey != nil {
-			err = LocalDB.Exec("UPDATE addressbook SET pubkey=? WHERE hash=?", address.Pubkey, addrHash.GetBytes())
+			err = store.conn.Exec("UPDATE addressbook SET pubkey=? WHERE hash=?", address.Pubkey, addrHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if address.Privkey != nil {
-			err = LocalDB.Exec("UPDATE addressbook SET privkey=? WHERE hash=?", address.Privkey, addrHash.GetBytes())
+			err = store.conn.Exec("UPDATE addressbook SET privkey=? WHERE hash=?", address.Privkey, addrHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if address.EncPrivkey != nil {
-			err = LocalDB.Exec("UPDATE addressbook SET encprivkey=? WHERE hash=?", address.EncPrivkey, addrHash.GetBytes())
+			err = store.conn.Exec("UPDATE addressbook SET encprivkey=? WHERE hash=?", address.EncPrivkey, addrHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 	} else { // Doesn't exist yet, insert it!
-		err = LocalDB.Exec("INSERT INTO addressbook VALUES (?, ?, ?, ?, ?, ?, ?, ?)", addrHash.GetBytes(), address.Address, address.IsRegistered, address.Pubkey, address.Privkey, address.Label, address.IsSubscribed, address.EncPrivkey)
+		err = store.conn.Exec("INSERT INTO addressbook (hash, address, registered, pubkey, privkey, label, subscribed, encprivkey) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", addrHash.GetBytes(), address.Address, address.IsRegistered, address.Pubkey, address.Privkey, address.Label, address.IsSubscribed, address.EncPrivkey)
 		if err != nil {
 			return err
 		}
-		Add(addrHash, ADDRESS)
+		store.Add(addrHash, ADDRESS)
 	}
 
 	return nil
 }
 
-func GetAddressDetail(addrHash objects.Hash) (*objects.AddressDetail, error) {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+func (store *Store) GetAddressDetail(addrHash objects.Hash) (*objects.AddressDetail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	if Contains(addrHash) != ADDRESS {
-		return nil, errors.New("Address not found!")
+	if store.Contains(addrHash) != ADDRESS {
+		return nil, NotFoundError("Address not found!")
 	}
 
 	ret := new(objects.AddressDetail)
 
-	s, err := LocalDB.Query("SELECT address, registered, pubkey, privkey, label, subscribed, encprivkey FROM addressbook WHERE hash=?", addrHash.GetBytes())
+	s, err := store.conn.Query("SELECT address, registered, pubkey, privkey, label, subscribed, encprivkey FROM addressbook WHERE hash=?", addrHash.GetBytes())
 	if err == nil {
 		s.Scan(&ret.Address, &ret.IsRegistered, &ret.Pubkey, &ret.Privkey, &ret.Label, &ret.IsSubscribed, &ret.EncPrivkey)
 		ret.String = encryption.AddressToString(ret.Address)
@@ -92,10 +94,10 @@ func GetAddressDetail(addrHash objects.Hash) (*objects.AddressDetail, error) {
 	return nil, err
 }
 
-func ListAddresses(registered bool) [][2]string {
+func (store *Store) ListAddresses(registered bool) [][2]string {
 	ret := make([][2]string, 0, 0)
 
-	for s, err := LocalDB.Query("SELECT address, label FROM addressbook WHERE registered=?", registered); err == nil; err = s.Next() {
+	for s, err := store.conn.Query("SELECT address, label FROM addressbook WHERE registered=?", registered); err == nil; err = s.Next() {
 		var addr []byte
 		var label string
 		s.Scan(&addr, &label)
@@ -105,19 +107,62 @@ func ListAddresses(registered bool) [][2]string {
 	return ret
 }
 
-func GetMessageDetail(txidHash objects.Hash) (*objects.FullMessage, error) {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+// List all registered addresses with a stored private key.
+func (store *Store) ListRegisteredKeys() []objects.AddressDetail {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	if Contains(txidHash) > SENDBOX {
-		return nil, errors.New("Message not found!")
+	ret := make([]objects.AddressDetail, 0, 0)
+
+	for s, err := store.conn.Query("SELECT address, pubkey, privkey, label, subscribed FROM addressbook WHERE registered=1 AND privkey IS NOT NULL"); err == nil; err = s.Next() {
+		detail := new(objects.AddressDetail)
+		s.Scan(&detail.Address, &detail.Pubkey, &detail.Privkey, &detail.Label, &detail.IsSubscribed)
+		detail.String = encryption.AddressToString(detail.Address)
+		detail.IsRegistered = true
+		ret = append(ret, *detail)
+	}
+
+	return ret
+}
+
+// List registered addresses whose public key hasn't been broadcast, like those created offline.
+func (store *Store) ListUnannounced() []objects.AddressDetail {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]objects.AddressDetail, 0, 0)
+
+	for s, err := store.conn.Query("SELECT address, pubkey FROM addressbook WHERE registered=1 AND announced=0 AND pubkey IS NOT NULL"); err == nil; err = s.Next() {
+		detail := new(objects.AddressDetail)
+		s.Scan(&detail.Address, &detail.Pubkey)
+		detail.String = encryption.AddressToString(detail.Address)
+		detail.IsRegistered = true
+		ret = append(ret, *detail)
+	}
+
+	return ret
+}
+
+func (store *Store) SetAnnounced(addrHash objects.Hash, announced bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.conn.Exec("UPDATE addressbook SET announced=? WHERE hash=?", announced, addrHash.GetBytes())
+}
+
+func (store *Store) GetMessageDetail(txidHash objects.Hash) (*objects.FullMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(txidHash) > DRAFTS {
+		return nil, NotFoundError("Message not found!")
 	}
 
 	ret := new(objects.FullMessage)
 	ret.Encrypted = new(encryption.EncryptedMessage)
 	ret.Decrypted = new(objects.DecryptedMessage)
 
-	s, err := LocalDB.Query("SELECT * FROM msg WHERE txid_hash=?", txidHash.GetBytes())
+	s, err := store.conn.Query("SELECT txid_hash, recipient, timestamp, box, encrypted, decrypted, purged, sender, to_list, cc_list, body_hash, failure FROM msg WHERE txid_hash=?", txidHash.GetBytes())
 	if err == nil {
 		recipient := make([]byte, 0, 0)
 		sender := make([]byte, 0, 0)
@@ -127,8 +172,11 @@ func GetMessageDetail(txidHash objects.Hash) (*objects.FullMessage, error) {
 		var timestamp int64
 		var purged bool
 		var box int
+		var to, cc string
 
-		s.Scan(&txidHash, &recipient, &timestamp, &box, &encrypted, &decrypted, &purged, &sender)
+		s.Scan(&txidHash, &recipient, &timestamp, &box, &encrypted, &decrypted, &purged, &sender, &to, &cc, &ret.BodyHash, &ret.MetaMessage.Failure)
+		ret.To = splitList(to)
+		ret.CC = splitList(cc)
 		ret.MetaMessage.TxidHash.FromBytes(txidHash)
 		ret.MetaMessage.Recipient = encryption.AddressToString(recipient)
 		ret.MetaMessage.Sender = encryption.AddressToString(sender)
@@ -147,78 +195,111 @@ func GetMessageDetail(txidHash objects.Hash) (*objects.FullMessage, error) {
 
 }
 
-func DeleteMessage(txidHash *objects.Hash) error {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+func (store *Store) DeleteMessage(txidHash *objects.Hash) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	if Contains(*txidHash) > SENDBOX {
-		return errors.New("Error Deleting Message: Not Found!")
+	if store.Contains(*txidHash) > DRAFTS {
+		return NotFoundError("Error Deleting Message: Not Found!")
 	}
 
-	return LocalDB.Exec("DELETE FROM msg WHERE txid_hash=?", txidHash.GetBytes())
+	return store.removeMessage(*txidHash)
 }
 
-func DeleteAddress(addrHash *objects.Hash) error {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+// Delete a message with its search index entry and tags.
+// Must be called with the store locked.
+func (store *Store) removeMessage(txidHash objects.Hash) error {
+	store.unindexMessage(txidHash)
+	store.conn.Exec("DELETE FROM msg_tag WHERE txid_hash=?", txidHash.GetBytes())
+	return store.conn.Exec("DELETE FROM msg WHERE txid_hash=?", txidHash.GetBytes())
+}
 
-	if Contains(*addrHash) > ADDRESS {
-		return errors.New("Error Deleting Message: Not Found!")
+func (store *Store) DeleteAddress(addrHash *objects.Hash) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(*addrHash) > ADDRESS {
+		return NotFoundError("Error Deleting Message: Not Found!")
 	}
 
-	return LocalDB.Exec("DELETE FROM addressbook WHERE hash=?", addrHash.GetBytes())
+	return store.conn.Exec("DELETE FROM addressbook WHERE hash=?", addrHash.GetBytes())
 }
 
-func AddUpdateMessage(msg *objects.FullMessage, box int) error {
-	localMutex.Lock()
-	defer localMutex.Unlock()
+func (store *Store) AddUpdateMessage(msg *objects.FullMessage, box int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
 	var err error
 
-	if Contains(msg.MetaMessage.TxidHash) > SENDBOX { // Insert Message Into Database!
+	if store.Contains(msg.MetaMessage.TxidHash) > DRAFTS { // Insert Message Into Database!
 
-		err = LocalDB.Exec("INSERT INTO msg VALUES (?, ?, ?, ?, ?, ?, ?, ?)", msg.MetaMessage.TxidHash.GetBytes(), encryption.StringToAddress(msg.MetaMessage.Recipient),
-			msg.MetaMessage.Timestamp.Unix(), box, msg.Encrypted.GetBytes(), msg.Decrypted.GetBytes(), msg.MetaMessage.Purged, encryption.StringToAddress(msg.MetaMessage.Sender))
+		err = store.conn.Exec("INSERT INTO msg (txid_hash, recipient, timestamp, box, encrypted, decrypted, purged, sender, to_list, cc_list, body_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", msg.MetaMessage.TxidHash.GetBytes(), encryption.StringToAddress(msg.MetaMessage.Recipient),
+			msg.MetaMessage.Timestamp.Unix(), box, msg.Encrypted.GetBytes(), msg.Decrypted.GetBytes(), msg.MetaMessage.Purged, encryption.StringToAddress(msg.MetaMessage.Sender),
+			strings.Join(msg.To, ","), strings.Join(msg.CC, ","), msg.BodyHash)
+		if err != nil {
+			return err
+		}
+
+		err = store.indexMessage(msg.MetaMessage.TxidHash, msg.Decrypted)
 		if err != nil {
 			return err
 		}
 
 	} else { // Update recipient, sender, purged, encrypted, decrypted, box
 		if box < 0 {
-			err = LocalDB.Exec("UPDATE msg SET purged=? WHERE txid_hash=?", msg.MetaMessage.Purged, msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET purged=? WHERE txid_hash=?", msg.MetaMessage.Purged, msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		} else {
-			err = LocalDB.Exec("UPDATE msg SET box=?, purged=? WHERE txid_hash=?", box, msg.MetaMessage.Purged, msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET box=?, purged=? WHERE txid_hash=?", box, msg.MetaMessage.Purged, msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if len(msg.MetaMessage.Sender) > 0 {
-			err = LocalDB.Exec("UPDATE msg SET sender=? WHERE txid_hash=?", encryption.StringToAddress(msg.MetaMessage.Sender), msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET sender=? WHERE txid_hash=?", encryption.StringToAddress(msg.MetaMessage.Sender), msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if len(msg.MetaMessage.Recipient) > 0 {
-			err = LocalDB.Exec("UPDATE msg SET recipient=? WHERE txid_hash=?", encryption.StringToAddress(msg.MetaMessage.Recipient), msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET recipient=? WHERE txid_hash=?", encryption.StringToAddress(msg.MetaMessage.Recipient), msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if msg.Encrypted != nil {
-			err = LocalDB.Exec("UPDATE msg SET encrypted=? WHERE txid_hash=?", msg.Encrypted.GetBytes(), msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET encrypted=? WHERE txid_hash=?", msg.Encrypted.GetBytes(), msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
 		}
 
 		if msg.Decrypted != nil {
-			err = LocalDB.Exec("UPDATE msg SET decrypted=? WHERE txid_hash=?", msg.Decrypted.GetBytes(), msg.MetaMessage.TxidHash.GetBytes())
+			err = store.conn.Exec("UPDATE msg SET decrypted=? WHERE txid_hash=?", msg.Decrypted.GetBytes(), msg.MetaMessage.TxidHash.GetBytes())
+			if err != nil {
+				return err
+			}
+
+			err = store.indexMessage(msg.MetaMessage.TxidHash, msg.Decrypted)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(msg.BodyHash) > 0 {
+			err = store.conn.Exec("UPDATE msg SET body_hash=? WHERE txid_hash=?", msg.BodyHash, msg.MetaMessage.TxidHash.GetBytes())
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(msg.To) > 0 || len(msg.CC) > 0 {
+			err = store.conn.Exec("UPDATE msg SET to_list=?, cc_list=? WHERE txid_hash=?", strings.Join(msg.To, ","), strings.Join(msg.CC, ","), msg.MetaMessage.TxidHash.GetBytes())
 			if err != nil {
 				return err
 			}
@@ -226,54 +307,54 @@ func AddUpdateMessage(msg *objects.FullMessage, box int) error {
 
 	}
 
-	Add(msg.MetaMessage.TxidHash, box)
+	store.Add(msg.MetaMessage.TxidHash, box)
 	return nil
 }
 
-func GetBox(box int) []objects.MetaMessage {
-	if box > SENDBOX || box < INBOX {
+func (store *Store) GetBox(box int) []objects.MetaMessage {
+	if box > DRAFTS || box < INBOX {
 		return nil
 	}
 
-	localMutex.Lock()
-	defer localMutex.Unlock()
-
-	ret := make([]objects.MetaMessage, 0, 0)
+	return store.queryMeta("SELECT txid_hash, timestamp, purged, sender, recipient, failure FROM msg WHERE box=?", box)
+}
 
-	for s, err := LocalDB.Query("SELECT txid_hash, timestamp, purged, sender, recipient FROM msg WHERE box=?", box); err == nil; err = s.Next() {
-		mm := new(objects.MetaMessage)
-		sendBytes := make([]byte, 0, 0)
-		recvBytes := make([]byte, 0, 0)
-		txidHash := make([]byte, 0, 0)
-		var timestamp int64
+func (store *Store) GetBySender(sender string) []objects.MetaMessage {
+	return store.queryMeta("SELECT txid_hash, timestamp, purged, sender, recipient, failure FROM msg WHERE sender=?", encryption.StringToAddress(sender))
+}
 
-		s.Scan(&txidHash, &timestamp, &mm.Purged, &sendBytes, &recvBytes)
-		mm.Sender = encryption.AddressToString(sendBytes)
-		mm.Recipient = encryption.AddressToString(recvBytes)
+func (store *Store) GetByRecipient(recipient string) []objects.MetaMessage {
+	return store.queryMeta("SELECT txid_hash, timestamp, purged, sender, recipient, failure FROM msg WHERE recipient=?", encryption.StringToAddress(recipient))
+}
 
-		mm.TxidHash.FromBytes(txidHash)
-		mm.Timestamp = time.Unix(timestamp, 0)
+// List the per-recipient copies of a message sent to several addresses.
+func (store *Store) GetByBody(bodyHash []byte) []objects.MetaMessage {
+	return store.queryMeta("SELECT txid_hash, timestamp, purged, sender, recipient, failure FROM msg WHERE body_hash=?", bodyHash)
+}
 
-		ret = append(ret, *mm)
-	}
+// Run a query selecting txid_hash, timestamp, purged, sender, recipient and failure from msg.
+func (store *Store) queryMeta(sql string, args ...interface{}) []objects.MetaMessage {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
+	ret, _ := store.selectMeta(sql, args...)
 	return ret
 }
 
-func GetBySender(sender string) []objects.MetaMessage {
-	localMutex.Lock()
-	defer localMutex.Unlock()
-
+// Same as queryMeta(), but must be called with the store locked. Returns the error if
+// the query fails, such as a full-text query with bad syntax.
+func (store *Store) selectMeta(sql string, args ...interface{}) ([]objects.MetaMessage, error) {
 	ret := make([]objects.MetaMessage, 0, 0)
 
-	for s, err := LocalDB.Query("SELECT txid_hash, timestamp, purged, sender, recipient FROM msg WHERE sender=?", sender); err == nil; err = s.Next() {
+	s, err := store.conn.Query(sql, args...)
+	for ; err == nil; err = s.Next() {
 		mm := new(objects.MetaMessage)
 		sendBytes := make([]byte, 0, 0)
 		recvBytes := make([]byte, 0, 0)
 		txidHash := make([]byte, 0, 0)
 		var timestamp int64
 
-		s.Scan(&txidHash, &timestamp, &mm.Purged, &sendBytes, &recvBytes)
+		s.Scan(&txidHash, &timestamp, &mm.Purged, &sendBytes, &recvBytes, &mm.Failure)
 		mm.Sender = encryption.AddressToString(sendBytes)
 		mm.Recipient = encryption.AddressToString(recvBytes)
 
@@ -282,53 +363,39 @@ func GetBySender(sender string) []objects.MetaMessage {
 
 		ret = append(ret, *mm)
 	}
+	if err != io.EOF {
+		return nil, err
+	}
 
-	return ret
+	return ret, nil
 }
 
-func GetByRecipient(recipient string) []objects.MetaMessage {
-	localMutex.Lock()
-	defer localMutex.Unlock()
-
-	ret := make([]objects.MetaMessage, 0, 0)
-
-	for s, err := LocalDB.Query("SELECT txid_hash, timestamp, purged, sender, recipient FROM msg WHERE recipient=?", recipient); err == nil; err = s.Next() {
-		mm := new(objects.MetaMessage)
-		sendBytes := make([]byte, 0, 0)
-		recvBytes := make([]byte, 0, 0)
-		txidHash := make([]byte, 0, 0)
-		var timestamp int64
-
-		s.Scan(&txidHash, &timestamp, &mm.Purged, &sendBytes, &recvBytes)
-		mm.Sender = encryption.AddressToString(sendBytes)
-		mm.Recipient = encryption.AddressToString(recvBytes)
-
-		mm.TxidHash.FromBytes(txidHash)
-		mm.Timestamp = time.Unix(timestamp, 0)
-
-		ret = append(ret, *mm)
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return nil
 	}
-
-	return ret
+	return strings.Split(list, ",")
 }
 
-func DeleteObject(obj objects.Hash) error {
+func (store *Store) DeleteObject(obj objects.Hash) error {
 	var err error
-	switch Contains(obj) {
+	switch store.Contains(obj) {
 	case INBOX:
 		fallthrough
 	case SENDBOX:
 		fallthrough
+	case DRAFTS:
+		fallthrough
 	case OUTBOX:
-		err = LocalDB.Exec("DELETE FROM msg WHERE txid_hash=?", obj.GetBytes())
+		err = store.removeMessage(obj)
 	case ADDRESS:
-		err = LocalDB.Exec("DELETE FROM addressbook WHERE hash=?", obj.GetBytes())
+		err = store.conn.Exec("DELETE FROM addressbook WHERE hash=?", obj.GetBytes())
 	default:
-		err = errors.New("Hash not found!")
+		err = NotFoundError("Hash not found!")
 	}
 
 	if err == nil {
-		Del(obj)
+		store.Del(obj)
 	}
 
 	return err
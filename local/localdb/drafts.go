@@ -0,0 +1,161 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"errors"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"strings"
+	"time"
+)
+
+// Drafts are stored in the msg table with box DRAFTS. Subject and Content are kept
+// in an unsigned decrypted message, which is signed and encrypted when it's sent.
+
+// Insert or replace a draft.
+func (store *Store) SaveDraft(draft *objects.Draft) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	box := store.Contains(draft.TxidHash)
+	if box != DRAFTS && box != NOTFOUND {
+		return errors.New("Message is not a draft!")
+	}
+
+	decrypted := new(objects.DecryptedMessage)
+	decrypted.Subject = draft.Subject
+	decrypted.MimeType = draft.MimeType
+	if len(decrypted.MimeType) == 0 {
+		decrypted.MimeType = "text/plain"
+	}
+	decrypted.Content = draft.Content
+	decrypted.Length = uint32(len(decrypted.Content))
+
+	var sendAt int64
+	if !draft.SendAt.IsZero() {
+		sendAt = draft.SendAt.Unix()
+	}
+
+	err := store.conn.Exec("INSERT INTO msg (txid_hash, recipient, timestamp, box, decrypted, purged, sender, to_list, cc_list, bcc_list, send_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		draft.TxidHash.GetBytes(), encryption.StringToAddress(draft.Recipient), draft.Timestamp.Unix(), DRAFTS, decrypted.GetBytes(), false,
+		encryption.StringToAddress(draft.Sender), strings.Join(draft.To, ","), strings.Join(draft.CC, ","), strings.Join(draft.BCC, ","), sendAt)
+	if err != nil {
+		return err
+	}
+
+	err = store.indexMessage(draft.TxidHash, decrypted)
+	if err != nil {
+		return err
+	}
+
+	store.Add(draft.TxidHash, DRAFTS)
+	return nil
+}
+
+func (store *Store) GetDraft(txidHash objects.Hash) (*objects.Draft, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.getDraft(txidHash)
+}
+
+// Must be called with the store locked.
+func (store *Store) getDraft(txidHash objects.Hash) (*objects.Draft, error) {
+	if store.Contains(txidHash) != DRAFTS {
+		return nil, NotFoundError("Draft not found!")
+	}
+
+	s, err := store.conn.Query("SELECT recipient, timestamp, decrypted, sender, to_list, cc_list, bcc_list, send_at FROM msg WHERE txid_hash=?", txidHash.GetBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(objects.Draft)
+	recipient := make([]byte, 0, 0)
+	sender := make([]byte, 0, 0)
+	decrypted := make([]byte, 0, 0)
+	var timestamp, sendAt int64
+	var to, cc, bcc string
+
+	s.Scan(&recipient, &timestamp, &decrypted, &sender, &to, &cc, &bcc, &sendAt)
+
+	msg := new(objects.DecryptedMessage)
+	msg.FromBytes(decrypted)
+
+	ret.TxidHash = txidHash
+	ret.Timestamp = time.Unix(timestamp, 0)
+	ret.Sender = encryption.AddressToString(sender)
+	ret.Recipient = encryption.AddressToString(recipient)
+	ret.To = splitList(to)
+	ret.CC = splitList(cc)
+	ret.BCC = splitList(bcc)
+	ret.Subject = msg.Subject
+	ret.MimeType = msg.MimeType
+	ret.Content = msg.Content
+	if sendAt > 0 {
+		ret.SendAt = time.Unix(sendAt, 0)
+	}
+
+	return ret, nil
+}
+
+// List scheduled drafts, earliest first. Timestamp is the time each will be sent.
+func (store *Store) GetScheduled() []objects.MetaMessage {
+	return store.queryMeta("SELECT txid_hash, send_at, purged, sender, recipient, failure FROM msg WHERE box=? AND send_at>0 ORDER BY send_at", DRAFTS)
+}
+
+// List scheduled drafts that should have been sent by now.
+func (store *Store) GetDueDrafts(now time.Time) []objects.MetaMessage {
+	return store.queryMeta("SELECT txid_hash, send_at, purged, sender, recipient, failure FROM msg WHERE box=? AND send_at>0 AND send_at<=? ORDER BY send_at", DRAFTS, now.Unix())
+}
+
+func (store *Store) DeleteDraft(txidHash objects.Hash) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(txidHash) != DRAFTS {
+		return NotFoundError("Draft not found!")
+	}
+
+	err := store.removeMessage(txidHash)
+	if err == nil {
+		store.Del(txidHash)
+	}
+
+	return err
+}
+
+// Load a draft and delete it in one step, so only one caller gets to send it. Returns a
+// NotFoundError if the draft is gone, including when someone else took it first.
+func (store *Store) TakeDraft(txidHash objects.Hash) (*objects.Draft, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	draft, err := store.getDraft(txidHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.conn.Exec("DELETE FROM msg WHERE txid_hash=? AND box=?", txidHash.GetBytes(), DRAFTS)
+	if err != nil {
+		return nil, err
+	}
+	if store.conn.RowsAffected() == 0 {
+		return nil, NotFoundError("Draft not found!")
+	}
+	store.Del(txidHash)
+
+	store.unindexMessage(txidHash)
+	store.conn.Exec("DELETE FROM msg_tag WHERE txid_hash=?", txidHash.GetBytes())
+	return draft, nil
+}
@@ -0,0 +1,191 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"errors"
+	"github.com/msecret/emp/objects"
+)
+
+// User-created folder. Messages not filed anywhere are in folder 0.
+type Folder struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"` // Number of messages in the folder
+}
+
+func (store *Store) CreateFolder(name string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(name) == 0 {
+		return 0, errors.New("Folder name required!")
+	}
+
+	err := store.conn.Exec("INSERT INTO folder (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+
+	return store.conn.LastInsertId(), nil
+}
+
+func (store *Store) RenameFolder(id int64, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(name) == 0 {
+		return errors.New("Folder name required!")
+	}
+
+	err := store.conn.Exec("UPDATE folder SET name=? WHERE id=?", name, id)
+	if err == nil && store.conn.RowsAffected() == 0 {
+		return NotFoundError("Folder not found!")
+	}
+	return err
+}
+
+// Delete a folder, its messages are moved out of it.
+func (store *Store) DeleteFolder(id int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.conn.Exec("DELETE FROM folder WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	if store.conn.RowsAffected() == 0 {
+		return NotFoundError("Folder not found!")
+	}
+
+	return store.conn.Exec("UPDATE msg SET folder=0 WHERE folder=?", id)
+}
+
+func (store *Store) ListFolders() []Folder {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]Folder, 0, 0)
+
+	for s, err := store.conn.Query("SELECT folder.id, folder.name, count(msg.txid_hash) FROM folder LEFT JOIN msg ON msg.folder=folder.id GROUP BY folder.id ORDER BY folder.name"); err == nil; err = s.Next() {
+		var f Folder
+		s.Scan(&f.Id, &f.Name, &f.Count)
+		ret = append(ret, f)
+	}
+
+	return ret
+}
+
+// Move a message into a folder, or out of all folders if id is 0.
+func (store *Store) MoveMessage(txidHash objects.Hash, id int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(txidHash) > DRAFTS {
+		return NotFoundError("Message not found!")
+	}
+
+	if id != 0 {
+		s, err := store.conn.Query("SELECT id FROM folder WHERE id=?", id)
+		if err != nil {
+			return NotFoundError("Folder not found!")
+		}
+		s.Close()
+	}
+
+	return store.conn.Exec("UPDATE msg SET folder=? WHERE txid_hash=?", id, txidHash.GetBytes())
+}
+
+// Name of the folder a message is in ("" if none), and whether it's archived.
+func (store *Store) GetFiling(txidHash objects.Hash) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var folder string
+	var archived bool
+
+	s, err := store.conn.Query("SELECT ifnull(folder.name, ''), msg.archived FROM msg LEFT JOIN folder ON folder.id=msg.folder WHERE msg.txid_hash=?", txidHash.GetBytes())
+	if err == nil {
+		s.Scan(&folder, &archived)
+		s.Close()
+	}
+
+	return folder, archived
+}
+
+// Archived messages are hidden from the inbox, but still found by searches.
+func (store *Store) SetArchived(txidHash objects.Hash, archived bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(txidHash) > DRAFTS {
+		return NotFoundError("Message not found!")
+	}
+
+	return store.conn.Exec("UPDATE msg SET archived=? WHERE txid_hash=?", archived, txidHash.GetBytes())
+}
+
+// Apply a tag to a message, creating the tag if it's new.
+func (store *Store) AddTag(txidHash objects.Hash, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.Contains(txidHash) > DRAFTS {
+		return NotFoundError("Message not found!")
+	}
+	if len(name) == 0 {
+		return errors.New("Tag name required!")
+	}
+
+	err := store.conn.Exec("INSERT OR IGNORE INTO tag (name) VALUES (?)", name)
+	if err != nil {
+		return err
+	}
+
+	return store.conn.Exec("INSERT OR IGNORE INTO msg_tag (txid_hash, tag) SELECT ?, id FROM tag WHERE name=?", txidHash.GetBytes(), name)
+}
+
+// Remove a tag from a message. Tags no longer used by any message are deleted.
+func (store *Store) RemoveTag(txidHash objects.Hash, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.conn.Exec("DELETE FROM msg_tag WHERE txid_hash=? AND tag IN (SELECT id FROM tag WHERE name=?)", txidHash.GetBytes(), name)
+	if err != nil {
+		return err
+	}
+
+	return store.conn.Exec("DELETE FROM tag WHERE id NOT IN (SELECT tag FROM msg_tag)")
+}
+
+// List tags of a message, or all tags in use if txidHash is nil.
+func (store *Store) GetTags(txidHash *objects.Hash) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]string, 0, 0)
+
+	sql := "SELECT name FROM tag ORDER BY name"
+	args := make([]interface{}, 0, 1)
+	if txidHash != nil {
+		sql = "SELECT tag.name FROM tag JOIN msg_tag ON msg_tag.tag=tag.id WHERE msg_tag.txid_hash=? ORDER BY tag.name"
+		args = append(args, txidHash.GetBytes())
+	}
+
+	for s, err := store.conn.Query(sql, args...); err == nil; err = s.Next() {
+		var name string
+		s.Scan(&name)
+		ret = append(ret, name)
+	}
+
+	return ret
+}
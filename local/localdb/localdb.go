@@ -14,86 +14,81 @@ package localdb
 
 import (
 	"fmt"
+	"github.com/msecret/emp/db/migrate"
 	"github.com/msecret/emp/objects"
 	"github.com/mxk/go-sqlite/sqlite3"
 	"sync"
 )
 
-// Database Connection
-var LocalDB *sqlite3.Conn
-var localMutex *sync.Mutex
+// One local database: the addressbook and message store of a profile. Every method
+// is safe to call from several goroutines.
+type Store struct {
+	conn      *sqlite3.Conn
+	mutex     sync.Mutex
+	hashList  map[string]int // Type of every address and message in the database, by hash
+	hashMutex sync.RWMutex   // Guards hashList, never held while taking mutex
+}
 
-// Initialize database with mutexes from file.
-func Initialize(log chan string, dbFile string) error {
+// Open a database file, creating or upgrading its schema as needed.
+func Open(log chan string, dbFile string) (*Store, error) {
 	var err error
-	if LocalDB != nil {
-		return nil
-	}
-
-	localMutex = new(sync.Mutex)
+	store := new(Store)
 
 	// Create Database Connection
-	LocalDB, err = sqlite3.Open(dbFile)
-	if err != nil || LocalDB == nil {
+	store.conn, err = sqlite3.Open(dbFile)
+	if err != nil || store.conn == nil {
 		log <- fmt.Sprintf("Error opening sqlite database at %s... %s", dbFile, err)
-		LocalDB = nil
-		return err
+		return nil, err
 	}
 
-	// Create Database Schema
-
-	err = LocalDB.Exec("CREATE TABLE IF NOT EXISTS addressbook (hash BLOB NOT NULL UNIQUE, address BLOB NOT NULL UNIQUE, registered INTEGER NOT NULL, pubkey BLOB, privkey BLOB, label TEXT, subscribed INTEGER NOT NULL, PRIMARY KEY (hash) ON CONFLICT REPLACE)")
+	_, err = migrate.Run(store.conn, migrations)
 	if err != nil {
-		log <- fmt.Sprintf("Error setting up addressbook schema... %s", err)
-		LocalDB = nil
-		return err
+		log <- fmt.Sprintf("Error setting up local database schema... %s", err)
+		store.conn.Close()
+		return nil, err
 	}
 
-	// Migration, Ignore error
-	LocalDB.Exec("ALTER TABLE addressbook ADD COLUMN subscribed INTEGER NOT NULL DEFAULT 0")
-	LocalDB.Exec("ALTER TABLE addressbook ADD COLUMN encprivkey BLOB")
-
-	err = LocalDB.Exec("CREATE TABLE IF NOT EXISTS msg (txid_hash BLOB NOT NULL, recipient BLOB, timestamp INTEGER, box INTEGER, encrypted BLOB, decrypted BLOB, purged INTEGER, sender BLOB, PRIMARY KEY (txid_hash) ON CONFLICT REPLACE)")
+	err = store.populateSearch()
 	if err != nil {
-		log <- fmt.Sprintf("Error setting up msg schema... %s", err)
-		LocalDB = nil
-		return err
-	}
-
-	if hashList == nil {
-		hashList = make(map[string]int)
-		return populateHashes()
-	}
-
-	if LocalDB == nil || hashList == nil {
-		fmt.Println("ERROR! ERROR! WTF!!! SHOULD BE INITIALIZED!")
+		log <- fmt.Sprintf("Error populating search index... %s", err)
 	}
 
-	return nil
+	return store, store.populateHashes()
 }
 
-func populateHashes() error {
-	for s, err := LocalDB.Query("SELECT hash FROM addressbook"); err == nil; err = s.Next() {
+// Replace the hash list with the contents of the database.
+func (store *Store) populateHashes() error {
+	hashList := make(map[string]int)
+
+	for s, err := store.conn.Query("SELECT hash FROM addressbook"); err == nil; err = s.Next() {
 		var hash []byte
 		s.Scan(&hash) // Assigns 1st column to rowid, the rest to row
 		hashList[string(hash)] = ADDRESS
 	}
 
-	for s, err := LocalDB.Query("SELECT txid_hash, box FROM msg"); err == nil; err = s.Next() {
+	for s, err := store.conn.Query("SELECT txid_hash, box FROM msg"); err == nil; err = s.Next() {
 		var hash []byte
 		var box int
 		s.Scan(&hash, &box) // Assigns 1st column to rowid, the rest to row
 		hashList[string(hash)] = box
 	}
 
+	store.hashMutex.Lock()
+	store.hashList = hashList
+	store.hashMutex.Unlock()
 	return nil
 }
 
-// Close and Cleanup database.
-func Cleanup() {
-	LocalDB.Close()
-	LocalDB = nil
-	hashList = nil
+// Close the database. The store can't be used afterwards.
+func (store *Store) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.conn.Close()
+
+	store.hashMutex.Lock()
+	store.hashList = nil
+	store.hashMutex.Unlock()
 }
 
 // Hash Types
@@ -101,34 +96,48 @@ const (
 	INBOX    = iota // Incoming Messages
 	OUTBOX   = iota // Outgoing, Unsent Messages
 	SENDBOX  = iota // Outgoing, Sent Messages
+	DRAFTS   = iota // Unsent Drafts and Scheduled Messages
 	ADDRESS  = iota // EMP Addresses
 	NOTFOUND = iota // Not Found in DB
 )
 
-// Hash List
-var hashList map[string]int
+// Returned when a message, address or other record isn't in the database.
+type NotFoundError string
+
+func (e NotFoundError) Error() string {
+	return string(e)
+}
+
+// Add to the Hash List.
+func (store *Store) Add(hashObj objects.Hash, hashType int) {
+	store.hashMutex.Lock()
+	defer store.hashMutex.Unlock()
 
-// Add to global Hash List.
-func Add(hashObj objects.Hash, hashType int) {
 	hash := string(hashObj.GetBytes())
-	if hashList != nil {
-		hashList[hash] = hashType
+	if store.hashList != nil {
+		store.hashList[hash] = hashType
 	}
 }
 
 // Delete hash from Hash List
-func Del(hashObj objects.Hash) {
+func (store *Store) Del(hashObj objects.Hash) {
+	store.hashMutex.Lock()
+	defer store.hashMutex.Unlock()
+
 	hash := string(hashObj.GetBytes())
-	if hashList != nil {
-		delete(hashList, hash)
+	if store.hashList != nil {
+		delete(store.hashList, hash)
 	}
 }
 
 // Get type of object in Hash List
-func Contains(hashObj objects.Hash) int {
+func (store *Store) Contains(hashObj objects.Hash) int {
+	store.hashMutex.RLock()
+	defer store.hashMutex.RUnlock()
+
 	hash := string(hashObj.GetBytes())
-	if hashList != nil {
-		hashType, ok := hashList[hash]
+	if store.hashList != nil {
+		hashType, ok := store.hashList[hash]
 		if ok {
 			return hashType
 		} else {
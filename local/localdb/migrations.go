@@ -0,0 +1,86 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"github.com/msecret/emp/db/migrate"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+// Schema history of the local database, see package migrate. Append new migrations
+// to the end, never change released ones.
+var migrations = []migrate.Migration{
+	{Description: "Schema before versioning", Up: baseSchema},
+}
+
+// Everything created before schema versions were recorded. Databases from those
+// versions may have any subset of the columns, so missing ones are added one by one.
+func baseSchema(conn *sqlite3.Conn) error {
+	err := conn.Exec("CREATE TABLE IF NOT EXISTS addressbook (hash BLOB NOT NULL UNIQUE, address BLOB NOT NULL UNIQUE, registered INTEGER NOT NULL, pubkey BLOB, privkey BLOB, label TEXT, subscribed INTEGER NOT NULL, PRIMARY KEY (hash) ON CONFLICT REPLACE)")
+	if err != nil {
+		return err
+	}
+
+	columns := [][3]string{
+		{"addressbook", "subscribed", "INTEGER NOT NULL DEFAULT 0"},
+		{"addressbook", "encprivkey", "BLOB"},
+		{"addressbook", "announced", "INTEGER NOT NULL DEFAULT 1"},
+	}
+	for _, c := range columns {
+		err = migrate.AddColumn(conn, c[0], c[1], c[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = conn.Exec("CREATE TABLE IF NOT EXISTS msg (txid_hash BLOB NOT NULL, recipient BLOB, timestamp INTEGER, box INTEGER, encrypted BLOB, decrypted BLOB, purged INTEGER, sender BLOB, PRIMARY KEY (txid_hash) ON CONFLICT REPLACE)")
+	if err != nil {
+		return err
+	}
+
+	columns = [][3]string{
+		{"msg", "to_list", "TEXT"},
+		{"msg", "cc_list", "TEXT"},
+		{"msg", "body_hash", "BLOB"},
+		{"msg", "bcc_list", "TEXT"},
+		{"msg", "send_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "next_retry", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "failure", "TEXT"},
+		{"msg", "resends", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "broadcast", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "addr_hash", "BLOB"},
+		{"msg", "folder", "INTEGER NOT NULL DEFAULT 0"},
+		{"msg", "archived", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		err = migrate.AddColumn(conn, c[0], c[1], c[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = migrate.Exec(
+		"CREATE TABLE IF NOT EXISTS folder (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL UNIQUE)",
+		"CREATE TABLE IF NOT EXISTS tag (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL UNIQUE)",
+		"CREATE TABLE IF NOT EXISTS msg_tag (txid_hash BLOB NOT NULL, tag INTEGER NOT NULL, PRIMARY KEY (txid_hash, tag) ON CONFLICT IGNORE)",
+		"CREATE TABLE IF NOT EXISTS token (name TEXT NOT NULL, hash BLOB NOT NULL, scopes TEXT, created INTEGER, expires INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (name))",
+		"CREATE VIRTUAL TABLE IF NOT EXISTS msg_search USING fts4(txid_hash, subject, content, notindexed=txid_hash)",
+	)(conn)
+	if err != nil {
+		return err
+	}
+
+	// Older clients didn't timestamp queued messages, start their deadline now.
+	return conn.Exec("UPDATE msg SET timestamp=? WHERE box=? AND timestamp<=0", time.Now().Unix(), OUTBOX)
+}
@@ -0,0 +1,122 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"time"
+)
+
+// Outbox message waiting for its recipient's public key.
+type Retry struct {
+	TxidHash  objects.Hash
+	Recipient string
+	Queued    time.Time // Time message was added to the outbox
+	Attempts  int       // Number of public key requests sent so far
+}
+
+// List outbox messages that haven't failed and are due for another public key request.
+func (store *Store) GetDueRetries(now time.Time) []Retry {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]Retry, 0, 0)
+
+	for s, err := store.conn.Query("SELECT txid_hash, recipient, timestamp, attempts FROM msg WHERE box=? AND (failure IS NULL OR failure='') AND next_retry<=?", OUTBOX, now.Unix()); err == nil; err = s.Next() {
+		r := new(Retry)
+		txidHash := make([]byte, 0, 0)
+		recvBytes := make([]byte, 0, 0)
+		var timestamp int64
+
+		s.Scan(&txidHash, &recvBytes, &timestamp, &r.Attempts)
+		r.TxidHash.FromBytes(txidHash)
+		r.Recipient = encryption.AddressToString(recvBytes)
+		r.Queued = time.Unix(timestamp, 0)
+
+		ret = append(ret, *r)
+	}
+
+	return ret
+}
+
+// Record a public key request and when the next one is due.
+func (store *Store) SetRetry(txidHash objects.Hash, attempts int, next time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.conn.Exec("UPDATE msg SET attempts=?, next_retry=? WHERE txid_hash=?", attempts, next.Unix(), txidHash.GetBytes())
+}
+
+// Mark a message as undeliverable. It stays in the outbox, and is still sent if the
+// public key turns up later.
+func (store *Store) SetFailure(txidHash objects.Hash, reason string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.conn.Exec("UPDATE msg SET failure=? WHERE txid_hash=?", reason, txidHash.GetBytes())
+}
+
+// Sent message that hasn't been read yet.
+type Resend struct {
+	TxidHash  objects.Hash
+	Recipient string
+	Encrypted *encryption.EncryptedMessage
+	AddrHash  []byte // Address hash or blinded tag it was broadcast with, nil if not recorded
+	BodyHash  []byte // Shared body of a message sent to several addresses
+	Resends   int    // Number of times the message has been rebroadcast
+}
+
+// List unread messages in the sendbox last broadcast before cutoff, that have been
+// rebroadcast less than max times.
+func (store *Store) GetExpiring(cutoff time.Time, max int) []Resend {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]Resend, 0, 0)
+
+	for s, err := store.conn.Query("SELECT txid_hash, recipient, encrypted, addr_hash, body_hash, resends FROM msg WHERE box=? AND purged=0 AND resends<? AND max(timestamp, broadcast)<=?", SENDBOX, max, cutoff.Unix()); err == nil; err = s.Next() {
+		r := new(Resend)
+		txidHash := make([]byte, 0, 0)
+		recvBytes := make([]byte, 0, 0)
+		encrypted := make([]byte, 0, 0)
+
+		s.Scan(&txidHash, &recvBytes, &encrypted, &r.AddrHash, &r.BodyHash, &r.Resends)
+		r.TxidHash.FromBytes(txidHash)
+		r.Recipient = encryption.AddressToString(recvBytes)
+		r.Encrypted = new(encryption.EncryptedMessage)
+		if r.Encrypted.FromBytes(encrypted) != nil {
+			r.Encrypted = nil
+		}
+
+		ret = append(ret, *r)
+	}
+
+	return ret
+}
+
+// Record the address hash, or blinded tag, a sent message was broadcast with, so it
+// can be broadcast again the same way.
+func (store *Store) SetAddrHash(txidHash objects.Hash, addrHash objects.Hash) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.conn.Exec("UPDATE msg SET addr_hash=? WHERE txid_hash=?", addrHash.GetBytes(), txidHash.GetBytes())
+}
+
+// Record a rebroadcast of a sent message.
+func (store *Store) SetResent(txidHash objects.Hash, resends int, broadcast time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.conn.Exec("UPDATE msg SET resends=?, broadcast=? WHERE txid_hash=?", resends, broadcast.Unix(), txidHash.GetBytes())
+}
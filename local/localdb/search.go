@@ -0,0 +1,250 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"fmt"
+	"github.com/msecret/emp/encryption"
+	"github.com/msecret/emp/objects"
+	"strings"
+	"time"
+)
+
+// Restricts a message query, empty fields match everything.
+type Filter struct {
+	Box       *int      `json:"box,omitempty"`       // INBOX, OUTBOX, SENDBOX or DRAFTS
+	Sender    string    `json:"sender,omitempty"`    // Address string
+	Recipient string    `json:"recipient,omitempty"` // Address string
+	After     time.Time `json:"after,omitempty"`
+	Before    time.Time `json:"before,omitempty"`
+	Read      *bool     `json:"read,omitempty"`
+	Folder    *int64    `json:"folder,omitempty"` // Folder id, 0 for messages not in any folder
+	Tag       string    `json:"tag,omitempty"`
+	Archived  *bool     `json:"archived,omitempty"`
+}
+
+// Build a WHERE clause (without the keyword) and its arguments for the msg table.
+func (f *Filter) where() (string, []interface{}) {
+	clauses := []string{"1"}
+	args := make([]interface{}, 0, 0)
+
+	if f == nil {
+		return clauses[0], args
+	}
+
+	if f.Box != nil {
+		clauses = append(clauses, "msg.box=?")
+		args = append(args, *f.Box)
+	}
+	if len(f.Sender) > 0 {
+		clauses = append(clauses, "msg.sender=?")
+		args = append(args, encryption.StringToAddress(f.Sender))
+	}
+	if len(f.Recipient) > 0 {
+		clauses = append(clauses, "msg.recipient=?")
+		args = append(args, encryption.StringToAddress(f.Recipient))
+	}
+	if !f.After.IsZero() {
+		clauses = append(clauses, "msg.timestamp>=?")
+		args = append(args, f.After.Unix())
+	}
+	if !f.Before.IsZero() {
+		clauses = append(clauses, "msg.timestamp<?")
+		args = append(args, f.Before.Unix())
+	}
+	if f.Read != nil {
+		clauses = append(clauses, "msg.purged=?")
+		args = append(args, *f.Read)
+	}
+	if f.Folder != nil {
+		clauses = append(clauses, "msg.folder=?")
+		args = append(args, *f.Folder)
+	}
+	if len(f.Tag) > 0 {
+		clauses = append(clauses, "msg.txid_hash IN (SELECT msg_tag.txid_hash FROM msg_tag JOIN tag ON tag.id=msg_tag.tag WHERE tag.name=?)")
+		args = append(args, f.Tag)
+	}
+	if f.Archived != nil {
+		clauses = append(clauses, "msg.archived=?")
+		args = append(args, *f.Archived)
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+// Selects one page of a message list, sorted by timestamp.
+type Page struct {
+	Cursor    []byte `json:"cursor,omitempty"`    // txid_hash of the last message on the previous page
+	Limit     int    `json:"limit,omitempty"`     // Messages per page, 0 for all
+	Ascending bool   `json:"ascending,omitempty"` // Oldest first instead of newest first
+}
+
+// Build the cursor condition (starting with AND), ORDER BY and LIMIT clauses and their
+// arguments. Messages with the same timestamp are ordered by txid_hash.
+// Must be called with the store locked.
+func (p *Page) clause(store *Store) (string, []interface{}, error) {
+	if p == nil {
+		p = new(Page)
+	}
+
+	var cmp, order, ret string
+	args := make([]interface{}, 0, 0)
+
+	if p.Ascending {
+		cmp, order = ">", "ASC"
+	} else {
+		cmp, order = "<", "DESC"
+	}
+
+	if len(p.Cursor) > 0 {
+		var cursor objects.Hash
+		cursor.FromBytes(p.Cursor)
+		if store.Contains(cursor) > DRAFTS {
+			return "", nil, NotFoundError("Cursor not found!")
+		}
+
+		ret = fmt.Sprintf(" AND (msg.timestamp%[1]s(SELECT timestamp FROM msg WHERE txid_hash=?) OR (msg.timestamp=(SELECT timestamp FROM msg WHERE txid_hash=?) AND msg.txid_hash%[1]s?))", cmp)
+		args = append(args, p.Cursor, p.Cursor, p.Cursor)
+	}
+
+	ret += fmt.Sprintf(" ORDER BY msg.timestamp %[1]s, msg.txid_hash %[1]s", order)
+
+	if p.Limit > 0 {
+		ret += " LIMIT ?"
+		args = append(args, p.Limit)
+	}
+
+	return ret, args, nil
+}
+
+// Full-text search over subject and content of decrypted messages.
+// Query uses SQLite FTS syntax, an empty query lists every message matching filter.
+func (store *Store) SearchMessages(query string, filter *Filter, page *Page) ([]objects.MetaMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	where, args := filter.where()
+
+	pageSql, pageArgs, err := page.clause(store)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query) == 0 {
+		return store.selectMeta("SELECT msg.txid_hash, msg.timestamp, msg.purged, msg.sender, msg.recipient, msg.failure FROM msg WHERE "+where+pageSql, append(args, pageArgs...)...)
+	}
+
+	args = append([]interface{}{query}, args...)
+	return store.selectMeta("SELECT msg.txid_hash, msg.timestamp, msg.purged, msg.sender, msg.recipient, msg.failure FROM msg JOIN msg_search ON msg.txid_hash=msg_search.txid_hash WHERE msg_search MATCH ? AND "+where+pageSql, append(args, pageArgs...)...)
+}
+
+// Number of messages in a box or folder.
+type Count struct {
+	Id     int64 `json:"id"` // Box constant or folder id
+	Total  int   `json:"total"`
+	Unread int   `json:"unread"`
+}
+
+type Counts struct {
+	Boxes   []Count `json:"boxes"`   // Archived messages are not counted
+	Folders []Count `json:"folders"` // Includes archived messages
+}
+
+// Count total and unread messages per box and folder.
+func (store *Store) GetCounts() *Counts {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := new(Counts)
+	ret.Boxes = store.countBy("SELECT box, count(*), total(purged=0) FROM msg WHERE archived=0 GROUP BY box")
+	ret.Folders = store.countBy("SELECT folder.id, count(msg.txid_hash), total(msg.purged=0) FROM folder LEFT JOIN msg ON msg.folder=folder.id GROUP BY folder.id")
+	return ret
+}
+
+// Must be called with the store locked.
+func (store *Store) countBy(sql string) []Count {
+	ret := make([]Count, 0, 0)
+
+	for s, err := store.conn.Query(sql); err == nil; err = s.Next() {
+		var c Count
+		var unread float64
+		s.Scan(&c.Id, &c.Total, &unread)
+		c.Unread = int(unread)
+		ret = append(ret, c)
+	}
+
+	return ret
+}
+
+// Replace the search index entry for a message. Key wraps of messages sent to
+// several addresses are skipped, they're indexed once the body is opened.
+// Must be called with the store locked.
+func (store *Store) indexMessage(txidHash objects.Hash, decrypted *objects.DecryptedMessage) error {
+	err := store.unindexMessage(txidHash)
+	if err != nil {
+		return err
+	}
+
+	if decrypted == nil || decrypted.MimeType == objects.MultiMimeType {
+		return nil
+	}
+
+	return store.conn.Exec("INSERT INTO msg_search (txid_hash, subject, content) VALUES (?, ?, ?)", txidHash.GetBytes(), decrypted.Subject, decrypted.Content)
+}
+
+// Must be called with the store locked.
+func (store *Store) unindexMessage(txidHash objects.Hash) error {
+	return store.conn.Exec("DELETE FROM msg_search WHERE txid_hash=?", txidHash.GetBytes())
+}
+
+// Index messages decrypted before the search index existed.
+func (store *Store) populateSearch() error {
+	s, err := store.conn.Query("SELECT count(*) FROM msg_search")
+	if err != nil {
+		return err
+	}
+	var count int
+	s.Scan(&count)
+	s.Close()
+	if count > 0 {
+		return nil
+	}
+
+	type row struct {
+		txidHash  objects.Hash
+		decrypted *objects.DecryptedMessage
+	}
+	rows := make([]row, 0, 0)
+
+	for s, err := store.conn.Query("SELECT txid_hash, decrypted FROM msg WHERE decrypted IS NOT NULL"); err == nil; err = s.Next() {
+		var r row
+		txidHash := make([]byte, 0, 0)
+		decrypted := make([]byte, 0, 0)
+		s.Scan(&txidHash, &decrypted)
+
+		r.txidHash.FromBytes(txidHash)
+		r.decrypted = new(objects.DecryptedMessage)
+		if len(decrypted) == 0 || r.decrypted.FromBytes(decrypted) != nil {
+			continue
+		}
+		rows = append(rows, r)
+	}
+
+	for _, r := range rows {
+		err = store.indexMessage(r.txidHash, r.decrypted)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
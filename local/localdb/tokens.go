@@ -0,0 +1,117 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package localdb
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+)
+
+// API token. Only a hash of the secret is stored, so it can't be recovered.
+type Token struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` // Zero if the token never expires
+}
+
+func (t *Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+func (store *Store) CreateToken(token *Token, hash []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(token.Name) == 0 {
+		return errors.New("Token name required!")
+	}
+
+	s, err := store.conn.Query("SELECT name FROM token WHERE name=?", token.Name)
+	if err == nil {
+		s.Close()
+		return errors.New("Token already exists!")
+	}
+
+	var expires int64
+	if !token.Expires.IsZero() {
+		expires = token.Expires.Unix()
+	}
+
+	return store.conn.Exec("INSERT INTO token (name, hash, scopes, created, expires) VALUES (?, ?, ?, ?, ?)", token.Name, hash, strings.Join(token.Scopes, ","), token.Created.Unix(), expires)
+}
+
+func (store *Store) RevokeToken(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.conn.Exec("DELETE FROM token WHERE name=?", name)
+	if err == nil && store.conn.RowsAffected() == 0 {
+		return NotFoundError("Token not found!")
+	}
+	return err
+}
+
+func (store *Store) ListTokens() []Token {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ret := make([]Token, 0, 0)
+
+	for s, err := store.conn.Query("SELECT name, scopes, created, expires FROM token ORDER BY name"); err == nil; err = s.Next() {
+		var t Token
+		var scopes string
+		var created, expires int64
+		s.Scan(&t.Name, &scopes, &created, &expires)
+
+		ret = append(ret, *scanToken(&t, scopes, created, expires))
+	}
+
+	return ret
+}
+
+// Find the token with the given hash. Every stored hash is compared in constant time,
+// so response times don't reveal how close a guess was.
+func (store *Store) LookupToken(hash []byte) *Token {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var found *Token
+
+	for s, err := store.conn.Query("SELECT name, hash, scopes, created, expires FROM token"); err == nil; err = s.Next() {
+		var t Token
+		var stored []byte
+		var scopes string
+		var created, expires int64
+		s.Scan(&t.Name, &stored, &scopes, &created, &expires)
+
+		if subtle.ConstantTimeCompare(stored, hash) == 1 {
+			found = scanToken(&t, scopes, created, expires)
+		}
+	}
+
+	return found
+}
+
+func scanToken(t *Token, scopes string, created, expires int64) *Token {
+	t.Scopes = make([]string, 0, 0)
+	if len(scopes) > 0 {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	t.Created = time.Unix(created, 0)
+	if expires > 0 {
+		t.Expires = time.Unix(expires, 0)
+	}
+	return t
+}
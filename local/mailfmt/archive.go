@@ -0,0 +1,283 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package mailfmt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive formats.
+const (
+	Mbox    = "mbox"    // One file, messages separated by "From " lines (mboxrd)
+	Maildir = "maildir" // Directory with tmp, new and cur, one file per message
+	EML     = "eml"     // Directory of <txid_hash>.eml files
+)
+
+// Where exported messages are written.
+type Writer interface {
+	Add(msg *Message) error
+	Close() error
+}
+
+// Create an archive at path, a file for mbox and a directory otherwise. Existing files
+// aren't overwritten.
+func Create(format, path string) (Writer, error) {
+	switch format {
+	case Mbox:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &mboxWriter{file, bufio.NewWriter(file)}, nil
+
+	case Maildir:
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			err := os.MkdirAll(filepath.Join(path, sub), 0700)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &maildirWriter{path}, nil
+
+	case EML:
+		err := os.MkdirAll(path, 0700)
+		if err != nil {
+			return nil, err
+		}
+		return &emlWriter{path}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown format %q, must be mbox, maildir or eml.", format))
+}
+
+type mboxWriter struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Lines starting with "From ", after any number of ">", get one more ">".
+func isFromLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, ">"), "From ")
+}
+
+func (m *mboxWriter) Add(msg *Message) error {
+	buf := new(bytes.Buffer)
+	err := Write(buf, msg)
+	if err != nil {
+		return err
+	}
+
+	from := "MAILER-DAEMON"
+	if len(msg.Sender) > 0 {
+		from = mailbox(msg.Sender)
+	}
+	fmt.Fprintf(m.w, "From %s %s\n", from, msg.Timestamp.UTC().Format(time.ANSIC))
+
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if isFromLine(line) {
+			m.w.WriteString(">")
+		}
+		m.w.WriteString(line)
+	}
+
+	_, err = m.w.WriteString("\n")
+	return err
+}
+
+func (m *mboxWriter) Close() error {
+	err := m.w.Flush()
+	if err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
+
+type maildirWriter struct {
+	dir string
+}
+
+// Written to tmp first, then moved into cur so readers never see partial messages.
+func (m *maildirWriter) Add(msg *Message) error {
+	name := fmt.Sprintf("%d.%s.emp", msg.Timestamp.Unix(), hex.EncodeToString(msg.TxidHash))
+	tmp := filepath.Join(m.dir, "tmp", name)
+
+	err := writeFile(tmp, msg)
+	if err != nil {
+		return err
+	}
+
+	flags := ""
+	if msg.Read {
+		flags = "S"
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, "cur", name+":2,"+flags))
+}
+
+func (m *maildirWriter) Close() error {
+	return nil
+}
+
+type emlWriter struct {
+	dir string
+}
+
+func (e *emlWriter) Add(msg *Message) error {
+	return writeFile(filepath.Join(e.dir, hex.EncodeToString(msg.TxidHash)+".eml"), msg)
+}
+
+func (e *emlWriter) Close() error {
+	return nil
+}
+
+func writeFile(path string, msg *Message) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = Write(file, msg)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Call fn for every message in the archive at path: an mbox or .eml file, a Maildir,
+// or a directory of .eml files. Returns the number of messages skipped because they
+// aren't from EMP.
+func ReadAll(path string, fn func(msg *Message) error) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		r := bufio.NewReader(file)
+		if start, _ := r.Peek(5); string(start) == "From " {
+			return readMbox(r, fn)
+		}
+		return readMessages([]string{path}, fn)
+	}
+
+	var files []string
+	if cur, err := os.Stat(filepath.Join(path, "cur")); err == nil && cur.IsDir() {
+		for _, sub := range []string{"cur", "new"} {
+			names, _ := filepath.Glob(filepath.Join(path, sub, "*"))
+			files = append(files, names...)
+		}
+	} else {
+		files, _ = filepath.Glob(filepath.Join(path, "*.eml"))
+	}
+	sort.Strings(files)
+
+	return readMessages(files, fn)
+}
+
+func readMessages(files []string, fn func(msg *Message) error) (int, error) {
+	skipped := 0
+
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return skipped, err
+		}
+
+		msg, err := Read(file)
+		file.Close()
+		if err == ErrNotEMP {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return skipped, errors.New(fmt.Sprintf("%s: %s", name, err))
+		}
+
+		err = fn(msg)
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, nil
+}
+
+func readMbox(r *bufio.Reader, fn func(msg *Message) error) (int, error) {
+	skipped, count := 0, 0
+	var buf *bytes.Buffer
+
+	// Parse the message collected so far, without the blank line before the next one.
+	flush := func() error {
+		if buf == nil {
+			return nil
+		}
+		count++
+
+		data := buf.Bytes()
+		if bytes.HasSuffix(data, []byte("\n\n")) {
+			data = data[:len(data)-1]
+		}
+
+		msg, err := Read(bytes.NewReader(data))
+		if err == ErrNotEMP {
+			skipped++
+			return nil
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Message %d: %s", count, err))
+		}
+		return fn(msg)
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			switch {
+			case strings.HasPrefix(line, "From "):
+				if err := flush(); err != nil {
+					return skipped, err
+				}
+				buf = new(bytes.Buffer)
+			case buf == nil:
+				// Anything before the first "From " line isn't a message.
+			case isFromLine(line):
+				buf.WriteString(line[1:])
+			default:
+				buf.WriteString(line)
+			}
+		}
+
+		if err == io.EOF {
+			return skipped, flush()
+		}
+		if err != nil {
+			return skipped, err
+		}
+	}
+}
@@ -0,0 +1,338 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+// Package mailfmt converts local messages to and from RFC 5322 mail, stored as mbox,
+// Maildir or .eml files. Everything needed to restore a message, including the
+// encrypted copy of unopened messages, is kept in X-EMP-* headers.
+package mailfmt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/msecret/emp/objects"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Domain of the addresses in From, To and Cc, the SMTP gateway's default.
+var Domain = "emp.local"
+
+// Signature status of a message.
+const (
+	SignatureValid   = "valid"
+	SignatureInvalid = "invalid"
+	SignatureNone    = "none" // Not opened yet, so there's nothing to check
+)
+
+// A message and its place in the local database.
+type Message struct {
+	TxidHash  []byte
+	Box       string // "inbox", "outbox" or "sendbox"
+	Timestamp time.Time
+	Read      bool
+	Sender    string
+	Recipient string
+	To        []string
+	CC        []string
+	BodyHash  []byte
+	Folder    string
+	Tags      []string
+	Archived  bool
+	Signature string // Only written, it's checked again when needed
+
+	Encrypted []byte                    // nil if there's no encrypted copy
+	Decrypted *objects.DecryptedMessage // nil if the message hasn't been opened
+}
+
+var ErrNotEMP = errors.New("Not an EMP message")
+
+const unopenedBody = "This message hasn't been opened, it is kept encrypted in the X-EMP-Encrypted header.\n"
+
+type header struct {
+	name, value string
+}
+
+func mailbox(address string) string {
+	return address + "@" + Domain
+}
+
+func mailboxes(list []string) string {
+	ret := make([]string, 0, len(list))
+	for _, address := range list {
+		ret = append(ret, mailbox(address))
+	}
+	return strings.Join(ret, ", ")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Split a long unbroken value, like base64, into lines of 76 characters.
+func fold(value, sep string) string {
+	lines := make([]string, 0, len(value)/76+1)
+	for len(value) > 76 {
+		lines = append(lines, value[:76])
+		value = value[76:]
+	}
+	return strings.Join(append(lines, value), sep)
+}
+
+// Content-Type for a message's MIME type. The sender chooses it, so types that don't
+// parse, including ones with line breaks that would end the header, become
+// application/octet-stream. X-EMP-Mime-Type keeps the original for the signature.
+func contentType(mimeType string) string {
+	if len(mimeType) == 0 {
+		return "text/plain; charset=utf-8"
+	}
+	if strings.ContainsAny(mimeType, "\r\n") {
+		return "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	if strings.HasPrefix(mediaType, "text/") && len(params["charset"]) == 0 {
+		params["charset"] = "utf-8"
+	}
+	if ret := mime.FormatMediaType(mediaType, params); len(ret) > 0 {
+		return ret
+	}
+	return "application/octet-stream"
+}
+
+// Write msg as RFC 5322 mail with LF line endings. Bodies are kept byte for byte, a
+// final newline is added if needed and removed again by Read using X-EMP-Length.
+func Write(w io.Writer, msg *Message) error {
+	headers := []header{{"Date", msg.Timestamp.Format(time.RFC1123Z)}}
+
+	if len(msg.Sender) > 0 {
+		headers = append(headers, header{"From", mailbox(msg.Sender)})
+	}
+	if len(msg.To) > 0 {
+		headers = append(headers, header{"To", mailboxes(msg.To)})
+	} else if len(msg.Recipient) > 0 {
+		headers = append(headers, header{"To", mailbox(msg.Recipient)})
+	}
+	if len(msg.CC) > 0 {
+		headers = append(headers, header{"Cc", mailboxes(msg.CC)})
+	}
+
+	txidHash := hex.EncodeToString(msg.TxidHash)
+	headers = append(headers, header{"Message-ID", "<" + mailbox(txidHash) + ">"})
+
+	body := []byte(unopenedBody)
+	mimeType, encoding := "text/plain; charset=utf-8", "8bit"
+	if d := msg.Decrypted; d != nil {
+		headers = append(headers, header{"Subject", mime.QEncoding.Encode("utf-8", d.Subject)})
+
+		mimeType, body = contentType(d.MimeType), []byte(d.Content)
+		if !strings.HasPrefix(mimeType, "text/") && !strings.HasPrefix(mimeType, "multipart/") {
+			encoding = "base64"
+			body = []byte(fold(base64.StdEncoding.EncodeToString(body), "\n"))
+		}
+	}
+	headers = append(headers, header{"MIME-Version", "1.0"}, header{"Content-Type", mimeType}, header{"Content-Transfer-Encoding", encoding})
+
+	status := "O"
+	if msg.Read {
+		status = "RO"
+	}
+	headers = append(headers, header{"Status", status})
+
+	headers = append(headers,
+		header{"X-EMP-Txid-Hash", txidHash},
+		header{"X-EMP-Box", msg.Box},
+		header{"X-EMP-Sender", msg.Sender},
+		header{"X-EMP-Recipient", msg.Recipient},
+		header{"X-EMP-Read", yesNo(msg.Read)},
+		header{"X-EMP-Signature", msg.Signature})
+
+	if len(msg.BodyHash) > 0 {
+		headers = append(headers, header{"X-EMP-Body-Hash", hex.EncodeToString(msg.BodyHash)})
+	}
+	if len(msg.Folder) > 0 {
+		headers = append(headers, header{"X-EMP-Folder", mime.QEncoding.Encode("utf-8", msg.Folder)})
+	}
+	if len(msg.Tags) > 0 {
+		headers = append(headers, header{"X-EMP-Tags", mime.QEncoding.Encode("utf-8", strings.Join(msg.Tags, ", "))})
+	}
+	if msg.Archived {
+		headers = append(headers, header{"X-EMP-Archived", "yes"})
+	}
+
+	if d := msg.Decrypted; d != nil {
+		headers = append(headers,
+			header{"X-EMP-Mime-Type", mime.QEncoding.Encode("utf-8", d.MimeType)},
+			header{"X-EMP-Txid", hex.EncodeToString(d.Txid[:])},
+			header{"X-EMP-Pubkey", hex.EncodeToString(d.Pubkey[:])},
+			header{"X-EMP-Signature-Data", hex.EncodeToString(d.Signature[:])},
+			header{"X-EMP-Length", strconv.Itoa(len(d.Content))})
+	}
+	if len(msg.Encrypted) > 0 {
+		headers = append(headers, header{"X-EMP-Encrypted", fold(base64.StdEncoding.EncodeToString(msg.Encrypted), "\n ")})
+	}
+
+	buf := new(bytes.Buffer)
+	for _, h := range headers {
+		fmt.Fprintf(buf, "%s: %s\n", h.name, h.value)
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	if len(body) == 0 || body[len(body)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func decodeHex(value string, size int) ([]byte, error) {
+	ret, err := hex.DecodeString(value)
+	if err == nil && size > 0 && len(ret) != size {
+		err = errors.New("Wrong length")
+	}
+	return ret, err
+}
+
+// Read a message written by Write. Mail without an X-EMP-Txid-Hash header isn't from
+// EMP and returns ErrNotEMP.
+func Read(r io.Reader) (*Message, error) {
+	parsed, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	h := parsed.Header
+
+	if len(h.Get("X-EMP-Txid-Hash")) == 0 {
+		return nil, ErrNotEMP
+	}
+
+	msg := new(Message)
+	decoder := new(mime.WordDecoder)
+	bad := func(name string, err error) (*Message, error) {
+		return nil, errors.New(fmt.Sprintf("Invalid %s header: %s", name, err))
+	}
+
+	msg.TxidHash, err = decodeHex(h.Get("X-EMP-Txid-Hash"), len(objects.Hash{}))
+	if err != nil {
+		return bad("X-EMP-Txid-Hash", err)
+	}
+	msg.Timestamp, err = h.Date()
+	if err != nil {
+		return bad("Date", err)
+	}
+
+	msg.Box = h.Get("X-EMP-Box")
+	msg.Sender = h.Get("X-EMP-Sender")
+	msg.Recipient = h.Get("X-EMP-Recipient")
+	msg.Read = h.Get("X-EMP-Read") == "yes"
+	msg.Archived = h.Get("X-EMP-Archived") == "yes"
+	msg.Signature = h.Get("X-EMP-Signature")
+
+	for _, list := range []struct {
+		name string
+		dest *[]string
+	}{{"To", &msg.To}, {"Cc", &msg.CC}} {
+		addresses, _ := h.AddressList(list.name)
+		for _, addr := range addresses {
+			if at := strings.LastIndex(addr.Address, "@"); at > 0 {
+				*list.dest = append(*list.dest, addr.Address[:at])
+			}
+		}
+	}
+
+	// Only messages sent to several addresses keep their visible recipients.
+	if value := h.Get("X-EMP-Body-Hash"); len(value) > 0 {
+		msg.BodyHash, err = decodeHex(value, 0)
+		if err != nil {
+			return bad("X-EMP-Body-Hash", err)
+		}
+	} else {
+		msg.To, msg.CC = nil, nil
+	}
+	if value := h.Get("X-EMP-Folder"); len(value) > 0 {
+		msg.Folder, _ = decoder.DecodeHeader(value)
+	}
+	if value := h.Get("X-EMP-Tags"); len(value) > 0 {
+		tags, _ := decoder.DecodeHeader(value)
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				msg.Tags = append(msg.Tags, tag)
+			}
+		}
+	}
+	if value := h.Get("X-EMP-Encrypted"); len(value) > 0 {
+		msg.Encrypted, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return bad("X-EMP-Encrypted", err)
+		}
+	}
+
+	if len(h.Get("X-EMP-Length")) == 0 {
+		return msg, nil
+	}
+
+	d := new(objects.DecryptedMessage)
+	for _, field := range []struct {
+		name string
+		dest []byte
+	}{{"X-EMP-Txid", d.Txid[:]}, {"X-EMP-Pubkey", d.Pubkey[:]}, {"X-EMP-Signature-Data", d.Signature[:]}} {
+		value, err := decodeHex(h.Get(field.name), len(field.dest))
+		if err != nil {
+			return bad(field.name, err)
+		}
+		copy(field.dest, value)
+	}
+
+	d.Subject, err = decoder.DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		return bad("Subject", err)
+	}
+
+	d.MimeType, err = decoder.DecodeHeader(h.Get("X-EMP-Mime-Type"))
+	if err != nil {
+		return bad("X-EMP-Mime-Type", err)
+	}
+
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		body, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err != nil {
+			return bad("body", err)
+		}
+	}
+
+	length, err := strconv.Atoi(h.Get("X-EMP-Length"))
+	if err != nil || length > len(body) || length < 0 {
+		return nil, errors.New("Invalid X-EMP-Length header, the body was changed")
+	}
+	d.Content = string(body[:length])
+	d.Length = uint32(length)
+
+	msg.Decrypted = d
+	return msg, nil
+}
@@ -0,0 +1,152 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package mailfmt
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/msecret/emp/objects"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testMessages() []*Message {
+	date := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	opened := &Message{TxidHash: bytes.Repeat([]byte{1}, 48), Box: "inbox", Timestamp: date, Read: true,
+		Sender: "1Alice", Recipient: "1Bob", To: []string{"1Bob", "1Carol"}, CC: []string{"1Dave"}, BodyHash: bytes.Repeat([]byte{2}, 48),
+		Folder: "Work stuff", Tags: []string{"urgent", "été"}, Archived: true, Signature: SignatureValid}
+	opened.Decrypted = &objects.DecryptedMessage{Subject: "Héllo there", MimeType: "text/plain", Length: 31,
+		Content: "First line\nFrom the second line"}
+	opened.Decrypted.Txid[0], opened.Decrypted.Pubkey[0], opened.Decrypted.Signature[0] = 3, 4, 5
+
+	binary := &Message{TxidHash: bytes.Repeat([]byte{6}, 48), Box: "sendbox", Timestamp: date.Add(time.Hour), Read: true,
+		Sender: "1Bob", Recipient: "1Alice", Signature: SignatureValid, Encrypted: []byte{7, 8, 9}}
+	binary.Decrypted = &objects.DecryptedMessage{Subject: "Data", MimeType: "application/octet-stream", Length: 3, Content: "\x00\n\xff"}
+
+	unopened := &Message{TxidHash: bytes.Repeat([]byte{10}, 48), Box: "inbox", Timestamp: date.Add(2 * time.Hour),
+		Recipient: "1Bob", Signature: SignatureNone, Encrypted: bytes.Repeat([]byte{11}, 200)}
+
+	// The sender chooses the MIME type, it mustn't end the header.
+	hostile := &Message{TxidHash: bytes.Repeat([]byte{12}, 48), Box: "inbox", Timestamp: date.Add(3 * time.Hour), Read: true,
+		Sender: "1Alice", Recipient: "1Bob", Signature: SignatureValid}
+	hostile.Decrypted = &objects.DecryptedMessage{Subject: "Hostile", MimeType: "text/plain\nX-EMP-Box: outbox\n\nInjected", Length: 4, Content: "Body"}
+
+	return []*Message{opened, binary, unopened, hostile}
+}
+
+func compare(t *testing.T, got, want *Message) {
+	if !got.Timestamp.Equal(want.Timestamp) {
+		fmt.Println("Wrong timestamp: ", got.Timestamp, want.Timestamp)
+		t.Fail()
+	}
+	got.Timestamp = want.Timestamp
+
+	if !reflect.DeepEqual(got, want) {
+		fmt.Printf("Message changed:\n%+v\n%+v\n", got, want)
+		if got.Decrypted != nil && want.Decrypted != nil {
+			fmt.Printf("%+v\n%+v\n", *got.Decrypted, *want.Decrypted)
+		}
+		t.Fail()
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, msg := range testMessages() {
+		buf := new(bytes.Buffer)
+		err := Write(buf, msg)
+		if err != nil {
+			fmt.Println("Error writing message: ", err)
+			t.FailNow()
+		}
+
+		got, err := Read(buf)
+		if err != nil {
+			fmt.Println("Error reading message: ", err)
+			t.FailNow()
+		}
+		compare(t, got, msg)
+	}
+
+	buf := new(bytes.Buffer)
+	Write(buf, testMessages()[3])
+	parsed, err := mail.ReadMessage(buf)
+	if err != nil || parsed.Header.Get("Content-Type") != "application/octet-stream" || len(parsed.Header["X-Emp-Box"]) != 1 {
+		fmt.Println("MIME type wasn't sanitized: ", err)
+		t.Fail()
+	}
+
+	_, err = Read(bytes.NewBufferString("From: someone@example.com\nSubject: Hi\n\nNot from EMP\n"))
+	if err != ErrNotEMP {
+		fmt.Println("Expected ErrNotEMP, got: ", err)
+		t.Fail()
+	}
+}
+
+func TestArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailfmt")
+	if err != nil {
+		fmt.Println("Error creating temp dir: ", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []string{Mbox, Maildir, EML} {
+		path := filepath.Join(dir, format)
+		w, err := Create(format, path)
+		if err != nil {
+			fmt.Println("Error creating archive: ", err)
+			t.FailNow()
+		}
+
+		want := testMessages()
+		for _, msg := range want {
+			if err := w.Add(msg); err != nil {
+				fmt.Println("Error adding message: ", err)
+				t.FailNow()
+			}
+		}
+		if err := w.Close(); err != nil {
+			fmt.Println("Error closing archive: ", err)
+			t.FailNow()
+		}
+
+		if _, err := Create(format, path); format == Mbox && err == nil {
+			fmt.Println("Existing mbox was overwritten.")
+			t.Fail()
+		}
+
+		got := make([]*Message, 0, len(want))
+		skipped, err := ReadAll(path, func(msg *Message) error {
+			got = append(got, msg)
+			return nil
+		})
+		if err != nil || skipped != 0 || len(got) != len(want) {
+			fmt.Println(format, ": read", len(got), "messages, skipped", skipped, "error", err)
+			t.FailNow()
+		}
+
+		// Maildir and eml files come back ordered by name.
+		order := map[string]int{}
+		for i, msg := range want {
+			order[string(msg.TxidHash)] = i
+		}
+		for _, msg := range got {
+			compare(t, msg, want[order[string(msg.TxidHash)]])
+		}
+	}
+}
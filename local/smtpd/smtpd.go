@@ -0,0 +1,423 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+// Package smtpd accepts mail submitted by local SMTP clients and hands it to a Backend
+// as EMP messages. Recipients are written as <emp-address>@<domain>.
+package smtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Where submitted messages go.
+type Backend interface {
+	// Check the credentials given with AUTH and return the EMP address to send from.
+	Authenticate(username, password string) (string, error)
+
+	// Send a message, recipients are EMP addresses.
+	Send(msg *Message) error
+}
+
+type Message struct {
+	Sender   string
+	To       []string // Recipients in the To: header, or not listed in any header
+	CC       []string // Recipients in the Cc: header
+	BCC      []string // Recipients only in the envelope
+	Subject  string
+	MimeType string
+	Body     string
+}
+
+type Server struct {
+	Domain   string // Recipients must be <address>@Domain
+	Hostname string // Name in the greeting
+	MaxSize  int    // Largest message accepted in bytes
+	Timeout  time.Duration
+	Backend  Backend
+	Log      chan string
+}
+
+const (
+	defaultMaxSize = 10 << 20
+	defaultTimeout = 5 * time.Minute
+)
+
+var errTooLarge = errors.New("Message too large")
+
+// Accept connections until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) log(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log <- fmt.Sprintf(format, args...)
+	}
+}
+
+// State of one SMTP session.
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+
+	sender     string // Authenticated EMP address
+	mailFrom   bool
+	recipients []string
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c := &session{server: s, conn: conn, text: textproto.NewConn(conn)}
+	c.reply(220, "%s EMP SMTP gateway ready", s.Hostname)
+
+	for {
+		c.deadline()
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			c.reply(250, "%s", s.Hostname)
+		case "EHLO":
+			c.reply(250, "%s\nAUTH PLAIN LOGIN\nSIZE %d\n8BITMIME\nPIPELINING", s.Hostname, s.maxSize())
+		case "AUTH":
+			c.auth(arg)
+		case "MAIL":
+			c.mail(arg)
+		case "RCPT":
+			c.rcpt(arg)
+		case "DATA":
+			c.data()
+		case "RSET":
+			c.reset()
+			c.reply(250, "OK")
+		case "NOOP":
+			c.reply(250, "OK")
+		case "VRFY":
+			c.reply(252, "Cannot verify, but will try")
+		case "QUIT":
+			c.reply(221, "Bye")
+			return
+		default:
+			c.reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (s *Server) maxSize() int {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return defaultMaxSize
+}
+
+func (c *session) deadline() {
+	timeout := c.server.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// Send a reply, each line of a multi-line message gets the code.
+func (c *session) reply(code int, format string, args ...interface{}) {
+	lines := strings.Split(fmt.Sprintf(format, args...), "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		c.text.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+func (c *session) reset() {
+	c.mailFrom = false
+	c.recipients = nil
+}
+
+func (c *session) auth(arg string) {
+	if len(c.sender) > 0 {
+		c.reply(503, "Already authenticated")
+		return
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		c.reply(501, "Syntax: AUTH <mechanism>")
+		return
+	}
+
+	var username, password string
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var response string
+		if len(fields) > 1 {
+			response = fields[1]
+		} else {
+			c.reply(334, "")
+			response, _ = c.text.ReadLine()
+		}
+		decoded, err := base64.StdEncoding.DecodeString(response)
+		parts := strings.Split(string(decoded), "\x00")
+		if err != nil || len(parts) != 3 {
+			c.reply(501, "Invalid PLAIN response")
+			return
+		}
+		username, password = parts[1], parts[2]
+
+	case "LOGIN":
+		c.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		line, _ := c.text.ReadLine()
+		user, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			c.reply(501, "Invalid LOGIN response")
+			return
+		}
+		c.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		line, _ = c.text.ReadLine()
+		pass, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			c.reply(501, "Invalid LOGIN response")
+			return
+		}
+		username, password = string(user), string(pass)
+
+	default:
+		c.reply(504, "Unsupported mechanism")
+		return
+	}
+
+	sender, err := c.server.Backend.Authenticate(username, password)
+	if err != nil {
+		c.server.log("SMTP authentication failed for %s from %s", username, c.conn.RemoteAddr())
+		c.reply(535, "Authentication failed")
+		return
+	}
+
+	c.sender = sender
+	c.reply(235, "Authenticated as %s", sender)
+}
+
+// Parse the address of a MAIL FROM:<...> or RCPT TO:<...> argument.
+func pathArg(arg, prefix string) (string, bool) {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+
+	end := strings.Index(arg, ">")
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (c *session) mail(arg string) {
+	if len(c.sender) == 0 {
+		c.reply(530, "Authentication required")
+		return
+	}
+	if c.mailFrom {
+		c.reply(503, "Sender already given")
+		return
+	}
+	if _, ok := pathArg(arg, "FROM:"); !ok {
+		c.reply(501, "Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	// The envelope sender is ignored, messages are always from the authenticated address.
+	c.mailFrom = true
+	c.reply(250, "OK")
+}
+
+// EMP address of <address>@domain, or "" if it's another domain.
+func (s *Server) empAddress(mailbox string) string {
+	at := strings.LastIndex(mailbox, "@")
+	if at <= 0 || !strings.EqualFold(mailbox[at+1:], s.Domain) {
+		return ""
+	}
+	return mailbox[:at]
+}
+
+func (c *session) rcpt(arg string) {
+	if !c.mailFrom {
+		c.reply(503, "MAIL first")
+		return
+	}
+
+	mailbox, ok := pathArg(arg, "TO:")
+	if !ok {
+		c.reply(501, "Syntax: RCPT TO:<address>")
+		return
+	}
+
+	address := c.server.empAddress(mailbox)
+	if len(address) == 0 {
+		c.reply(550, "Only <emp-address>@%s recipients are accepted", c.server.Domain)
+		return
+	}
+
+	c.recipients = append(c.recipients, address)
+	c.reply(250, "OK")
+}
+
+func (c *session) data() {
+	if len(c.recipients) == 0 {
+		c.reply(503, "RCPT first")
+		return
+	}
+
+	c.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	// Read one byte more than allowed to detect oversized messages.
+	reader := c.text.DotReader()
+	raw, err := ioutil.ReadAll(io.LimitReader(reader, int64(c.server.maxSize())+1))
+	if err != nil {
+		return
+	}
+	if len(raw) > c.server.maxSize() {
+		io.Copy(ioutil.Discard, reader)
+		c.reply(552, "%s", errTooLarge)
+		c.reset()
+		return
+	}
+
+	msg, err := c.server.parse(c.sender, c.recipients, raw)
+	if err == nil {
+		err = c.server.Backend.Send(msg)
+	}
+	c.reset()
+
+	if err != nil {
+		c.server.log("SMTP message from %s rejected: %s", c.sender, err)
+		c.reply(554, "Rejected: %s", err)
+		return
+	}
+
+	c.reply(250, "OK, sent")
+}
+
+// Build an EMP message from raw RFC 5322 data. Recipients are sorted into To, CC
+// and BCC by the headers they appear in.
+func (s *Server) parse(sender string, recipients []string, raw []byte) (*Message, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Message{Sender: sender}
+
+	decoder := new(mime.WordDecoder)
+	ret.Subject, err = decoder.DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		ret.Subject = parsed.Header.Get("Subject")
+	}
+
+	inHeader := func(name string) map[string]bool {
+		found := make(map[string]bool)
+		list, _ := parsed.Header.AddressList(name)
+		for _, addr := range list {
+			if address := s.empAddress(addr.Address); len(address) > 0 {
+				found[address] = true
+			}
+		}
+		return found
+	}
+	to, cc := inHeader("To"), inHeader("Cc")
+
+	seen := make(map[string]bool)
+	for _, address := range recipients {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		switch {
+		case to[address]:
+			ret.To = append(ret.To, address)
+		case cc[address]:
+			ret.CC = append(ret.CC, address)
+		case len(to) == 0 && len(cc) == 0:
+			ret.To = append(ret.To, address) // No headers to go by
+		default:
+			ret.BCC = append(ret.BCC, address)
+		}
+	}
+
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.MimeType = "text/plain"
+	contentType := parsed.Header.Get("Content-Type")
+	if len(contentType) > 0 {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			// Parts are kept as they are, the boundary is needed to read them.
+			ret.MimeType = contentType
+			ret.Body = string(body)
+			return ret, nil
+		}
+
+		ret.MimeType = mediaType
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+			ret.MimeType = mime.FormatMediaType(mediaType, map[string]string{"charset": charset})
+		}
+	}
+
+	switch strings.ToLower(parsed.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body, err = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "base64":
+		body, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.Join(bytes.Fields(body), nil))))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Body = strings.Replace(string(body), "\r\n", "\n", -1)
+	return ret, nil
+}
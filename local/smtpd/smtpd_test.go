@@ -0,0 +1,112 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+type testBackend struct {
+	sent []*Message
+}
+
+func (b *testBackend) Authenticate(username, password string) (string, error) {
+	if username == "alice" && password == "secret" {
+		return "AliceAddress", nil
+	}
+	return "", errors.New("Unauthorized")
+}
+
+func (b *testBackend) Send(msg *Message) error {
+	b.sent = append(b.sent, msg)
+	return nil
+}
+
+func TestSMTP(t *testing.T) {
+	backend := new(testBackend)
+	server := &Server{Domain: "emp.local", Hostname: "localhost", Backend: backend}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error listening: ", err)
+		t.FailNow()
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	addr := l.Addr().String()
+	host, _, _ := net.SplitHostPort(addr)
+
+	body := "From: alice@example.com\r\n" +
+		"To: Bob <BobAddress@emp.local>\r\n" +
+		"Cc: CarolAddress@emp.local\r\n" +
+		"Subject: =?utf-8?q?Build_=C3=A9chou=C3=A9?=\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Build 42 failed=\r\n on master.\r\n"
+	recipients := []string{"BobAddress@emp.local", "CarolAddress@emp.local", "DaveAddress@emp.local"}
+
+	// Wrong password
+	err = smtp.SendMail(addr, smtp.PlainAuth("", "alice", "wrong", host), "alice@example.com", recipients, []byte(body))
+	if err == nil || len(backend.sent) != 0 {
+		fmt.Println("Wrong password accepted.")
+		t.Fail()
+	}
+
+	// No authentication
+	err = smtp.SendMail(addr, nil, "alice@example.com", recipients, []byte(body))
+	if err == nil || !strings.Contains(err.Error(), "530") {
+		fmt.Println("Unauthenticated mail accepted: ", err)
+		t.Fail()
+	}
+
+	// Other domains aren't relayed
+	err = smtp.SendMail(addr, smtp.PlainAuth("", "alice", "secret", host), "alice@example.com", []string{"bob@example.com"}, []byte(body))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		fmt.Println("Relayed to another domain: ", err)
+		t.Fail()
+	}
+
+	err = smtp.SendMail(addr, smtp.PlainAuth("", "alice", "secret", host), "alice@example.com", recipients, []byte(body))
+	if err != nil || len(backend.sent) != 1 {
+		fmt.Println("Error sending mail: ", err)
+		t.FailNow()
+	}
+
+	msg := backend.sent[0]
+	if msg.Sender != "AliceAddress" || msg.Subject != "Build échoué" || msg.MimeType != "text/plain" {
+		fmt.Println("Wrong headers: ", msg.Sender, msg.Subject, msg.MimeType)
+		t.Fail()
+	}
+	if msg.Body != "Build 42 failed on master.\n" {
+		fmt.Printf("Wrong body: %q\n", msg.Body)
+		t.Fail()
+	}
+	if len(msg.To) != 1 || msg.To[0] != "BobAddress" || len(msg.CC) != 1 || msg.CC[0] != "CarolAddress" || len(msg.BCC) != 1 || msg.BCC[0] != "DaveAddress" {
+		fmt.Println("Wrong recipients: ", msg.To, msg.CC, msg.BCC)
+		t.Fail()
+	}
+
+	// Oversized messages are refused
+	server.MaxSize = 100
+	err = smtp.SendMail(addr, smtp.PlainAuth("", "alice", "secret", host), "alice@example.com", recipients, []byte(body+strings.Repeat("x", 200)))
+	if err == nil || !strings.Contains(err.Error(), "552") || len(backend.sent) != 1 {
+		fmt.Println("Oversized message accepted: ", err)
+		t.Fail()
+	}
+}
@@ -20,17 +20,36 @@ import (
 )
 
 type MetaMessage struct {
-	TxidHash  Hash      `json:"txid_hash"` // Hash of random identifier
-	Timestamp time.Time `json:"sent"`      // Time message was sent
-	Purged    bool      `json:"read"`      // Whether purge token has been received
-	Sender    string    `json:"sender"`    // String representation of sender's address, if available.
-	Recipient string    `json:"recipient"` // String representation of recipient's address, if available.
+	TxidHash  Hash      `json:"txid_hash"`         // Hash of random identifier
+	Timestamp time.Time `json:"sent"`              // Time message was sent
+	Purged    bool      `json:"read"`              // Whether purge token has been received
+	Sender    string    `json:"sender"`            // String representation of sender's address, if available.
+	Recipient string    `json:"recipient"`         // String representation of recipient's address, if available.
+	Failure   string    `json:"failure,omitempty"` // Why an outgoing message couldn't be delivered, if it failed.
 }
 
 type FullMessage struct {
 	MetaMessage MetaMessage                  `json:"info"`
 	Decrypted   *DecryptedMessage            `json:"decrypted"`
 	Encrypted   *encryption.EncryptedMessage `json:"encrypted"`
+	To          []string                     `json:"to,omitempty"`        // Visible recipients of a message sent to several addresses.
+	CC          []string                     `json:"cc,omitempty"`        // Visible copy recipients of a message sent to several addresses.
+	BodyHash    []byte                       `json:"body_hash,omitempty"` // TxidHash of the shared body of a message sent to several addresses.
+}
+
+// Unsent message stored locally. If SendAt is set, it's sent automatically at that time.
+type Draft struct {
+	TxidHash  Hash      `json:"txid_hash"` // Hash of random identifier, changes when the draft is sent.
+	Timestamp time.Time `json:"saved"`     // Time draft was last saved
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	To        []string  `json:"to"`
+	CC        []string  `json:"cc"`
+	BCC       []string  `json:"bcc"`
+	Subject   string    `json:"subject"`
+	MimeType  string    `json:"mime_type,omitempty"` // Type of content, text/plain if empty
+	Content   string    `json:"content"`
+	SendAt    time.Time `json:"send_at"` // Zero if not scheduled
 }
 
 type DecryptedMessage struct {
@@ -93,3 +112,76 @@ func (d *DecryptedMessage) FromBytes(data []byte) error {
 
 	return nil
 }
+
+// Padding bucket bounds, see PaddedLength().
+const (
+	minPadLen  = 256
+	padMarker  = 0x80
+	padVersion = 0x01 // Last byte of padded data, so data from clients that don't pad is left alone
+)
+
+// Returns the size of the bucket a plaintext of n bytes is padded to before encryption.
+// If step is positive, buckets are multiples of step, otherwise they are powers of two.
+// Buckets are never smaller than 256 bytes.
+func PaddedLength(n, step int) int {
+	if step > 0 {
+		ret := ((n + step - 1) / step) * step
+		for ret < minPadLen {
+			ret += step
+		}
+		return ret
+	}
+
+	ret := minPadLen
+	for ret < n {
+		ret *= 2
+	}
+	return ret
+}
+
+// Pad data to a fixed size bucket (see PaddedLength) with a single 0x80 byte,
+// 0x00 bytes, and the padVersion byte.
+func Pad(data []byte, step int) []byte {
+	padded := PaddedLength(len(data)+2, step)
+
+	ret := make([]byte, len(data), padded)
+	copy(ret, data)
+	ret = append(ret, padMarker)
+	ret = append(ret, make([]byte, padded-len(ret)-1, padded-len(ret)-1)...)
+	return append(ret, padVersion)
+}
+
+// Strip padding added by Pad(). Data without the padVersion byte and marker is
+// returned unchanged.
+func Unpad(data []byte) []byte {
+	if len(data) == 0 || data[len(data)-1] != padVersion {
+		return data
+	}
+
+	end := len(data) - 1
+	for end > 0 && data[end-1] == 0 {
+		end--
+	}
+
+	if end > 0 && data[end-1] == padMarker {
+		return data[:end-1]
+	}
+	return data
+}
+
+// Serialize the message and pad it to a fixed size bucket (see PaddedLength), so the
+// length of the ciphertext doesn't reveal the length of the subject and content.
+func (d *DecryptedMessage) GetPaddedBytes(step int) []byte {
+	if d == nil {
+		return nil
+	}
+
+	return Pad(d.GetBytes(), step)
+}
+
+// Fill the message from data written by GetPaddedBytes(), or by clients that don't
+// pad. The message records its own length, so padding after the signature is never
+// read and old messages parse the same whatever bytes they end with.
+func (d *DecryptedMessage) FromPaddedBytes(data []byte) error {
+	return d.FromBytes(data)
+}
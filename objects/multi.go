@@ -0,0 +1,101 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package objects
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// A message for several recipients is sent as one body, encrypted once under a random
+// content key, and one small message per recipient carrying a KeyWrap. The KeyWrap is
+// the Content of a DecryptedMessage with this Mime-Type.
+const (
+	MultiMimeType = "application/x-emp-keywrap"
+	keyWrapLen    = 64 + hashLen
+)
+
+type KeyWrap struct {
+	Key      [64]byte // AES-256 key followed by HMAC-SHA256 key of the body.
+	BodyHash Hash     // TxidHash of the network message carrying the body.
+}
+
+type MultiBody struct {
+	To      []string         // Visible recipients
+	CC      []string         // Visible copy recipients
+	Message DecryptedMessage // Message shared by all recipients
+}
+
+func (k *KeyWrap) GetBytes() []byte {
+	if k == nil {
+		return nil
+	}
+
+	ret := make([]byte, 0, keyWrapLen)
+	ret = append(ret, k.Key[:]...)
+	ret = append(ret, k.BodyHash.GetBytes()...)
+	return ret
+}
+
+func (k *KeyWrap) FromBytes(data []byte) error {
+	if k == nil {
+		return errors.New("Can't fill nil KeyWrap Object.")
+	}
+	if len(data) != keyWrapLen {
+		return errors.New("Invalid length for KeyWrap.")
+	}
+
+	copy(k.Key[:], data[:64])
+	return k.BodyHash.FromBytes(data[64:])
+}
+
+func (m *MultiBody) GetBytes() []byte {
+	if m == nil {
+		return nil
+	}
+
+	ret := append([]byte(strings.Join(m.To, ",")), 0)
+	ret = append(ret, strings.Join(m.CC, ",")...)
+	ret = append(ret, 0)
+	ret = append(ret, m.Message.GetBytes()...)
+	return ret
+}
+
+func (m *MultiBody) FromBytes(data []byte) error {
+	if m == nil {
+		return errors.New("Can't fill nil MultiBody Object.")
+	}
+
+	buf := bytes.NewBuffer(data)
+
+	to, err := buf.ReadString(0)
+	if err != nil {
+		return err
+	}
+	cc, err := buf.ReadString(0)
+	if err != nil {
+		return err
+	}
+
+	m.To = splitList(to[:len(to)-1])
+	m.CC = splitList(cc[:len(cc)-1])
+
+	return m.Message.FromBytes(buf.Bytes())
+}
+
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
@@ -12,6 +12,7 @@
 package objects
 
 import (
+	"bytes"
 	"crypto/elliptic"
 	"emp/encryption"
 	"fmt"
@@ -196,3 +197,86 @@ func TestMessage(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPadding(t *testing.T) {
+	if PaddedLength(10, 0) != 256 || PaddedLength(257, 0) != 512 || PaddedLength(1025, 0) != 2048 {
+		fmt.Println("Incorrect power of two buckets.")
+		t.Fail()
+	}
+	if PaddedLength(10, 100) != 300 || PaddedLength(301, 100) != 400 {
+		fmt.Println("Incorrect stepped buckets.")
+		t.Fail()
+	}
+
+	msg := new(DecryptedMessage)
+	msg.Subject = "Subject"
+	msg.MimeType = "text/plain"
+	msg.Content = "Hello World!"
+	msg.Length = uint32(len(msg.Content))
+	msg.Signature[64] = 0x80
+
+	padded := msg.GetPaddedBytes(0)
+	if len(padded) != 256 {
+		fmt.Println("Incorrect padded length: ", len(padded))
+		t.FailNow()
+	}
+
+	msg2 := new(DecryptedMessage)
+	err := msg2.FromPaddedBytes(padded)
+	if err != nil {
+		fmt.Println("Error decoding padded message: ", err)
+		t.FailNow()
+	}
+	if msg2.Subject != msg.Subject || msg2.Content != msg.Content || msg2.Signature != msg.Signature {
+		fmt.Println("Incorrect decoding of padded message: ", msg2)
+		t.Fail()
+	}
+
+	// Unpadded messages from older clients, even ones that end like padding.
+	for _, end := range [][]byte{{0x01}, {0x80, 0x00}, {0x80, 0x00, 0x01}} {
+		copy(msg.Signature[65-len(end):], end)
+		msg2 = new(DecryptedMessage)
+		err = msg2.FromPaddedBytes(msg.GetBytes())
+		if err != nil || msg2.Content != msg.Content || msg2.Signature != msg.Signature {
+			fmt.Println("Incorrect decoding of unpadded message: ", msg2)
+			t.Fail()
+		}
+	}
+
+	legacy := []byte("ends like padding\x80\x00\x00")
+	if !bytes.Equal(Unpad(legacy), legacy) || !bytes.Equal(Unpad(Pad(legacy, 0)), legacy) {
+		fmt.Println("Unpadded data was stripped.")
+		t.Fail()
+	}
+}
+
+func TestMultiBody(t *testing.T) {
+	body := new(MultiBody)
+	body.To = []string{"1abc", "1def"}
+	body.Message.Subject = "Subject"
+	body.Message.MimeType = "text/plain"
+	body.Message.Content = "Hello World!"
+	body.Message.Length = uint32(len(body.Message.Content))
+
+	body2 := new(MultiBody)
+	err := body2.FromBytes(body.GetBytes())
+	if err != nil {
+		fmt.Println("Error decoding multi body: ", err)
+		t.FailNow()
+	}
+	if len(body2.To) != 2 || body2.To[1] != "1def" || body2.CC != nil || body2.Message.Content != body.Message.Content {
+		fmt.Println("Incorrect decoding of multi body: ", body2)
+		t.Fail()
+	}
+
+	wrap := new(KeyWrap)
+	wrap.Key[5] = 7
+	wrap.BodyHash = MakeHash([]byte("body"))
+
+	wrap2 := new(KeyWrap)
+	err = wrap2.FromBytes(wrap.GetBytes())
+	if err != nil || wrap2.Key != wrap.Key || wrap2.BodyHash != wrap.BodyHash {
+		fmt.Println("Incorrect decoding of key wrap: ", err)
+		t.Fail()
+	}
+}
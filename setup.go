@@ -0,0 +1,127 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/localapi"
+	"github.com/msecret/emp/local/localdb"
+	"github.com/msecret/emp/objects"
+)
+
+// Create the config directory and a msg.conf with random RPC credentials.
+func cmdInit(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	confDir := flags.String("conf", "", "configuration directory")
+	force := flags.Bool("force", false, "replace an existing msg.conf")
+	flags.Parse(args)
+
+	if len(*confDir) > 0 {
+		api.SetConfDir(*confDir)
+	}
+
+	user, pass, err := api.InitConfDir(*force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %smsg.conf\n", api.GetConfDir())
+	fmt.Printf("RPC user: %s\n", user)
+	fmt.Printf("RPC pass: %s\n", pass)
+	fmt.Println("Add bootstrap nodes to msg.conf, then start the daemon with \"emp\".")
+	return nil
+}
+
+// Validate msg.conf, printing every problem found.
+func cmdConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("Usage: emp " + cliCommands["config"].usage)
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	confDir := flags.String("conf", "", "configuration directory")
+	flags.Parse(args[1:])
+
+	if len(*confDir) > 0 {
+		api.SetConfDir(*confDir)
+	}
+
+	confFile := api.GetConfDir() + "msg.conf"
+	problems, warnings := api.CheckConfig(confFile)
+
+	for _, problem := range problems {
+		fmt.Printf("error: %s\n", problem)
+	}
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(fmt.Sprintf("%s has %d error(s)", confFile, len(problems)))
+	}
+	fmt.Printf("%s is valid.\n", confFile)
+	return nil
+}
+
+// Create an address without a running daemon. Its public key is broadcast the next
+// time the daemon starts.
+func cmdKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	confDir := flags.String("conf", "", "configuration directory")
+	profileName := flags.String("profile", api.DefaultProfile, "profile to add the address to")
+	label := flags.String("label", "", "label of the new address")
+	flags.Parse(args)
+
+	if len(*confDir) > 0 {
+		api.SetConfDir(*confDir)
+	}
+
+	config := api.GetConfig(api.GetConfDir() + "msg.conf")
+	if config == nil {
+		return errors.New("Error Loading Config")
+	}
+
+	profile, err := config.GetProfile(*profileName)
+	if err != nil {
+		return err
+	}
+
+	store, err := localdb.Open(config.Log, profile.LocalDB)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	detail, err := localapi.NewAddress(store, config.Log)
+	if err != nil {
+		return err
+	}
+
+	if len(*label) > 0 {
+		detail.Label = *label
+		err = store.AddUpdateAddress(detail)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = store.SetAnnounced(objects.MakeHash(detail.Address), false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(detail.String)
+	return nil
+}
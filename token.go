@@ -0,0 +1,108 @@
+/**
+    Copyright 2014 JARST, LLC.
+
+    This file is part of EMP.
+
+    EMP is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the included
+    LICENSE file for more details.
+**/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/msecret/emp/api"
+	"github.com/msecret/emp/local/localapi"
+	"github.com/msecret/emp/local/localdb"
+	"strings"
+	"time"
+)
+
+const tokenUsage = `Usage:
+  emp token create [-conf dir] [-profile name] [-expires duration] <name> <scope,...>
+  emp token list [-conf dir] [-profile name]
+  emp token revoke [-conf dir] [-profile name] <name>
+
+Scopes: %s
+`
+
+// Manage API tokens directly in the local database, works whether or not the daemon is running.
+func tokenCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Printf(tokenUsage, strings.Join(localapi.Scopes, ", "))
+		return 2
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	confDir := flags.String("conf", "", "configuration directory")
+	profileName := flags.String("profile", api.DefaultProfile, "profile whose tokens are managed")
+	expires := flags.Duration("expires", 0, "lifetime of the token, e.g. 720h (default never expires)")
+	flags.Parse(args[1:])
+
+	if len(*confDir) > 0 {
+		api.SetConfDir(*confDir)
+	}
+
+	config := api.GetConfig(api.GetConfDir() + "msg.conf")
+	if config == nil {
+		fmt.Println("Error Loading Config, exiting...")
+		return 1
+	}
+
+	profile, err := config.GetProfile(*profileName)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	store, err := localdb.Open(config.Log, profile.LocalDB)
+	if err != nil {
+		fmt.Printf("Error opening local database: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	switch {
+	case args[0] == "create" && flags.NArg() == 2:
+		tokenArgs := &localapi.TokenArgs{Name: flags.Arg(0), Scopes: strings.Split(flags.Arg(1), ",")}
+		if *expires > 0 {
+			tokenArgs.Expires = time.Now().Add(*expires).Round(time.Second)
+		}
+
+		secret, err := localapi.NewToken(store, tokenArgs)
+		if err != nil {
+			fmt.Printf("Error creating token: %s\n", err)
+			return 1
+		}
+		fmt.Println("Token created. It will not be shown again:")
+		fmt.Println(secret)
+
+	case args[0] == "list" && flags.NArg() == 0:
+		for _, token := range store.ListTokens() {
+			expiry := "never expires"
+			if token.Expired() {
+				expiry = "expired " + token.Expires.Format(time.RFC3339)
+			} else if !token.Expires.IsZero() {
+				expiry = "expires " + token.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\n", token.Name, strings.Join(token.Scopes, ","), expiry)
+		}
+
+	case args[0] == "revoke" && flags.NArg() == 1:
+		err = store.RevokeToken(flags.Arg(0))
+		if err != nil {
+			fmt.Printf("Error revoking token: %s\n", err)
+			return 1
+		}
+		fmt.Println("Token revoked.")
+
+	default:
+		fmt.Printf(tokenUsage, strings.Join(localapi.Scopes, ", "))
+		return 2
+	}
+
+	return 0
+}